@@ -1,7 +1,10 @@
 package gentity
 
 import (
+	"errors"
+	"fmt"
 	"google.golang.org/protobuf/proto"
+	"reflect"
 	"time"
 )
 
@@ -59,4 +62,168 @@ type KvCache interface {
 
 	// 缓存数据加载到proto.Message
 	GetProto(key string, value proto.Message) error
+
+	// redis ZAdd
+	// member如果是proto.Message,会先进行序列化
+	ZAdd(key string, members ...ZMember) (int64, error)
+
+	// redis ZIncrBy
+	// member如果是proto.Message,会先进行序列化
+	ZIncrBy(key string, increment float64, member interface{}) (float64, error)
+
+	// redis ZRevRangeWithScores,按分数从高到低
+	// 返回的ZMember.Member是string,proto.Message可以使用ZMember.GetProto解析
+	ZRevRangeWithScores(key string, start, stop int64) ([]ZMember, error)
+
+	// redis ZRank,按分数从低到高的排名,从0开始
+	// member不存在时返回-1
+	ZRank(key string, member interface{}) (int64, error)
+
+	// redis ZRem
+	ZRem(key string, members ...interface{}) (int64, error)
+
+	// redis LPush
+	// value如果是proto.Message,会先进行序列化
+	LPush(key string, values ...interface{}) (int64, error)
+
+	// redis RPush
+	// value如果是proto.Message,会先进行序列化
+	RPush(key string, values ...interface{}) (int64, error)
+
+	// redis LTrim
+	LTrim(key string, start, stop int64) error
+
+	// redis LRange
+	// proto.Message可以使用ParseProtoList解析
+	LRange(key string, start, stop int64) ([]string, error)
+}
+
+// 有序集合的成员
+type ZMember struct {
+	Score float64
+	// 写入时如果是proto.Message,会先进行序列化,读取时是string
+	Member interface{}
+}
+
+// Member解析成proto.Message
+func (this *ZMember) GetProto(value proto.Message) error {
+	str, ok := this.Member.(string)
+	if !ok {
+		return errors.New(fmt.Sprintf("member type err:%T", this.Member))
+	}
+	return proto.Unmarshal([]byte(str), value)
+}
+
+// 缓存的字符串列表解析成proto.Message列表,如LRange的返回值
+//
+// example:
+//   values, _ := kvCache.LRange("mylist", 0, -1)
+//   list, err := ParseProtoList(values, func() *pb.TestData { return new(pb.TestData) })
+func ParseProtoList[T proto.Message](values []string, newValue func() T) ([]T, error) {
+	list := make([]T, 0, len(values))
+	for _, str := range values {
+		value := newValue()
+		if err := proto.Unmarshal([]byte(str), value); err != nil {
+			return nil, err
+		}
+		list = append(list, value)
+	}
+	return list, nil
+}
+
+// 有序集合的member和列表的value -> string
+// member需要唯一,proto.Message使用确定性的序列化,保证相同的数据序列化结果一致
+func formatCacheMember(value interface{}) (string, error) {
+	if protoMessage, ok := value.(proto.Message); ok {
+		bytes, err := proto.MarshalOptions{Deterministic: true}.Marshal(protoMessage)
+		if err != nil {
+			return "", err
+		}
+		return string(bytes), nil
+	}
+	return formatMemCacheValue(value)
+}
+
+func formatCacheMembers(values []interface{}) ([]interface{}, error) {
+	members := make([]interface{}, len(values))
+	for i, value := range values {
+		member, err := formatCacheMember(value)
+		if err != nil {
+			return nil, err
+		}
+		members[i] = member
+	}
+	return members, nil
+}
+
+// hash数据 -> map
+// m必须是一个类型明确有效的map
+func loadMapFromCacheData(key string, strMap map[string]string, m interface{}) error {
+	val := reflect.ValueOf(m)
+	if val.Kind() != reflect.Map {
+		return errors.New(fmt.Sprintf("unsupport type kind:%v key:%v", val.Kind(), key))
+	}
+	typ := reflect.TypeOf(m)
+	keyType := typ.Key()
+	valType := typ.Elem()
+	for k, v := range strMap {
+		realKey := ConvertStringToRealType(keyType, k)
+		// 如果是map是map[string]any,value解析需要特殊处理
+		realValue := ConvertStringToRealType(valType, v)
+		val.SetMapIndex(reflect.ValueOf(realKey), reflect.ValueOf(realValue))
+	}
+	return nil
+}
+
+// map -> hash数据
+// key转换成string,value如果是proto.Message,会先进行序列化
+func convertMapToCacheData(m interface{}) (map[string]interface{}, error) {
+	cacheData := make(map[string]interface{})
+	val := reflect.ValueOf(m)
+	it := val.MapRange()
+	for it.Next() {
+		key, err := convertValueToString(it.Key())
+		if err != nil {
+			return nil, err
+		}
+		value, err := convertValueToStringOrInterface(it.Value())
+		if err != nil {
+			return nil, err
+		}
+		cacheData[key] = value
+	}
+	return cacheData, nil
+}
+
+// 支持过期时间和原子累加的KvCache,CacheEntityDb和CacheKvDb需要
+type AdvancedKvCache interface {
+	// redis Expire
+	Expire(key string, expiration time.Duration) (bool, error)
+
+	// redis IncrBy
+	IncrBy(key string, value int64) (int64, error)
+
+	// redis IncrByFloat
+	IncrByFloat(key string, value float64) (float64, error)
+}
+
+// 支持hash条件写入的KvCache,CacheEntityDb用于原子的新建和修改实体
+type AtomicHashKvCache interface {
+	// key不存在时才写入hash,expiration>0时同时设置过期时间,返回是否写入
+	HSetIfNotExists(key string, values map[string]string, expiration time.Duration) (bool, error)
+
+	// key存在,并且expected里的字段的当前值都一致时(""表示字段不存在),才写入values和删除delFields
+	// expiration>0时同时刷新过期时间,返回是否写入
+	HCompareAndSwap(key string, expected map[string]string, values map[string]string, delFields []string, expiration time.Duration) (bool, error)
+}
+
+// 支持批量操作的KvCache
+type KvCacheBatch interface {
+	// 批量执行f中的缓存操作,只有1次网络交互
+	//
+	//	RedisCache使用MULTI/EXEC事务管道,f中的操作在提交时一次性执行,其他客户端不会看到中间状态
+	//	MemCache在f执行期间持有锁,其他协程不会看到中间状态
+	//	f中只能使用batchCache,batchCache的读操作和写操作的返回值在提交前可能无效,不要依赖
+	//	返回值是提交的结果
+	Batch(f func(batchCache KvCache)) error
 }
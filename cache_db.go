@@ -0,0 +1,602 @@
+package gentity
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// https://github.com/uber-go/guide/blob/master/style.md#verify-interface-compliance
+var _ EntityDb = (*CacheEntityDb)(nil)
+var _ IncrementalEntityDb = (*CacheEntityDb)(nil)
+var _ KvDb = (*CacheKvDb)(nil)
+var _ ExpirableKvDb = (*CacheKvDb)(nil)
+
+// 基于KvCache的EntityDb实现,适用于房间,比赛,临时活动等生命周期较短的实体
+//
+//	每个实体对应一个hash,key格式和GetEntityCacheKey一致,每个组件对应hash的一个字段,字段值是json格式
+//	设置了过期时间时,kvCache需要实现AdvancedKvCache
+//	组件的子字段保存在组件的json里,保存子字段时会先读取整个hash
+//	kvCache实现了AtomicHashKvCache时(MemCache,RedisCache),新建和修改都是原子操作,修改冲突时会重新读取并重试,
+//	否则新建和修改由多条命令组成,同一个实体不要在多个进程同时写入
+type CacheEntityDb struct {
+	kvCache   KvCache
+	keyPrefix string
+	// 唯一id的字段名
+	uniqueId string
+	// 过期时间,每次写入后刷新,<=0表示不过期
+	expiration time.Duration
+}
+
+// 修改冲突时的最大重试次数
+const cacheEntityDbMaxRetry = 8
+
+func NewCacheEntityDb(kvCache KvCache, keyPrefix string, uniqueId string, expiration time.Duration) *CacheEntityDb {
+	return &CacheEntityDb{
+		kvCache:    kvCache,
+		keyPrefix:  keyPrefix,
+		uniqueId:   uniqueId,
+		expiration: expiration,
+	}
+}
+
+func (this *CacheEntityDb) GetKeyPrefix() string {
+	return this.keyPrefix
+}
+
+func (this *CacheEntityDb) getKey(entityKey interface{}) string {
+	return GetEntityCacheKey(this.keyPrefix, entityKey)
+}
+
+// 设置了过期时间时,kvCache需要实现AdvancedKvCache,否则返回ErrNotSupported
+func (this *CacheEntityDb) refreshExpire(key string) error {
+	if this.expiration <= 0 {
+		return nil
+	}
+	advancedCache, ok := this.kvCache.(AdvancedKvCache)
+	if !ok {
+		return ErrNotSupported
+	}
+	_, err := advancedCache.Expire(key, this.expiration)
+	return err
+}
+
+// 根据id查找数据
+func (this *CacheEntityDb) FindEntityById(entityKey interface{}, data interface{}) (bool, error) {
+	hashFields, err := this.kvCache.HGetAll(this.getKey(entityKey))
+	if err != nil || len(hashFields) == 0 {
+		return false, err
+	}
+	fields := make(map[string]json.RawMessage, len(hashFields))
+	for name, value := range hashFields {
+		fields[name] = json.RawMessage(value)
+	}
+	err = decodeJsonFields(fields, data)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// 缓存不支持按条件查询,返回ErrNotSupported
+func (this *CacheEntityDb) FindEntities(query *Query, newData func() interface{}) (*QueryResult, error) {
+	return nil, ErrNotSupported
+}
+
+// 每个实体执行一次HGetAll
+func (this *CacheEntityDb) FindEntitiesByIds(entityKeys []interface{}, newData func() interface{}, componentNames ...string) (map[interface{}]interface{}, error) {
+	datas := make(map[interface{}]interface{}, len(entityKeys))
+	for _, entityKey := range entityKeys {
+		hashFields, err := this.kvCache.HGetAll(this.getKey(entityKey))
+		if err != nil {
+			return nil, err
+		}
+		if len(hashFields) == 0 {
+			continue
+		}
+		fields := make(map[string]json.RawMessage, len(hashFields))
+		for name, value := range hashFields {
+			if len(componentNames) > 0 && name != this.uniqueId && !slices.Contains(componentNames, name) {
+				continue
+			}
+			fields[name] = json.RawMessage(value)
+		}
+		data := newData()
+		if err = decodeJsonFields(fields, data); err != nil {
+			return nil, err
+		}
+		datas[entityKey] = data
+	}
+	return datas, nil
+}
+
+// 新建Entity
+//
+//	entityData可以是map[string]interface{}或者struct
+//	kvCache实现了AtomicHashKvCache时,使用HSetIfNotExists一次写入所有字段和过期时间
+//	否则使用HSETNX唯一id字段的方式检查实体是否已存在,再写入其他字段
+func (this *CacheEntityDb) InsertEntity(entityKey interface{}, entityData interface{}) (err error, isDuplicateKey bool) {
+	fields, err := toJsonFields(entityData)
+	if err != nil {
+		return err, false
+	}
+	delete(fields, this.uniqueId)
+	hashValues, err := encodeCacheEntityFields(fields)
+	if err != nil {
+		return err, false
+	}
+	keyBytes, err := json.Marshal(entityKey)
+	if err != nil {
+		return err, false
+	}
+	key := this.getKey(entityKey)
+	if atomicCache, ok := this.kvCache.(AtomicHashKvCache); ok {
+		hashValues[this.uniqueId] = string(keyBytes)
+		isSetOk, err := atomicCache.HSetIfNotExists(key, hashValues, this.expiration)
+		if err != nil {
+			return err, false
+		}
+		if !isSetOk {
+			return fmt.Errorf("%v %v:%v %w", this.keyPrefix, this.uniqueId, entityKey, ErrDuplicateKey), true
+		}
+		return nil, false
+	}
+	isSetOk, err := this.kvCache.HSetNX(key, this.uniqueId, string(keyBytes))
+	if err != nil {
+		return err, false
+	}
+	if !isSetOk {
+		return fmt.Errorf("%v %v:%v %w", this.keyPrefix, this.uniqueId, entityKey, ErrDuplicateKey), true
+	}
+	if len(hashValues) > 0 {
+		if _, err = this.kvCache.HSet(key, hashValues); err != nil {
+			return err, false
+		}
+	}
+	return this.refreshExpire(key), false
+}
+
+// 保存Entity数据,只更新entityData里的字段
+func (this *CacheEntityDb) SaveEntity(entityKey interface{}, entityData interface{}) error {
+	fields, err := toJsonFields(entityData)
+	if err != nil {
+		return err
+	}
+	delete(fields, this.uniqueId)
+	return this.SaveComponents(entityKey, fields)
+}
+
+// 删除Entity数据
+func (this *CacheEntityDb) DeleteEntity(entityKey interface{}) error {
+	_, err := this.kvCache.Del(this.getKey(entityKey))
+	return err
+}
+
+// 保存1个组件
+func (this *CacheEntityDb) SaveComponent(entityKey interface{}, componentName string, componentData interface{}) error {
+	return this.SaveComponents(entityKey, map[string]interface{}{componentName: componentData})
+}
+
+func (this *CacheEntityDb) SupportIncrementalSave() bool {
+	return true
+}
+
+// 批量保存组件,只执行一次HSET
+//
+//	components的key格式: componentName 或 componentName.childName,值为UnsetComponentField时删除该字段
+//	值为PushComponentField的返回值时追加到json数组的尾部
+//	和mongodb的update一样,实体不存在时不会创建
+func (this *CacheEntityDb) SaveComponents(entityKey interface{}, components map[string]interface{}) error {
+	if len(components) == 0 {
+		return nil
+	}
+	key := this.getKey(entityKey)
+	keys := make([]string, 0, len(components))
+	hasChild := false
+	for k, v := range components {
+		keys = append(keys, k)
+		if _, isPush := getPushComponentField(v); isPush || strings.Contains(k, ".") {
+			hasChild = true
+		}
+	}
+	sort.Strings(keys)
+	_, err := this.updateHash(key, hasChild, func(oldValues map[string]string) (map[string]string, []string, error) {
+		newValues := make(map[string]string)
+		var delFields []string
+		for _, k := range keys {
+			names := strings.Split(k, ".")
+			isUnset := isUnsetComponentField(components[k])
+			if len(names) == 1 && isUnset {
+				delFields = append(delFields, k)
+				continue
+			}
+			if pushItems, ok := getPushComponentField(components[k]); ok {
+				var oldValue json.RawMessage
+				if v, ok := newValues[names[0]]; ok {
+					oldValue = json.RawMessage(v)
+				} else if v, ok := oldValues[names[0]]; ok {
+					oldValue = json.RawMessage(v)
+				}
+				newValue, err := appendJsonPath(oldValue, names[1:], pushItems)
+				if err != nil {
+					return nil, nil, errors.New(fmt.Sprintf("%v.%v err:%v", key, k, err))
+				}
+				newValues[names[0]] = string(newValue)
+				continue
+			}
+			var valueBytes []byte
+			if !isUnset {
+				var err error
+				valueBytes, err = json.Marshal(components[k])
+				if err != nil {
+					return nil, nil, errors.New(fmt.Sprintf("%v.%v err:%v", key, k, err))
+				}
+			}
+			if len(names) == 1 {
+				newValues[k] = string(valueBytes)
+				continue
+			}
+			var oldValue json.RawMessage
+			if v, ok := newValues[names[0]]; ok {
+				oldValue = json.RawMessage(v)
+			} else if v, ok := oldValues[names[0]]; ok {
+				oldValue = json.RawMessage(v)
+			}
+			var newValue json.RawMessage
+			var err error
+			if isUnset {
+				if len(oldValue) == 0 {
+					continue
+				}
+				newValue, err = removeJsonPath(oldValue, names[1:])
+			} else {
+				newValue, err = setJsonPath(oldValue, names[1:], valueBytes)
+			}
+			if err != nil {
+				return nil, nil, errors.New(fmt.Sprintf("%v.%v err:%v", key, k, err))
+			}
+			newValues[names[0]] = string(newValue)
+		}
+		return newValues, delFields, nil
+	})
+	return err
+}
+
+// 修改实体的hash,返回实体是否存在
+//
+//	readAll为true时,先读取整个hash再传给f,否则只检查实体是否存在,传给f的是nil
+//	f返回要写入的字段和要删除的字段,都为空时不写入
+//	kvCache实现了AtomicHashKvCache时,使用HCompareAndSwap写入,写入的字段被其他地方修改过时重新读取并重试
+func (this *CacheEntityDb) updateHash(key string, readAll bool, f func(oldValues map[string]string) (map[string]string, []string, error)) (bool, error) {
+	atomicCache, isAtomic := this.kvCache.(AtomicHashKvCache)
+	for i := 0; i < cacheEntityDbMaxRetry; i++ {
+		var oldValues map[string]string
+		if readAll {
+			var err error
+			oldValues, err = this.kvCache.HGetAll(key)
+			if err != nil {
+				return false, err
+			}
+			if len(oldValues) == 0 {
+				return false, nil
+			}
+		} else if !isAtomic {
+			// HCompareAndSwap会检查key是否存在
+			typ, err := this.kvCache.Type(key)
+			if err != nil {
+				return false, err
+			}
+			if typ == "none" {
+				return false, nil
+			}
+		}
+		newValues, delFields, err := f(oldValues)
+		if err != nil {
+			return true, err
+		}
+		if len(newValues) == 0 && len(delFields) == 0 {
+			return true, nil
+		}
+		if !isAtomic {
+			if len(newValues) > 0 {
+				if _, err = this.kvCache.HSet(key, newValues); err != nil {
+					return true, err
+				}
+			}
+			if len(delFields) > 0 {
+				if _, err = this.kvCache.HDel(key, delFields...); err != nil {
+					return true, err
+				}
+			}
+			return true, this.refreshExpire(key)
+		}
+		// 写入的字段必须和读取时一致,""表示字段不存在
+		expected := make(map[string]string)
+		if readAll {
+			for name := range newValues {
+				expected[name] = oldValues[name]
+			}
+			for _, name := range delFields {
+				expected[name] = oldValues[name]
+			}
+		}
+		isSetOk, err := atomicCache.HCompareAndSwap(key, expected, newValues, delFields, this.expiration)
+		if err != nil {
+			return true, err
+		}
+		if isSetOk {
+			return true, nil
+		}
+		if !readAll {
+			// 没有比较字段,失败说明实体不存在
+			return false, nil
+		}
+	}
+	return true, errors.New(fmt.Sprintf("%v update conflict, retry:%v", key, cacheEntityDbMaxRetry))
+}
+
+// 保存1个组件的一个字段
+func (this *CacheEntityDb) SaveComponentField(entityKey interface{}, componentName string, fieldName string, fieldData interface{}) error {
+	return this.SaveComponents(entityKey, map[string]interface{}{componentName + "." + fieldName: fieldData})
+}
+
+// 删除1个组件的某些字段
+func (this *CacheEntityDb) DeleteComponentField(entityKey interface{}, componentName string, fieldName ...string) error {
+	if len(fieldName) == 0 {
+		return nil
+	}
+	key := this.getKey(entityKey)
+	_, err := this.updateHash(key, true, func(oldValues map[string]string) (map[string]string, []string, error) {
+		oldValue, ok := oldValues[componentName]
+		if !ok {
+			return nil, nil, nil
+		}
+		newValue := json.RawMessage(oldValue)
+		var err error
+		for _, name := range fieldName {
+			newValue, err = removeJsonPath(newValue, []string{name})
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+		return map[string]string{componentName: string(newValue)}, nil, nil
+	})
+	return err
+}
+
+// 列表操作,listName对应hash的一个字段,字段值是json数组
+//
+//	f返回新的列表,返回nil时删除字段
+func (this *CacheEntityDb) updateList(entityKey interface{}, listName string, f func(list []json.RawMessage) ([]json.RawMessage, error)) error {
+	key := this.getKey(entityKey)
+	exists, err := this.updateHash(key, true, func(oldValues map[string]string) (map[string]string, []string, error) {
+		list, err := parseJsonList([]byte(oldValues[listName]))
+		if err != nil {
+			return nil, nil, errors.New(fmt.Sprintf("%v.%v err:%v", key, listName, err))
+		}
+		newList, err := f(list)
+		if err != nil {
+			return nil, nil, err
+		}
+		if newList == nil {
+			return nil, []string{listName}, nil
+		}
+		newBytes, err := json.Marshal(newList)
+		if err != nil {
+			return nil, nil, err
+		}
+		return map[string]string{listName: string(newBytes)}, nil, nil
+	})
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return ErrEntityNotExists
+	}
+	return nil
+}
+
+func (this *CacheEntityDb) PushToList(entityKey interface{}, listName string, item interface{}, maxLen int) error {
+	itemBytes, err := json.Marshal(item)
+	if err != nil {
+		return err
+	}
+	return this.updateList(entityKey, listName, func(list []json.RawMessage) ([]json.RawMessage, error) {
+		return pushListItem(list, json.RawMessage(itemBytes), maxLen), nil
+	})
+}
+
+func (this *CacheEntityDb) PopList(entityKey interface{}, listName string, count int, data interface{}) error {
+	var popped []json.RawMessage
+	err := this.updateList(entityKey, listName, func(list []json.RawMessage) ([]json.RawMessage, error) {
+		var rest []json.RawMessage
+		popped, rest = popListItems(list, count)
+		// 和MongoCollection一致,取出全部时删除列表
+		if count <= 0 {
+			return nil, nil
+		}
+		if rest == nil {
+			rest = []json.RawMessage{}
+		}
+		return rest, nil
+	})
+	if err != nil || popped == nil {
+		return err
+	}
+	return decodeJsonList(popped, data)
+}
+
+func (this *CacheEntityDb) RangeList(entityKey interface{}, listName string, start int, count int, data interface{}) error {
+	key := this.getKey(entityKey)
+	hashFields, err := this.kvCache.HGetAll(key)
+	if err != nil {
+		return err
+	}
+	if len(hashFields) == 0 {
+		return ErrEntityNotExists
+	}
+	list, err := parseJsonList([]byte(hashFields[listName]))
+	if err != nil || list == nil {
+		return err
+	}
+	return decodeJsonList(rangeListItems(list, start, count), data)
+}
+
+func (this *CacheEntityDb) RemoveFromList(entityKey interface{}, listName string, item interface{}) error {
+	itemBytes, err := json.Marshal(item)
+	if err != nil {
+		return err
+	}
+	return this.updateList(entityKey, listName, func(list []json.RawMessage) ([]json.RawMessage, error) {
+		if list == nil {
+			return nil, nil
+		}
+		return removeListItems(list, func(v json.RawMessage) bool {
+			return isJsonValueEqual(v, itemBytes)
+		}), nil
+	})
+}
+
+// 字段值 -> json字符串
+func encodeCacheEntityFields(fields map[string]any) (map[string]string, error) {
+	hashValues := make(map[string]string, len(fields))
+	for name, value := range fields {
+		valueBytes, err := json.Marshal(value)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("%v err:%v", name, err))
+		}
+		hashValues[name] = string(valueBytes)
+	}
+	return hashValues, nil
+}
+
+// 基于KvCache的KvDb实现
+//
+//	每个key对应一个string,key格式和GetEntityCacheKey一致,值是json格式
+type CacheKvDb struct {
+	kvCache   KvCache
+	keyPrefix string
+	// 过期时间,每次写入后刷新,<=0表示不过期
+	expiration time.Duration
+}
+
+func NewCacheKvDb(kvCache KvCache, keyPrefix string, expiration time.Duration) *CacheKvDb {
+	return &CacheKvDb{
+		kvCache:    kvCache,
+		keyPrefix:  keyPrefix,
+		expiration: expiration,
+	}
+}
+
+func (this *CacheKvDb) getKey(key interface{}) string {
+	return GetEntityCacheKey(this.keyPrefix, key)
+}
+
+// 数字会被解析成int64或float64
+func (this *CacheKvDb) Find(key interface{}) (interface{}, error) {
+	value, err := this.kvCache.Get(this.getKey(key))
+	if err != nil || value == "" {
+		return nil, err
+	}
+	return decodeJsonValue([]byte(value))
+}
+
+func (this *CacheKvDb) FindAndDecode(key interface{}, decodeData interface{}) error {
+	value, err := this.kvCache.Get(this.getKey(key))
+	if err != nil || value == "" {
+		return err
+	}
+	return json.Unmarshal([]byte(value), decodeData)
+}
+
+func (this *CacheKvDb) Insert(key interface{}, value interface{}) (err error, isDuplicateKey bool) {
+	return this.InsertWithTTL(key, value, this.expiration)
+}
+
+// 使用缓存的过期时间
+func (this *CacheKvDb) InsertWithTTL(key interface{}, value interface{}, ttl time.Duration) (err error, isDuplicateKey bool) {
+	valueBytes, err := json.Marshal(value)
+	if err != nil {
+		return err, false
+	}
+	isSetOk, err := this.kvCache.SetNX(this.getKey(key), string(valueBytes), ttl)
+	if err != nil {
+		return err, false
+	}
+	if !isSetOk {
+		return fmt.Errorf("%v key:%v %w", this.keyPrefix, key, ErrDuplicateKey), true
+	}
+	return nil, false
+}
+
+// 使用NewCacheKvDb设置的过期时间,不保留原有的过期时间
+func (this *CacheKvDb) Update(key interface{}, value interface{}, upsert bool) error {
+	return this.UpdateWithTTL(key, value, this.expiration, upsert)
+}
+
+// 使用缓存的过期时间
+func (this *CacheKvDb) UpdateWithTTL(key interface{}, value interface{}, ttl time.Duration, upsert bool) error {
+	valueBytes, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	cacheKey := this.getKey(key)
+	if !upsert {
+		typ, err := this.kvCache.Type(cacheKey)
+		if err != nil || typ == "none" {
+			return err
+		}
+	}
+	return this.kvCache.Set(cacheKey, string(valueBytes), ttl)
+}
+
+// 整数使用IncrBy,浮点数使用IncrByFloat,json格式的数字和redis的数字格式兼容
+//
+//	kvCache需要实现AdvancedKvCache,否则返回ErrNotSupported
+func (this *CacheKvDb) Inc(key interface{}, value interface{}, upsert bool) (interface{}, error) {
+	advancedCache, ok := this.kvCache.(AdvancedKvCache)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+	cacheKey := this.getKey(key)
+	if !upsert {
+		typ, err := this.kvCache.Type(cacheKey)
+		if err != nil {
+			return nil, err
+		}
+		if typ == "none" {
+			return nil, ErrEntityNotExists
+		}
+	}
+	var result interface{}
+	if i, ok := toInt64(value); ok {
+		newValue, err := advancedCache.IncrBy(cacheKey, i)
+		if err != nil {
+			return nil, err
+		}
+		result = newValue
+	} else if f, ok := toFloat64(value); ok {
+		newValue, err := advancedCache.IncrByFloat(cacheKey, f)
+		if err != nil {
+			return nil, err
+		}
+		result = newValue
+	} else {
+		return nil, errors.New(fmt.Sprintf("Cannot apply $inc to a value of non-numeric type:%v", value))
+	}
+	if this.expiration > 0 {
+		if _, err := advancedCache.Expire(cacheKey, this.expiration); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+func (this *CacheKvDb) Delete(key interface{}) error {
+	_, err := this.kvCache.Del(this.getKey(key))
+	return err
+}
@@ -1,10 +1,25 @@
 package gentity
 
+import (
+	"slices"
+	"strings"
+	"time"
+)
+
 // Entity的数据库接口
 type EntityDb interface {
 	// 根据id查找数据
 	FindEntityById(entityKey interface{}, data interface{}) (bool, error)
 
+	// 根据id批量查找数据,用于一次加载多个实体的数据,如公会成员的摘要数据
+	// newData用于创建每个实体的数据对象,返回值的key是entityKeys里的值,不存在的实体不在返回值中
+	// componentNames不为空时,只加载这些组件的数据
+	FindEntitiesByIds(entityKeys []interface{}, newData func() interface{}, componentNames ...string) (map[interface{}]interface{}, error)
+
+	// 按条件查询,支持字段路径(componentName.fieldName)的过滤,排序,分页和投影,如排行榜,后台管理工具
+	// newData用于创建每个实体的数据对象,QueryResult.Datas按照排序的顺序
+	FindEntities(query *Query, newData func() interface{}) (*QueryResult, error)
+
 	// 新建Entity(insert)
 	InsertEntity(entityKey interface{}, entityData interface{}) (err error, isDuplicateKey bool)
 
@@ -18,6 +33,7 @@ type EntityDb interface {
 	SaveComponent(entityKey interface{}, componentName string, componentData interface{}) error
 
 	// 批量保存组件(update entity's components...)
+	// components的key可以是字段路径(componentName.fieldName)
 	SaveComponents(entityKey interface{}, components map[string]interface{}) error
 
 	// 保存1个组件的一个字段(update entity's component.field)
@@ -25,7 +41,86 @@ type EntityDb interface {
 
 	// 删除1个组件的某些字段
 	DeleteComponentField(entityKey interface{}, componentName string, fieldName ...string) error
-	// TODO:需要一个有容量限制的列表接口,用于邮件或者离线操作之类的接口
+
+	// 有容量限制的列表接口,用于邮件或者离线操作之类的接口,不需要加载整个实体
+	// 实体不存在时返回ErrEntityNotExists
+
+	// 添加1项到列表尾部,列表长度超过maxLen时,删除最早的数据,maxLen<=0表示不限制长度
+	PushToList(entityKey interface{}, listName string, item interface{}, maxLen int) error
+
+	// 从列表头部取出最多count项,并从列表中删除,count<=0表示取出全部
+	// data必须是slice的指针,如*[]*pb.MailData
+	PopList(entityKey interface{}, listName string, count int, data interface{}) error
+
+	// 读取列表从start开始的最多count项,start<0表示从尾部开始计数,count<=0表示读取到列表尾部
+	// data必须是slice的指针,如*[]*pb.MailData
+	RangeList(entityKey interface{}, listName string, start int, count int, data interface{}) error
+
+	// 删除列表中和item相等的项
+	RemoveFromList(entityKey interface{}, listName string, item interface{}) error
+}
+
+// 支持乐观锁的EntityDb,用于防止多个服务器同时保存同一个实体时互相覆盖,如ReBalance期间
+//
+//	每次保存时版本号+1,并且只有数据库中的版本号和实体的版本号一致时才保存
+//	MongoCollection的批量保存还会在文档里额外保存一个versionField+"Token"字段,用于判断每个实体是否保存成功,
+//	查询实体数据时会排除该字段,直接读取数据库的工具需要注意
+type VersionedEntityDb interface {
+	// 设置版本号字段名,为空表示不使用乐观锁(默认)
+	SetVersionField(versionField string)
+
+	GetVersionField() string
+
+	// 查询实体的版本号,版本号字段不存在时返回0,实体不存在时返回ErrEntityNotExists
+	FindEntityVersion(entityKey interface{}) (int64, error)
+
+	// 根据id查找数据,同时返回同一次读取的版本号,加载实体时使用,保证数据和版本号一致
+	FindEntityByIdWithVersion(entityKey interface{}, data interface{}) (bool, int64, error)
+
+	// 数据库中的版本号等于version时才保存,保存成功后数据库中的版本号+1
+	// 版本号不一致时返回ErrVersionConflict,实体不存在时返回ErrEntityNotExists
+	SaveComponentsWithVersion(entityKey interface{}, components map[string]interface{}, version int64) error
+}
+
+// 支持增量保存的EntityDb
+//
+//	SaveComponents的value可以是UnsetComponentField和PushComponentField的返回值
+//	map和slice的数据库增量保存依赖该接口
+//	EntityDb没有实现该接口或者返回false时,保存整个字段
+type IncrementalEntityDb interface {
+	// 是否支持增量保存
+	SupportIncrementalSave() bool
+}
+
+// 支持乐观锁的PlayerDb
+type VersionedPlayerDb interface {
+	// 根据账号id查找玩家数据,同时返回同一次读取的版本号
+	FindPlayerByAccountIdWithVersion(accountId int64, regionId int32, playerData interface{}) (bool, int64, error)
+}
+
+// 根据id加载实体的数据,entityDb开启了乐观锁时,同时返回同一次读取的版本号,否则版本号为0
+//
+//	加载数据后调用VersionedEntity.SetVersion
+func FindEntityByIdWithVersion(entityDb EntityDb, entityKey interface{}, data interface{}) (bool, int64, error) {
+	if versionedDb, ok := entityDb.(VersionedEntityDb); ok && len(versionedDb.GetVersionField()) > 0 {
+		return versionedDb.FindEntityByIdWithVersion(entityKey, data)
+	}
+	exists, err := entityDb.FindEntityById(entityKey, data)
+	return exists, 0, err
+}
+
+// 根据账号id加载玩家的数据,playerDb开启了乐观锁时,同时返回同一次读取的版本号,否则版本号为0
+//
+//	加载数据后调用VersionedEntity.SetVersion
+func FindPlayerByAccountIdWithVersion(playerDb PlayerDb, accountId int64, regionId int32, playerData interface{}) (bool, int64, error) {
+	versionedDb, ok := playerDb.(VersionedEntityDb)
+	if ok && len(versionedDb.GetVersionField()) > 0 {
+		if versionedPlayerDb, ok := playerDb.(VersionedPlayerDb); ok {
+			return versionedPlayerDb.FindPlayerByAccountIdWithVersion(accountId, regionId, playerData)
+		}
+	}
+	exists, err := playerDb.FindPlayerByAccountId(accountId, regionId, playerData)
+	return exists, 0, err
 }
 
 // 玩家数据接口
@@ -65,8 +160,123 @@ type KvDb interface {
 	Delete(key interface{}) error
 }
 
+// 支持过期时间的KvDb,如每日重置的数据,临时封禁,邀请码
+//
+//	已过期但还没被数据库删除的数据,视为不存在
+type ExpirableKvDb interface {
+	// 插入数据,ttl之后过期
+	InsertWithTTL(key interface{}, value interface{}, ttl time.Duration) (err error, isDuplicateKey bool)
+
+	// 更新数据,并重新设置过期时间
+	UpdateWithTTL(key interface{}, value interface{}, ttl time.Duration, upsert bool) error
+}
+
+// 支持批量,条件更新和扫描的KvDb
+//
+//	用于跨服务器的数据,如世界boss的血量,拍卖行的商品,服务器的计数器
+type AdvancedKvDb interface {
+	// 批量查找,返回值的key是keys里的值,不存在的key不在返回值中
+	FindMany(keys []interface{}) (map[interface{}]interface{}, error)
+
+	// 当前值等于expected时才更新为newValue,返回是否更新成功
+	// expected为nil表示key不存在时才插入
+	CompareAndSwap(key interface{}, expected interface{}, newValue interface{}) (bool, error)
+
+	// 按照key升序扫描,支持前缀和范围条件,通过KvScanResult.NextCursor分页
+	Scan(scan *KvScan) (*KvScanResult, error)
+
+	// 原子的累加value里的多个字段,如世界boss的血量和被攻击次数
+	// fields的key是value里的字段路径,如hp或者stat.hitCount,返回累加后的值
+	IncFields(key interface{}, fields map[string]interface{}, upsert bool) (map[string]interface{}, error)
+}
+
 // 数据表管理接口
 type DbMgr interface {
 	GetEntityDb(name string) EntityDb
 	GetKvDb(name string) KvDb
 }
+
+// 支持批量保存的EntityDb
+type BulkEntityDb interface {
+	// 批量保存多个实体的组件数据,只有1次数据库交互,每个实体的保存结果互不影响
+	// 返回值和datas一一对应,nil表示保存成功,检查版本号失败时为ErrVersionConflict
+	SaveComponentsBulk(datas []*EntityComponentsData) []error
+}
+
+// 实体的数据库数据的变化,如GM工具或者离线任务直接修改了数据库
+type EntityChangeEvent struct {
+	EntityKey interface{}
+	// insert update replace delete
+	OperationType string
+	// update时修改或删除的字段路径,其他操作时为空,表示整个实体
+	UpdatedFields []string
+	// EntityDb开启了乐观锁时,update后的版本号
+	Version int64
+}
+
+// 受影响的组件名(字段路径的第一级),为空表示整个实体
+func (this *EntityChangeEvent) GetComponentNames() []string {
+	var componentNames []string
+	for _, fieldPath := range this.UpdatedFields {
+		componentName, _, _ := strings.Cut(fieldPath, ".")
+		if !slices.Contains(componentNames, componentName) {
+			componentNames = append(componentNames, componentName)
+		}
+	}
+	return componentNames
+}
+
+// 是否是实体自己保存数据库产生的变化,需要EntityDb开启乐观锁,在实体的协程中调用
+func (this *EntityChangeEvent) IsSavedBy(entity Entity) bool {
+	versionedEntity, ok := entity.(VersionedEntity)
+	return ok && this.Version > 0 && this.Version <= versionedEntity.GetVersion()
+}
+
+// SaveComponents的组件数据为UnsetComponentField时,表示删除该字段,如map增量保存时删除的项
+//
+//	components["bag.Items.1001"] = UnsetComponentField
+var UnsetComponentField interface{} = unsetComponentField{}
+
+type unsetComponentField struct{}
+
+func isUnsetComponentField(value interface{}) bool {
+	_, ok := value.(unsetComponentField)
+	return ok
+}
+
+// SaveComponents的组件数据为PushComponentField的返回值时,表示在数组字段的尾部追加数据,如SliceData的追加保存
+//
+//	components["quest.Finished"] = PushComponentField(1001, 1002)
+func PushComponentField(items ...interface{}) interface{} {
+	return &pushComponentField{items: items}
+}
+
+type pushComponentField struct {
+	items []interface{}
+}
+
+// 需要追加的数据
+func getPushComponentField(value interface{}) ([]interface{}, bool) {
+	pushField, ok := value.(*pushComponentField)
+	if !ok {
+		return nil, false
+	}
+	return pushField.items, true
+}
+
+// 1个实体需要保存的组件数据
+type EntityComponentsData struct {
+	EntityDb   EntityDb
+	EntityKey  interface{}
+	Components map[string]interface{}
+	// 是否检查版本号,EntityDb开启了乐观锁时使用
+	CheckVersion bool
+	Version      int64
+}
+
+// 支持事务的DbMgr
+type TransactionDbMgr interface {
+	// 在一个事务中保存多个实体的组件数据,要么全部成功,要么全部失败
+	// 检查版本号失败时返回ErrVersionConflict
+	SaveComponentsInTransaction(datas []*EntityComponentsData) error
+}
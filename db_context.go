@@ -0,0 +1,518 @@
+package gentity
+
+import (
+	"context"
+	"google.golang.org/protobuf/proto"
+	"sync"
+	"time"
+)
+
+// https://github.com/uber-go/guide/blob/master/style.md#verify-interface-compliance
+var _ EntityDbContext = (*MongoCollection)(nil)
+var _ PlayerDbContext = (*MongoCollectionPlayer)(nil)
+var _ KvDbContext = (*MongoKvDb)(nil)
+var _ KvCacheContext = (*RedisCache)(nil)
+var _ EntityDb = (*entityDbWithContext)(nil)
+var _ VersionedEntityDb = (*entityDbWithContext)(nil)
+var _ IncrementalEntityDb = (*entityDbWithContext)(nil)
+var _ KvDb = (*kvDbWithContext)(nil)
+var _ ExpirableKvDb = (*kvDbWithContext)(nil)
+var _ AdvancedKvDb = (*kvDbWithContext)(nil)
+var _ KvCache = (*kvCacheWithContext)(nil)
+var _ AdvancedKvCache = (*kvCacheWithContext)(nil)
+var _ AtomicHashKvCache = (*kvCacheWithContext)(nil)
+var _ KvCacheBatch = (*kvCacheWithContext)(nil)
+
+// 支持context的EntityDb接口
+//
+//	ctx可以设置deadline或者取消,防止数据库无响应时阻塞实体的协程
+type EntityDbContext interface {
+	FindEntityByIdContext(ctx context.Context, entityKey interface{}, data interface{}) (bool, error)
+
+	FindEntitiesByIdsContext(ctx context.Context, entityKeys []interface{}, newData func() interface{}, componentNames ...string) (map[interface{}]interface{}, error)
+
+	FindEntitiesContext(ctx context.Context, query *Query, newData func() interface{}) (*QueryResult, error)
+
+	InsertEntityContext(ctx context.Context, entityKey interface{}, entityData interface{}) (err error, isDuplicateKey bool)
+
+	SaveEntityContext(ctx context.Context, entityKey interface{}, entityData interface{}) error
+
+	DeleteEntityContext(ctx context.Context, entityKey interface{}) error
+
+	SaveComponentContext(ctx context.Context, entityKey interface{}, componentName string, componentData interface{}) error
+
+	SaveComponentsContext(ctx context.Context, entityKey interface{}, components map[string]interface{}) error
+
+	SaveComponentFieldContext(ctx context.Context, entityKey interface{}, componentName string, fieldName string, fieldData interface{}) error
+
+	DeleteComponentFieldContext(ctx context.Context, entityKey interface{}, componentName string, fieldName ...string) error
+
+	FindEntityVersionContext(ctx context.Context, entityKey interface{}) (int64, error)
+
+	FindEntityByIdWithVersionContext(ctx context.Context, entityKey interface{}, data interface{}) (bool, int64, error)
+
+	SaveComponentsWithVersionContext(ctx context.Context, entityKey interface{}, components map[string]interface{}, version int64) error
+
+	PushToListContext(ctx context.Context, entityKey interface{}, listName string, item interface{}, maxLen int) error
+
+	PopListContext(ctx context.Context, entityKey interface{}, listName string, count int, data interface{}) error
+
+	RangeListContext(ctx context.Context, entityKey interface{}, listName string, start int, count int, data interface{}) error
+
+	RemoveFromListContext(ctx context.Context, entityKey interface{}, listName string, item interface{}) error
+}
+
+// 支持context的PlayerDb接口
+type PlayerDbContext interface {
+	EntityDbContext
+
+	FindPlayerIdByAccountIdContext(ctx context.Context, accountId int64, regionId int32) (int64, error)
+
+	FindPlayerIdsByAccountIdContext(ctx context.Context, accountId int64, regionId int32) ([]int64, error)
+
+	FindPlayerByAccountIdContext(ctx context.Context, accountId int64, regionId int32, playerData interface{}) (bool, error)
+
+	FindPlayerByAccountIdWithVersionContext(ctx context.Context, accountId int64, regionId int32, playerData interface{}) (bool, int64, error)
+
+	FindAccountIdByPlayerIdContext(ctx context.Context, playerId int64) (int64, error)
+}
+
+// 支持context的KvDb接口
+type KvDbContext interface {
+	FindContext(ctx context.Context, key interface{}) (interface{}, error)
+
+	FindAndDecodeContext(ctx context.Context, key interface{}, decodeData interface{}) error
+
+	InsertContext(ctx context.Context, key interface{}, value interface{}) (err error, isDuplicateKey bool)
+
+	UpdateContext(ctx context.Context, key interface{}, value interface{}, upsert bool) error
+
+	IncContext(ctx context.Context, key interface{}, value interface{}, upsert bool) (interface{}, error)
+
+	DeleteContext(ctx context.Context, key interface{}) error
+
+	InsertWithTTLContext(ctx context.Context, key interface{}, value interface{}, ttl time.Duration) (err error, isDuplicateKey bool)
+
+	UpdateWithTTLContext(ctx context.Context, key interface{}, value interface{}, ttl time.Duration, upsert bool) error
+
+	FindManyContext(ctx context.Context, keys []interface{}) (map[interface{}]interface{}, error)
+
+	CompareAndSwapContext(ctx context.Context, key interface{}, expected interface{}, newValue interface{}) (bool, error)
+
+	ScanContext(ctx context.Context, scan *KvScan) (*KvScanResult, error)
+
+	IncFieldsContext(ctx context.Context, key interface{}, fields map[string]interface{}, upsert bool) (map[string]interface{}, error)
+}
+
+// 支持context的KvCache接口
+type KvCacheContext interface {
+	GetContext(ctx context.Context, key string) (string, error)
+
+	SetContext(ctx context.Context, key string, value interface{}, expiration time.Duration) error
+
+	SetNXContext(ctx context.Context, key string, value interface{}, expiration time.Duration) (bool, error)
+
+	DelContext(ctx context.Context, key ...string) (int64, error)
+
+	TypeContext(ctx context.Context, key string) (string, error)
+
+	ExpireContext(ctx context.Context, key string, expiration time.Duration) (bool, error)
+
+	IncrByContext(ctx context.Context, key string, value int64) (int64, error)
+
+	IncrByFloatContext(ctx context.Context, key string, value float64) (float64, error)
+
+	HSetIfNotExistsContext(ctx context.Context, key string, values map[string]string, expiration time.Duration) (bool, error)
+
+	HCompareAndSwapContext(ctx context.Context, key string, expected map[string]string, values map[string]string, delFields []string, expiration time.Duration) (bool, error)
+
+	GetMapContext(ctx context.Context, key string, m interface{}) error
+
+	SetMapContext(ctx context.Context, key string, m interface{}) error
+
+	HGetAllContext(ctx context.Context, key string) (map[string]string, error)
+
+	HSetContext(ctx context.Context, key string, values ...interface{}) (int64, error)
+
+	HSetNXContext(ctx context.Context, key, field string, value interface{}) (bool, error)
+
+	HDelContext(ctx context.Context, key string, fields ...string) (int64, error)
+
+	GetProtoContext(ctx context.Context, key string, value proto.Message) error
+
+	ZAddContext(ctx context.Context, key string, members ...ZMember) (int64, error)
+
+	ZIncrByContext(ctx context.Context, key string, increment float64, member interface{}) (float64, error)
+
+	ZRevRangeWithScoresContext(ctx context.Context, key string, start, stop int64) ([]ZMember, error)
+
+	ZRankContext(ctx context.Context, key string, member interface{}) (int64, error)
+
+	ZRemContext(ctx context.Context, key string, members ...interface{}) (int64, error)
+
+	LPushContext(ctx context.Context, key string, values ...interface{}) (int64, error)
+
+	RPushContext(ctx context.Context, key string, values ...interface{}) (int64, error)
+
+	LTrimContext(ctx context.Context, key string, start, stop int64) error
+
+	LRangeContext(ctx context.Context, key string, start, stop int64) ([]string, error)
+
+	BatchContext(ctx context.Context, f func(batchCache KvCache)) error
+}
+
+// 数据库和缓存操作的超时设置
+//
+//	ctx没有设置deadline时,使用操作对应的超时时间,操作名就是接口的方法名,如"FindEntityById","HGetAll"
+//	没有单独设置的操作使用默认超时时间,<=0表示不超时
+type OpTimeouts struct {
+	defaultTimeout time.Duration
+	opTimeouts     map[string]time.Duration
+	lock           sync.RWMutex
+}
+
+func NewOpTimeouts(defaultTimeout time.Duration) *OpTimeouts {
+	return &OpTimeouts{
+		defaultTimeout: defaultTimeout,
+		opTimeouts:     make(map[string]time.Duration),
+	}
+}
+
+func (this *OpTimeouts) SetDefaultTimeout(timeout time.Duration) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.defaultTimeout = timeout
+}
+
+// 设置某个操作的超时时间
+func (this *OpTimeouts) SetOpTimeout(op string, timeout time.Duration) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.opTimeouts[op] = timeout
+}
+
+func (this *OpTimeouts) GetOpTimeout(op string) time.Duration {
+	if this == nil {
+		return 0
+	}
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+	if timeout, ok := this.opTimeouts[op]; ok {
+		return timeout
+	}
+	return this.defaultTimeout
+}
+
+// ctx没有设置deadline时,加上操作对应的超时时间
+func (this *OpTimeouts) WithTimeout(ctx context.Context, op string) (context.Context, context.CancelFunc) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if _, hasDeadline := ctx.Deadline(); hasDeadline {
+		return ctx, func() {}
+	}
+	timeout := this.GetOpTimeout(op)
+	if timeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// 把ctx绑定到EntityDb上,返回的EntityDb的每个操作都使用ctx
+//
+//	entityDb没有实现EntityDbContext时,直接返回entityDb,ctx不生效
+func WithEntityDbContext(ctx context.Context, entityDb EntityDb) EntityDb {
+	if entityDbContext, ok := entityDb.(EntityDbContext); ok {
+		return &entityDbWithContext{
+			ctx: ctx,
+			db:  entityDbContext,
+		}
+	}
+	return entityDb
+}
+
+// 把ctx绑定到KvDb上,返回的KvDb的每个操作都使用ctx
+//
+//	kvDb没有实现KvDbContext时,直接返回kvDb,ctx不生效
+func WithKvDbContext(ctx context.Context, kvDb KvDb) KvDb {
+	if kvDbContext, ok := kvDb.(KvDbContext); ok {
+		return &kvDbWithContext{
+			ctx: ctx,
+			db:  kvDbContext,
+		}
+	}
+	return kvDb
+}
+
+// 把ctx绑定到KvCache上,返回的KvCache的每个操作都使用ctx
+//
+//	kvCache没有实现KvCacheContext时,直接返回kvCache,ctx不生效
+func WithKvCacheContext(ctx context.Context, kvCache KvCache) KvCache {
+	if kvCacheContext, ok := kvCache.(KvCacheContext); ok {
+		return &kvCacheWithContext{
+			ctx:   ctx,
+			cache: kvCacheContext,
+		}
+	}
+	return kvCache
+}
+
+// 绑定了ctx的EntityDb
+type entityDbWithContext struct {
+	ctx context.Context
+	db  EntityDbContext
+}
+
+func (this *entityDbWithContext) FindEntityById(entityKey interface{}, data interface{}) (bool, error) {
+	return this.db.FindEntityByIdContext(this.ctx, entityKey, data)
+}
+
+func (this *entityDbWithContext) FindEntitiesByIds(entityKeys []interface{}, newData func() interface{}, componentNames ...string) (map[interface{}]interface{}, error) {
+	return this.db.FindEntitiesByIdsContext(this.ctx, entityKeys, newData, componentNames...)
+}
+
+func (this *entityDbWithContext) FindEntities(query *Query, newData func() interface{}) (*QueryResult, error) {
+	return this.db.FindEntitiesContext(this.ctx, query, newData)
+}
+
+func (this *entityDbWithContext) InsertEntity(entityKey interface{}, entityData interface{}) (err error, isDuplicateKey bool) {
+	return this.db.InsertEntityContext(this.ctx, entityKey, entityData)
+}
+
+func (this *entityDbWithContext) SaveEntity(entityKey interface{}, entityData interface{}) error {
+	return this.db.SaveEntityContext(this.ctx, entityKey, entityData)
+}
+
+func (this *entityDbWithContext) DeleteEntity(entityKey interface{}) error {
+	return this.db.DeleteEntityContext(this.ctx, entityKey)
+}
+
+func (this *entityDbWithContext) SaveComponent(entityKey interface{}, componentName string, componentData interface{}) error {
+	return this.db.SaveComponentContext(this.ctx, entityKey, componentName, componentData)
+}
+
+func (this *entityDbWithContext) SaveComponents(entityKey interface{}, components map[string]interface{}) error {
+	return this.db.SaveComponentsContext(this.ctx, entityKey, components)
+}
+
+func (this *entityDbWithContext) SupportIncrementalSave() bool {
+	incrementalDb, ok := this.db.(IncrementalEntityDb)
+	return ok && incrementalDb.SupportIncrementalSave()
+}
+
+func (this *entityDbWithContext) SaveComponentField(entityKey interface{}, componentName string, fieldName string, fieldData interface{}) error {
+	return this.db.SaveComponentFieldContext(this.ctx, entityKey, componentName, fieldName, fieldData)
+}
+
+func (this *entityDbWithContext) DeleteComponentField(entityKey interface{}, componentName string, fieldName ...string) error {
+	return this.db.DeleteComponentFieldContext(this.ctx, entityKey, componentName, fieldName...)
+}
+
+func (this *entityDbWithContext) SetVersionField(versionField string) {
+	if versionedDb, ok := this.db.(VersionedEntityDb); ok {
+		versionedDb.SetVersionField(versionField)
+	}
+}
+
+func (this *entityDbWithContext) GetVersionField() string {
+	if versionedDb, ok := this.db.(VersionedEntityDb); ok {
+		return versionedDb.GetVersionField()
+	}
+	return ""
+}
+
+func (this *entityDbWithContext) FindEntityVersion(entityKey interface{}) (int64, error) {
+	return this.db.FindEntityVersionContext(this.ctx, entityKey)
+}
+
+func (this *entityDbWithContext) FindEntityByIdWithVersion(entityKey interface{}, data interface{}) (bool, int64, error) {
+	return this.db.FindEntityByIdWithVersionContext(this.ctx, entityKey, data)
+}
+
+func (this *entityDbWithContext) SaveComponentsWithVersion(entityKey interface{}, components map[string]interface{}, version int64) error {
+	return this.db.SaveComponentsWithVersionContext(this.ctx, entityKey, components, version)
+}
+
+func (this *entityDbWithContext) PushToList(entityKey interface{}, listName string, item interface{}, maxLen int) error {
+	return this.db.PushToListContext(this.ctx, entityKey, listName, item, maxLen)
+}
+
+func (this *entityDbWithContext) PopList(entityKey interface{}, listName string, count int, data interface{}) error {
+	return this.db.PopListContext(this.ctx, entityKey, listName, count, data)
+}
+
+func (this *entityDbWithContext) RangeList(entityKey interface{}, listName string, start int, count int, data interface{}) error {
+	return this.db.RangeListContext(this.ctx, entityKey, listName, start, count, data)
+}
+
+func (this *entityDbWithContext) RemoveFromList(entityKey interface{}, listName string, item interface{}) error {
+	return this.db.RemoveFromListContext(this.ctx, entityKey, listName, item)
+}
+
+// 绑定了ctx的KvDb
+type kvDbWithContext struct {
+	ctx context.Context
+	db  KvDbContext
+}
+
+func (this *kvDbWithContext) Find(key interface{}) (interface{}, error) {
+	return this.db.FindContext(this.ctx, key)
+}
+
+func (this *kvDbWithContext) FindAndDecode(key interface{}, decodeData interface{}) error {
+	return this.db.FindAndDecodeContext(this.ctx, key, decodeData)
+}
+
+func (this *kvDbWithContext) Insert(key interface{}, value interface{}) (err error, isDuplicateKey bool) {
+	return this.db.InsertContext(this.ctx, key, value)
+}
+
+func (this *kvDbWithContext) Update(key interface{}, value interface{}, upsert bool) error {
+	return this.db.UpdateContext(this.ctx, key, value, upsert)
+}
+
+func (this *kvDbWithContext) Inc(key interface{}, value interface{}, upsert bool) (interface{}, error) {
+	return this.db.IncContext(this.ctx, key, value, upsert)
+}
+
+func (this *kvDbWithContext) Delete(key interface{}) error {
+	return this.db.DeleteContext(this.ctx, key)
+}
+
+func (this *kvDbWithContext) InsertWithTTL(key interface{}, value interface{}, ttl time.Duration) (err error, isDuplicateKey bool) {
+	return this.db.InsertWithTTLContext(this.ctx, key, value, ttl)
+}
+
+func (this *kvDbWithContext) UpdateWithTTL(key interface{}, value interface{}, ttl time.Duration, upsert bool) error {
+	return this.db.UpdateWithTTLContext(this.ctx, key, value, ttl, upsert)
+}
+
+func (this *kvDbWithContext) FindMany(keys []interface{}) (map[interface{}]interface{}, error) {
+	return this.db.FindManyContext(this.ctx, keys)
+}
+
+func (this *kvDbWithContext) CompareAndSwap(key interface{}, expected interface{}, newValue interface{}) (bool, error) {
+	return this.db.CompareAndSwapContext(this.ctx, key, expected, newValue)
+}
+
+func (this *kvDbWithContext) Scan(scan *KvScan) (*KvScanResult, error) {
+	return this.db.ScanContext(this.ctx, scan)
+}
+
+func (this *kvDbWithContext) IncFields(key interface{}, fields map[string]interface{}, upsert bool) (map[string]interface{}, error) {
+	return this.db.IncFieldsContext(this.ctx, key, fields, upsert)
+}
+
+// 绑定了ctx的KvCache
+type kvCacheWithContext struct {
+	ctx   context.Context
+	cache KvCacheContext
+}
+
+func (this *kvCacheWithContext) Get(key string) (string, error) {
+	return this.cache.GetContext(this.ctx, key)
+}
+
+func (this *kvCacheWithContext) Set(key string, value interface{}, expiration time.Duration) error {
+	return this.cache.SetContext(this.ctx, key, value, expiration)
+}
+
+func (this *kvCacheWithContext) SetNX(key string, value interface{}, expiration time.Duration) (bool, error) {
+	return this.cache.SetNXContext(this.ctx, key, value, expiration)
+}
+
+func (this *kvCacheWithContext) Del(key ...string) (int64, error) {
+	return this.cache.DelContext(this.ctx, key...)
+}
+
+func (this *kvCacheWithContext) Type(key string) (string, error) {
+	return this.cache.TypeContext(this.ctx, key)
+}
+
+func (this *kvCacheWithContext) Expire(key string, expiration time.Duration) (bool, error) {
+	return this.cache.ExpireContext(this.ctx, key, expiration)
+}
+
+func (this *kvCacheWithContext) IncrBy(key string, value int64) (int64, error) {
+	return this.cache.IncrByContext(this.ctx, key, value)
+}
+
+func (this *kvCacheWithContext) IncrByFloat(key string, value float64) (float64, error) {
+	return this.cache.IncrByFloatContext(this.ctx, key, value)
+}
+
+func (this *kvCacheWithContext) HSetIfNotExists(key string, values map[string]string, expiration time.Duration) (bool, error) {
+	return this.cache.HSetIfNotExistsContext(this.ctx, key, values, expiration)
+}
+
+func (this *kvCacheWithContext) HCompareAndSwap(key string, expected map[string]string, values map[string]string, delFields []string, expiration time.Duration) (bool, error) {
+	return this.cache.HCompareAndSwapContext(this.ctx, key, expected, values, delFields, expiration)
+}
+
+func (this *kvCacheWithContext) GetMap(key string, m interface{}) error {
+	return this.cache.GetMapContext(this.ctx, key, m)
+}
+
+func (this *kvCacheWithContext) SetMap(key string, m interface{}) error {
+	return this.cache.SetMapContext(this.ctx, key, m)
+}
+
+func (this *kvCacheWithContext) HGetAll(key string) (map[string]string, error) {
+	return this.cache.HGetAllContext(this.ctx, key)
+}
+
+func (this *kvCacheWithContext) HSet(key string, values ...interface{}) (int64, error) {
+	return this.cache.HSetContext(this.ctx, key, values...)
+}
+
+func (this *kvCacheWithContext) HSetNX(key, field string, value interface{}) (bool, error) {
+	return this.cache.HSetNXContext(this.ctx, key, field, value)
+}
+
+func (this *kvCacheWithContext) HDel(key string, fields ...string) (int64, error) {
+	return this.cache.HDelContext(this.ctx, key, fields...)
+}
+
+func (this *kvCacheWithContext) GetProto(key string, value proto.Message) error {
+	return this.cache.GetProtoContext(this.ctx, key, value)
+}
+
+func (this *kvCacheWithContext) ZAdd(key string, members ...ZMember) (int64, error) {
+	return this.cache.ZAddContext(this.ctx, key, members...)
+}
+
+func (this *kvCacheWithContext) ZIncrBy(key string, increment float64, member interface{}) (float64, error) {
+	return this.cache.ZIncrByContext(this.ctx, key, increment, member)
+}
+
+func (this *kvCacheWithContext) ZRevRangeWithScores(key string, start, stop int64) ([]ZMember, error) {
+	return this.cache.ZRevRangeWithScoresContext(this.ctx, key, start, stop)
+}
+
+func (this *kvCacheWithContext) ZRank(key string, member interface{}) (int64, error) {
+	return this.cache.ZRankContext(this.ctx, key, member)
+}
+
+func (this *kvCacheWithContext) ZRem(key string, members ...interface{}) (int64, error) {
+	return this.cache.ZRemContext(this.ctx, key, members...)
+}
+
+func (this *kvCacheWithContext) LPush(key string, values ...interface{}) (int64, error) {
+	return this.cache.LPushContext(this.ctx, key, values...)
+}
+
+func (this *kvCacheWithContext) RPush(key string, values ...interface{}) (int64, error) {
+	return this.cache.RPushContext(this.ctx, key, values...)
+}
+
+func (this *kvCacheWithContext) LTrim(key string, start, stop int64) error {
+	return this.cache.LTrimContext(this.ctx, key, start, stop)
+}
+
+func (this *kvCacheWithContext) LRange(key string, start, stop int64) ([]string, error) {
+	return this.cache.LRangeContext(this.ctx, key, start, stop)
+}
+
+func (this *kvCacheWithContext) Batch(f func(batchCache KvCache)) error {
+	return this.cache.BatchContext(this.ctx, f)
+}
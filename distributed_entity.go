@@ -1,6 +1,7 @@
 package gentity
 
 import (
+	"context"
 	"github.com/fish-tennis/gentity/util"
 	"sync"
 )
@@ -61,8 +62,14 @@ func (this *DistributedEntityMgr) GetEntity(entityId int64) RoutineEntity {
 // 加载分布式实体
 // 加载成功后,开启独立协程
 func (this *DistributedEntityMgr) LoadEntity(entityId int64, entityData interface{}) RoutineEntity {
-	// 到数据库加载数据
-	exist, err := this.entityDb.FindEntityById(entityId, entityData)
+	return this.LoadEntityContext(context.Background(), entityId, entityData)
+}
+
+// LoadEntity的context版本,ctx用于数据库加载
+func (this *DistributedEntityMgr) LoadEntityContext(ctx context.Context, entityId int64, entityData interface{}) RoutineEntity {
+	entityDb := WithEntityDbContext(ctx, this.entityDb)
+	// 到数据库加载数据,开启了乐观锁时,版本号和数据来自同一次读取
+	exist, version, err := FindEntityByIdWithVersion(entityDb, entityId, entityData)
 	if err != nil {
 		GetLogger().Debug("LoadEntity err:%v entityId:%v", err, entityId)
 		return nil
@@ -76,6 +83,9 @@ func (this *DistributedEntityMgr) LoadEntity(entityId int64, entityData interfac
 		GetLogger().Debug("LoadEntity newEntity==nil entityId:%v", entityId)
 		return nil
 	}
+	if versionedEntity, ok := newEntity.(VersionedEntity); ok {
+		versionedEntity.SetVersion(version)
+	}
 	this.entityMapLock.Lock()
 	defer this.entityMapLock.Unlock()
 	if existGuild, ok := this.entityMap[entityId]; ok {
@@ -113,6 +123,26 @@ func (this *DistributedEntityMgr) LoadEntity(entityId int64, entityData interfac
 	return newEntity
 }
 
+// 实体的数据库数据变化时调用,如配合MongoCollection.Watch使用,只处理路由到本服务器的实体
+//
+//	实体已加载时,把event推送给实体,由ProcessMessageFunc处理(如重新加载数据),可以用event.IsSavedBy过滤实体自己的保存
+//	实体没有加载时,删除实体的组件缓存,schemaEntity用于解析组件结构
+func (this *DistributedEntityMgr) OnEntityDbChanged(event *EntityChangeEvent, schemaEntity Entity, cacheKeyPrefix string) {
+	entityId, ok := toInt64(event.EntityKey)
+	if !ok {
+		GetLogger().Error("OnEntityDbChanged entityKey err:%v", event.EntityKey)
+		return
+	}
+	if this.distributedEntityHelper.RouteServerId(entityId) != GetApplication().GetId() {
+		return
+	}
+	if entity := this.GetEntity(entityId); entity != nil {
+		entity.PushMessage(event)
+		return
+	}
+	InvalidateEntityCache(this.cache, schemaEntity, cacheKeyPrefix, event)
+}
+
 // 分布式锁Lock
 // redis实现的分布式锁,保证同一个实体的逻辑处理协程只会在一个服务器上
 func (this *DistributedEntityMgr) DistributeLock(entityId int64) bool {
@@ -21,6 +21,14 @@ type Entity interface {
 	RangeComponent(fun func(component Component) bool)
 }
 
+// 使用乐观锁的实体,记录加载时的版本号,配合VersionedEntityDb使用
+//
+//	用FindEntityByIdWithVersion或FindPlayerByAccountIdWithVersion加载数据,再设置返回的版本号
+type VersionedEntity interface {
+	GetVersion() int64
+	SetVersion(version int64)
+}
+
 // 实体组件接口
 type Component interface {
 	// 组件名
@@ -43,6 +51,8 @@ type BaseEntity struct {
 	components []Component
 	// 事件响应
 	eventReceivers []EventReceiver
+	// 数据版本号,EntityDb开启乐观锁时使用
+	version int64
 }
 
 // Entity唯一id
@@ -50,6 +60,15 @@ func (this *BaseEntity) GetId() int64 {
 	return this.Id
 }
 
+// 数据版本号
+func (this *BaseEntity) GetVersion() int64 {
+	return this.version
+}
+
+func (this *BaseEntity) SetVersion(version int64) {
+	this.version = version
+}
+
 // 获取组件
 func (this *BaseEntity) GetComponentByName(componentName string) Component {
 	for _, v := range this.components {
@@ -106,11 +125,9 @@ func (this *BaseEntity) RangeEventReceiver(f func(eventReceiver EventReceiver) b
 	}
 }
 
+// 把修改数据保存到缓存,kvCache实现了KvCacheBatch接口时,批量提交
 func (this *BaseEntity) SaveCache(kvCache KvCache, cacheKeyPrefix string, entityKey interface{}) error {
-	for _, component := range this.components {
-		SaveComponentChangedDataToCache(kvCache, cacheKeyPrefix, entityKey, component)
-	}
-	return nil
+	return SaveEntityChangedDataToCache(kvCache, cacheKeyPrefix, entityKey, this)
 }
 
 type BaseComponent struct {
@@ -199,6 +216,34 @@ func GetEntityComponentChildCacheKey(prefix string, entityId interface{}, compon
 	}
 }
 
+// 获取实体组件的所有缓存key,用于删除实体的缓存
+//
+//	entity用于解析组件结构,componentNames为空时返回所有组件的缓存key,组件名不区分大小写
+func GetEntityComponentCacheKeys(entity Entity, prefix string, entityId interface{}, componentNames ...string) []string {
+	var cacheKeys []string
+	entity.RangeComponent(func(component Component) bool {
+		if len(componentNames) > 0 && !slices.ContainsFunc(componentNames, func(componentName string) bool {
+			return strings.EqualFold(componentName, component.GetName())
+		}) {
+			return true
+		}
+		objStruct := GetObjSaveableStruct(component)
+		if objStruct == nil {
+			// 组件可以没有保存字段
+			return true
+		}
+		if objStruct.IsSingleField() {
+			cacheKeys = append(cacheKeys, GetEntityComponentCacheKey(prefix, entityId, component.GetName()))
+			return true
+		}
+		for _, childStruct := range objStruct.Children {
+			cacheKeys = append(cacheKeys, GetEntityComponentChildCacheKey(prefix, entityId, component.GetName(), childStruct.Name))
+		}
+		return true
+	})
+	return cacheKeys
+}
+
 func GetChildCacheKey(parentName, childName string) string {
 	return fmt.Sprintf("%v.%v", parentName, childName)
 }
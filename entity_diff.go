@@ -0,0 +1,277 @@
+package gentity
+
+import (
+	"fmt"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"google.golang.org/protobuf/proto"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// 数据差异的类型
+type EntityDiffOp int
+
+const (
+	// 新增的数据
+	EntityDiffAdd EntityDiffOp = iota + 1
+	// 删除的数据
+	EntityDiffRemove
+	// 修改的数据
+	EntityDiffModify
+)
+
+func (this EntityDiffOp) String() string {
+	switch this {
+	case EntityDiffAdd:
+		return "add"
+	case EntityDiffRemove:
+		return "remove"
+	case EntityDiffModify:
+		return "modify"
+	}
+	return "unknown"
+}
+
+// 一条数据差异
+type EntityDiff struct {
+	// 字段路径,和数据库的字段路径规则一致,如Quest.Quests.1.progress
+	Path string
+	Op   EntityDiffOp
+	// 新增时Old为nil,删除时New为nil
+	// 序列化保存的proto数据会被反序列化,值是bson格式,方便阅读
+	Old interface{}
+	New interface{}
+}
+
+func (this *EntityDiff) String() string {
+	return fmt.Sprintf("%v %v: %v -> %v", this.Op, this.Path, this.Old, this.New)
+}
+
+// 比较2个版本的实体保存数据,如2个快照,或者缓存和数据库的数据
+//
+//	oldData和newData的格式和GetEntitySaveData一致: 组件名 -> 组件的保存数据
+//	按照schemaEntity的组件结构逐层比较: 组件,子对象,map的key,proto的字段
+//	只比较schemaEntity里有的组件
+//	InterfaceMap的值需要InterfaceMap字段所在的对象实现InterfaceMapValueCreator,才能逐个字段比较
+func DiffEntitySaveData(schemaEntity Entity, oldData, newData map[string]interface{}) ([]*EntityDiff, error) {
+	var diffs []*EntityDiff
+	var diffErr error
+	schemaEntity.RangeComponent(func(component Component) bool {
+		objStruct := GetObjSaveableStruct(component)
+		if objStruct == nil {
+			// 组件可以没有保存字段
+			return true
+		}
+		componentName := GetComponentSaveName(component)
+		oldValue, err := toBsonValue(oldData[componentName])
+		if err != nil {
+			diffErr = err
+			return false
+		}
+		newValue, err := toBsonValue(newData[componentName])
+		if err != nil {
+			diffErr = err
+			return false
+		}
+		diffs = diffSaveableObject(componentName, component, oldValue, newValue, diffs)
+		return true
+	})
+	return diffs, diffErr
+}
+
+// 比较2个实体的当前数据,newEntity同时用于解析组件结构
+//
+//	如比较缓存和数据库的数据: 一个实体从数据库加载,另一个实体再用LoadFromCache加载缓存
+func DiffEntities(oldEntity, newEntity Entity) ([]*EntityDiff, error) {
+	oldData := make(map[string]interface{})
+	GetEntitySaveData(oldEntity, oldData)
+	newData := make(map[string]interface{})
+	GetEntitySaveData(newEntity, newData)
+	return DiffEntitySaveData(newEntity, oldData, newData)
+}
+
+// InterfaceMap的值对象的构造接口,用于比较数据差异时反序列化InterfaceMap的值
+//
+//	和InterfaceMapLoader一样,放在InterfaceMap字段所在的对象上(一般是组件上)
+//	没有实现该接口时,InterfaceMap的值按照序列化后的数据比较
+type InterfaceMapValueCreator interface {
+	// 根据map的key(字符串格式)创建值对象,返回nil表示该key的值按照序列化后的数据比较
+	NewInterfaceMapValue(key string) interface{}
+}
+
+// 按照obj的组件结构比较bson格式的2个值,obj是组件或者InterfaceMap的值对象
+func diffSaveableObject(path string, obj interface{}, oldValue, newValue interface{}, diffs []*EntityDiff) []*EntityDiff {
+	objStruct := GetObjSaveableStruct(obj)
+	if objStruct == nil {
+		return diffSaveValue(path, nil, oldValue, newValue, diffs)
+	}
+	if objStruct.IsSingleField() {
+		_, saveableField := objStruct.GetSingleSaveable(obj)
+		return diffSaveableField(path, obj, saveableField, oldValue, newValue, diffs)
+	}
+	// 多个child子模块的组合,组件被整体新增或删除时,逐个比较子模块
+	oldChildren, _ := oldValue.(bson.M)
+	newChildren, _ := newValue.(bson.M)
+	objVal := reflect.ValueOf(obj)
+	if objVal.Kind() == reflect.Ptr {
+		objVal = objVal.Elem()
+	}
+	for childIndex, childStruct := range objStruct.Children {
+		_, saveableField := objStruct.GetChildSaveable(obj, childIndex)
+		// child的InterfaceMapValueCreator放在child对象上
+		var childObj interface{}
+		if fieldVal := objVal.Field(childStruct.FieldIndex); fieldVal.Kind() == reflect.Struct {
+			childObj = convertStructToInterface(fieldVal)
+		} else if fieldVal.CanInterface() {
+			childObj = fieldVal.Interface()
+		}
+		diffs = diffSaveableField(path+"."+childStruct.Name, childObj, saveableField,
+			oldChildren[childStruct.Name], newChildren[childStruct.Name], diffs)
+	}
+	return diffs
+}
+
+// 比较一个保存字段,owner是字段所在的对象
+func diffSaveableField(path string, owner interface{}, saveableField *SaveableField, oldValue, newValue interface{}, diffs []*EntityDiff) []*EntityDiff {
+	if saveableField == nil {
+		return diffSaveValue(path, nil, oldValue, newValue, diffs)
+	}
+	if saveableField.IsInterfaceMap() {
+		if creator, ok := owner.(InterfaceMapValueCreator); ok {
+			return diffInterfaceMap(path, creator, oldValue, newValue, diffs)
+		}
+	}
+	return diffSaveValue(path, saveableField.StructField.Type, oldValue, newValue, diffs)
+}
+
+// 逐个比较InterfaceMap的key,值按照creator创建的值对象的结构比较
+func diffInterfaceMap(path string, creator InterfaceMapValueCreator, oldValue, newValue interface{}, diffs []*EntityDiff) []*EntityDiff {
+	oldMap, isOldMap := oldValue.(bson.M)
+	newMap, isNewMap := newValue.(bson.M)
+	if (oldValue != nil && !isOldMap) || (newValue != nil && !isNewMap) {
+		return diffSaveValue(path, nil, oldValue, newValue, diffs)
+	}
+	keys := make([]string, 0, len(oldMap)+len(newMap))
+	for k := range oldMap {
+		keys = append(keys, k)
+	}
+	for k := range newMap {
+		if _, ok := oldMap[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	slices.SortFunc(keys, compareDiffKey)
+	for _, k := range keys {
+		valuePath := path + "." + k
+		if valueObj := creator.NewInterfaceMapValue(k); valueObj != nil {
+			diffs = diffSaveableObject(valuePath, valueObj, oldMap[k], newMap[k], diffs)
+		} else {
+			diffs = diffSaveValue(valuePath, nil, oldMap[k], newMap[k], diffs)
+		}
+	}
+	return diffs
+}
+
+// 比较bson格式的2个值,fieldType是值对应的字段类型,用于反序列化proto,可以为nil
+func diffSaveValue(path string, fieldType reflect.Type, oldValue, newValue interface{}, diffs []*EntityDiff) []*EntityDiff {
+	oldValue = decodeDiffValue(path, fieldType, oldValue)
+	newValue = decodeDiffValue(path, fieldType, newValue)
+	if oldValue == nil && newValue == nil {
+		return diffs
+	}
+	if oldValue == nil {
+		return append(diffs, &EntityDiff{Path: path, Op: EntityDiffAdd, New: newValue})
+	}
+	if newValue == nil {
+		return append(diffs, &EntityDiff{Path: path, Op: EntityDiffRemove, Old: oldValue})
+	}
+	// map和slice的元素类型,proto反序列化之后的字段不需要类型
+	var elemType reflect.Type
+	if fieldType != nil {
+		switch fieldType.Kind() {
+		case reflect.Map, reflect.Slice, reflect.Array:
+			elemType = fieldType.Elem()
+		}
+	}
+	switch oldVal := oldValue.(type) {
+	case bson.M:
+		if newVal, ok := newValue.(bson.M); ok {
+			return diffSaveMap(path, elemType, oldVal, newVal, diffs)
+		}
+	case bson.A:
+		if newVal, ok := newValue.(bson.A); ok {
+			return diffSaveSlice(path, elemType, oldVal, newVal, diffs)
+		}
+	}
+	if !isBsonValueEqual(oldValue, newValue) {
+		diffs = append(diffs, &EntityDiff{Path: path, Op: EntityDiffModify, Old: oldValue, New: newValue})
+	}
+	return diffs
+}
+
+// 逐个比较map的key,key按数字或字符串排序
+func diffSaveMap(path string, elemType reflect.Type, oldMap, newMap bson.M, diffs []*EntityDiff) []*EntityDiff {
+	keys := make([]string, 0, len(oldMap)+len(newMap))
+	for k := range oldMap {
+		keys = append(keys, k)
+	}
+	for k := range newMap {
+		if _, ok := oldMap[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	slices.SortFunc(keys, compareDiffKey)
+	for _, k := range keys {
+		diffs = diffSaveValue(path+"."+k, elemType, oldMap[k], newMap[k], diffs)
+	}
+	return diffs
+}
+
+// 按索引比较slice
+func diffSaveSlice(path string, elemType reflect.Type, oldSlice, newSlice bson.A, diffs []*EntityDiff) []*EntityDiff {
+	for i := 0; i < max(len(oldSlice), len(newSlice)); i++ {
+		var oldItem, newItem interface{}
+		if i < len(oldSlice) {
+			oldItem = oldSlice[i]
+		}
+		if i < len(newSlice) {
+			newItem = newSlice[i]
+		}
+		diffs = diffSaveValue(path+"."+strconv.Itoa(i), elemType, oldItem, newItem, diffs)
+	}
+	return diffs
+}
+
+// map的key都是数字时按数字排序
+func compareDiffKey(a, b string) int {
+	ai, errA := strconv.ParseInt(a, 10, 64)
+	bi, errB := strconv.ParseInt(b, 10, 64)
+	if errA == nil && errB == nil {
+		return compareOrdered(ai, bi)
+	}
+	return strings.Compare(a, b)
+}
+
+// 序列化保存的proto数据,反序列化之后转换成bson格式,以便逐个字段比较
+func decodeDiffValue(path string, fieldType reflect.Type, value interface{}) interface{} {
+	binary, ok := value.(bson.Binary)
+	if !ok || fieldType == nil || fieldType.Kind() != reflect.Ptr {
+		return value
+	}
+	message, ok := reflect.New(fieldType.Elem()).Interface().(proto.Message)
+	if !ok {
+		return value
+	}
+	if err := proto.Unmarshal(binary.Data, message); err != nil {
+		GetLogger().Error("diff %v proto.Unmarshal err:%v", path, err)
+		return value
+	}
+	bsonValue, err := toBsonValue(message)
+	if err != nil {
+		GetLogger().Error("diff %v toBsonValue err:%v", path, err)
+		return value
+	}
+	return bsonValue
+}
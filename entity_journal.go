@@ -0,0 +1,308 @@
+package gentity
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// 日志文件的扩展名
+	entityJournalExt = ".journal"
+	// 日志记录的字段名
+	entityJournalKey        = "k"
+	entityJournalComponents = "c"
+)
+
+// 本地预写日志(write-ahead journal),不依赖缓存的崩溃恢复
+//
+//	保存缓存之前,把有修改的组件的完整数据追加写入本地文件,一个实体对应一个文件
+//	保存数据库成功后清空该实体的日志,进程启动时把残留的日志回放到数据库
+//	日志的每条记录是一个bson文档: {"k":entityKey,"c":{componentName:componentData}}
+//	同一个实体的日志需要在同一个协程里读写,如RoutineEntity的协程
+//
+// example:
+//
+//	journal := NewEntityJournal("./journal/player")
+//	// 进程启动时,在加载实体之前回放
+//	journal.Replay(playerDb)
+//	// 保存缓存之前
+//	SaveEntityChangedDataToJournal(journal, player.GetId(), player)
+//	SaveEntityChangedDataToCache(kvCache, "p", player.GetId(), player)
+//	// 保存数据库
+//	SaveEntityChangedDataToDbWithJournal(journal, playerDb, player, player.GetId(), kvCache, false, "p")
+type EntityJournal struct {
+	dir string
+	// 每次写入后是否调用fsync
+	sync bool
+}
+
+func NewEntityJournal(dir string) *EntityJournal {
+	return &EntityJournal{
+		dir:  dir,
+		sync: true,
+	}
+}
+
+func (this *EntityJournal) GetDir() string {
+	return this.dir
+}
+
+// 设置每次写入后是否调用fsync,关闭后性能更好,但是操作系统崩溃时可能丢失最近的日志
+func (this *EntityJournal) SetSync(sync bool) {
+	this.sync = sync
+}
+
+// entityKey -> 文件路径
+func (this *EntityJournal) getPath(entityKey any) string {
+	return filepath.Join(this.dir, url.PathEscape(memKey(entityKey))+entityJournalExt)
+}
+
+// 追加一条日志
+func (this *EntityJournal) Append(entityKey any, components map[string]any) error {
+	if len(components) == 0 {
+		return nil
+	}
+	data, err := bson.Marshal(bson.M{
+		entityJournalKey:        entityKey,
+		entityJournalComponents: components,
+	})
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(this.getPath(entityKey), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if os.IsNotExist(err) {
+		if err = os.MkdirAll(this.dir, 0755); err != nil {
+			return err
+		}
+		file, err = os.OpenFile(this.getPath(entityKey), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	}
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if err == nil && this.sync {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// 清空实体的日志,保存数据库成功后调用
+func (this *EntityJournal) Truncate(entityKey any) error {
+	err := os.Remove(this.getPath(entityKey))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// 读取实体的日志,同一个组件以最后一条记录为准
+//
+//	没有日志时返回nil
+func (this *EntityJournal) Load(entityKey any) (map[string]any, error) {
+	_, components, err := this.readFile(this.getPath(entityKey))
+	return components, err
+}
+
+// 读取日志文件,返回entityKey和合并后的组件数据
+//
+//	进程崩溃时最后一条记录可能不完整,忽略不完整的记录
+func (this *EntityJournal) readFile(path string) (any, map[string]any, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil, nil
+		}
+		return nil, nil, err
+	}
+	var entityKey any
+	var components map[string]any
+	for len(data) > 0 {
+		// bson文档的前4个字节是文档的长度
+		if len(data) < 4 {
+			GetLogger().Error("journal %v incomplete record len:%v", path, len(data))
+			break
+		}
+		recordLen := int(int32(binary.LittleEndian.Uint32(data)))
+		if recordLen < 5 || recordLen > len(data) {
+			GetLogger().Error("journal %v incomplete record len:%v remain:%v", path, recordLen, len(data))
+			break
+		}
+		record, err := decodeBsonRecord(data[:recordLen])
+		if err != nil {
+			GetLogger().Error("journal %v decode err:%v", path, err)
+			break
+		}
+		data = data[recordLen:]
+		recordComponents, ok := record[entityJournalComponents].(bson.M)
+		if !ok {
+			continue
+		}
+		entityKey = record[entityJournalKey]
+		if components == nil {
+			components = make(map[string]any)
+		}
+		for componentName, componentData := range recordComponents {
+			components[componentName] = normalizeJournalValue(componentData)
+		}
+	}
+	return entityKey, components, nil
+}
+
+// 解码一条bson记录,嵌套的文档解码成bson.M
+func decodeBsonRecord(data []byte) (bson.M, error) {
+	decoder := bson.NewDecoder(bson.NewDocumentReader(bytes.NewReader(data)))
+	decoder.DefaultDocumentM()
+	record := make(bson.M)
+	if err := decoder.Decode(&record); err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+// bson解码后的二进制数据转换成[]byte,和GetComponentSaveData的数据格式保持一致
+func normalizeJournalValue(value any) any {
+	switch v := value.(type) {
+	case bson.Binary:
+		return v.Data
+	case bson.M:
+		for k, item := range v {
+			v[k] = normalizeJournalValue(item)
+		}
+		return v
+	case bson.A:
+		for i, item := range v {
+			v[i] = normalizeJournalValue(item)
+		}
+		return v
+	}
+	return value
+}
+
+// 把所有残留的日志回放到数据库,回放成功的日志会被删除
+//
+//	需要在进程启动时,加载实体之前调用,返回回放的实体数量
+func (this *EntityJournal) Replay(entityDb EntityDb) (int, error) {
+	entries, err := os.ReadDir(this.dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	var errs []error
+	count := 0
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), entityJournalExt) {
+			continue
+		}
+		path := filepath.Join(this.dir, entry.Name())
+		entityKey, components, err := this.readFile(path)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if len(components) > 0 {
+			if err = entityDb.SaveComponents(entityKey, components); err != nil {
+				GetLogger().Error("journal replay %v err:%v", entityKey, err)
+				errs = append(errs, errors.New(fmt.Sprintf("journal replay %v err:%v", entityKey, err)))
+				continue
+			}
+			count++
+			GetLogger().Info("journal replay %v components:%v", entityKey, len(components))
+		}
+		if err = os.Remove(path); err != nil && !os.IsNotExist(err) {
+			errs = append(errs, err)
+		}
+	}
+	return count, errors.Join(errs...)
+}
+
+// 把实体有修改的组件的完整数据写入日志,需要在SaveEntityChangedDataToCache之前调用
+func SaveEntityChangedDataToJournal(journal *EntityJournal, entityKey interface{}, entity Entity) error {
+	components := make(map[string]interface{})
+	var saveErr error
+	entity.RangeComponent(func(component Component) bool {
+		if !isObjectDirty(component) {
+			return true
+		}
+		componentData, err := GetComponentSaveData(component)
+		if err != nil {
+			saveErr = err
+			return false
+		}
+		components[GetComponentSaveName(component)] = componentData
+		return true
+	})
+	if saveErr != nil {
+		return saveErr
+	}
+	return journal.Append(entityKey, components)
+}
+
+// 保存修改数据到数据库,成功后清空实体的日志
+func SaveEntityChangedDataToDbWithJournal(journal *EntityJournal, entityDb EntityDb, entity Entity, entityKey interface{}, kvCache KvCache, removeCacheAfterSaveDb bool, cachePrefix string) error {
+	if err := SaveEntityChangedDataToDbByKey(entityDb, entity, entityKey, kvCache, removeCacheAfterSaveDb, cachePrefix); err != nil {
+		return err
+	}
+	return journal.Truncate(entityKey)
+}
+
+// 缓存的修改标记,DirtyMark和MapDirtyMark都满足
+type cacheDirtyMark interface {
+	IsDirty() bool
+	ResetDirty()
+}
+
+// 遍历对象的Saveable字段
+func rangeObjectSaveables(obj any, f func(saveable any)) {
+	objStruct := GetObjSaveableStruct(obj)
+	if objStruct == nil {
+		return
+	}
+	if objStruct.IsSingleField() {
+		if saveable, _ := objStruct.GetSingleSaveable(obj); saveable != nil {
+			f(saveable)
+		}
+		return
+	}
+	for childIndex := range objStruct.Children {
+		if saveable, _ := objStruct.GetChildSaveable(obj, childIndex); saveable != nil {
+			f(saveable)
+		}
+	}
+}
+
+// 对象是否有需要保存到缓存的修改,没有缓存标记的Saveable以数据库的修改标记为准
+func isObjectDirty(obj any) bool {
+	dirty := false
+	rangeObjectSaveables(obj, func(saveable any) {
+		if dirtyMark, ok := saveable.(cacheDirtyMark); ok {
+			dirty = dirty || dirtyMark.IsDirty()
+		} else if s, ok := saveable.(Saveable); ok {
+			dirty = dirty || s.IsChanged()
+		}
+	})
+	return dirty
+}
+
+// 重置实体所有组件的缓存标记
+func resetEntityDirty(entity Entity) {
+	entity.RangeComponent(func(component Component) bool {
+		rangeObjectSaveables(component, func(saveable any) {
+			if dirtyMark, ok := saveable.(cacheDirtyMark); ok {
+				dirtyMark.ResetDirty()
+			}
+		})
+		return true
+	})
+}
@@ -0,0 +1,191 @@
+package gentity
+
+import (
+	"errors"
+	"math/rand/v2"
+	"time"
+)
+
+// 定时保存的设置
+type EntitySaverOptions struct {
+	// 保存缓存的间隔,<=0表示不定时保存缓存
+	CacheInterval time.Duration
+	// 保存数据库的间隔,<=0表示不定时保存数据库
+	DbInterval time.Duration
+	// 保存数据库的随机抖动,实际间隔在[DbInterval-DbJitter,DbInterval+DbJitter]之间
+	// 同时在线的实体很多时,可以分散数据库的压力
+	DbJitter time.Duration
+	// 保存失败时的重试间隔,从MinBackoff开始,每次失败翻倍,最大MaxBackoff
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// 保存数据库成功后,是否删除缓存
+	RemoveCacheAfterSaveDb bool
+}
+
+func NewEntitySaverOptions() *EntitySaverOptions {
+	return &EntitySaverOptions{
+		CacheInterval: time.Second,
+		DbInterval:    5 * time.Minute,
+		DbJitter:      30 * time.Second,
+		MinBackoff:    time.Second,
+		MaxBackoff:    time.Minute,
+	}
+}
+
+// 实体的定时保存(write-behind)
+//
+//	在RoutineEntity的计时管理(TimerEntries)里定时把修改数据保存到缓存和数据库,
+//	计时器的回调在RoutineEntity协程里执行,所以是协程安全的
+//	保存失败时按指数退避重试,Stop时强制保存一次
+//
+// example:
+//
+//	saver := NewEntitySaver(player, playerDb, kvCache, "p", NewEntitySaverOptions())
+//	player.SetEntitySaver(saver)
+//	player.RunProcessRoutine(player, routineArgs)
+type EntitySaver struct {
+	entity      Entity
+	entityDb    EntityDb
+	kvCache     KvCache
+	cachePrefix string
+	options     *EntitySaverOptions
+	// 本地预写日志,可选
+	journal *EntityJournal
+	// 当前的重试间隔,0表示上次保存成功
+	cacheBackoff time.Duration
+	dbBackoff    time.Duration
+	stopped      bool
+}
+
+// entityDb或kvCache为nil时,不保存对应的数据
+func NewEntitySaver(entity Entity, entityDb EntityDb, kvCache KvCache, cachePrefix string, options *EntitySaverOptions) *EntitySaver {
+	if options == nil {
+		options = NewEntitySaverOptions()
+	}
+	return &EntitySaver{
+		entity:      entity,
+		entityDb:    entityDb,
+		kvCache:     kvCache,
+		cachePrefix: cachePrefix,
+		options:     options,
+	}
+}
+
+func (this *EntitySaver) GetOptions() *EntitySaverOptions {
+	return this.options
+}
+
+func (this *EntitySaver) GetJournal() *EntityJournal {
+	return this.journal
+}
+
+// 设置本地预写日志,保存缓存之前先写日志,保存数据库成功后清空日志
+//
+//	没有缓存时,只写日志
+func (this *EntitySaver) SetJournal(journal *EntityJournal) {
+	this.journal = journal
+}
+
+// 是否需要定时保存缓存(或者日志)
+func (this *EntitySaver) hasCache() bool {
+	return this.kvCache != nil || this.journal != nil
+}
+
+// 把定时保存加入计时管理,需要在RoutineEntity协程里调用,或者在协程启动之前调用
+func (this *EntitySaver) Start(timerEntries *TimerEntries) {
+	this.stopped = false
+	if this.hasCache() && this.options.CacheInterval > 0 {
+		timerEntries.After(this.options.CacheInterval, this.onCacheTimer)
+	}
+	if this.entityDb != nil && this.options.DbInterval > 0 {
+		timerEntries.After(this.nextDbInterval(), this.onDbTimer)
+	}
+}
+
+// 停止定时保存,并强制保存一次
+func (this *EntitySaver) Stop() error {
+	if this.stopped {
+		return nil
+	}
+	this.stopped = true
+	return this.Flush()
+}
+
+// 立即保存修改数据到缓存和数据库
+func (this *EntitySaver) Flush() error {
+	var cacheErr, dbErr error
+	if this.hasCache() {
+		cacheErr = this.SaveCache()
+	}
+	if this.entityDb != nil {
+		dbErr = this.SaveDb()
+	}
+	return errors.Join(cacheErr, dbErr)
+}
+
+// 保存修改数据到缓存,设置了日志时先写日志
+func (this *EntitySaver) SaveCache() error {
+	if this.journal != nil {
+		if err := SaveEntityChangedDataToJournal(this.journal, this.entity.GetId(), this.entity); err != nil {
+			return err
+		}
+		if this.kvCache == nil {
+			// 没有缓存,写入日志后就重置缓存标记,避免重复写入
+			resetEntityDirty(this.entity)
+			return nil
+		}
+	}
+	return SaveEntityChangedDataToCache(this.kvCache, this.cachePrefix, this.entity.GetId(), this.entity)
+}
+
+// 保存修改数据到数据库,设置了日志时,保存成功后清空日志
+func (this *EntitySaver) SaveDb() error {
+	if this.journal != nil {
+		return SaveEntityChangedDataToDbWithJournal(this.journal, this.entityDb, this.entity, this.entity.GetId(), this.kvCache, this.options.RemoveCacheAfterSaveDb, this.cachePrefix)
+	}
+	return SaveEntityChangedDataToDb(this.entityDb, this.entity, this.kvCache, this.options.RemoveCacheAfterSaveDb, this.cachePrefix)
+}
+
+func (this *EntitySaver) onCacheTimer() time.Duration {
+	if this.stopped {
+		return 0
+	}
+	if err := this.SaveCache(); err != nil {
+		this.cacheBackoff = nextBackoff(this.cacheBackoff, this.options.MinBackoff, this.options.MaxBackoff)
+		GetLogger().Error("EntitySaver SaveCache %v err:%v retry:%v", this.entity.GetId(), err, this.cacheBackoff)
+		if this.cacheBackoff > 0 {
+			return this.cacheBackoff
+		}
+	} else {
+		this.cacheBackoff = 0
+	}
+	return this.options.CacheInterval
+}
+
+func (this *EntitySaver) onDbTimer() time.Duration {
+	if this.stopped {
+		return 0
+	}
+	if err := this.SaveDb(); err != nil {
+		this.dbBackoff = nextBackoff(this.dbBackoff, this.options.MinBackoff, this.options.MaxBackoff)
+		GetLogger().Error("EntitySaver SaveDb %v err:%v retry:%v", this.entity.GetId(), err, this.dbBackoff)
+		if this.dbBackoff > 0 {
+			return this.dbBackoff
+		}
+	} else {
+		this.dbBackoff = 0
+	}
+	return this.nextDbInterval()
+}
+
+// 加上随机抖动的保存数据库间隔
+func (this *EntitySaver) nextDbInterval() time.Duration {
+	interval := this.options.DbInterval
+	if jitter := this.options.DbJitter; jitter > 0 {
+		interval += time.Duration(rand.Int64N(int64(2*jitter)+1)) - jitter
+	}
+	if interval <= 0 {
+		return this.options.DbInterval
+	}
+	return interval
+}
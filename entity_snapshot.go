@@ -0,0 +1,362 @@
+package gentity
+
+import (
+	"errors"
+	"fmt"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// https://github.com/uber-go/guide/blob/master/style.md#verify-interface-compliance
+var _ EntitySnapshotStore = (*KvSnapshotStore)(nil)
+
+// 常用的快照原因
+const (
+	SnapshotReasonInterval = "interval"
+	SnapshotReasonLogout   = "logout"
+)
+
+const (
+	// 快照记录的字段名
+	entitySnapshotKey        = "k"
+	entitySnapshotId         = "id"
+	entitySnapshotReason     = "r"
+	entitySnapshotComponents = "c"
+)
+
+// 实体的快照,用于回档
+type EntitySnapshot struct {
+	// 快照id,值是创建快照时的UnixNano,同一个实体的快照id按时间递增
+	Id        int64
+	EntityKey interface{}
+	// 创建快照的原因,如定时,下线,交易之前
+	Reason string
+	// 组件名 -> 组件的完整保存数据,和GetEntitySaveData的格式一致
+	Components map[string]interface{}
+}
+
+// 创建快照的时间
+func (this *EntitySnapshot) GetTime() time.Time {
+	return time.Unix(0, this.Id)
+}
+
+// 快照的存储接口
+type EntitySnapshotStore interface {
+	// 保存快照
+	SaveSnapshot(snapshot *EntitySnapshot) error
+
+	// 查找快照,不存在时返回ErrSnapshotNotExists
+	FindSnapshot(entityKey interface{}, snapshotId int64) (*EntitySnapshot, error)
+
+	// 实体的所有快照id,按时间升序
+	FindSnapshotIds(entityKey interface{}) ([]int64, error)
+
+	// 删除快照
+	DeleteSnapshot(entityKey interface{}, snapshotId int64) error
+}
+
+// 快照的保留策略
+type SnapshotRetention struct {
+	// 每个实体最多保留的快照数量,<=0表示不限制
+	MaxCount int
+	// 快照的最长保留时间,<=0表示不限制
+	MaxAge time.Duration
+}
+
+// 删除不满足保留策略的快照,返回删除的数量
+func (this *SnapshotRetention) Apply(store EntitySnapshotStore, entityKey interface{}, now time.Time) (int, error) {
+	if this.MaxCount <= 0 && this.MaxAge <= 0 {
+		return 0, nil
+	}
+	snapshotIds, err := store.FindSnapshotIds(entityKey)
+	if err != nil {
+		return 0, err
+	}
+	removeCount := 0
+	if this.MaxCount > 0 && len(snapshotIds) > this.MaxCount {
+		removeCount = len(snapshotIds) - this.MaxCount
+	}
+	if this.MaxAge > 0 {
+		expireId := now.Add(-this.MaxAge).UnixNano()
+		for removeCount < len(snapshotIds) && snapshotIds[removeCount] < expireId {
+			removeCount++
+		}
+	}
+	for i := 0; i < removeCount; i++ {
+		if err = store.DeleteSnapshot(entityKey, snapshotIds[i]); err != nil {
+			return i, err
+		}
+	}
+	return removeCount, nil
+}
+
+// 使用KvDb保存快照,一个快照对应一条kv数据
+//
+//	key的格式: keyPrefix+entityKey/snapshotId, value是bson序列化后的快照
+//	查找实体的快照列表需要kvDb实现AdvancedKvDb
+type KvSnapshotStore struct {
+	kvDb      KvDb
+	keyPrefix string
+}
+
+func NewKvSnapshotStore(kvDb KvDb, keyPrefix string) *KvSnapshotStore {
+	return &KvSnapshotStore{
+		kvDb:      kvDb,
+		keyPrefix: keyPrefix,
+	}
+}
+
+// 实体的快照key的前缀
+func (this *KvSnapshotStore) getEntityPrefix(entityKey interface{}) string {
+	return this.keyPrefix + url.PathEscape(memKey(entityKey)) + "/"
+}
+
+// snapshotId补齐到固定长度,使key的顺序和时间顺序一致
+func (this *KvSnapshotStore) getKey(entityKey interface{}, snapshotId int64) string {
+	return fmt.Sprintf("%v%019d", this.getEntityPrefix(entityKey), snapshotId)
+}
+
+func (this *KvSnapshotStore) SaveSnapshot(snapshot *EntitySnapshot) error {
+	data, err := bson.Marshal(bson.M{
+		entitySnapshotKey:        snapshot.EntityKey,
+		entitySnapshotId:         snapshot.Id,
+		entitySnapshotReason:     snapshot.Reason,
+		entitySnapshotComponents: snapshot.Components,
+	})
+	if err != nil {
+		return err
+	}
+	return this.kvDb.Update(this.getKey(snapshot.EntityKey, snapshot.Id), data, true)
+}
+
+func (this *KvSnapshotStore) FindSnapshot(entityKey interface{}, snapshotId int64) (*EntitySnapshot, error) {
+	var data []byte
+	err := this.kvDb.FindAndDecode(this.getKey(entityKey, snapshotId), &data)
+	if err != nil {
+		return nil, err
+	}
+	// key不存在时,data不会被赋值
+	if len(data) == 0 {
+		return nil, ErrSnapshotNotExists
+	}
+	record, err := decodeBsonRecord(data)
+	if err != nil {
+		return nil, err
+	}
+	snapshot := &EntitySnapshot{
+		Id:         snapshotId,
+		EntityKey:  record[entitySnapshotKey],
+		Components: make(map[string]interface{}),
+	}
+	snapshot.Reason, _ = record[entitySnapshotReason].(string)
+	if components, ok := record[entitySnapshotComponents].(bson.M); ok {
+		for componentName, componentData := range components {
+			snapshot.Components[componentName] = normalizeJournalValue(componentData)
+		}
+	}
+	return snapshot, nil
+}
+
+func (this *KvSnapshotStore) FindSnapshotIds(entityKey interface{}) ([]int64, error) {
+	advancedKvDb, ok := this.kvDb.(AdvancedKvDb)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+	prefix := this.getEntityPrefix(entityKey)
+	scan := NewKvScan().SetPrefix(prefix).SetLimit(1000)
+	var snapshotIds []int64
+	for {
+		result, err := advancedKvDb.Scan(scan)
+		if err != nil {
+			return nil, err
+		}
+		for _, pair := range result.Pairs {
+			key, _ := pair.Key.(string)
+			snapshotId, err := strconv.ParseInt(strings.TrimPrefix(key, prefix), 10, 64)
+			if err != nil {
+				GetLogger().Error("snapshot key err:%v", key)
+				continue
+			}
+			snapshotIds = append(snapshotIds, snapshotId)
+		}
+		if result.NextCursor == nil {
+			break
+		}
+		scan.SetCursor(result.NextCursor)
+	}
+	return snapshotIds, nil
+}
+
+func (this *KvSnapshotStore) DeleteSnapshot(entityKey interface{}, snapshotId int64) error {
+	return this.kvDb.Delete(this.getKey(entityKey, snapshotId))
+}
+
+// 快照的设置
+type EntitySnapshotOptions struct {
+	// 定时创建快照的间隔,<=0表示不定时创建
+	Interval time.Duration
+	// Stop时是否创建快照,如玩家下线
+	SnapshotOnStop bool
+	// 保留策略
+	Retention SnapshotRetention
+}
+
+func NewEntitySnapshotOptions() *EntitySnapshotOptions {
+	return &EntitySnapshotOptions{
+		Interval:       time.Hour,
+		SnapshotOnStop: true,
+		Retention: SnapshotRetention{
+			MaxCount: 24,
+			MaxAge:   7 * 24 * time.Hour,
+		},
+	}
+}
+
+// 实体的快照管理,用于回档
+//
+//	定时创建快照,或者在有风险的操作(如交易)之前调用Snapshot
+//	需要在实体的协程里调用,如RoutineEntity的协程
+//
+// example:
+//
+//	snapshotter := NewEntitySnapshotter(player, NewKvSnapshotStore(snapshotKvDb, "p_"), NewEntitySnapshotOptions())
+//	// RoutineEntityRoutineArgs.InitFunc
+//	snapshotter.Start(player.GetTimerEntries())
+//	// 交易之前
+//	snapshotter.Snapshot("trade")
+//	// RoutineEntityRoutineArgs.EndFunc
+//	snapshotter.Stop()
+type EntitySnapshotter struct {
+	entity  Entity
+	store   EntitySnapshotStore
+	options *EntitySnapshotOptions
+	// 上一个快照id,保证同一个实体的快照id递增
+	lastSnapshotId int64
+	stopped        bool
+}
+
+func NewEntitySnapshotter(entity Entity, store EntitySnapshotStore, options *EntitySnapshotOptions) *EntitySnapshotter {
+	if options == nil {
+		options = NewEntitySnapshotOptions()
+	}
+	return &EntitySnapshotter{
+		entity:  entity,
+		store:   store,
+		options: options,
+	}
+}
+
+func (this *EntitySnapshotter) GetOptions() *EntitySnapshotOptions {
+	return this.options
+}
+
+// 把定时快照加入计时管理
+func (this *EntitySnapshotter) Start(timerEntries *TimerEntries) {
+	this.stopped = false
+	if this.options.Interval > 0 {
+		timerEntries.After(this.options.Interval, this.onTimer)
+	}
+}
+
+// 停止定时快照,设置了SnapshotOnStop时创建一个快照
+func (this *EntitySnapshotter) Stop() error {
+	if this.stopped {
+		return nil
+	}
+	this.stopped = true
+	if !this.options.SnapshotOnStop {
+		return nil
+	}
+	_, err := this.Snapshot(SnapshotReasonLogout)
+	return err
+}
+
+// 创建快照,并删除不满足保留策略的快照
+func (this *EntitySnapshotter) Snapshot(reason string) (*EntitySnapshot, error) {
+	snapshotId := time.Now().UnixNano()
+	if snapshotId <= this.lastSnapshotId {
+		snapshotId = this.lastSnapshotId + 1
+	}
+	snapshot := &EntitySnapshot{
+		Id:         snapshotId,
+		EntityKey:  this.entity.GetId(),
+		Reason:     reason,
+		Components: make(map[string]interface{}),
+	}
+	GetEntitySaveData(this.entity, snapshot.Components)
+	if err := this.store.SaveSnapshot(snapshot); err != nil {
+		GetLogger().Error("SaveSnapshot %v %v err:%v", snapshot.EntityKey, reason, err)
+		return nil, err
+	}
+	this.lastSnapshotId = snapshotId
+	GetLogger().Debug("SaveSnapshot %v %v %v", snapshot.EntityKey, snapshotId, reason)
+	if _, err := this.options.Retention.Apply(this.store, snapshot.EntityKey, snapshot.GetTime()); err != nil {
+		GetLogger().Error("SnapshotRetention %v err:%v", snapshot.EntityKey, err)
+	}
+	return snapshot, nil
+}
+
+func (this *EntitySnapshotter) onTimer() time.Duration {
+	if this.stopped {
+		return 0
+	}
+	this.Snapshot(SnapshotReasonInterval)
+	return this.options.Interval
+}
+
+// 快照数据写回数据库,开启了乐观锁时版本号+1,其他服务器上还在内存中的实体之后保存会返回ErrVersionConflict
+func saveSnapshotComponents(entityDb EntityDb, entityKey interface{}, components map[string]interface{}) error {
+	versionedDb, ok := entityDb.(VersionedEntityDb)
+	if !ok || len(versionedDb.GetVersionField()) == 0 {
+		return entityDb.SaveComponents(entityKey, components)
+	}
+	version, err := versionedDb.FindEntityVersion(entityKey)
+	if err != nil {
+		return err
+	}
+	return versionedDb.SaveComponentsWithVersion(entityKey, components, version)
+}
+
+// 把快照数据写回数据库,再清空实体的日志,删除实体的缓存
+// 防止之后的EntityJournal.Replay和FixEntityDataFromCache用回档之前的数据覆盖回档的数据
+//
+//	实体需要不在线(没有加载到内存中),schemaEntity用于解析组件结构
+//	journal为nil时不清空日志,kvCache为nil时不删除缓存
+func RestoreEntitySnapshot(store EntitySnapshotStore, entityDb EntityDb, journal *EntityJournal, kvCache KvCache, schemaEntity Entity, cachePrefix string,
+	entityKey interface{}, snapshotId int64) error {
+	snapshot, err := store.FindSnapshot(entityKey, snapshotId)
+	if err != nil {
+		return err
+	}
+	if len(snapshot.Components) == 0 {
+		return errors.New(fmt.Sprintf("snapshot %v %v has no component", entityKey, snapshotId))
+	}
+	if err = saveSnapshotComponents(entityDb, entityKey, snapshot.Components); err != nil {
+		GetLogger().Error("RestoreEntitySnapshot %v %v err:%v", entityKey, snapshotId, err)
+		return err
+	}
+	GetLogger().Info("RestoreEntitySnapshot %v %v %v", entityKey, snapshotId, snapshot.Reason)
+	if journal != nil {
+		if err = journal.Truncate(entityKey); err != nil {
+			GetLogger().Error("RestoreEntitySnapshot %v truncate journal err:%v", entityKey, err)
+			return err
+		}
+	}
+	if kvCache == nil {
+		return nil
+	}
+	// 快照里没有的组件,缓存里的数据也可能比回档的时间点新,所以删除所有组件的缓存
+	cacheKeys := GetEntityComponentCacheKeys(schemaEntity, cachePrefix, entityKey)
+	if len(cacheKeys) == 0 {
+		return nil
+	}
+	_, err = kvCache.Del(cacheKeys...)
+	if IsRedisError(err) {
+		GetLogger().Error("RestoreEntitySnapshot %v del cache err:%v", entityKey, err.Error())
+		return err
+	}
+	return nil
+}
@@ -15,4 +15,8 @@ var (
 	ErrConvertRoutineMessage = errors.New("convert routine message error")
 	ErrSourceDataType        = errors.New("sourceData type error")
 	ErrNotSaveable           = errors.New("not saveable")
+	ErrDuplicateKey          = errors.New("duplicate key")
+	ErrNotSupported          = errors.New("not supported")
+	ErrVersionConflict       = errors.New("version conflict")
+	ErrSnapshotNotExists     = errors.New("snapshot not exists")
 )
@@ -0,0 +1,128 @@
+package examples
+
+import (
+	"context"
+	"github.com/fish-tennis/gentity"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+	"go.mongodb.org/mongo-driver/v2/mongo/readpref"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 测试用的数据库后端
+const (
+	testBackendMem   = "Mem"
+	testBackendFile  = "File"
+	testBackendSql   = "Sql"
+	testBackendCache = "Cache"
+	testBackendMongo = "Mongo"
+	// 需要部署数据库,见_sqlTestBackends
+	testBackendMysql    = "Mysql"
+	testBackendPostgres = "Postgres"
+)
+
+// 所有的数据库后端
+var _allTestBackends = []string{testBackendMem, testBackendFile, testBackendSql, testBackendCache, testBackendMongo}
+
+var (
+	_mongoAvailableOnce sync.Once
+	_mongoAvailable     bool
+)
+
+// 需要部署mongodb的测试,连接不上时跳过
+//
+//	只检测一次,避免每个测试都等待连接超时
+func skipIfMongoUnavailable(t *testing.T) {
+	t.Helper()
+	_mongoAvailableOnce.Do(func() {
+		client, err := mongo.Connect(options.Client().ApplyURI(_mongoUri).SetServerSelectionTimeout(2 * time.Second))
+		if err != nil {
+			return
+		}
+		defer client.Disconnect(context.Background())
+		_mongoAvailable = client.Ping(context.Background(), readpref.Primary()) == nil
+	})
+	if !_mongoAvailable {
+		t.Skipf("mongodb not available:%v", _mongoUri)
+	}
+}
+
+// 同一个后端的玩家数据库和kv数据库
+type testDbs struct {
+	playerDb gentity.EntityDb
+	kvDb     gentity.KvDb
+}
+
+// 创建一个后端的数据库,collectionName是mongodb使用的collection名,测试前会清空
+func newTestDbs(t *testing.T, backend string, collectionName string) *testDbs {
+	switch backend {
+	case testBackendMem:
+		memDb := gentity.NewMemDb()
+		return &testDbs{
+			playerDb: memDb.RegisterPlayerDb(_collectionName, "_id", "AccountId", "RegionId"),
+			kvDb:     memDb.RegisterKvDb("kv", "k", "v"),
+		}
+	case testBackendFile:
+		fileDb := gentity.NewFileDb(t.TempDir())
+		dbs := &testDbs{
+			playerDb: fileDb.RegisterPlayerDb(_collectionName, "_id", "AccountId", "RegionId"),
+			kvDb:     fileDb.RegisterKvDb("kv", "k", "v"),
+		}
+		if !fileDb.Connect() {
+			t.Fatal("connect failed")
+		}
+		return dbs
+	case testBackendSql, testBackendMysql, testBackendPostgres:
+		_, playerDb, kvDb := newTestSqlDbOf(t, backend)
+		return &testDbs{playerDb: playerDb, kvDb: kvDb}
+	case testBackendCache:
+		kvCache := gentity.NewMemCache()
+		return &testDbs{
+			playerDb: gentity.NewCacheEntityDb(kvCache, "p", "_id", time.Minute),
+			kvDb:     gentity.NewCacheKvDb(kvCache, "kv", 0),
+		}
+	case testBackendMongo:
+		skipIfMongoUnavailable(t)
+		mongoDb := gentity.NewMongoDb(_mongoUri, _mongoDbName)
+		playerDb := mongoDb.RegisterPlayerDb(collectionName, false, "_id", "AccountId", "RegionId")
+		kvDb := mongoDb.RegisterKvDb(collectionName+"kv", false, "k", "v")
+		if !mongoDb.Connect() {
+			t.Fatal("connect db error")
+		}
+		t.Cleanup(mongoDb.Disconnect)
+		for _, name := range []string{collectionName, collectionName + "kv"} {
+			if _, err := mongoDb.GetMongoDatabase().Collection(name).DeleteMany(context.Background(), bson.D{}); err != nil {
+				t.Fatalf("clear %v err:%v", name, err)
+			}
+		}
+		return &testDbs{playerDb: playerDb, kvDb: kvDb}
+	}
+	t.Fatalf("unknown backend:%v", backend)
+	return nil
+}
+
+// 对每个后端执行一次子测试
+func runBackendTests(t *testing.T, backends []string, collectionName string, f func(t *testing.T, dbs *testDbs)) {
+	for _, backend := range backends {
+		t.Run(backend, func(t *testing.T) {
+			f(t, newTestDbs(t, backend, collectionName))
+		})
+	}
+}
+
+// 对每个后端的玩家数据库执行一次子测试
+func runEntityDbTests(t *testing.T, backends []string, collectionName string, f func(t *testing.T, entityDb gentity.EntityDb)) {
+	runBackendTests(t, backends, collectionName, func(t *testing.T, dbs *testDbs) {
+		f(t, dbs.playerDb)
+	})
+}
+
+// 对每个后端的kv数据库执行一次子测试
+func runKvDbTests(t *testing.T, backends []string, collectionName string, f func(t *testing.T, kvDb gentity.KvDb)) {
+	runBackendTests(t, backends, collectionName, func(t *testing.T, dbs *testDbs) {
+		f(t, dbs.kvDb)
+	})
+}
@@ -28,7 +28,7 @@ func init() {
 // 基本信息组件
 type BaseInfo struct {
 	gentity.DataComponent
-	BaseInfo *pb.BaseInfo `db:"plain"`
+	BaseInfo *pb.BaseInfo `db:"plain" index:"-level,-exp"`
 }
 
 func (this *Player) GetBaseInfo() *BaseInfo {
@@ -0,0 +1,93 @@
+package examples
+
+import (
+	"errors"
+	"github.com/fish-tennis/gentity"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"testing"
+)
+
+// 批量保存多个实体,其中一个实体版本号冲突,不影响其他实体
+func testSaveEntitiesBulk(t *testing.T, entityDb gentity.EntityDb) {
+	entityDb.(gentity.VersionedEntityDb).SetVersionField("_version")
+	var entities []gentity.Entity
+	for i := int64(1); i <= 3; i++ {
+		player := newTestPlayer(i, 100)
+		entityDb.InsertEntity(player.Id, getNewPlayerSaveData(player))
+		player.GetBaseInfo().AddExp(int32(i))
+		entities = append(entities, player)
+	}
+	stalePlayer := entities[1].(*Player)
+	stalePlayer.SetVersion(5)
+	// 没有修改数据的实体
+	entities = append(entities, newTestPlayer(4, 100))
+
+	errs := gentity.SaveEntitiesChangedDataToDb(entityDb, entities, nil, false, "p")
+	if len(errs) != len(entities) || errs[0] != nil || errs[2] != nil || errs[3] != nil {
+		t.Fatalf("SaveEntitiesChangedDataToDb errs:%v", errs)
+	}
+	if !errors.Is(errs[1], gentity.ErrVersionConflict) || !stalePlayer.GetBaseInfo().IsChanged() {
+		t.Fatalf("stale player err:%v", errs[1])
+	}
+	for _, i := range []int{0, 2} {
+		player := entities[i].(*Player)
+		if player.GetBaseInfo().IsChanged() || player.GetVersion() != 1 {
+			t.Fatalf("player%v changed:%v version:%v", player.Id, player.GetBaseInfo().IsChanged(), player.GetVersion())
+		}
+		if exp := getTestPlayerExp(t, entityDb, player.Id); exp != int32(player.Id) {
+			t.Fatalf("player%v exp:%v", player.Id, exp)
+		}
+	}
+	// 批量保存写入的token字段不会出现在实体数据里
+	doc := make(bson.M)
+	if _, err := entityDb.FindEntityById(int64(1), &doc); err != nil || doc["_versionToken"] != nil {
+		t.Fatalf("FindEntityById %v err:%v", doc, err)
+	}
+}
+
+// 读取版本号之后,批量保存之前,另一个服务器保存了其中一个实体
+func testSaveEntitiesBulkConcurrent(t *testing.T, entityDb gentity.EntityDb) {
+	entityDb.(gentity.VersionedEntityDb).SetVersionField("_version")
+	var entities []gentity.Entity
+	for i := int64(1); i <= 2; i++ {
+		player := newTestPlayer(i, 100)
+		entityDb.InsertEntity(player.Id, getNewPlayerSaveData(player))
+		player.GetBaseInfo().AddExp(int32(i))
+		entities = append(entities, player)
+	}
+	// 另一个服务器上的实体1先保存了
+	otherPlayer := newTestPlayer(1, 100)
+	otherPlayer.GetBaseInfo().AddExp(100)
+	if err := gentity.SaveEntityChangedDataToDb(entityDb, otherPlayer, nil, false, "p"); err != nil {
+		t.Fatalf("other save err:%v", err)
+	}
+	errs := gentity.SaveEntitiesChangedDataToDb(entityDb, entities, nil, false, "p")
+	if !errors.Is(errs[0], gentity.ErrVersionConflict) || errs[1] != nil {
+		t.Fatalf("SaveEntitiesChangedDataToDb errs:%v", errs)
+	}
+	stalePlayer := entities[0].(*Player)
+	if !stalePlayer.GetBaseInfo().IsChanged() || stalePlayer.GetVersion() != 0 {
+		t.Fatalf("stale player changed:%v version:%v", stalePlayer.GetBaseInfo().IsChanged(), stalePlayer.GetVersion())
+	}
+	if exp := getTestPlayerExp(t, entityDb, 1); exp != 100 {
+		t.Fatalf("player1 exp:%v", exp)
+	}
+	// 实体2保存成功之后,另一个服务器又保存了实体2,不影响已经返回的结果
+	otherPlayer = newTestPlayer(2, 100)
+	otherPlayer.SetVersion(1)
+	otherPlayer.GetBaseInfo().AddExp(200)
+	if err := gentity.SaveEntityChangedDataToDb(entityDb, otherPlayer, nil, false, "p"); err != nil {
+		t.Fatalf("other save err:%v", err)
+	}
+	if savedPlayer := entities[1].(*Player); savedPlayer.GetBaseInfo().IsChanged() || savedPlayer.GetVersion() != 1 {
+		t.Fatalf("player2 changed:%v version:%v", savedPlayer.GetBaseInfo().IsChanged(), savedPlayer.GetVersion())
+	}
+}
+
+func TestSaveEntitiesBulk(t *testing.T) {
+	runEntityDbTests(t, []string{testBackendMem, testBackendMongo}, "bulktest", testSaveEntitiesBulk)
+}
+
+func TestSaveEntitiesBulkConcurrent(t *testing.T) {
+	runEntityDbTests(t, []string{testBackendMem, testBackendFile, testBackendMongo}, "bulktest", testSaveEntitiesBulkConcurrent)
+}
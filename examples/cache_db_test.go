@@ -0,0 +1,189 @@
+package examples
+
+import (
+	"github.com/fish-tennis/gentity"
+	"github.com/fish-tennis/gentity/examples/pb"
+	"testing"
+	"time"
+)
+
+// 基于KvCache的EntityDb测试,使用内存缓存,无需部署redis
+func TestCacheEntityDb(t *testing.T) {
+	gentity.SetLogLevel(gentity.DebugLevel)
+	kvCache := gentity.NewMemCache()
+	now := time.Now()
+	kvCache.SetNowFunc(func() time.Time {
+		return now
+	})
+	entityDb := gentity.NewCacheEntityDb(kvCache, "room", "_id", time.Minute)
+
+	player1 := newTestPlayer(1, 100)
+	err, _ := entityDb.InsertEntity(player1.Id, getNewPlayerSaveData(player1))
+	if err != nil {
+		t.Fatalf("InsertEntity err:%v", err)
+	}
+	err, isDuplicateKey := entityDb.InsertEntity(player1.Id, getNewPlayerSaveData(player1))
+	if !isDuplicateKey || !gentity.IsDuplicateKeyError(err) {
+		t.Fatalf("InsertEntity duplicate err:%v isDuplicateKey:%v", err, isDuplicateKey)
+	}
+
+	player1.GetBaseInfo().AddExp(123)
+	player1.GetQuest().AddFinishId(1)
+	player1.GetQuest().Quests.Set(2, &pb.QuestData{CfgId: 2, Progress: 5})
+	player1.GetBag().BagUniqueItem.AddUniqueItem(&pb.UniqueItem{UniqueId: 1001, CfgId: 1})
+	player1.GetStruct().Set(11, 12)
+	err = gentity.SaveEntityChangedDataToDb(entityDb, player1, nil, false, "p")
+	if err != nil {
+		t.Fatalf("SaveEntityChangedDataToDb err:%v", err)
+	}
+
+	loadData := &pb.PlayerData{}
+	exists, err := entityDb.FindEntityById(player1.Id, loadData)
+	if err != nil || !exists || loadData.XId != player1.Id || loadData.Name != "player1" {
+		t.Fatalf("FindEntityById %v exists:%v err:%v", loadData, exists, err)
+	}
+	loadPlayer := newTestPlayerFromData(loadData)
+	if loadPlayer.GetBaseInfo().BaseInfo.Exp != 123 {
+		t.Fatalf("BaseInfo:%v", loadPlayer.GetBaseInfo().BaseInfo)
+	}
+	if len(loadPlayer.GetQuest().Finished.Data) != 1 || loadPlayer.GetQuest().Quests.Data[2].GetProgress() != 5 {
+		t.Fatalf("Quest:%v %v", loadPlayer.GetQuest().Finished.Data, loadPlayer.GetQuest().Quests.Data)
+	}
+	if loadPlayer.GetBag().BagUniqueItem.Data[1001].GetCfgId() != 1 || loadPlayer.GetStruct().Data.CfgId != 11 {
+		t.Fatalf("Bag:%v Struct:%v", loadPlayer.GetBag().BagUniqueItem.Data, &loadPlayer.GetStruct().Data)
+	}
+
+	err = entityDb.DeleteComponentField(player1.Id, "Quest", "Quests")
+	if err != nil {
+		t.Fatalf("DeleteComponentField err:%v", err)
+	}
+	loadData = &pb.PlayerData{}
+	entityDb.FindEntityById(player1.Id, loadData)
+	if len(loadData.Quest.Quests) != 0 || len(loadData.Quest.Finished) != 1 {
+		t.Fatalf("loadData:%v", loadData)
+	}
+	// 不存在的实体,保存操作不会创建数据
+	entityDb.SaveComponent(int64(2), "BaseInfo", &pb.BaseInfo{Exp: 1})
+	if exists, _ = entityDb.FindEntityById(int64(2), &pb.PlayerData{}); exists {
+		t.Fatal("SaveComponent should not create entity")
+	}
+
+	// 过期后,实体数据被删除
+	now = now.Add(time.Minute)
+	if exists, _ = entityDb.FindEntityById(player1.Id, &pb.PlayerData{}); exists {
+		t.Fatal("entity not expired")
+	}
+}
+
+func TestCacheKvDb(t *testing.T) {
+	kvDb := gentity.NewCacheKvDb(gentity.NewMemCache(), "kv", 0)
+
+	for i := 0; i < 10; i++ {
+		kvDb.Inc("id", 1, true)
+	}
+	id, err := kvDb.Find("id")
+	if err != nil || id != int64(10) {
+		t.Fatalf("Inc result:%v err:%v", id, err)
+	}
+	_, err = kvDb.Inc("notExists", 1, false)
+	if err == nil {
+		t.Fatal("Inc without upsert should fail")
+	}
+
+	kvDb.Update("proto_data", &pb.BaseInfo{Level: 10, Exp: 123}, true)
+	protoDecodeData := new(pb.BaseInfo)
+	err = kvDb.FindAndDecode("proto_data", protoDecodeData)
+	if err != nil || protoDecodeData.Exp != 123 {
+		t.Fatalf("FindAndDecode %v err:%v", protoDecodeData, err)
+	}
+	err, _ = kvDb.Insert("temp", "temp value")
+	if err != nil {
+		t.Fatalf("Insert err:%v", err)
+	}
+	err, isDuplicateKey := kvDb.Insert("temp", "temp value")
+	if !isDuplicateKey {
+		t.Fatalf("Insert duplicate err:%v", err)
+	}
+	kvDb.Delete("temp")
+	temp, err := kvDb.Find("temp")
+	if temp != nil || err != nil {
+		t.Fatalf("Delete failed %v %v", temp, err)
+	}
+}
+
+// 读取hash后触发一次其他地方的写入,用于模拟并发修改
+type conflictMemCache struct {
+	*gentity.MemCache
+	onHGetAll func()
+}
+
+func (this *conflictMemCache) HGetAll(key string) (map[string]string, error) {
+	values, err := this.MemCache.HGetAll(key)
+	if this.onHGetAll != nil {
+		f := this.onHGetAll
+		this.onHGetAll = nil
+		f()
+	}
+	return values, err
+}
+
+// kvCache实现了AtomicHashKvCache时,修改冲突会重新读取并重试,不会丢失其他地方的写入
+func TestCacheEntityDbAtomic(t *testing.T) {
+	memCache := gentity.NewMemCache()
+	now := time.Now()
+	memCache.SetNowFunc(func() time.Time {
+		return now
+	})
+	kvCache := &conflictMemCache{MemCache: memCache}
+	entityDb := gentity.NewCacheEntityDb(kvCache, "room", "_id", time.Minute)
+	otherDb := gentity.NewCacheEntityDb(memCache, "room", "_id", time.Minute)
+
+	err, _ := entityDb.InsertEntity(int64(1), map[string]interface{}{"Name": "room1"})
+	if err != nil {
+		t.Fatalf("InsertEntity err:%v", err)
+	}
+	err, isDuplicateKey := otherDb.InsertEntity(int64(1), map[string]interface{}{"Name": "room1"})
+	if !isDuplicateKey || !gentity.IsDuplicateKeyError(err) {
+		t.Fatalf("InsertEntity duplicate err:%v isDuplicateKey:%v", err, isDuplicateKey)
+	}
+
+	if err = entityDb.PushToList(int64(1), "Items", 1, 0); err != nil {
+		t.Fatalf("PushToList err:%v", err)
+	}
+	kvCache.onHGetAll = func() {
+		if err := otherDb.PushToList(int64(1), "Items", 2, 0); err != nil {
+			t.Fatalf("other PushToList err:%v", err)
+		}
+	}
+	if err = entityDb.PushToList(int64(1), "Items", 3, 0); err != nil {
+		t.Fatalf("PushToList err:%v", err)
+	}
+	var items []int
+	if err = entityDb.RangeList(int64(1), "Items", 0, 0, &items); err != nil || len(items) != 3 ||
+		items[0] != 1 || items[1] != 2 || items[2] != 3 {
+		t.Fatalf("RangeList %v err:%v", items, err)
+	}
+
+	kvCache.onHGetAll = func() {
+		if err := otherDb.SaveComponentField(int64(1), "BaseInfo", "Level", 2); err != nil {
+			t.Fatalf("other SaveComponentField err:%v", err)
+		}
+	}
+	if err = entityDb.SaveComponentField(int64(1), "BaseInfo", "Exp", 100); err != nil {
+		t.Fatalf("SaveComponentField err:%v", err)
+	}
+	loadData := &pb.PlayerData{}
+	if exists, err := entityDb.FindEntityById(int64(1), loadData); err != nil || !exists ||
+		loadData.BaseInfo.GetLevel() != 2 || loadData.BaseInfo.GetExp() != 100 {
+		t.Fatalf("FindEntityById %v exists:%v err:%v", loadData, exists, err)
+	}
+
+	// 新建和修改时都会设置过期时间
+	now = now.Add(time.Minute)
+	if exists, _ := entityDb.FindEntityById(int64(1), &pb.PlayerData{}); exists {
+		t.Fatal("entity not expired")
+	}
+	if err = entityDb.PushToList(int64(1), "Items", 4, 0); err != gentity.ErrEntityNotExists {
+		t.Fatalf("PushToList expired entity err:%v", err)
+	}
+}
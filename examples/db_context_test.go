@@ -0,0 +1,73 @@
+package examples
+
+import (
+	"context"
+	"github.com/fish-tennis/gentity"
+	"testing"
+	"time"
+)
+
+func TestOpTimeouts(t *testing.T) {
+	timeouts := gentity.NewOpTimeouts(time.Second)
+	timeouts.SetOpTimeout("FindEntityById", time.Minute)
+	timeouts.SetOpTimeout("Del", 0)
+	if timeouts.GetOpTimeout("FindEntityById") != time.Minute || timeouts.GetOpTimeout("HGetAll") != time.Second {
+		t.Fatal("GetOpTimeout err")
+	}
+	ctx, cancel := timeouts.WithTimeout(context.Background(), "HGetAll")
+	deadline, ok := ctx.Deadline()
+	cancel()
+	if !ok || time.Until(deadline) > time.Second {
+		t.Fatalf("deadline:%v %v", deadline, ok)
+	}
+	// 超时时间<=0,不设置deadline
+	ctx, cancel = timeouts.WithTimeout(context.Background(), "Del")
+	cancel()
+	if _, ok = ctx.Deadline(); ok {
+		t.Fatal("Del should not have deadline")
+	}
+	// ctx已经有deadline时,不覆盖
+	parentCtx, parentCancel := context.WithTimeout(context.Background(), time.Hour)
+	defer parentCancel()
+	ctx, cancel = timeouts.WithTimeout(parentCtx, "HGetAll")
+	cancel()
+	if ctx != parentCtx {
+		t.Fatal("parent deadline overwritten")
+	}
+	// nil OpTimeouts不设置超时
+	var nilTimeouts *gentity.OpTimeouts
+	ctx, cancel = nilTimeouts.WithTimeout(context.Background(), "HGetAll")
+	cancel()
+	if _, ok = ctx.Deadline(); ok {
+		t.Fatal("nil OpTimeouts should not have deadline")
+	}
+}
+
+// 不支持context的实现,ctx不生效,接口行为不变
+func TestSaveEntityContext(t *testing.T) {
+	memDb := gentity.NewMemDb()
+	playerDb := memDb.RegisterPlayerDb(_collectionName, "_id", "AccountId", "RegionId")
+	kvCache := gentity.NewMemCache()
+	if gentity.WithKvCacheContext(context.Background(), kvCache) != kvCache {
+		t.Fatal("WithKvCacheContext should return the same cache")
+	}
+	if gentity.WithKvCacheContext(context.Background(), nil) != nil {
+		t.Fatal("WithKvCacheContext(nil) should return nil")
+	}
+	player1 := newTestPlayer(1, 100)
+	playerDb.InsertEntity(player1.Id, getNewPlayerSaveData(player1))
+	player1.GetBaseInfo().AddExp(123)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	err := gentity.SaveEntityChangedDataToDbContext(ctx, playerDb, player1, kvCache, false, "p")
+	if err != nil {
+		t.Fatalf("SaveEntityChangedDataToDbContext err:%v", err)
+	}
+	loadPlayer := newTestPlayer(1, 100)
+	gentity.FixEntityDataFromCacheContext(ctx, loadPlayer, playerDb, kvCache, "p", loadPlayer.Id)
+	loadData := make(map[string]any)
+	exists, err := gentity.WithEntityDbContext(ctx, playerDb).FindEntityById(player1.Id, loadData)
+	if err != nil || !exists || loadData["BaseInfo"] == nil {
+		t.Fatalf("FindEntityById %v exists:%v err:%v", loadData, exists, err)
+	}
+}
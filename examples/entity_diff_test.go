@@ -0,0 +1,129 @@
+package examples
+
+import (
+	"github.com/fish-tennis/gentity"
+	"github.com/fish-tennis/gentity/examples/pb"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"testing"
+)
+
+func newDiffTestPlayer() *Player {
+	player := newTestPlayer(1, 100)
+	player.GetBaseInfo().AddExp(10)
+	player.GetQuest().AddFinishId(1)
+	player.GetQuest().Quests.Set(1, &pb.QuestData{CfgId: 1, Progress: 1})
+	player.GetQuest().Quests.Set(2, &pb.QuestData{CfgId: 2, Progress: 2})
+	player.GetBag().BagCountItem.AddItem(1001, 5)
+	return player
+}
+
+func diffsToMap(diffs []*gentity.EntityDiff) map[string]*gentity.EntityDiff {
+	m := make(map[string]*gentity.EntityDiff)
+	for _, diff := range diffs {
+		m[diff.Path] = diff
+	}
+	return m
+}
+
+func TestDiffEntities(t *testing.T) {
+	oldPlayer := newDiffTestPlayer()
+	newPlayer := newDiffTestPlayer()
+	if diffs, err := gentity.DiffEntities(oldPlayer, newPlayer); err != nil || len(diffs) != 0 {
+		t.Fatalf("same data diffs:%v err:%v", diffs, err)
+	}
+
+	newPlayer.GetBaseInfo().AddExp(5)
+	newPlayer.GetQuest().AddFinishId(2)
+	newPlayer.GetQuest().Quests.Set(1, &pb.QuestData{CfgId: 1, Progress: 3})
+	newPlayer.GetQuest().Quests.Delete(2)
+	newPlayer.GetQuest().Quests.Set(3, &pb.QuestData{CfgId: 3})
+	newPlayer.GetBag().BagCountItem.AddItem(1001, 1)
+	diffs, err := gentity.DiffEntities(oldPlayer, newPlayer)
+	if err != nil {
+		t.Fatalf("DiffEntities err:%v", err)
+	}
+	for _, diff := range diffs {
+		t.Logf("%v", diff)
+	}
+	diffMap := diffsToMap(diffs)
+	expected := map[string]gentity.EntityDiffOp{
+		"BaseInfo.exp":            gentity.EntityDiffModify,
+		"Quest.Finished.1":        gentity.EntityDiffAdd,
+		"Quest.Quests.1.progress": gentity.EntityDiffModify,
+		"Quest.Quests.2":          gentity.EntityDiffRemove,
+		"Quest.Quests.3":          gentity.EntityDiffAdd,
+		"Bag.CountItem.1001":      gentity.EntityDiffModify,
+	}
+	if len(diffs) != len(expected) {
+		t.Fatalf("diffs:%v", diffs)
+	}
+	for path, op := range expected {
+		if diff, ok := diffMap[path]; !ok || diff.Op != op {
+			t.Fatalf("diff %v:%v", path, diff)
+		}
+	}
+	// 序列化的proto被反序列化成可读的字段
+	if diff := diffMap["Quest.Quests.1.progress"]; diff.Old != int32(1) || diff.New != int32(3) {
+		t.Fatalf("proto field diff:%v", diff)
+	}
+}
+
+// 快照的数据和内存中的数据格式不同,比较时不会产生多余的差异
+func TestDiffEntitySnapshot(t *testing.T) {
+	memDb := gentity.NewMemDb()
+	store := gentity.NewKvSnapshotStore(memDb.RegisterKvDb("snapshot", "k", "v"), "")
+	player := newDiffTestPlayer()
+	snapshotter := gentity.NewEntitySnapshotter(player, store, nil)
+	snapshot, err := snapshotter.Snapshot("test")
+	if err != nil {
+		t.Fatalf("Snapshot err:%v", err)
+	}
+	snapshot, err = store.FindSnapshot(player.Id, snapshot.Id)
+	if err != nil {
+		t.Fatalf("FindSnapshot err:%v", err)
+	}
+	player.GetQuest().Quests.Set(2, &pb.QuestData{CfgId: 2, Progress: 9})
+	currentData := make(map[string]interface{})
+	gentity.GetEntitySaveData(player, currentData)
+	diffs, err := gentity.DiffEntitySaveData(player, snapshot.Components, currentData)
+	if err != nil || len(diffs) != 1 || diffs[0].Path != "Quest.Quests.2.progress" {
+		t.Fatalf("diffs:%v err:%v", diffs, err)
+	}
+}
+
+// InterfaceMap的值通过InterfaceMapValueCreator反序列化,逐个字段比较
+func TestDiffInterfaceMap(t *testing.T) {
+	oldPlayer := newDiffTestPlayer()
+	oldPlayer.GetInterfaceMap().makeTestData()
+	newPlayer := newDiffTestPlayer()
+	newPlayer.GetInterfaceMap().makeTestData()
+	if diffs, err := gentity.DiffEntities(oldPlayer, newPlayer); err != nil || len(diffs) != 0 {
+		t.Fatalf("same data diffs:%v err:%v", diffs, err)
+	}
+
+	newPlayer.GetInterfaceMap().InterfaceMap.Data["mapItem1"].(*mapItem1).addExp(2)
+	newPlayer.GetInterfaceMap().InterfaceMap.Delete("mapItem2")
+	diffs, err := gentity.DiffEntities(oldPlayer, newPlayer)
+	if err != nil {
+		t.Fatalf("DiffEntities err:%v", err)
+	}
+	for _, diff := range diffs {
+		t.Logf("%v", diff)
+	}
+	diffMap := diffsToMap(diffs)
+	if len(diffs) != 2 {
+		t.Fatalf("diffs:%v", diffs)
+	}
+	if diff := diffMap["InterfaceMap.mapItem1.exp"]; diff == nil || diff.Op != gentity.EntityDiffModify ||
+		diff.Old != int32(168) || diff.New != int32(170) {
+		t.Fatalf("mapItem1 diff:%v", diff)
+	}
+	// 删除的值也会被反序列化
+	diff := diffMap["InterfaceMap.mapItem2"]
+	if diff == nil || diff.Op != gentity.EntityDiffRemove {
+		t.Fatalf("mapItem2 diff:%v", diff)
+	}
+	if old, ok := diff.Old.(bson.M); !ok || old["cfgid"] != int32(120) {
+		t.Fatalf("mapItem2 old:%v", diff.Old)
+	}
+}
@@ -0,0 +1,99 @@
+package examples
+
+import (
+	"github.com/fish-tennis/gentity"
+	"github.com/fish-tennis/gentity/examples/pb"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func testEntityJournal(t *testing.T, playerDb gentity.EntityDb) {
+	journal := gentity.NewEntityJournal(filepath.Join(t.TempDir(), "player"))
+	player := newTestPlayer(1, 100)
+	playerDb.InsertEntity(player.Id, getNewPlayerSaveData(player))
+	player.GetBaseInfo().AddExp(10)
+	player.GetQuest().AddFinishId(1)
+	player.GetQuest().Quests.Set(2, &pb.QuestData{CfgId: 2, Progress: 3})
+	if err := gentity.SaveEntityChangedDataToJournal(journal, player.Id, player); err != nil {
+		t.Fatalf("SaveEntityChangedDataToJournal err:%v", err)
+	}
+	// 写入日志不会重置修改标记
+	gentity.SaveEntityChangedDataToCache(gentity.NewMemCache(), "p", player.Id, player)
+	player.GetBaseInfo().AddExp(5)
+	if err := gentity.SaveEntityChangedDataToJournal(journal, player.Id, player); err != nil {
+		t.Fatalf("SaveEntityChangedDataToJournal err:%v", err)
+	}
+	components, err := journal.Load(player.Id)
+	if err != nil || len(components) != 2 {
+		t.Fatalf("Load components:%v err:%v", components, err)
+	}
+
+	// 模拟进程崩溃,最后一条记录只写入了一部分
+	journalFile := filepath.Join(journal.GetDir(), "1.journal")
+	file, err := os.OpenFile(journalFile, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatalf("OpenFile err:%v", err)
+	}
+	file.Write([]byte{100, 0, 0, 0, 3})
+	file.Close()
+
+	// 进程重启后回放日志
+	count, err := journal.Replay(playerDb)
+	if err != nil || count != 1 {
+		t.Fatalf("Replay count:%v err:%v", count, err)
+	}
+	if _, err = os.Stat(journalFile); !os.IsNotExist(err) {
+		t.Fatalf("journal not removed:%v", err)
+	}
+	loadPlayer := loadTestPlayer(t, playerDb, player.Id)
+	if loadPlayer.GetBaseInfo().BaseInfo.Exp != 15 {
+		t.Fatalf("BaseInfo:%v", loadPlayer.GetBaseInfo().BaseInfo)
+	}
+	if len(loadPlayer.GetQuest().Finished.Data) != 1 || loadPlayer.GetQuest().Quests.Data[2].GetProgress() != 3 {
+		t.Fatalf("Quest:%v %v", loadPlayer.GetQuest().Finished.Data, loadPlayer.GetQuest().Quests.Data)
+	}
+
+	// 保存数据库成功后清空日志
+	loadPlayer.GetBaseInfo().AddExp(1)
+	gentity.SaveEntityChangedDataToJournal(journal, loadPlayer.Id, loadPlayer)
+	if err = gentity.SaveEntityChangedDataToDbWithJournal(journal, playerDb, loadPlayer, loadPlayer.Id, nil, false, "p"); err != nil {
+		t.Fatalf("SaveEntityChangedDataToDbWithJournal err:%v", err)
+	}
+	if components, _ = journal.Load(loadPlayer.Id); components != nil {
+		t.Fatalf("journal not truncated:%v", components)
+	}
+}
+
+func TestEntityJournal(t *testing.T) {
+	runEntityDbTests(t, []string{testBackendMem, testBackendSql}, "journaltest", testEntityJournal)
+}
+
+// 没有缓存时,EntitySaver只写日志
+func TestEntitySaverJournal(t *testing.T) {
+	memDb := gentity.NewMemDb()
+	playerDb := memDb.RegisterPlayerDb(_collectionName, "_id", "AccountId", "RegionId")
+	journal := gentity.NewEntityJournal(t.TempDir())
+	player := newTestPlayer(1, 100)
+	playerDb.InsertEntity(player.Id, getNewPlayerSaveData(player))
+	saver := gentity.NewEntitySaver(player, playerDb, nil, "p", nil)
+	saver.SetJournal(journal)
+	player.GetBaseInfo().AddExp(10)
+	if err := saver.SaveCache(); err != nil {
+		t.Fatalf("SaveCache err:%v", err)
+	}
+	// 已经写入日志的数据不会重复写入
+	if err := saver.SaveCache(); err != nil {
+		t.Fatalf("SaveCache err:%v", err)
+	}
+	components, _ := journal.Load(player.Id)
+	if len(components) != 1 {
+		t.Fatalf("journal components:%v", components)
+	}
+	if err := saver.SaveDb(); err != nil {
+		t.Fatalf("SaveDb err:%v", err)
+	}
+	if components, _ = journal.Load(player.Id); components != nil {
+		t.Fatalf("journal not truncated:%v", components)
+	}
+}
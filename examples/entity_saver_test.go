@@ -0,0 +1,110 @@
+package examples
+
+import (
+	"errors"
+	"github.com/fish-tennis/gentity"
+	"github.com/fish-tennis/gentity/examples/pb"
+	"testing"
+	"time"
+)
+
+// 可以模拟保存失败的数据库
+type failableEntityDb struct {
+	gentity.EntityDb
+	fail      bool
+	saveCount int
+}
+
+func (this *failableEntityDb) SaveComponents(entityKey interface{}, components map[string]interface{}) error {
+	this.saveCount++
+	if this.fail {
+		return errors.New("save failed")
+	}
+	return this.EntityDb.SaveComponents(entityKey, components)
+}
+
+func TestEntitySaver(t *testing.T) {
+	memDb := gentity.NewMemDb()
+	playerDb := memDb.RegisterPlayerDb(_collectionName, "_id", "AccountId", "RegionId")
+	entityDb := &failableEntityDb{EntityDb: playerDb}
+	kvCache := gentity.NewMemCache()
+	player := newTestPlayer(1, 100)
+	playerDb.InsertEntity(player.Id, getNewPlayerSaveData(player))
+
+	now := time.Now()
+	timerEntries := gentity.NewTimerEntriesWithArgs(func() time.Time {
+		return now
+	}, time.Millisecond)
+	options := gentity.NewEntitySaverOptions()
+	options.CacheInterval = time.Second
+	options.DbInterval = time.Minute
+	options.DbJitter = 0
+	options.MinBackoff = 2 * time.Second
+	options.MaxBackoff = 5 * time.Second
+	saver := gentity.NewEntitySaver(player, entityDb, kvCache, "p", options)
+	saver.Start(timerEntries)
+	timerEntries.Start()
+	defer timerEntries.Stop()
+	advance := func(d time.Duration) {
+		now = now.Add(d)
+		timerEntries.Run(now)
+	}
+
+	// 定时保存缓存
+	player.GetBaseInfo().AddExp(10)
+	advance(time.Second)
+	cacheKey := gentity.GetEntityComponentCacheKey("p", player.Id, "BaseInfo")
+	if typ, _ := kvCache.Type(cacheKey); typ == "none" || typ == "" {
+		t.Fatalf("cache not saved:%v", typ)
+	}
+	if entityDb.saveCount != 0 {
+		t.Fatalf("saveCount:%v", entityDb.saveCount)
+	}
+
+	// 定时保存数据库,失败后指数退避重试
+	entityDb.fail = true
+	advance(time.Minute)
+	if entityDb.saveCount != 1 {
+		t.Fatalf("saveCount:%v", entityDb.saveCount)
+	}
+	advance(time.Second)
+	if entityDb.saveCount != 1 {
+		t.Fatalf("retry before backoff, saveCount:%v", entityDb.saveCount)
+	}
+	advance(time.Second)
+	if entityDb.saveCount != 2 {
+		t.Fatalf("retry after backoff, saveCount:%v", entityDb.saveCount)
+	}
+	advance(4 * time.Second)
+	if entityDb.saveCount != 3 {
+		t.Fatalf("retry after backoff, saveCount:%v", entityDb.saveCount)
+	}
+	entityDb.fail = false
+	advance(5 * time.Second)
+	if entityDb.saveCount != 4 {
+		t.Fatalf("retry success, saveCount:%v", entityDb.saveCount)
+	}
+	loadData := &pb.PlayerData{}
+	playerDb.FindEntityById(player.Id, loadData)
+	if loadData.BaseInfo.GetExp() != 10 {
+		t.Fatalf("BaseInfo:%v", loadData.BaseInfo)
+	}
+
+	// 停止时强制保存
+	player.GetBaseInfo().AddExp(5)
+	if err := saver.Stop(); err != nil {
+		t.Fatalf("Stop err:%v", err)
+	}
+	loadData = &pb.PlayerData{}
+	playerDb.FindEntityById(player.Id, loadData)
+	if loadData.BaseInfo.GetExp() != 15 {
+		t.Fatalf("BaseInfo after stop:%v", loadData.BaseInfo)
+	}
+	// 停止后不再定时保存
+	saveCount := entityDb.saveCount
+	player.GetBaseInfo().AddExp(1)
+	advance(time.Hour)
+	if entityDb.saveCount != saveCount {
+		t.Fatalf("saved after stop, saveCount:%v", entityDb.saveCount)
+	}
+}
@@ -0,0 +1,82 @@
+package examples
+
+import (
+	"errors"
+	"github.com/fish-tennis/gentity"
+	"github.com/fish-tennis/gentity/examples/pb"
+	"testing"
+	"time"
+)
+
+// 快照和回档
+func testEntitySnapshot(t *testing.T, playerDb gentity.EntityDb, kvDb gentity.KvDb) {
+	kvCache := gentity.NewMemCache()
+	store := gentity.NewKvSnapshotStore(kvDb, "snapshot_")
+	player := newTestPlayer(1, 100)
+	playerDb.InsertEntity(player.Id, getNewPlayerSaveData(player))
+	options := gentity.NewEntitySnapshotOptions()
+	options.Retention = gentity.SnapshotRetention{MaxCount: 2}
+	snapshotter := gentity.NewEntitySnapshotter(player, store, options)
+
+	player.GetBaseInfo().AddExp(10)
+	player.GetQuest().Quests.Set(1, &pb.QuestData{CfgId: 1, Progress: 2})
+	snapshot1, err := snapshotter.Snapshot("trade")
+	if err != nil {
+		t.Fatalf("Snapshot err:%v", err)
+	}
+	player.GetBaseInfo().AddExp(20)
+	player.GetQuest().Quests.Delete(1)
+	snapshot2, _ := snapshotter.Snapshot("trade")
+	if snapshot2.Id <= snapshot1.Id {
+		t.Fatalf("snapshot id:%v %v", snapshot1.Id, snapshot2.Id)
+	}
+	// 下线后又上线的其他数据
+	gentity.SaveEntityChangedDataToDb(playerDb, player, nil, false, "p")
+	player.GetBaseInfo().AddExp(30)
+	journal := gentity.NewEntityJournal(t.TempDir())
+	gentity.SaveEntityChangedDataToJournal(journal, player.Id, player)
+	gentity.SaveEntityChangedDataToCache(kvCache, "p", player.Id, player)
+	snapshotIds, err := store.FindSnapshotIds(player.Id)
+	if err != nil || len(snapshotIds) != 2 || snapshotIds[0] != snapshot1.Id {
+		t.Fatalf("FindSnapshotIds:%v err:%v", snapshotIds, err)
+	}
+	findSnapshot, err := store.FindSnapshot(player.Id, snapshot1.Id)
+	if err != nil || findSnapshot.Reason != "trade" || findSnapshot.GetTime().IsZero() {
+		t.Fatalf("FindSnapshot:%v err:%v", findSnapshot, err)
+	}
+
+	// 回档到第1个快照
+	if err = gentity.RestoreEntitySnapshot(store, playerDb, journal, kvCache, newTestPlayer(0, 0), "p", player.Id, snapshot1.Id); err != nil {
+		t.Fatalf("RestoreEntitySnapshot err:%v", err)
+	}
+	loadPlayer := loadTestPlayer(t, playerDb, player.Id)
+	if loadPlayer.GetBaseInfo().BaseInfo.Exp != 10 || loadPlayer.GetQuest().Quests.Data[1].GetProgress() != 2 {
+		t.Fatalf("restore:%v %v", loadPlayer.GetBaseInfo().BaseInfo, loadPlayer.GetQuest().Quests.Data)
+	}
+	if typ, _ := kvCache.Type(gentity.GetEntityComponentCacheKey("p", player.Id, "BaseInfo")); typ != "none" {
+		t.Fatalf("cache not removed:%v", typ)
+	}
+	// 日志被清空,回放时不会覆盖回档的数据
+	if components, err := journal.Load(player.Id); err != nil || components != nil {
+		t.Fatalf("journal not truncated:%v err:%v", components, err)
+	}
+
+	// 保留策略
+	snapshotter.Snapshot("trade")
+	if snapshotIds, _ = store.FindSnapshotIds(player.Id); len(snapshotIds) != 2 || snapshotIds[0] != snapshot2.Id {
+		t.Fatalf("retention:%v", snapshotIds)
+	}
+	removed, err := (&gentity.SnapshotRetention{MaxAge: time.Hour}).Apply(store, player.Id, time.Now().Add(2*time.Hour))
+	if err != nil || removed != 2 {
+		t.Fatalf("retention MaxAge removed:%v err:%v", removed, err)
+	}
+	if _, err = store.FindSnapshot(player.Id, snapshot2.Id); !errors.Is(err, gentity.ErrSnapshotNotExists) {
+		t.Fatalf("FindSnapshot err:%v", err)
+	}
+}
+
+func TestEntitySnapshot(t *testing.T) {
+	runBackendTests(t, []string{testBackendMem, testBackendSql}, "snapshottest", func(t *testing.T, dbs *testDbs) {
+		testEntitySnapshot(t, dbs.playerDb, dbs.kvDb)
+	})
+}
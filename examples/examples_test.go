@@ -47,6 +47,7 @@ func initRedis() gentity.KvCache {
 // 测试根据账号查找角色的接口
 func TestFindPlayerId(t *testing.T) {
 	gentity.SetLogLevel(gentity.DebugLevel)
+	skipIfMongoUnavailable(t)
 	mongoDb := gentity.NewMongoDb(_mongoUri, _mongoDbName)
 	playerDb := mongoDb.RegisterPlayerDb(_collectionName, true, "_id", "AccountId", "RegionId")
 	if !mongoDb.Connect() {
@@ -91,6 +92,7 @@ func TestFindPlayerId(t *testing.T) {
 // 测试缓存接口
 func TestDbCache(t *testing.T) {
 	gentity.SetLogLevel(gentity.DebugLevel)
+	skipIfMongoUnavailable(t)
 	mongoDb := gentity.NewMongoDb(_mongoUri, _mongoDbName)
 	playerDb := mongoDb.RegisterPlayerDb(_collectionName, true, "_id", "AccountId", "RegionId")
 	if !mongoDb.Connect() {
@@ -193,6 +195,7 @@ func TestDbCache(t *testing.T) {
 // 测试从缓存修复数据的接口
 func TestFixDataFromCache(t *testing.T) {
 	gentity.SetLogLevel(gentity.DebugLevel)
+	skipIfMongoUnavailable(t)
 	mongoDb := gentity.NewMongoDb(_mongoUri, _mongoDbName)
 	playerDb := mongoDb.RegisterPlayerDb(_collectionName, true, "_id", "AccountId", "RegionId")
 	if !mongoDb.Connect() {
@@ -299,6 +302,7 @@ func TestHandlerRegister(t *testing.T) {
 
 func TestPlayerData(t *testing.T) {
 	gentity.SetLogLevel(gentity.DebugLevel)
+	skipIfMongoUnavailable(t)
 	mongoDb := gentity.NewMongoDb(_mongoUri, _mongoDbName)
 	playerDb := mongoDb.RegisterPlayerDb(_collectionName, true, "_id", "AccountId", "RegionId")
 	if !mongoDb.Connect() {
@@ -0,0 +1,106 @@
+package examples
+
+import (
+	"github.com/fish-tennis/gentity"
+	"github.com/fish-tennis/gentity/examples/pb"
+	"testing"
+)
+
+// 本地文件数据库测试,无需部署mongodb
+func TestFilePlayerDb(t *testing.T) {
+	gentity.SetLogLevel(gentity.DebugLevel)
+	rootDir := t.TempDir()
+	fileDb := gentity.NewFileDb(rootDir)
+	playerDb := fileDb.RegisterPlayerDb(_collectionName, "_id", "AccountId", "RegionId")
+	if !fileDb.Connect() {
+		t.Fatal("connect failed")
+	}
+
+	player1 := newTestPlayer(1, 100)
+	err, _ := playerDb.InsertEntity(player1.Id, getNewPlayerSaveData(player1))
+	if err != nil {
+		t.Fatalf("InsertEntity err:%v", err)
+	}
+	err, isDuplicateKey := playerDb.InsertEntity(player1.Id, getNewPlayerSaveData(player1))
+	if !isDuplicateKey || !gentity.IsDuplicateKeyError(err) {
+		t.Fatalf("InsertEntity duplicate err:%v isDuplicateKey:%v", err, isDuplicateKey)
+	}
+	player2 := newTestPlayer(2, 100)
+	playerDb.InsertEntity(player2.Id, getNewPlayerSaveData(player2))
+
+	player1.GetBaseInfo().AddExp(123)
+	player1.GetQuest().AddFinishId(1)
+	player1.GetQuest().Quests.Set(2, &pb.QuestData{CfgId: 2, Progress: 5})
+	player1.GetBag().BagUniqueItem.AddUniqueItem(&pb.UniqueItem{UniqueId: 1001, CfgId: 1})
+	player1.GetStruct().Set(11, 12)
+	err = gentity.SaveEntityChangedDataToDb(playerDb, player1, nil, false, "p")
+	if err != nil {
+		t.Fatalf("SaveEntityChangedDataToDb err:%v", err)
+	}
+	playerDb.DeleteEntity(player2.Id)
+	fileDb.Disconnect()
+
+	// 重新打开,账号索引从文件重建
+	fileDb = gentity.NewFileDb(rootDir)
+	playerDb = fileDb.RegisterPlayerDb(_collectionName, "_id", "AccountId", "RegionId")
+	if !fileDb.Connect() {
+		t.Fatal("reconnect failed")
+	}
+	findPlayerIds, err := playerDb.FindPlayerIdsByAccountId(100, 1)
+	if err != nil || len(findPlayerIds) != 1 || findPlayerIds[0] != player1.Id {
+		t.Fatalf("FindPlayerIdsByAccountId %v err:%v", findPlayerIds, err)
+	}
+	accountId, err := playerDb.FindAccountIdByPlayerId(player1.Id)
+	if err != nil || accountId != 100 {
+		t.Fatalf("FindAccountIdByPlayerId %v err:%v", accountId, err)
+	}
+	loadData := &pb.PlayerData{}
+	exists, err := playerDb.FindPlayerByAccountId(100, 1, loadData)
+	if err != nil || !exists {
+		t.Fatalf("FindPlayerByAccountId exists:%v err:%v", exists, err)
+	}
+	loadPlayer := newTestPlayerFromData(loadData)
+	if loadPlayer.GetBaseInfo().BaseInfo.Exp != 123 {
+		t.Fatalf("BaseInfo:%v", loadPlayer.GetBaseInfo().BaseInfo)
+	}
+	if len(loadPlayer.GetQuest().Finished.Data) != 1 || loadPlayer.GetQuest().Quests.Data[2].GetProgress() != 5 {
+		t.Fatalf("Quest:%v %v", loadPlayer.GetQuest().Finished.Data, loadPlayer.GetQuest().Quests.Data)
+	}
+	if loadPlayer.GetBag().BagUniqueItem.Data[1001].GetCfgId() != 1 || loadPlayer.GetStruct().Data.CfgId != 11 {
+		t.Fatalf("Bag:%v Struct:%v", loadPlayer.GetBag().BagUniqueItem.Data, &loadPlayer.GetStruct().Data)
+	}
+	// 和mongodb一样,不能在非文档类型的字段下创建字段
+	if err = playerDb.SaveComponentField(player1.Id, "Struct", "CfgId", 1); err == nil {
+		t.Fatal("SaveComponentField on binary field should fail")
+	}
+}
+
+func TestFileKvDb(t *testing.T) {
+	fileDb := gentity.NewFileDb(t.TempDir())
+	kvDb := fileDb.RegisterKvDb("kv", "k", "v")
+	if !fileDb.Connect() {
+		t.Fatal("connect failed")
+	}
+	for i := 0; i < 10; i++ {
+		kvDb.Inc("id", 1, true)
+	}
+	id, err := kvDb.Find("id")
+	if err != nil || id != int32(10) {
+		t.Fatalf("Inc result:%v err:%v", id, err)
+	}
+	// 字符串key中的路径分隔符会被转义
+	kvDb.Update("a/b", &pb.BaseInfo{Level: 10, Exp: 123}, true)
+	protoDecodeData := new(pb.BaseInfo)
+	err = kvDb.FindAndDecode("a/b", protoDecodeData)
+	if err != nil || protoDecodeData.Exp != 123 {
+		t.Fatalf("FindAndDecode %v err:%v", protoDecodeData, err)
+	}
+	err, isDuplicateKey := kvDb.Insert("a/b", "value")
+	if !isDuplicateKey {
+		t.Fatalf("Insert duplicate err:%v", err)
+	}
+	kvDb.Delete("a/b")
+	if value, err := kvDb.Find("a/b"); value != nil || err != nil {
+		t.Fatalf("Delete failed %v %v", value, err)
+	}
+}
@@ -0,0 +1,38 @@
+package examples
+
+import (
+	"github.com/fish-tennis/gentity"
+	"github.com/fish-tennis/gentity/examples/pb"
+	"testing"
+)
+
+// 批量加载实体数据,如公会成员的摘要数据
+func testFindEntitiesByIds(t *testing.T, entityDb gentity.EntityDb) {
+	for i := int64(1); i <= 3; i++ {
+		player := newTestPlayer(i, 100+i)
+		player.GetBaseInfo().AddExp(int32(i))
+		entityDb.InsertEntity(player.Id, getNewPlayerSaveData(player))
+	}
+	newData := func() interface{} {
+		return &pb.PlayerData{}
+	}
+	datas, err := entityDb.FindEntitiesByIds([]interface{}{int64(1), int64(3), int64(4)}, newData)
+	if err != nil || len(datas) != 2 {
+		t.Fatalf("FindEntitiesByIds %v err:%v", datas, err)
+	}
+	if data := datas[int64(3)].(*pb.PlayerData); data.Name != "player3" || data.BaseInfo.GetExp() != 3 {
+		t.Fatalf("FindEntitiesByIds %v", data)
+	}
+	// 只加载BaseInfo组件
+	datas, err = entityDb.FindEntitiesByIds([]interface{}{int64(1), int64(2)}, newData, "BaseInfo")
+	if err != nil || len(datas) != 2 {
+		t.Fatalf("FindEntitiesByIds projection %v err:%v", datas, err)
+	}
+	if data := datas[int64(2)].(*pb.PlayerData); data.Name != "" || data.BaseInfo.GetExp() != 2 {
+		t.Fatalf("FindEntitiesByIds projection %v", data)
+	}
+}
+
+func TestFindEntitiesByIds(t *testing.T) {
+	runEntityDbTests(t, _allTestBackends, "findtest", testFindEntitiesByIds)
+}
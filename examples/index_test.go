@@ -0,0 +1,62 @@
+package examples
+
+import (
+	"context"
+	"github.com/fish-tennis/gentity"
+	"testing"
+	"time"
+)
+
+func TestEntityIndexDefs(t *testing.T) {
+	player := newTestPlayer(1, 100)
+	indexDefs := gentity.GetEntityIndexDefs(player)
+	if len(indexDefs) != 1 {
+		t.Fatalf("indexDefs:%v", indexDefs)
+	}
+	if indexDefs[0].GetName() != "BaseInfo.level_-1_BaseInfo.exp_-1" || !indexDefs[0].Keys[1].Desc {
+		t.Fatalf("indexDef:%v", indexDefs[0])
+	}
+	indexDef := gentity.NewIndexDef("AccountId", "-RegionId").SetUnique(true)
+	if indexDef.GetName() != "AccountId_1_RegionId_-1" || !indexDef.Unique {
+		t.Fatalf("indexDef:%v", indexDef)
+	}
+}
+
+func TestMongoIndexes(t *testing.T) {
+	skipIfMongoUnavailable(t)
+	collectionName := "indextest"
+	mongoDb := gentity.NewMongoDb(_mongoUri, _mongoDbName)
+	indexDefs := append(gentity.GetEntityIndexDefs(newTestPlayer(1, 100)),
+		gentity.NewIndexDef("AccountId", "RegionId"),
+		gentity.NewIndexDef("LoginTime").SetExpireAfter(time.Hour))
+	mongoDb.RegisterPlayerDb(collectionName, false, "Id", "AccountId", "RegionId", indexDefs...)
+	if !mongoDb.Connect() {
+		t.Fatal("connect db error")
+	}
+	defer mongoDb.Disconnect()
+	col := mongoDb.GetMongoDatabase().Collection(collectionName)
+	defer col.Drop(context.Background())
+	// 第一次Connect已经创建好索引,再次检查不会有差异
+	playerDb := mongoDb.GetEntityDb(collectionName).(*gentity.MongoCollectionPlayer)
+	drifts, err := playerDb.EnsureIndexes(context.Background())
+	if err != nil || len(drifts) != 0 {
+		t.Fatalf("drifts:%v err:%v", drifts, err)
+	}
+
+	// 声明和数据库里的索引不一致
+	mongoDb2 := gentity.NewMongoDb(_mongoUri, _mongoDbName)
+	mongoDb2.RegisterPlayerDb(collectionName, false, "Id", "AccountId", "RegionId",
+		gentity.NewIndexDef("AccountId", "RegionId").SetUnique(true))
+	if !mongoDb2.Connect() {
+		t.Fatal("connect db error")
+	}
+	defer mongoDb2.Disconnect()
+	driftTypes := make(map[string]gentity.IndexDriftType)
+	for _, drift := range mongoDb2.GetIndexDrifts() {
+		driftTypes[drift.IndexName] = drift.DriftType
+	}
+	if len(driftTypes) != 3 || driftTypes["AccountId_1_RegionId_1"] != gentity.IndexDriftMismatch ||
+		driftTypes["LoginTime_1"] != gentity.IndexDriftUndeclared {
+		t.Fatalf("drifts:%v", mongoDb2.GetIndexDrifts())
+	}
+}
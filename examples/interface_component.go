@@ -31,33 +31,34 @@ func (this *Player) GetInterfaceMap() *InterfaceMap {
 	return this.GetComponentByName(ComponentNameInterfaceMap).(*InterfaceMap)
 }
 
+// 根据key创建InterfaceMap的值对象,实现gentity.InterfaceMapValueCreator
+func (im *InterfaceMap) NewInterfaceMapValue(key string) interface{} {
+	switch key {
+	case "mapItem1":
+		return &mapItem1{
+			MapValueDirtyMark: gentity.NewMapValueDirtyMark(im, "mapItem1"),
+			Data:              &pb.BaseInfo{},
+		}
+	case "mapItem2":
+		return &mapItem2{
+			MapValueDirtyMark: gentity.NewMapValueDirtyMark(im, "mapItem2"),
+			Data:              &pb.QuestData{},
+		}
+	case "mapItem3":
+		return &mapItem1{
+			MapValueDirtyMark: gentity.NewMapValueDirtyMark(im, "mapItem3"),
+			Data:              &pb.BaseInfo{},
+		}
+	}
+	return nil
+}
+
 // 反序列化
 func (im *InterfaceMap) LoadFromBytesMap(bytesMap any) error {
-	registerValueCtor := map[string]func() interface{}{
-		"mapItem1": func() interface{} {
-			return &mapItem1{
-				MapValueDirtyMark: gentity.NewMapValueDirtyMark(im, "mapItem1"),
-				Data:              &pb.BaseInfo{},
-			}
-		},
-		"mapItem2": func() interface{} {
-			return &mapItem2{
-				MapValueDirtyMark: gentity.NewMapValueDirtyMark(im, "mapItem2"),
-				Data:              &pb.QuestData{},
-			}
-		},
-		"mapItem3": func() interface{} {
-			return &mapItem1{
-				MapValueDirtyMark: gentity.NewMapValueDirtyMark(im, "mapItem3"),
-				Data:              &pb.BaseInfo{},
-			}
-		},
-	}
 	sourceData := bytesMap.(map[string][]byte)
 	for k, v := range sourceData {
-		if ctor, ok := registerValueCtor[k]; ok {
-			// 动态构造
-			val := ctor()
+		// 动态构造
+		if val := im.NewInterfaceMapValue(k); val != nil {
 			err := gentity.LoadObjData(val, v)
 			if err != nil {
 				gentity.GetLogger().Error("loadDataErr %v %v", k, err.Error())
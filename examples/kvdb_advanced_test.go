@@ -0,0 +1,89 @@
+package examples
+
+import (
+	"fmt"
+	"github.com/fish-tennis/gentity"
+	"testing"
+)
+
+func checkKvScanKeys(t *testing.T, result *gentity.KvScanResult, expected ...string) {
+	if len(result.Pairs) != len(expected) {
+		t.Fatalf("pairs:%v expected:%v", len(result.Pairs), expected)
+	}
+	for i, pair := range result.Pairs {
+		if pair.Key != expected[i] {
+			t.Fatalf("key:%v expected:%v", pair.Key, expected[i])
+		}
+	}
+}
+
+// 跨服务器的数据,如世界boss的血量,拍卖行的商品,服务器计数器
+func testAdvancedKvDb(t *testing.T, kvDb gentity.KvDb) {
+	advancedKvDb := kvDb.(gentity.AdvancedKvDb)
+	for _, key := range []string{"boss_1", "counter", "lock", "auction_1", "auction_2", "auction_3", "auction_4", "auction_5"} {
+		kvDb.Delete(key)
+	}
+
+	// 世界boss的血量和被攻击次数
+	kvDb.Update("boss_1", map[string]interface{}{"hp": 1000, "hitCount": 0}, true)
+	newValues, err := advancedKvDb.IncFields("boss_1", map[string]interface{}{"hp": -100, "hitCount": 1}, false)
+	if err != nil || fmt.Sprint(newValues["hp"]) != "900" || fmt.Sprint(newValues["hitCount"]) != "1" {
+		t.Fatalf("IncFields %v err:%v", newValues, err)
+	}
+	if _, err = advancedKvDb.IncFields("boss_2", map[string]interface{}{"hp": -100}, false); err == nil {
+		t.Fatal("IncFields without upsert should fail")
+	}
+	newValues, err = advancedKvDb.IncFields("counter", map[string]interface{}{"online": 5, "stat.login": 1}, true)
+	if err != nil || fmt.Sprint(newValues["online"]) != "5" || fmt.Sprint(newValues["stat.login"]) != "1" {
+		t.Fatalf("IncFields upsert %v err:%v", newValues, err)
+	}
+
+	values, err := advancedKvDb.FindMany([]interface{}{"boss_1", "missing", "counter"})
+	if err != nil || len(values) != 2 || values["boss_1"] == nil || values["counter"] == nil {
+		t.Fatalf("FindMany %v err:%v", values, err)
+	}
+
+	// 分布式锁
+	if ok, err := advancedKvDb.CompareAndSwap("lock", nil, "owner1"); !ok || err != nil {
+		t.Fatalf("CompareAndSwap insert ok:%v err:%v", ok, err)
+	}
+	if ok, _ := advancedKvDb.CompareAndSwap("lock", nil, "owner2"); ok {
+		t.Fatal("CompareAndSwap insert exists key")
+	}
+	if ok, _ := advancedKvDb.CompareAndSwap("lock", "owner3", "owner2"); ok {
+		t.Fatal("CompareAndSwap with wrong expected")
+	}
+	if ok, err := advancedKvDb.CompareAndSwap("lock", "owner1", "owner2"); !ok || err != nil {
+		t.Fatalf("CompareAndSwap ok:%v err:%v", ok, err)
+	}
+	if value, _ := kvDb.Find("lock"); value != "owner2" {
+		t.Fatalf("Find lock:%v", value)
+	}
+
+	// 拍卖行的商品分页
+	for i := 5; i >= 1; i-- {
+		kvDb.Insert(fmt.Sprintf("auction_%v", i), i*100)
+	}
+	scan := gentity.NewKvScan().SetPrefix("auction_").SetLimit(2)
+	result, err := advancedKvDb.Scan(scan)
+	if err != nil {
+		t.Fatalf("Scan err:%v", err)
+	}
+	checkKvScanKeys(t, result, "auction_1", "auction_2")
+	if fmt.Sprint(result.Pairs[1].Value) != "200" {
+		t.Fatalf("Scan value:%v", result.Pairs[1].Value)
+	}
+	result, _ = advancedKvDb.Scan(scan.SetCursor(result.NextCursor))
+	checkKvScanKeys(t, result, "auction_3", "auction_4")
+	result, _ = advancedKvDb.Scan(scan.SetCursor(result.NextCursor))
+	checkKvScanKeys(t, result, "auction_5")
+	if result.NextCursor != nil {
+		t.Fatalf("NextCursor:%v", result.NextCursor)
+	}
+	result, _ = advancedKvDb.Scan(gentity.NewKvScan().SetRange("auction_2", "auction_4"))
+	checkKvScanKeys(t, result, "auction_2", "auction_3")
+}
+
+func TestAdvancedKvDb(t *testing.T) {
+	runKvDbTests(t, []string{testBackendMem, testBackendFile, testBackendSql, testBackendMongo}, "kvadvanced", testAdvancedKvDb)
+}
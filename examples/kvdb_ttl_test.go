@@ -0,0 +1,90 @@
+package examples
+
+import (
+	"fmt"
+	"github.com/fish-tennis/gentity"
+	"testing"
+	"time"
+)
+
+// 过期的数据视为不存在,如每日重置的数据,临时封禁,邀请码
+// keepTTLOnUpdate: 不带过期时间的Update是否保留原有的过期时间,CacheKvDb使用NewCacheKvDb设置的过期时间
+func testExpirableKvDb(t *testing.T, kvDb gentity.KvDb, keepTTLOnUpdate bool) {
+	expirableKvDb := kvDb.(gentity.ExpirableKvDb)
+	kvDb.Delete("invite")
+	kvDb.Delete("ban")
+	kvDb.Delete("daily")
+	if err, _ := expirableKvDb.InsertWithTTL("invite", "code123", 100*time.Millisecond); err != nil {
+		t.Fatalf("InsertWithTTL err:%v", err)
+	}
+	if _, isDuplicateKey := expirableKvDb.InsertWithTTL("invite", "code456", time.Minute); !isDuplicateKey {
+		t.Fatal("InsertWithTTL should be duplicate")
+	}
+	expirableKvDb.UpdateWithTTL("ban", "cheat", 100*time.Millisecond, true)
+	kvDb.Update("daily", 1, true)
+	if keepTTLOnUpdate {
+		kvDb.Update("ban", "cheat again", false)
+		if value, err := kvDb.Find("ban"); err != nil || value != "cheat again" {
+			t.Fatalf("Find ban:%v err:%v", value, err)
+		}
+	}
+	time.Sleep(200 * time.Millisecond)
+
+	if value, err := kvDb.Find("invite"); err != nil || value != nil {
+		t.Fatalf("Find expired invite:%v err:%v", value, err)
+	}
+	if value, err := kvDb.Find("ban"); err != nil || value != nil {
+		t.Fatalf("Find expired ban:%v err:%v", value, err)
+	}
+	var decodeValue string
+	if err := kvDb.FindAndDecode("invite", &decodeValue); err != nil || decodeValue != "" {
+		t.Fatalf("FindAndDecode expired invite:%v err:%v", decodeValue, err)
+	}
+	// 过期的数据不影响插入
+	if err, _ := kvDb.Insert("invite", "code789"); err != nil {
+		t.Fatalf("Insert after expired err:%v", err)
+	}
+	if value, _ := kvDb.Find("invite"); value != "code789" {
+		t.Fatalf("Find invite:%v", value)
+	}
+	// 过期的数据不会被不带upsert的更新恢复
+	expirableKvDb.UpdateWithTTL("ban", "cheat", time.Minute, false)
+	if value, _ := kvDb.Find("ban"); value != nil {
+		t.Fatalf("Find ban:%v", value)
+	}
+	if value, _ := kvDb.Find("daily"); value != int32(1) && value != int64(1) {
+		t.Fatalf("Find daily:%v", value)
+	}
+}
+
+func TestExpirableKvDb(t *testing.T) {
+	runKvDbTests(t, []string{testBackendMem, testBackendCache, testBackendMongo}, "kvttl", func(t *testing.T, kvDb gentity.KvDb) {
+		// CacheKvDb的Update使用NewCacheKvDb设置的过期时间,不保留原有的过期时间
+		_, isCacheKvDb := kvDb.(*gentity.CacheKvDb)
+		testExpirableKvDb(t, kvDb, !isCacheKvDb)
+	})
+}
+
+// 没有过期时间的数据,upsert的Inc在原来的值上累加,过期的数据从0开始累加
+func TestExpirableKvDbInc(t *testing.T) {
+	runKvDbTests(t, []string{testBackendMem, testBackendCache, testBackendMongo}, "kvinc", func(t *testing.T, kvDb gentity.KvDb) {
+		expirableKvDb := kvDb.(gentity.ExpirableKvDb)
+		kvDb.Delete("counter")
+		kvDb.Delete("expiredCounter")
+		for i := 0; i < 2; i++ {
+			if _, err := kvDb.Inc("counter", 2, true); err != nil {
+				t.Fatalf("Inc err:%v", err)
+			}
+		}
+		if value, err := kvDb.Find("counter"); err != nil || fmt.Sprint(value) != "4" {
+			t.Fatalf("Find counter:%v err:%v", value, err)
+		}
+		if err, _ := expirableKvDb.InsertWithTTL("expiredCounter", 5, 100*time.Millisecond); err != nil {
+			t.Fatalf("InsertWithTTL err:%v", err)
+		}
+		time.Sleep(200 * time.Millisecond)
+		if value, err := kvDb.Inc("expiredCounter", 1, true); err != nil || fmt.Sprint(value) != "1" {
+			t.Fatalf("Inc expired:%v err:%v", value, err)
+		}
+	})
+}
@@ -0,0 +1,55 @@
+package examples
+
+import (
+	"errors"
+	"github.com/fish-tennis/gentity"
+	"github.com/fish-tennis/gentity/examples/pb"
+	"testing"
+)
+
+// 有容量限制的列表,如离线玩家的邮件
+func testEntityList(t *testing.T, entityDb gentity.EntityDb) {
+	player1 := newTestPlayer(1, 100)
+	entityDb.InsertEntity(player1.Id, getNewPlayerSaveData(player1))
+	for i := int32(1); i <= 5; i++ {
+		if err := entityDb.PushToList(player1.Id, "Mails", &pb.QuestData{CfgId: i}, 3); err != nil {
+			t.Fatalf("PushToList err:%v", err)
+		}
+	}
+	err := entityDb.PushToList(int64(2), "Mails", &pb.QuestData{CfgId: 1}, 3)
+	if !errors.Is(err, gentity.ErrEntityNotExists) {
+		t.Fatalf("PushToList not exists err:%v", err)
+	}
+	var mails []*pb.QuestData
+	if err = entityDb.RangeList(player1.Id, "Mails", 0, 0, &mails); err != nil || len(mails) != 3 || mails[0].CfgId != 3 {
+		t.Fatalf("RangeList %v err:%v", mails, err)
+	}
+	mails = nil
+	if err = entityDb.RangeList(player1.Id, "Mails", -1, 0, &mails); err != nil || len(mails) != 1 || mails[0].CfgId != 5 {
+		t.Fatalf("RangeList last %v err:%v", mails, err)
+	}
+	if err = entityDb.RemoveFromList(player1.Id, "Mails", &pb.QuestData{CfgId: 4}); err != nil {
+		t.Fatalf("RemoveFromList err:%v", err)
+	}
+	mails = nil
+	if err = entityDb.PopList(player1.Id, "Mails", 1, &mails); err != nil || len(mails) != 1 || mails[0].CfgId != 3 {
+		t.Fatalf("PopList %v err:%v", mails, err)
+	}
+	mails = nil
+	if err = entityDb.PopList(player1.Id, "Mails", 0, &mails); err != nil || len(mails) != 1 || mails[0].CfgId != 5 {
+		t.Fatalf("PopList all %v err:%v", mails, err)
+	}
+	mails = nil
+	if err = entityDb.RangeList(player1.Id, "Mails", 0, 0, &mails); err != nil || len(mails) != 0 {
+		t.Fatalf("RangeList after pop %v err:%v", mails, err)
+	}
+	// 列表字段不影响实体数据的加载
+	loadData := &pb.PlayerData{}
+	if exists, err := entityDb.FindEntityById(player1.Id, loadData); err != nil || !exists {
+		t.Fatalf("FindEntityById exists:%v err:%v", exists, err)
+	}
+}
+
+func TestEntityList(t *testing.T) {
+	runEntityDbTests(t, _allTestBackends, "listtest", testEntityList)
+}
@@ -0,0 +1,165 @@
+package examples
+
+import (
+	"github.com/fish-tennis/gentity"
+	"github.com/fish-tennis/gentity/examples/pb"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// 记录SaveComponents的参数
+type saveRecordEntityDb struct {
+	gentity.EntityDb
+	saved []map[string]interface{}
+	// 模拟不支持增量保存的EntityDb
+	disableIncremental bool
+}
+
+func (this *saveRecordEntityDb) SupportIncrementalSave() bool {
+	incrementalDb, ok := this.EntityDb.(gentity.IncrementalEntityDb)
+	return !this.disableIncremental && ok && incrementalDb.SupportIncrementalSave()
+}
+
+func (this *saveRecordEntityDb) SaveComponents(entityKey interface{}, components map[string]interface{}) error {
+	this.saved = append(this.saved, components)
+	return this.EntityDb.SaveComponents(entityKey, components)
+}
+
+// 最后一次保存的字段路径,只返回prefix开头的
+func (this *saveRecordEntityDb) lastSavedKeys(prefix string) []string {
+	var keys []string
+	for k := range this.saved[len(this.saved)-1] {
+		if strings.HasPrefix(k, prefix) {
+			keys = append(keys, k)
+		}
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+func loadTestPlayer(t *testing.T, entityDb gentity.EntityDb, playerId int64) *Player {
+	loadData := &pb.PlayerData{}
+	exists, err := entityDb.FindEntityById(playerId, loadData)
+	if err != nil || !exists {
+		t.Fatalf("FindEntityById %v exists:%v err:%v", playerId, exists, err)
+	}
+	// bson解码时_id不会填充到XId
+	loadData.XId = playerId
+	return newTestPlayerFromData(loadData)
+}
+
+// map数据的数据库增量保存
+func testMapIncrementalSave(t *testing.T, entityDb gentity.EntityDb) {
+	recordDb := &saveRecordEntityDb{EntityDb: entityDb}
+	player := newTestPlayer(1, 100)
+	entityDb.InsertEntity(player.Id, getNewPlayerSaveData(player))
+	quests := player.GetQuest().Quests
+	quests.Set(1, &pb.QuestData{CfgId: 1})
+	quests.Set(2, &pb.QuestData{CfgId: 2})
+	player.GetBag().BagCountItem.Set(1001, 5)
+	if err := gentity.SaveEntityChangedDataToDb(recordDb, player, nil, false, "p"); err != nil {
+		t.Fatalf("SaveEntityChangedDataToDb err:%v", err)
+	}
+	// 第一次保存整体数据
+	if keys := recordDb.lastSavedKeys(""); !slices.Equal(keys, []string{"Bag.CountItem", "Quest.Quests"}) {
+		t.Fatalf("first save keys:%v", keys)
+	}
+
+	quests.Set(3, &pb.QuestData{CfgId: 3, Progress: 1})
+	quests.Delete(1)
+	player.GetBag().BagCountItem.Set(1002, 6)
+	if err := gentity.SaveEntityChangedDataToDb(recordDb, player, nil, false, "p"); err != nil {
+		t.Fatalf("SaveEntityChangedDataToDb err:%v", err)
+	}
+	if keys := recordDb.lastSavedKeys(""); !slices.Equal(keys, []string{"Bag.CountItem.1002", "Quest.Quests.1", "Quest.Quests.3"}) {
+		t.Fatalf("incremental save keys:%v", keys)
+	}
+	if recordDb.saved[1]["Quest.Quests.1"] != gentity.UnsetComponentField {
+		t.Fatalf("deleted key not unset:%v", recordDb.saved[1]["Quest.Quests.1"])
+	}
+
+	// 从数据库加载的map,之后的修改直接增量保存
+	loadPlayer := loadTestPlayer(t, entityDb, player.Id)
+	loadQuests := loadPlayer.GetQuest().Quests
+	if len(loadQuests.Data) != 2 || loadQuests.Data[3].GetProgress() != 1 || loadQuests.Contains(1) {
+		t.Fatalf("load quests:%v", loadQuests.Data)
+	}
+	if countItem := loadPlayer.GetBag().BagCountItem.Data; len(countItem) != 2 || countItem[1002] != 6 {
+		t.Fatalf("load countItem:%v", countItem)
+	}
+	loadQuests.Delete(2)
+	if err := gentity.SaveEntityChangedDataToDb(recordDb, loadPlayer, nil, false, "p"); err != nil {
+		t.Fatalf("SaveEntityChangedDataToDb err:%v", err)
+	}
+	if keys := recordDb.lastSavedKeys("Quest"); !slices.Equal(keys, []string{"Quest.Quests.2"}) {
+		t.Fatalf("loaded save keys:%v", keys)
+	}
+	loadQuests = loadTestPlayer(t, entityDb, player.Id).GetQuest().Quests
+	if len(loadQuests.Data) != 1 || !loadQuests.Contains(3) {
+		t.Fatalf("load quests after delete:%v", loadQuests.Data)
+	}
+}
+
+// EntityDb不支持增量保存时,map保存整体数据
+func TestMemMapSaveWithoutIncrementalDb(t *testing.T) {
+	memDb := gentity.NewMemDb()
+	playerDb := memDb.RegisterPlayerDb(_collectionName, "_id", "AccountId", "RegionId")
+	recordDb := &saveRecordEntityDb{EntityDb: playerDb, disableIncremental: true}
+	player := newTestPlayer(1, 100)
+	playerDb.InsertEntity(player.Id, getNewPlayerSaveData(player))
+	quests := player.GetQuest().Quests
+	quests.Set(1, &pb.QuestData{CfgId: 1})
+	gentity.SaveEntityChangedDataToDb(recordDb, player, nil, false, "p")
+	quests.Set(2, &pb.QuestData{CfgId: 2})
+	quests.Delete(1)
+	if err := gentity.SaveEntityChangedDataToDb(recordDb, player, nil, false, "p"); err != nil {
+		t.Fatalf("SaveEntityChangedDataToDb err:%v", err)
+	}
+	if keys := recordDb.lastSavedKeys("Quest"); !slices.Equal(keys, []string{"Quest.Quests"}) {
+		t.Fatalf("save keys:%v", keys)
+	}
+	loadQuests := loadTestPlayer(t, playerDb, player.Id).GetQuest().Quests
+	if len(loadQuests.Data) != 1 || !loadQuests.Contains(2) {
+		t.Fatalf("load quests:%v", loadQuests.Data)
+	}
+}
+
+// 保存过nil map之后,数据库里是null,不能增量保存
+func TestMemMapSaveAfterNilMap(t *testing.T) {
+	memDb := gentity.NewMemDb()
+	playerDb := memDb.RegisterPlayerDb(_collectionName, "_id", "AccountId", "RegionId")
+	recordDb := &saveRecordEntityDb{EntityDb: playerDb}
+	player := newTestPlayer(1, 100)
+	playerDb.InsertEntity(player.Id, getNewPlayerSaveData(player))
+	quests := player.GetQuest().Quests
+	quests.Data = nil
+	quests.SetDirty(1, false)
+	if err := gentity.SaveEntityChangedDataToDb(recordDb, player, nil, false, "p"); err != nil {
+		t.Fatalf("SaveEntityChangedDataToDb err:%v", err)
+	}
+	quests.Init()
+	quests.Set(2, &pb.QuestData{CfgId: 2})
+	if err := gentity.SaveEntityChangedDataToDb(recordDb, player, nil, false, "p"); err != nil {
+		t.Fatalf("SaveEntityChangedDataToDb err:%v", err)
+	}
+	if keys := recordDb.lastSavedKeys("Quest"); !slices.Equal(keys, []string{"Quest.Quests"}) {
+		t.Fatalf("save keys:%v", keys)
+	}
+	// 保存了整体数据之后,可以增量保存
+	quests.Set(3, &pb.QuestData{CfgId: 3})
+	if err := gentity.SaveEntityChangedDataToDb(recordDb, player, nil, false, "p"); err != nil {
+		t.Fatalf("SaveEntityChangedDataToDb err:%v", err)
+	}
+	if keys := recordDb.lastSavedKeys("Quest"); !slices.Equal(keys, []string{"Quest.Quests.3"}) {
+		t.Fatalf("incremental save keys:%v", keys)
+	}
+	loadQuests := loadTestPlayer(t, playerDb, player.Id).GetQuest().Quests
+	if len(loadQuests.Data) != 2 || !loadQuests.Contains(2) || !loadQuests.Contains(3) {
+		t.Fatalf("load quests:%v", loadQuests.Data)
+	}
+}
+
+func TestMapIncrementalSave(t *testing.T) {
+	runEntityDbTests(t, _allTestBackends, "maptest", testMapIncrementalSave)
+}
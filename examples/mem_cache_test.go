@@ -0,0 +1,228 @@
+package examples
+
+import (
+	"errors"
+	"github.com/fish-tennis/gentity"
+	"github.com/fish-tennis/gentity/examples/pb"
+	"testing"
+	"time"
+)
+
+// 内存缓存测试,无需部署redis
+func TestMemCache(t *testing.T) {
+	kvCache := gentity.NewMemCache()
+	now := time.Now()
+	kvCache.SetNowFunc(func() time.Time {
+		return now
+	})
+
+	kvCache.Set("str", 123, time.Second)
+	if typ, _ := kvCache.Type("str"); typ != "string" {
+		t.Fatalf("Type:%v", typ)
+	}
+	if str, _ := kvCache.Get("str"); str != "123" {
+		t.Fatalf("Get:%v", str)
+	}
+	if ok, _ := kvCache.SetNX("str", 456, 0); ok {
+		t.Fatal("SetNX exists key")
+	}
+	if _, err := kvCache.HSet("str", "k", "v"); err == nil {
+		t.Fatal("HSet on string key should fail")
+	}
+	now = now.Add(time.Second)
+	if typ, _ := kvCache.Type("str"); typ != "none" {
+		t.Fatalf("expired Type:%v", typ)
+	}
+	if ok, _ := kvCache.SetNX("str", 456, 0); !ok {
+		t.Fatal("SetNX expired key")
+	}
+
+	protoData := &pb.QuestData{CfgId: 1, Progress: 2}
+	kvCache.Set("proto", protoData, 0)
+	loadProto := &pb.QuestData{}
+	if err := kvCache.GetProto("proto", loadProto); err != nil || loadProto.Progress != 2 {
+		t.Fatalf("GetProto %v err:%v", loadProto, err)
+	}
+
+	kvCache.SetMap("hash", map[int32]*pb.QuestData{1: {CfgId: 1, Progress: 10}, 2: {CfgId: 2, Progress: 20}})
+	if typ, _ := kvCache.Type("hash"); typ != "hash" {
+		t.Fatalf("Type:%v", typ)
+	}
+	loadMap := make(map[int32]*pb.QuestData)
+	if err := kvCache.GetMap("hash", loadMap); err != nil || loadMap[2].GetProgress() != 20 {
+		t.Fatalf("GetMap %v err:%v", loadMap, err)
+	}
+	if ok, _ := kvCache.HSetNX("hash", "1", "v"); ok {
+		t.Fatal("HSetNX exists field")
+	}
+	if delCount, _ := kvCache.HDel("hash", "1", "2", "3"); delCount != 2 {
+		t.Fatalf("HDel count:%v", delCount)
+	}
+	// hash为空时,key也会被删除
+	if typ, _ := kvCache.Type("hash"); typ != "none" {
+		t.Fatalf("empty hash Type:%v", typ)
+	}
+}
+
+// 内存数据库+内存缓存,测试完整的缓存保存和修复流程
+func TestMemFixDataFromCache(t *testing.T) {
+	gentity.SetLogLevel(gentity.DebugLevel)
+	memDb := gentity.NewMemDb()
+	playerDb := memDb.RegisterPlayerDb(_collectionName, "_id", "AccountId", "RegionId")
+	kvCache := gentity.NewMemCache()
+
+	player1 := newTestPlayer(1, 1)
+	playerDb.InsertEntity(player1.Id, getNewPlayerSaveData(player1))
+
+	player1.GetBaseInfo().AddExp(123)
+	player1.SaveCache(kvCache)
+	quest := player1.GetQuest()
+	quest.AddFinishId(1)
+	quest.Quests.Set(2, &pb.QuestData{CfgId: 2, Progress: 5})
+	player1.SaveCache(kvCache)
+	// 增量更新
+	quest.Quests.Set(3, &pb.QuestData{CfgId: 3, Progress: 6})
+	quest.Quests.Delete(2)
+	player1.SaveCache(kvCache)
+	interfaceMap := player1.GetInterfaceMap()
+	if len(interfaceMap.InterfaceMap.Data) == 0 {
+		interfaceMap.makeTestData()
+	}
+	interfaceMap.InterfaceMap.Data["mapItem1"].(*mapItem1).addExp(10)
+	player1.SaveCache(kvCache)
+	array := player1.GetArray()
+	for i := 0; i < len(array.Array); i++ {
+		array.Array[i] = int32(i) + 1
+	}
+	array.SetDirty()
+	player1.GetSlice().Add(&pb.QuestData{CfgId: 4, Progress: 7})
+	player1.GetStruct().Set(11, 12)
+	player1.GetBag().BagCountItem.AddItem(1, 10)
+	player1.GetBag().BagUniqueItem.AddUniqueItem(&pb.UniqueItem{UniqueId: 1001, CfgId: 1})
+	player1.GetBag().TestUniqueItem.Add(&pb.UniqueItem{UniqueId: 2001, CfgId: 2})
+	player1.SaveCache(kvCache)
+
+	// player1的修改数据只保存到了缓存,模拟服务器crash后,从缓存修复数据
+	fixPlayer := newTestPlayer(1, 1)
+	gentity.FixEntityDataFromCache(fixPlayer, playerDb, kvCache, "p", fixPlayer.GetId())
+
+	loadData := &pb.PlayerData{}
+	playerDb.FindEntityById(player1.Id, loadData)
+	loadPlayer := newTestPlayerFromData(loadData)
+	if loadPlayer.GetBaseInfo().BaseInfo.Exp != 123 {
+		t.Fatalf("BaseInfo:%v", loadPlayer.GetBaseInfo().BaseInfo)
+	}
+	quests := loadPlayer.GetQuest().Quests.Data
+	if len(quests) != 1 || quests[3].GetProgress() != 6 || len(loadPlayer.GetQuest().Finished.Data) != 1 {
+		t.Fatalf("Quest:%v %v", loadPlayer.GetQuest().Finished.Data, quests)
+	}
+	if loadPlayer.GetInterfaceMap().InterfaceMap.Data["mapItem1"].(*mapItem1).Data.Exp != 178 {
+		t.Fatalf("InterfaceMap:%v", loadPlayer.GetInterfaceMap().InterfaceMap)
+	}
+	if loadPlayer.GetArray().Array[1] != 2 {
+		t.Fatalf("Array:%v", loadPlayer.GetArray().Array)
+	}
+	if len(loadPlayer.GetSlice().Data) != 1 || loadPlayer.GetStruct().Data.Progress != 12 {
+		t.Fatalf("Slice:%v Struct:%v", loadPlayer.GetSlice().Data, &loadPlayer.GetStruct().Data)
+	}
+	bag := loadPlayer.GetBag()
+	if bag.BagCountItem.Data[1] != 10 || bag.BagUniqueItem.Data[1001] == nil || len(bag.TestUniqueItem.Data) != 1 {
+		t.Fatalf("Bag:%v %v %v", bag.BagCountItem.Data, bag.BagUniqueItem.Data, bag.TestUniqueItem.Data)
+	}
+	// 修复完成后,缓存会被删除
+	if typ, _ := kvCache.Type(gentity.GetEntityComponentCacheKey("p", player1.Id, "BaseInfo")); typ != "none" {
+		t.Fatalf("cache not removed:%v", typ)
+	}
+}
+
+// 批量提交失败的缓存
+type failedBatchCache struct {
+	*gentity.MemCache
+}
+
+func (this *failedBatchCache) Batch(f func(batchCache gentity.KvCache)) error {
+	f(gentity.NewMemCache())
+	return errors.New("batch failed")
+}
+
+// 批量提交失败时,保留脏标记,下次重新保存
+func TestMemBatchSaveCache(t *testing.T) {
+	kvCache := gentity.NewMemCache()
+	player1 := newTestPlayer(1, 1)
+	player1.GetBaseInfo().AddExp(123)
+	player1.GetQuest().Quests.Set(2, &pb.QuestData{CfgId: 2, Progress: 5})
+	if err := player1.SaveCache(&failedBatchCache{MemCache: kvCache}); err == nil {
+		t.Fatal("SaveCache should fail")
+	}
+	if !player1.GetBaseInfo().IsDirty() || !player1.GetQuest().Quests.IsDirty() {
+		t.Fatal("dirty mark reset after failed batch")
+	}
+	if err := player1.SaveCache(kvCache); err != nil {
+		t.Fatalf("SaveCache err:%v", err)
+	}
+	if player1.GetBaseInfo().IsDirty() || player1.GetQuest().Quests.IsDirty() || !player1.GetQuest().Quests.HasCached() {
+		t.Fatal("dirty mark not reset after batch")
+	}
+	baseInfo := &pb.BaseInfo{}
+	kvCache.GetProto("p.{1}.BaseInfo", baseInfo)
+	if baseInfo.Exp != 123 {
+		t.Fatalf("BaseInfo:%v", baseInfo)
+	}
+	quests := make(map[int32]*pb.QuestData)
+	kvCache.GetMap("p.{1}.Quest.Quests", quests)
+	if quests[2].GetProgress() != 5 {
+		t.Fatalf("Quests:%v", quests)
+	}
+}
+
+// 排行榜和最近记录列表
+func TestMemCacheZSetAndList(t *testing.T) {
+	kvCache := gentity.NewMemCache()
+	kvCache.ZAdd("rank", gentity.ZMember{Score: 10, Member: int64(1)}, gentity.ZMember{Score: 30, Member: int64(2)})
+	kvCache.ZAdd("rank", gentity.ZMember{Score: 20, Member: int64(3)})
+	score, err := kvCache.ZIncrBy("rank", 25, int64(1))
+	if err != nil || score != 35 {
+		t.Fatalf("ZIncrBy %v err:%v", score, err)
+	}
+	members, err := kvCache.ZRevRangeWithScores("rank", 0, 1)
+	if err != nil || len(members) != 2 || members[0].Member != "1" || members[1].Member != "2" || members[1].Score != 30 {
+		t.Fatalf("ZRevRangeWithScores %v err:%v", members, err)
+	}
+	if rank, _ := kvCache.ZRank("rank", int64(3)); rank != 0 {
+		t.Fatalf("ZRank:%v", rank)
+	}
+	if rank, _ := kvCache.ZRank("rank", int64(4)); rank != -1 {
+		t.Fatalf("ZRank not exists:%v", rank)
+	}
+	kvCache.ZRem("rank", int64(1), int64(2), int64(3))
+	if typ, _ := kvCache.Type("rank"); typ != "none" {
+		t.Fatalf("empty zset Type:%v", typ)
+	}
+	// proto作为member
+	kvCache.ZAdd("protoRank", gentity.ZMember{Score: 1, Member: &pb.BaseInfo{Level: 1, LongFieldNameTest: "a"}})
+	kvCache.ZIncrBy("protoRank", 1, &pb.BaseInfo{Level: 1, LongFieldNameTest: "a"})
+	members, _ = kvCache.ZRevRangeWithScores("protoRank", 0, -1)
+	baseInfo := &pb.BaseInfo{}
+	if len(members) != 1 || members[0].Score != 2 || members[0].GetProto(baseInfo) != nil || baseInfo.LongFieldNameTest != "a" {
+		t.Fatalf("protoRank:%v %v", members, baseInfo)
+	}
+
+	// 只保留最近的3条记录
+	for i := int32(1); i <= 5; i++ {
+		kvCache.LPush("recent", &pb.QuestData{CfgId: i})
+		kvCache.LTrim("recent", 0, 2)
+	}
+	values, err := kvCache.LRange("recent", 0, -1)
+	if err != nil {
+		t.Fatalf("LRange err:%v", err)
+	}
+	recent, err := gentity.ParseProtoList(values, func() *pb.QuestData {
+		return new(pb.QuestData)
+	})
+	if err != nil || len(recent) != 3 || recent[0].CfgId != 5 || recent[2].CfgId != 3 {
+		t.Fatalf("recent:%v err:%v", recent, err)
+	}
+	if _, err = kvCache.HGetAll("recent"); err == nil {
+		t.Fatal("HGetAll on list should fail")
+	}
+}
@@ -0,0 +1,152 @@
+package examples
+
+import (
+	"github.com/fish-tennis/gentity"
+	"github.com/fish-tennis/gentity/examples/pb"
+	"sync"
+	"testing"
+)
+
+// 内存数据库测试,无需部署mongodb
+func TestMemPlayerDb(t *testing.T) {
+	gentity.SetLogLevel(gentity.DebugLevel)
+	memDb := gentity.NewMemDb()
+	playerDb := memDb.RegisterPlayerDb(_collectionName, "_id", "AccountId", "RegionId")
+
+	player1 := newTestPlayer(1, 100)
+	err, isDuplicateKey := playerDb.InsertEntity(player1.Id, getNewPlayerSaveData(player1))
+	if err != nil {
+		t.Fatalf("InsertEntity err:%v", err)
+	}
+	err, isDuplicateKey = playerDb.InsertEntity(player1.Id, getNewPlayerSaveData(player1))
+	if !isDuplicateKey || !gentity.IsDuplicateKeyError(err) {
+		t.Fatalf("InsertEntity duplicate err:%v isDuplicateKey:%v", err, isDuplicateKey)
+	}
+	player2 := newTestPlayer(2, 100)
+	playerDb.InsertEntity(player2.Id, getNewPlayerSaveData(player2))
+
+	findPlayerId, err := playerDb.FindPlayerIdByAccountId(100, 1)
+	if err != nil || findPlayerId != 1 {
+		t.Fatalf("FindPlayerIdByAccountId %v err:%v", findPlayerId, err)
+	}
+	findPlayerIds, err := playerDb.FindPlayerIdsByAccountId(100, 1)
+	if err != nil || len(findPlayerIds) != 2 {
+		t.Fatalf("FindPlayerIdsByAccountId %v err:%v", findPlayerIds, err)
+	}
+	accountId, err := playerDb.FindAccountIdByPlayerId(2)
+	if err != nil || accountId != 100 {
+		t.Fatalf("FindAccountIdByPlayerId %v err:%v", accountId, err)
+	}
+	accountPlayerData := &pb.PlayerData{}
+	exists, err := playerDb.FindPlayerByAccountId(100, 1, accountPlayerData)
+	if err != nil || !exists || accountPlayerData.Name != "player1" {
+		t.Fatalf("FindPlayerByAccountId %v err:%v", accountPlayerData, err)
+	}
+
+	player1.GetBaseInfo().AddExp(123)
+	player1.GetQuest().AddFinishId(1)
+	player1.GetQuest().Quests.Set(2, &pb.QuestData{CfgId: 2, Progress: 5})
+	player1.GetBag().BagCountItem.AddItem(1, 10)
+	player1.GetBag().BagUniqueItem.AddUniqueItem(&pb.UniqueItem{UniqueId: 1001, CfgId: 1})
+	player1.GetStruct().Set(11, 12)
+	err = gentity.SaveEntityChangedDataToDb(playerDb, player1, nil, false, "p")
+	if err != nil {
+		t.Fatalf("SaveEntityChangedDataToDb err:%v", err)
+	}
+
+	loadData := &pb.PlayerData{}
+	exists, err = playerDb.FindEntityById(player1.Id, loadData)
+	if err != nil || !exists {
+		t.Fatalf("FindEntityById exists:%v err:%v", exists, err)
+	}
+	loadPlayer := newTestPlayerFromData(loadData)
+	if loadPlayer.GetBaseInfo().BaseInfo.Exp != 123 {
+		t.Fatalf("BaseInfo:%v", loadPlayer.GetBaseInfo().BaseInfo)
+	}
+	if len(loadPlayer.GetQuest().Finished.Data) != 1 || loadPlayer.GetQuest().Quests.Data[2].GetProgress() != 5 {
+		t.Fatalf("Quest:%v %v", loadPlayer.GetQuest().Finished.Data, loadPlayer.GetQuest().Quests.Data)
+	}
+	if loadPlayer.GetBag().BagCountItem.Data[1] != 10 || loadPlayer.GetBag().BagUniqueItem.Data[1001].GetCfgId() != 1 {
+		t.Fatalf("Bag:%v %v", loadPlayer.GetBag().BagCountItem.Data, loadPlayer.GetBag().BagUniqueItem.Data)
+	}
+	if loadPlayer.GetStruct().Data.CfgId != 11 {
+		t.Fatalf("Struct:%v", &loadPlayer.GetStruct().Data)
+	}
+
+	// componentName.fieldName
+	err = playerDb.SaveComponentField(player1.Id, "Bag", "CountItem", map[int32]int32{1: 20, 2: 30})
+	if err != nil {
+		t.Fatalf("SaveComponentField err:%v", err)
+	}
+	err = playerDb.DeleteComponentField(player1.Id, "Quest", "Quests")
+	if err != nil {
+		t.Fatalf("DeleteComponentField err:%v", err)
+	}
+	loadData = &pb.PlayerData{}
+	playerDb.FindEntityById(player1.Id, loadData)
+	if loadData.Bag.CountItem[2] != 30 || len(loadData.Quest.Quests) != 0 || len(loadData.Quest.Finished) != 1 {
+		t.Fatalf("loadData:%v", loadData)
+	}
+	// 和mongodb一样,不能在非文档类型的字段下创建字段
+	err = playerDb.SaveComponentField(player1.Id, "Struct", "CfgId", 1)
+	if err == nil {
+		t.Fatal("SaveComponentField on binary field should fail")
+	}
+
+	playerDb.DeleteEntity(int32(1))
+	exists, _ = playerDb.FindEntityById(int64(1), &pb.PlayerData{})
+	if exists {
+		t.Fatal("DeleteEntity failed")
+	}
+}
+
+func TestMemKvDb(t *testing.T) {
+	memDb := gentity.NewMemDb()
+	kvDb := memDb.RegisterKvDb("kv", "k", "v")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := kvDb.Inc("id", 1, true)
+			if err != nil {
+				t.Logf("%v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	id, err := kvDb.Find("id")
+	if err != nil || id != int32(10) {
+		t.Fatalf("Inc result:%v err:%v", id, err)
+	}
+	_, err = kvDb.Inc("notExists", 1, false)
+	if err == nil {
+		t.Fatal("Inc without upsert should fail")
+	}
+
+	protoData := &pb.BaseInfo{
+		Gender: 1,
+		Level:  10,
+		Exp:    123,
+	}
+	kvDb.Update("proto_data", protoData, true)
+	protoDecodeData := new(pb.BaseInfo)
+	err = kvDb.FindAndDecode("proto_data", protoDecodeData)
+	if err != nil || protoDecodeData.Exp != 123 {
+		t.Fatalf("FindAndDecode %v err:%v", protoDecodeData, err)
+	}
+	err, _ = kvDb.Insert("temp", "temp value")
+	if err != nil {
+		t.Fatalf("Insert err:%v", err)
+	}
+	err, isDuplicateKey := kvDb.Insert("temp", "temp value")
+	if !isDuplicateKey {
+		t.Fatalf("Insert duplicate err:%v", err)
+	}
+	kvDb.Delete("temp")
+	temp, err := kvDb.Find("temp")
+	if temp != nil || err != nil {
+		t.Fatalf("Delete failed %v %v", temp, err)
+	}
+}
@@ -0,0 +1,148 @@
+package examples
+
+import (
+	"context"
+	"errors"
+	"github.com/fish-tennis/gentity"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// 没有连接时,直接返回ErrNotConnected
+func TestMongoHealthNotConnected(t *testing.T) {
+	mongoDb := gentity.NewMongoDb("mongodb://127.0.0.1:1/?serverSelectionTimeoutMS=100", _mongoDbName)
+	playerDb := mongoDb.RegisterPlayerDb("healthtest", false, "_id", "AccountId", "RegionId")
+	kvDb := mongoDb.RegisterKvDb("healthkv", false, "k", "v")
+	if _, err := playerDb.FindEntityById(1, &struct{}{}); !errors.Is(err, gentity.ErrNotConnected) {
+		t.Fatalf("FindEntityById err:%v", err)
+	}
+	if _, err := kvDb.Find("k"); !errors.Is(err, gentity.ErrNotConnected) {
+		t.Fatalf("Find err:%v", err)
+	}
+
+	var lock sync.Mutex
+	var states []gentity.MongoConnState
+	mongoDb.AddConnStateCallback(func(state gentity.MongoConnState) {
+		lock.Lock()
+		defer lock.Unlock()
+		states = append(states, state)
+	})
+	healthOptions := mongoDb.GetHealthOptions()
+	healthOptions.PingInterval = 50 * time.Millisecond
+	healthOptions.PingTimeout = 50 * time.Millisecond
+	healthOptions.MinBackoff = 10 * time.Millisecond
+	healthOptions.MaxBackoff = 40 * time.Millisecond
+	// 开启健康检查时,连接失败会在后台重试
+	if mongoDb.Connect() {
+		t.Fatal("Connect should fail")
+	}
+	if mongoDb.IsHealthy() || mongoDb.GetConnState() != gentity.MongoConnUnhealthy {
+		t.Fatalf("state:%v", mongoDb.GetConnState())
+	}
+	if err := playerDb.SaveComponent(1, "BaseInfo", nil); !errors.Is(err, gentity.ErrNotConnected) {
+		t.Fatalf("SaveComponent err:%v", err)
+	}
+	time.Sleep(300 * time.Millisecond)
+	mongoDb.Disconnect()
+	if mongoDb.GetConnState() != gentity.MongoConnDisconnected {
+		t.Fatalf("state:%v", mongoDb.GetConnState())
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if len(states) != 2 || states[0] != gentity.MongoConnUnhealthy || states[1] != gentity.MongoConnDisconnected {
+		t.Fatalf("states:%v", states)
+	}
+}
+
+// 用自定义的Ping模拟连接断开和恢复,无需部署mongodb
+func TestMongoHealthRecover(t *testing.T) {
+	mongoDb := gentity.NewMongoDb("mongodb://127.0.0.1:1/?serverSelectionTimeoutMS=100", _mongoDbName)
+	kvDb := mongoDb.RegisterKvDb("healthkv", false, "k", "v")
+	var lock sync.Mutex
+	var states []gentity.MongoConnState
+	mongoDb.AddConnStateCallback(func(state gentity.MongoConnState) {
+		lock.Lock()
+		defer lock.Unlock()
+		states = append(states, state)
+	})
+	var down atomic.Bool
+	healthOptions := mongoDb.GetHealthOptions()
+	healthOptions.PingInterval = 20 * time.Millisecond
+	healthOptions.FailureThreshold = 1
+	healthOptions.MinBackoff = 10 * time.Millisecond
+	healthOptions.MaxBackoff = 10 * time.Second
+	healthOptions.FastRetries = 100
+	healthOptions.Ping = func(ctx context.Context) error {
+		if down.Load() {
+			return errors.New("ping failed")
+		}
+		return nil
+	}
+	waitState := func(state gentity.MongoConnState, timeout time.Duration) {
+		t.Helper()
+		for deadline := time.Now().Add(timeout); mongoDb.GetConnState() != state; {
+			if time.Now().After(deadline) {
+				t.Fatalf("wait %v timeout, state:%v", state, mongoDb.GetConnState())
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	// Connect时没有连上,健康检查成功之后恢复
+	mongoDb.Connect()
+	waitState(gentity.MongoConnHealthy, time.Second)
+
+	down.Store(true)
+	waitState(gentity.MongoConnUnhealthy, time.Second)
+	if _, err := kvDb.Find("k"); !errors.Is(err, gentity.ErrNotConnected) {
+		t.Fatalf("Find err:%v", err)
+	}
+	// 不健康时先快速重试,恢复之后很快就能检测到
+	time.Sleep(150 * time.Millisecond)
+	down.Store(false)
+	waitState(gentity.MongoConnHealthy, 100*time.Millisecond)
+
+	mongoDb.Disconnect()
+	lock.Lock()
+	defer lock.Unlock()
+	expectStates := []gentity.MongoConnState{gentity.MongoConnUnhealthy, gentity.MongoConnHealthy,
+		gentity.MongoConnUnhealthy, gentity.MongoConnHealthy, gentity.MongoConnDisconnected}
+	if len(states) != len(expectStates) {
+		t.Fatalf("states:%v", states)
+	}
+	for i, state := range expectStates {
+		if states[i] != state {
+			t.Fatalf("states:%v", states)
+		}
+	}
+}
+
+func TestMongoHealthCheck(t *testing.T) {
+	skipIfMongoUnavailable(t)
+	mongoDb := gentity.NewMongoDb(_mongoUri, _mongoDbName)
+	kvDb := mongoDb.RegisterKvDb("healthkv", false, "k", "v")
+	mongoDb.GetHealthOptions().PingInterval = 100 * time.Millisecond
+	if !mongoDb.Connect() {
+		t.Fatal("connect db error")
+	}
+	if !mongoDb.IsHealthy() {
+		t.Fatalf("state:%v", mongoDb.GetConnState())
+	}
+	time.Sleep(300 * time.Millisecond)
+	if _, err := kvDb.Find("k"); err != nil {
+		t.Fatalf("Find err:%v", err)
+	}
+	mongoDb.Disconnect()
+	if _, err := kvDb.Find("k"); !errors.Is(err, gentity.ErrNotConnected) {
+		t.Fatalf("Find after Disconnect err:%v", err)
+	}
+	// Disconnect之后可以再次Connect
+	if !mongoDb.Connect() {
+		t.Fatal("reconnect db error")
+	}
+	defer mongoDb.Disconnect()
+	if _, err := kvDb.Find("k"); err != nil {
+		t.Fatalf("Find after reconnect err:%v", err)
+	}
+}
@@ -10,6 +10,7 @@ import (
 
 // mongo实现的自增id方式
 func TestIncrementId(t *testing.T) {
+	skipIfMongoUnavailable(t)
 	mongoDb := gentity.NewMongoDb(_mongoUri, _mongoDbName)
 	kvDb := mongoDb.RegisterKvDb("kv", false, "k", "v")
 	if !mongoDb.Connect() {
@@ -35,6 +36,7 @@ func TestIncrementId(t *testing.T) {
 }
 
 func TestKvDb(t *testing.T) {
+	skipIfMongoUnavailable(t)
 	mongoDb := gentity.NewMongoDb(_mongoUri, _mongoDbName)
 	kvDb := mongoDb.RegisterKvDb("kv", false, "k", "v")
 	if !mongoDb.Connect() {
@@ -70,6 +72,7 @@ func TestKvDb(t *testing.T) {
 // 设置分片
 // 只对集群模式的mongodb有效
 func TestShard(t *testing.T) {
+	skipIfMongoUnavailable(t)
 	mongoDb := gentity.NewMongoDb(_mongoUri, _mongoDbName)
 	playerDb := mongoDb.RegisterPlayerDb("player", true, "_id", "AccountId", "RegionId")
 	if !mongoDb.Connect() {
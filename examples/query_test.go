@@ -0,0 +1,93 @@
+package examples
+
+import (
+	"errors"
+	"github.com/fish-tennis/gentity"
+	"github.com/fish-tennis/gentity/examples/pb"
+	"testing"
+	"time"
+)
+
+func getQueryPlayerNames(t *testing.T, entityDb gentity.EntityDb, query *gentity.Query) ([]string, *gentity.QueryResult) {
+	result, err := entityDb.FindEntities(query, func() interface{} {
+		return &pb.PlayerData{}
+	})
+	if err != nil {
+		t.Fatalf("FindEntities err:%v", err)
+	}
+	var playerNames []string
+	for _, data := range result.Datas {
+		playerNames = append(playerNames, data.(*pb.PlayerData).Name)
+	}
+	return playerNames, result
+}
+
+func checkQueryPlayerNames(t *testing.T, playerNames []string, expected ...string) {
+	if len(playerNames) != len(expected) {
+		t.Fatalf("playerNames:%v expected:%v", playerNames, expected)
+	}
+	for i, playerName := range playerNames {
+		if playerName != expected[i] {
+			t.Fatalf("playerNames:%v expected:%v", playerNames, expected)
+		}
+	}
+}
+
+// 条件查询和分页,如排行榜,后台管理工具
+func testFindEntities(t *testing.T, entityDb gentity.EntityDb) {
+	for i := int64(1); i <= 5; i++ {
+		player := newTestPlayer(i, 100+i%2)
+		player.GetBaseInfo().AddExp(int32(i * 10))
+		entityDb.InsertEntity(player.Id, getNewPlayerSaveData(player))
+	}
+
+	// 游标分页
+	query := gentity.NewQuery().Where("BaseInfo.exp", gentity.QueryOpGte, 20).SortBy("BaseInfo.exp", true).SetLimit(2)
+	playerNames, result := getQueryPlayerNames(t, entityDb, query)
+	checkQueryPlayerNames(t, playerNames, "player5", "player4")
+	if result.NextCursor == nil {
+		t.Fatal("NextCursor nil")
+	}
+	playerNames, result = getQueryPlayerNames(t, entityDb, query.SetCursor(result.NextCursor))
+	checkQueryPlayerNames(t, playerNames, "player3", "player2")
+	playerNames, result = getQueryPlayerNames(t, entityDb, query.SetCursor(result.NextCursor))
+	checkQueryPlayerNames(t, playerNames)
+	if result.NextCursor != nil {
+		t.Fatalf("NextCursor:%v", result.NextCursor)
+	}
+
+	// Skip分页,相同的AccountId按照唯一id排序
+	playerNames, _ = getQueryPlayerNames(t, entityDb, gentity.NewQuery().SortBy("AccountId", false).SetSkip(1).SetLimit(3))
+	checkQueryPlayerNames(t, playerNames, "player4", "player1", "player3")
+
+	playerNames, _ = getQueryPlayerNames(t, entityDb, gentity.NewQuery().Where("BaseInfo.exp", gentity.QueryOpNe, 30).
+		Where("AccountId", gentity.QueryOpEq, 101))
+	checkQueryPlayerNames(t, playerNames, "player1", "player5")
+
+	// 只加载BaseInfo组件
+	result, err := entityDb.FindEntities(gentity.NewQuery().Where("Name", gentity.QueryOpIn, []string{"player1", "player3"}).
+		Select("BaseInfo"), func() interface{} {
+		return &pb.PlayerData{}
+	})
+	if err != nil || len(result.Datas) != 2 || result.NextCursor != nil {
+		t.Fatalf("FindEntities projection %v err:%v", result, err)
+	}
+	if data := result.Datas[1].(*pb.PlayerData); data.Name != "" || data.BaseInfo.GetExp() != 30 {
+		t.Fatalf("FindEntities projection %v", data)
+	}
+}
+
+// CacheEntityDb不支持条件查询,见TestCacheFindEntities
+func TestFindEntities(t *testing.T) {
+	runEntityDbTests(t, []string{testBackendMem, testBackendFile, testBackendSql, testBackendMongo}, "querytest", testFindEntities)
+}
+
+func TestCacheFindEntities(t *testing.T) {
+	entityDb := gentity.NewCacheEntityDb(gentity.NewMemCache(), "p", "_id", time.Minute)
+	_, err := entityDb.FindEntities(gentity.NewQuery(), func() interface{} {
+		return &pb.PlayerData{}
+	})
+	if !errors.Is(err, gentity.ErrNotSupported) {
+		t.Fatalf("FindEntities err:%v", err)
+	}
+}
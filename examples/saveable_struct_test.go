@@ -98,6 +98,7 @@ func initSingleComponents(t *testing.T) {
 
 func TestLoadMongo(t *testing.T) {
 	gentity.SetLogLevel(gentity.DebugLevel)
+	skipIfMongoUnavailable(t)
 	mongoDb := gentity.NewMongoDb(_mongoUri, _mongoDbName)
 	playerDb := mongoDb.RegisterPlayerDb(_collectionName, true, "_id", "AccountId", "RegionId")
 	if !mongoDb.Connect() {
@@ -118,6 +119,7 @@ func TestLoadMongo(t *testing.T) {
 
 func TestSingleField(t *testing.T) {
 	gentity.SetLogLevel(gentity.DebugLevel)
+	skipIfMongoUnavailable(t)
 	mongoDb := gentity.NewMongoDb(_mongoUri, _mongoDbName)
 	playerDb := mongoDb.RegisterPlayerDb(_collectionName, true, "_id", "AccountId", "RegionId")
 	if !mongoDb.Connect() {
@@ -287,6 +289,7 @@ type ChildEntityData struct {
 
 func TestMapField(t *testing.T) {
 	gentity.SetLogLevel(gentity.DebugLevel)
+	skipIfMongoUnavailable(t)
 	mongoDb := gentity.NewMongoDb(_mongoUri, _mongoDbName)
 	playerDb := mongoDb.RegisterPlayerDb(_collectionName, true, "_id", "AccountId", "RegionId")
 	if !mongoDb.Connect() {
@@ -431,6 +434,7 @@ func initChildComponents(t *testing.T) {
 
 func TestChildFields(t *testing.T) {
 	gentity.SetLogLevel(gentity.DebugLevel)
+	skipIfMongoUnavailable(t)
 	mongoDb := gentity.NewMongoDb(_mongoUri, _mongoDbName)
 	playerDb := mongoDb.RegisterPlayerDb(_collectionName, true, "_id", "AccountId", "RegionId")
 	if !mongoDb.Connect() {
@@ -0,0 +1,171 @@
+package examples
+
+import (
+	"github.com/fish-tennis/gentity"
+	"github.com/fish-tennis/gentity/examples/pb"
+	"reflect"
+	"slices"
+	"testing"
+)
+
+// 是否是整体保存的slice
+func isWholeSlice(v interface{}) bool {
+	return v != nil && reflect.TypeOf(v).Kind() == reflect.Slice
+}
+
+// slice数据的数据库追加保存
+func testSliceAppendSave(t *testing.T, entityDb gentity.EntityDb) {
+	recordDb := &saveRecordEntityDb{EntityDb: entityDb}
+	player := newTestPlayer(1, 100)
+	entityDb.InsertEntity(player.Id, getNewPlayerSaveData(player))
+	quest := player.GetQuest()
+	bag := player.GetBag()
+	quest.AddFinishId(1)
+	quest.AddFinishId(2)
+	if err := gentity.SaveEntityChangedDataToDb(recordDb, player, nil, false, "p"); err != nil {
+		t.Fatalf("SaveEntityChangedDataToDb err:%v", err)
+	}
+	// 第一次保存整体数据
+	if v := recordDb.saved[0]["Quest.Finished"]; !isWholeSlice(v) {
+		t.Fatalf("first save:%v", v)
+	}
+
+	quest.AddFinishId(3)
+	bag.TestUniqueItem.Add(&pb.UniqueItem{UniqueId: 1, CfgId: 1})
+	if err := gentity.SaveEntityChangedDataToDb(recordDb, player, nil, false, "p"); err != nil {
+		t.Fatalf("SaveEntityChangedDataToDb err:%v", err)
+	}
+	if keys := recordDb.lastSavedKeys(""); !slices.Equal(keys, []string{"Bag.TestUniqueItem", "Quest.Finished"}) {
+		t.Fatalf("append save keys:%v", keys)
+	}
+	if v := recordDb.saved[1]["Quest.Finished"]; isWholeSlice(v) {
+		t.Fatalf("append save whole slice:%v", v)
+	}
+	if v := recordDb.saved[1]["Bag.TestUniqueItem"]; !isWholeSlice(v) {
+		t.Fatalf("first save:%v", v)
+	}
+	bag.TestUniqueItem.Add(&pb.UniqueItem{UniqueId: 2, CfgId: 2}, &pb.UniqueItem{UniqueId: 3, CfgId: 3})
+	if err := gentity.SaveEntityChangedDataToDb(recordDb, player, nil, false, "p"); err != nil {
+		t.Fatalf("SaveEntityChangedDataToDb err:%v", err)
+	}
+	if v := recordDb.saved[2]["Bag.TestUniqueItem"]; isWholeSlice(v) {
+		t.Fatalf("append save whole slice:%v", v)
+	}
+
+	// 从数据库加载的slice,之后的追加直接增量保存
+	loadPlayer := loadTestPlayer(t, entityDb, player.Id)
+	loadFinished := loadPlayer.GetQuest().Finished
+	if !slices.Equal(loadFinished.Data, []int32{1, 2, 3}) {
+		t.Fatalf("load finished:%v", loadFinished.Data)
+	}
+	if items := loadPlayer.GetBag().TestUniqueItem.Data; len(items) != 3 || items[2].GetUniqueId() != 3 {
+		t.Fatalf("load TestUniqueItem:%v", items)
+	}
+	loadPlayer.GetQuest().AddFinishId(4)
+	if err := gentity.SaveEntityChangedDataToDb(recordDb, loadPlayer, nil, false, "p"); err != nil {
+		t.Fatalf("SaveEntityChangedDataToDb err:%v", err)
+	}
+	if v := recordDb.saved[len(recordDb.saved)-1]["Quest.Finished"]; isWholeSlice(v) {
+		t.Fatalf("loaded append save whole slice:%v", v)
+	}
+	// 不是追加的修改,保存整体数据
+	loadFinished.Data[0] = 10
+	loadFinished.SetDirty()
+	if err := gentity.SaveEntityChangedDataToDb(recordDb, loadPlayer, nil, false, "p"); err != nil {
+		t.Fatalf("SaveEntityChangedDataToDb err:%v", err)
+	}
+	if v := recordDb.saved[len(recordDb.saved)-1]["Quest.Finished"]; !isWholeSlice(v) {
+		t.Fatalf("modify save:%v", v)
+	}
+	loadFinished = loadTestPlayer(t, entityDb, player.Id).GetQuest().Finished
+	if !slices.Equal(loadFinished.Data, []int32{10, 2, 3, 4}) {
+		t.Fatalf("load finished after modify:%v", loadFinished.Data)
+	}
+}
+
+// EntityDb不支持增量保存时,slice保存整体数据
+func TestMemSliceSaveWithoutIncrementalDb(t *testing.T) {
+	memDb := gentity.NewMemDb()
+	playerDb := memDb.RegisterPlayerDb(_collectionName, "_id", "AccountId", "RegionId")
+	recordDb := &saveRecordEntityDb{EntityDb: playerDb, disableIncremental: true}
+	player := newTestPlayer(1, 100)
+	playerDb.InsertEntity(player.Id, getNewPlayerSaveData(player))
+	quest := player.GetQuest()
+	quest.AddFinishId(1)
+	gentity.SaveEntityChangedDataToDb(recordDb, player, nil, false, "p")
+	quest.AddFinishId(2)
+	if err := gentity.SaveEntityChangedDataToDb(recordDb, player, nil, false, "p"); err != nil {
+		t.Fatalf("SaveEntityChangedDataToDb err:%v", err)
+	}
+	if v := recordDb.saved[1]["Quest.Finished"]; !isWholeSlice(v) {
+		t.Fatalf("save:%v", v)
+	}
+	if loadFinished := loadTestPlayer(t, playerDb, player.Id).GetQuest().Finished; !slices.Equal(loadFinished.Data, []int32{1, 2}) {
+		t.Fatalf("load finished:%v", loadFinished.Data)
+	}
+}
+
+func TestSliceAppendSave(t *testing.T) {
+	runEntityDbTests(t, _allTestBackends, "slicetest", testSliceAppendSave)
+}
+
+// 记录删除的缓存key
+type delRecordCache struct {
+	*gentity.MemCache
+	delKeys []string
+}
+
+func (this *delRecordCache) Del(key ...string) (int64, error) {
+	this.delKeys = append(this.delKeys, key...)
+	return this.MemCache.Del(key...)
+}
+
+// slice的缓存用list保存,只追加了数据时使用RPUSH
+func TestCacheSliceAppend(t *testing.T) {
+	kvCache := &delRecordCache{MemCache: gentity.NewMemCache()}
+	player := newTestPlayer(1, 100)
+	quest := player.GetQuest()
+	cacheKey := gentity.GetEntityComponentChildCacheKey("p", player.Id, "Quest", "Finished")
+	quest.AddFinishId(1)
+	quest.AddFinishId(2)
+	gentity.SaveComponentChangedDataToCache(kvCache, "p", player.Id, quest)
+	if typ, _ := kvCache.Type(cacheKey); typ != "list" {
+		t.Fatalf("cache type:%v", typ)
+	}
+	kvCache.delKeys = nil
+	quest.AddFinishId(3)
+	gentity.SaveComponentChangedDataToCache(kvCache, "p", player.Id, quest)
+	if slices.Contains(kvCache.delKeys, cacheKey) {
+		t.Fatalf("append deleted cache:%v", kvCache.delKeys)
+	}
+	if values, _ := kvCache.LRange(cacheKey, 0, -1); !slices.Equal(values, []string{"1", "2", "3"}) {
+		t.Fatalf("cache values:%v", values)
+	}
+
+	// 从list缓存加载
+	loadPlayer := newTestPlayer(1, 100)
+	loadQuest := loadPlayer.GetQuest()
+	if hasCache, err := gentity.LoadFromCache(loadQuest.Finished, kvCache, cacheKey, loadQuest); !hasCache || err != nil {
+		t.Fatalf("LoadFromCache hasCache:%v err:%v", hasCache, err)
+	}
+	if !slices.Equal(loadQuest.Finished.Data, []int32{1, 2, 3}) {
+		t.Fatalf("load finished:%v", loadQuest.Finished.Data)
+	}
+	kvCache.delKeys = nil
+	loadQuest.AddFinishId(4)
+	gentity.SaveComponentChangedDataToCache(kvCache, "p", player.Id, loadQuest)
+	if slices.Contains(kvCache.delKeys, cacheKey) {
+		t.Fatalf("loaded append deleted cache:%v", kvCache.delKeys)
+	}
+	if values, _ := kvCache.LRange(cacheKey, 0, -1); len(values) != 4 {
+		t.Fatalf("cache values:%v", values)
+	}
+
+	// 清空之后用json字符串保存
+	loadQuest.Finished.Data = loadQuest.Finished.Data[:0]
+	loadQuest.Finished.SetDirty()
+	gentity.SaveComponentChangedDataToCache(kvCache, "p", player.Id, loadQuest)
+	if typ, _ := kvCache.Type(cacheKey); typ != "string" {
+		t.Fatalf("empty cache type:%v", typ)
+	}
+}
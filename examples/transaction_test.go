@@ -0,0 +1,85 @@
+package examples
+
+import (
+	"errors"
+	"github.com/fish-tennis/gentity"
+	"github.com/fish-tennis/gentity/examples/pb"
+	"testing"
+)
+
+func getTestPlayerExp(t *testing.T, entityDb gentity.EntityDb, playerId int64) int32 {
+	loadData := &pb.PlayerData{}
+	exists, err := entityDb.FindEntityById(playerId, loadData)
+	if err != nil || !exists {
+		t.Fatalf("FindEntityById %v exists:%v err:%v", playerId, exists, err)
+	}
+	return loadData.BaseInfo.GetExp()
+}
+
+// 2个实体的修改数据在一个事务中保存,如玩家之间的交易
+func testSaveInTransaction(t *testing.T, dbMgr gentity.DbMgr, playerDb, otherDb gentity.EntityDb) {
+	player1 := newTestPlayer(1, 100)
+	player2 := newTestPlayer(2, 100)
+	playerDb.InsertEntity(player1.Id, getNewPlayerSaveData(player1))
+	otherDb.InsertEntity(player2.Id, getNewPlayerSaveData(player2))
+
+	player1.GetBaseInfo().AddExp(10)
+	player2.GetBaseInfo().AddExp(20)
+	err := gentity.SaveEntitiesChangedDataToDbInTransaction(dbMgr, nil, false,
+		&gentity.EntitySaveInfo{EntityDb: playerDb, Entity: player1, CachePrefix: "p"},
+		&gentity.EntitySaveInfo{EntityDb: otherDb, Entity: player2, CachePrefix: "p"})
+	if err != nil {
+		t.Fatalf("SaveEntitiesChangedDataToDbInTransaction err:%v", err)
+	}
+	if player1.GetBaseInfo().IsChanged() || player2.GetBaseInfo().IsChanged() {
+		t.Fatal("changed flag not reset")
+	}
+	if getTestPlayerExp(t, playerDb, player1.Id) != 10 || getTestPlayerExp(t, otherDb, player2.Id) != 20 {
+		t.Fatal("transaction not saved")
+	}
+
+	// 版本号冲突时,整个事务失败,所有实体的修改标记都保留
+	otherDb.(gentity.VersionedEntityDb).SetVersionField("_version")
+	player2.SetVersion(5)
+	player1.GetBaseInfo().AddExp(10)
+	player2.GetBaseInfo().AddExp(20)
+	err = gentity.SaveEntitiesChangedDataToDbInTransaction(dbMgr, nil, false,
+		&gentity.EntitySaveInfo{EntityDb: playerDb, Entity: player1, CachePrefix: "p"},
+		&gentity.EntitySaveInfo{EntityDb: otherDb, Entity: player2, CachePrefix: "p"})
+	if !errors.Is(err, gentity.ErrVersionConflict) {
+		t.Fatalf("SaveEntitiesChangedDataToDbInTransaction err:%v", err)
+	}
+	if !player1.GetBaseInfo().IsChanged() || !player2.GetBaseInfo().IsChanged() {
+		t.Fatal("changed flag reset")
+	}
+	if getTestPlayerExp(t, playerDb, player1.Id) != 10 {
+		t.Fatal("transaction not rollback")
+	}
+}
+
+func TestMemSaveInTransaction(t *testing.T) {
+	memDb := gentity.NewMemDb()
+	testSaveInTransaction(t, memDb, memDb.RegisterPlayerDb(_collectionName, "_id", "AccountId", "RegionId"),
+		memDb.RegisterEntityDb("other", "_id"))
+
+	fileDb := gentity.NewFileDb(t.TempDir())
+	err := gentity.SaveEntitiesChangedDataToDbInTransaction(fileDb, nil, false)
+	if !errors.Is(err, gentity.ErrNotSupported) {
+		t.Fatalf("FileDb transaction err:%v", err)
+	}
+}
+
+// mongodb需要部署为副本集
+func TestMongoSaveInTransaction(t *testing.T) {
+	skipIfMongoUnavailable(t)
+	mongoDb := gentity.NewMongoDb(_mongoUri, _mongoDbName)
+	playerDb := mongoDb.RegisterPlayerDb("transactiontest", false, "_id", "AccountId", "RegionId")
+	otherDb := mongoDb.RegisterEntityDb("transactiontest2", false, "_id")
+	if !mongoDb.Connect() {
+		t.Fatal("connect db error")
+	}
+	defer mongoDb.Disconnect()
+	playerDb.DeleteEntity(int64(1))
+	otherDb.DeleteEntity(int64(2))
+	testSaveInTransaction(t, mongoDb, playerDb, otherDb)
+}
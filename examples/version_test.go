@@ -0,0 +1,130 @@
+package examples
+
+import (
+	"errors"
+	"github.com/fish-tennis/gentity"
+	"github.com/fish-tennis/gentity/examples/pb"
+	"testing"
+)
+
+// 2个服务器同时加载了同一个实体,后保存的返回ErrVersionConflict
+func testVersionedSave(t *testing.T, entityDb gentity.EntityDb) {
+	versionedDb := entityDb.(gentity.VersionedEntityDb)
+	versionedDb.SetVersionField("_version")
+	player := newTestPlayer(1, 100)
+	if err, _ := entityDb.InsertEntity(player.Id, getNewPlayerSaveData(player)); err != nil {
+		t.Fatalf("InsertEntity err:%v", err)
+	}
+	// 模拟另一个服务器上的同一个实体
+	stalePlayer := newTestPlayer(1, 100)
+
+	player.GetBaseInfo().AddExp(10)
+	if err := gentity.SaveEntityChangedDataToDb(entityDb, player, nil, false, "p"); err != nil {
+		t.Fatalf("SaveEntityChangedDataToDb err:%v", err)
+	}
+	if version, err := versionedDb.FindEntityVersion(player.Id); err != nil || version != 1 || player.GetVersion() != 1 {
+		t.Fatalf("version:%v entityVersion:%v err:%v", version, player.GetVersion(), err)
+	}
+
+	stalePlayer.GetBaseInfo().AddExp(20)
+	err := gentity.SaveEntityChangedDataToDb(entityDb, stalePlayer, nil, false, "p")
+	if !errors.Is(err, gentity.ErrVersionConflict) {
+		t.Fatalf("stale save err:%v", err)
+	}
+	// 保存失败,修改标记保留
+	if !stalePlayer.GetBaseInfo().IsChanged() || stalePlayer.GetVersion() != 0 {
+		t.Fatalf("stale player changed:%v version:%v", stalePlayer.GetBaseInfo().IsChanged(), stalePlayer.GetVersion())
+	}
+	if _, err = versionedDb.FindEntityVersion(int64(2)); !errors.Is(err, gentity.ErrEntityNotExists) {
+		t.Fatalf("FindEntityVersion err:%v", err)
+	}
+
+	player.GetBaseInfo().AddExp(10)
+	if err = gentity.SaveEntityChangedDataToDb(entityDb, player, nil, false, "p"); err != nil || player.GetVersion() != 2 {
+		t.Fatalf("SaveEntityChangedDataToDb version:%v err:%v", player.GetVersion(), err)
+	}
+}
+
+// 加载数据时,版本号和数据来自同一次读取
+func testVersionedLoad(t *testing.T, playerDb gentity.PlayerDb) {
+	playerDb.(gentity.VersionedEntityDb).SetVersionField("_version")
+	player := newTestPlayer(1, 100)
+	playerDb.InsertEntity(player.Id, getNewPlayerSaveData(player))
+	player.GetBaseInfo().AddExp(10)
+	gentity.SaveEntityChangedDataToDb(playerDb, player, nil, false, "p")
+	player.GetBaseInfo().AddExp(10)
+	gentity.SaveEntityChangedDataToDb(playerDb, player, nil, false, "p")
+
+	loadData := &pb.PlayerData{}
+	exists, version, err := gentity.FindEntityByIdWithVersion(playerDb, player.Id, loadData)
+	if !exists || err != nil || version != 2 || loadData.BaseInfo.GetExp() != 20 {
+		t.Fatalf("FindEntityByIdWithVersion exists:%v version:%v err:%v", exists, version, err)
+	}
+	loadData = &pb.PlayerData{}
+	exists, version, err = gentity.FindPlayerByAccountIdWithVersion(playerDb, 100, 1, loadData)
+	if !exists || err != nil || version != 2 {
+		t.Fatalf("FindPlayerByAccountIdWithVersion exists:%v version:%v err:%v", exists, version, err)
+	}
+	loadData.XId = player.Id
+	loadPlayer := newTestPlayerFromData(loadData)
+	loadPlayer.SetVersion(version)
+	loadPlayer.GetBaseInfo().AddExp(10)
+	if err = gentity.SaveEntityChangedDataToDb(playerDb, loadPlayer, nil, false, "p"); err != nil || loadPlayer.GetVersion() != 3 {
+		t.Fatalf("loaded player save version:%v err:%v", loadPlayer.GetVersion(), err)
+	}
+	if exists, _, err = gentity.FindEntityByIdWithVersion(playerDb, int64(2), &pb.PlayerData{}); exists || err != nil {
+		t.Fatalf("not exists:%v err:%v", exists, err)
+	}
+}
+
+func TestVersionedLoad(t *testing.T) {
+	runEntityDbTests(t, []string{testBackendMem, testBackendFile}, "versiontest", func(t *testing.T, entityDb gentity.EntityDb) {
+		testVersionedLoad(t, entityDb.(gentity.PlayerDb))
+	})
+}
+
+// 用缓存修复数据和回档时,版本号+1,其他服务器上的旧实体保存时返回ErrVersionConflict
+func TestMemVersionedFixAndRestore(t *testing.T) {
+	memDb := gentity.NewMemDb()
+	playerDb := memDb.RegisterPlayerDb(_collectionName, "_id", "AccountId", "RegionId")
+	versionedDb := playerDb.(gentity.VersionedEntityDb)
+	versionedDb.SetVersionField("_version")
+	kvCache := gentity.NewMemCache()
+	player := newTestPlayer(1, 100)
+	playerDb.InsertEntity(player.Id, getNewPlayerSaveData(player))
+	stalePlayer := newTestPlayer(1, 100)
+
+	// 缓存里有没保存数据库的数据
+	player.GetBaseInfo().AddExp(10)
+	player.GetQuest().AddFinishId(1)
+	gentity.SaveEntityChangedDataToCache(kvCache, "p", player.Id, player)
+	fixPlayer := newTestPlayer(1, 100)
+	gentity.FixEntityDataFromCache(fixPlayer, playerDb, kvCache, "p", fixPlayer.Id)
+	if version, _ := versionedDb.FindEntityVersion(player.Id); version != 2 || fixPlayer.GetVersion() != 2 {
+		t.Fatalf("fix version:%v entityVersion:%v", version, fixPlayer.GetVersion())
+	}
+	stalePlayer.GetBaseInfo().AddExp(1)
+	if err := gentity.SaveEntityChangedDataToDb(playerDb, stalePlayer, nil, false, "p"); !errors.Is(err, gentity.ErrVersionConflict) {
+		t.Fatalf("stale save after fix err:%v", err)
+	}
+
+	store := gentity.NewKvSnapshotStore(memDb.RegisterKvDb("snapshot", "k", "v"), "")
+	snapshot, err := gentity.NewEntitySnapshotter(fixPlayer, store, nil).Snapshot("test")
+	if err != nil {
+		t.Fatalf("Snapshot err:%v", err)
+	}
+	if err = gentity.RestoreEntitySnapshot(store, playerDb, nil, kvCache, fixPlayer, "p", player.Id, snapshot.Id); err != nil {
+		t.Fatalf("RestoreEntitySnapshot err:%v", err)
+	}
+	if version, _ := versionedDb.FindEntityVersion(player.Id); version != 3 {
+		t.Fatalf("restore version:%v", version)
+	}
+	fixPlayer.GetBaseInfo().AddExp(1)
+	if err = gentity.SaveEntityChangedDataToDb(playerDb, fixPlayer, nil, false, "p"); !errors.Is(err, gentity.ErrVersionConflict) {
+		t.Fatalf("stale save after restore err:%v", err)
+	}
+}
+
+func TestVersionedSave(t *testing.T) {
+	runEntityDbTests(t, []string{testBackendMem, testBackendFile, testBackendMongo}, "versiontest", testVersionedSave)
+}
@@ -0,0 +1,89 @@
+package examples
+
+import (
+	"context"
+	"github.com/fish-tennis/gentity"
+	"github.com/fish-tennis/gentity/examples/pb"
+	"testing"
+	"time"
+)
+
+func checkCacheKeyType(t *testing.T, kvCache gentity.KvCache, cacheKey string, expected string) {
+	if keyType, _ := kvCache.Type(cacheKey); keyType != expected {
+		t.Fatalf("%v type:%v expected:%v", cacheKey, keyType, expected)
+	}
+}
+
+// 数据库被外部修改时,删除受影响的组件的缓存
+func TestInvalidateEntityCache(t *testing.T) {
+	kvCache := gentity.NewMemCache()
+	player := newTestPlayer(1, 100)
+	player.GetBaseInfo().AddExp(10)
+	player.GetQuest().AddFinishId(1)
+	player.GetQuest().Quests.Set(2, &pb.QuestData{CfgId: 2, Progress: 5})
+	player.SaveCache(kvCache)
+	baseInfoKey := gentity.GetEntityComponentCacheKey("p", player.Id, "BaseInfo")
+	finishedKey := gentity.GetEntityComponentChildCacheKey("p", player.Id, "Quest", "Finished")
+	questsKey := gentity.GetEntityComponentChildCacheKey("p", player.Id, "Quest", "Quests")
+	checkCacheKeyType(t, kvCache, baseInfoKey, "string")
+	checkCacheKeyType(t, kvCache, questsKey, "hash")
+
+	schemaPlayer := newTestPlayer(0, 0)
+	event := &gentity.EntityChangeEvent{
+		EntityKey:     player.Id,
+		OperationType: "update",
+		UpdatedFields: []string{"baseinfo.exp"},
+	}
+	if err := gentity.InvalidateEntityCache(kvCache, schemaPlayer, "p", event); err != nil {
+		t.Fatalf("InvalidateEntityCache err:%v", err)
+	}
+	checkCacheKeyType(t, kvCache, baseInfoKey, "none")
+	checkCacheKeyType(t, kvCache, questsKey, "hash")
+
+	// 整个实体被替换
+	event = &gentity.EntityChangeEvent{
+		EntityKey:     player.Id,
+		OperationType: "replace",
+	}
+	gentity.InvalidateEntityCache(kvCache, schemaPlayer, "p", event)
+	checkCacheKeyType(t, kvCache, questsKey, "none")
+	checkCacheKeyType(t, kvCache, finishedKey, "none")
+
+	player.SetVersion(3)
+	if !(&gentity.EntityChangeEvent{Version: 3}).IsSavedBy(player) || (&gentity.EntityChangeEvent{Version: 4}).IsSavedBy(player) {
+		t.Fatal("IsSavedBy error")
+	}
+}
+
+// mongodb需要部署为副本集
+func TestMongoWatch(t *testing.T) {
+	skipIfMongoUnavailable(t)
+	mongoDb := gentity.NewMongoDb(_mongoUri, _mongoDbName)
+	playerDb := mongoDb.RegisterPlayerDb("watchtest", false, "_id", "AccountId", "RegionId")
+	if !mongoDb.Connect() {
+		t.Fatal("connect db error")
+	}
+	defer mongoDb.Disconnect()
+	player := newTestPlayer(1, 100)
+	playerDb.DeleteEntity(player.Id)
+	playerDb.InsertEntity(player.Id, getNewPlayerSaveData(player))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	events := make(chan *gentity.EntityChangeEvent, 1)
+	go playerDb.(*gentity.MongoCollectionPlayer).Watch(ctx, func(event *gentity.EntityChangeEvent) {
+		events <- event
+		cancel()
+	})
+	// 等待change stream开启
+	time.Sleep(time.Second)
+	playerDb.SaveComponentField(player.Id, "BaseInfo", "exp", 10)
+	select {
+	case event := <-events:
+		if event.EntityKey != player.Id || event.OperationType != "update" || event.GetComponentNames()[0] != "BaseInfo" {
+			t.Fatalf("event:%v", event)
+		}
+	case <-ctx.Done():
+		t.Fatal("watch timeout")
+	}
+}
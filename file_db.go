@@ -0,0 +1,922 @@
+package gentity
+
+import (
+	"bytes"
+	"fmt"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// https://github.com/uber-go/guide/blob/master/style.md#verify-interface-compliance
+var _ PlayerDb = (*FileCollectionPlayer)(nil)
+var _ VersionedPlayerDb = (*FileCollectionPlayer)(nil)
+var _ EntityDb = (*FileCollection)(nil)
+var _ IncrementalEntityDb = (*FileCollection)(nil)
+var _ VersionedEntityDb = (*FileCollection)(nil)
+var _ KvDb = (*FileKvDb)(nil)
+var _ AdvancedKvDb = (*FileKvDb)(nil)
+var _ DbMgr = (*FileDb)(nil)
+
+const (
+	// 文档文件的扩展名
+	fileDocumentExt = ".json"
+	// 写入中的临时文件的前缀
+	fileDocumentTempPrefix = ".tmp-"
+)
+
+// 一个目录对应一个collection,一个文件对应一个文档
+//
+//	文件内容是mongodb的extended json格式,数据格式和MongoCollection保持一致
+type fileDocuments struct {
+	dir string
+}
+
+// key -> 文件路径
+func (this *fileDocuments) getPath(key any) string {
+	return filepath.Join(this.dir, url.PathEscape(memKey(key))+fileDocumentExt)
+}
+
+// 读取文档,文件不存在时返回nil
+func (this *fileDocuments) read(key any) (memDocument, error) {
+	return this.readFile(this.getPath(key))
+}
+
+func (this *fileDocuments) readFile(path string) (memDocument, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	vr, err := bson.NewExtJSONValueReader(bytes.NewReader(data), true)
+	if err != nil {
+		return nil, err
+	}
+	decoder := bson.NewDecoder(vr)
+	decoder.DefaultDocumentM()
+	doc := make(memDocument)
+	if err = decoder.Decode(&doc); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+func (this *fileDocuments) exists(key any) bool {
+	_, err := os.Stat(this.getPath(key))
+	return err == nil
+}
+
+// 原子写入: 先写临时文件,再rename,最后fsync目录,保证rename在断电后不会丢失
+func (this *fileDocuments) write(key any, doc memDocument) error {
+	data, err := bson.MarshalExtJSONIndent(doc, true, false, "", "  ")
+	if err != nil {
+		return err
+	}
+	tempFile, err := os.CreateTemp(this.dir, fileDocumentTempPrefix+"*")
+	if err != nil {
+		return err
+	}
+	tempPath := tempFile.Name()
+	_, err = tempFile.Write(data)
+	if err == nil {
+		err = tempFile.Sync()
+	}
+	if closeErr := tempFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tempPath, this.getPath(key))
+	}
+	if err != nil {
+		os.Remove(tempPath)
+		return err
+	}
+	return syncDir(this.dir)
+}
+
+// fsync目录,windows不支持对目录fsync,直接跳过
+func syncDir(dir string) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	dirFile, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = dirFile.Sync()
+	if closeErr := dirFile.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (this *fileDocuments) delete(key any) error {
+	err := os.Remove(this.getPath(key))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// 创建目录,并删除上次进程退出时残留的临时文件
+func (this *fileDocuments) init() error {
+	if err := os.MkdirAll(this.dir, 0755); err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(this.dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), fileDocumentTempPrefix) {
+			os.Remove(filepath.Join(this.dir, entry.Name()))
+		}
+	}
+	return nil
+}
+
+// 遍历所有文档
+func (this *fileDocuments) rangeDocs(f func(doc memDocument) bool) error {
+	entries, err := os.ReadDir(this.dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), fileDocumentExt) ||
+			strings.HasPrefix(entry.Name(), fileDocumentTempPrefix) {
+			continue
+		}
+		doc, err := this.readFile(filepath.Join(this.dir, entry.Name()))
+		if err != nil {
+			return err
+		}
+		if doc != nil && !f(doc) {
+			return nil
+		}
+	}
+	return nil
+}
+
+// EntityDb的本地文件实现,用于单机部署的开发服务器,离线工具和集成测试,无需部署mongodb
+//
+//	一个实体对应一个文件,数据格式和MongoCollection一致,字段路径(componentName.fieldName)的规则也一致
+type FileCollection struct {
+	documents *fileDocuments
+	lock      sync.RWMutex
+
+	// 表名
+	collectionName string
+	// 唯一id
+	uniqueId string
+	// 乐观锁的版本号字段,为空表示不使用乐观锁
+	versionField string
+	// 文档变化的回调,文档被删除时doc为nil,调用者已加锁
+	onChanged func(entityKey any, doc memDocument)
+}
+
+func (this *FileCollection) GetCollectionName() string {
+	return this.collectionName
+}
+
+// 根据id查找数据
+func (this *FileCollection) FindEntityById(entityKey interface{}, data interface{}) (bool, error) {
+	exists, _, err := this.FindEntityByIdWithVersion(entityKey, data)
+	return exists, err
+}
+
+func (this *FileCollection) FindEntityByIdWithVersion(entityKey interface{}, data interface{}) (bool, int64, error) {
+	if len(this.uniqueId) == 0 {
+		return false, 0, ErrNoUniqueColumn
+	}
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+	doc, err := this.documents.read(entityKey)
+	if err != nil || doc == nil {
+		return false, 0, err
+	}
+	err = decodeBsonDocument(doc, data)
+	if err != nil {
+		return false, 0, err
+	}
+	return true, getDocumentVersion(doc, this.versionField), nil
+}
+
+func (this *FileCollection) FindEntitiesByIds(entityKeys []interface{}, newData func() interface{}, componentNames ...string) (map[interface{}]interface{}, error) {
+	if len(this.uniqueId) == 0 {
+		return nil, ErrNoUniqueColumn
+	}
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+	datas := make(map[interface{}]interface{}, len(entityKeys))
+	for _, entityKey := range entityKeys {
+		doc, err := this.documents.read(entityKey)
+		if err != nil {
+			return nil, err
+		}
+		if doc == nil {
+			continue
+		}
+		data := newData()
+		if err = decodeBsonDocument(projectDocument(doc, this.uniqueId, componentNames), data); err != nil {
+			return nil, err
+		}
+		datas[entityKey] = data
+	}
+	return datas, nil
+}
+
+// 在内存中执行查询,会读取所有文件,适合数据量不大的场景
+func (this *FileCollection) FindEntities(query *Query, newData func() interface{}) (*QueryResult, error) {
+	if len(this.uniqueId) == 0 {
+		return nil, ErrNoUniqueColumn
+	}
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+	var docs []memDocument
+	err := this.documents.rangeDocs(func(doc memDocument) bool {
+		docs = append(docs, doc)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return decodeQueryDocuments(query, this.uniqueId, docs, newData)
+}
+
+func (this *FileCollection) InsertEntity(entityKey interface{}, entityData interface{}) (err error, isDuplicateKey bool) {
+	doc, err := toBsonDocument(entityData)
+	if err != nil {
+		return err, false
+	}
+	// 和mongodb一样,以文档里的uniqueId作为主键
+	if key, ok := doc[this.uniqueId]; ok {
+		entityKey = key
+	} else {
+		doc[this.uniqueId], err = toBsonValue(entityKey)
+		if err != nil {
+			return err, false
+		}
+	}
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if this.documents.exists(entityKey) {
+		return fmt.Errorf("%v %v:%v %w", this.collectionName, this.uniqueId, entityKey, ErrDuplicateKey), true
+	}
+	if err = this.documents.write(entityKey, doc); err != nil {
+		return err, false
+	}
+	this.notifyChanged(entityKey, doc)
+	return nil, false
+}
+
+func (this *FileCollection) notifyChanged(entityKey any, doc memDocument) {
+	if this.onChanged != nil {
+		this.onChanged(entityKey, doc)
+	}
+}
+
+// entityData是mongodb格式的更新操作,如bson.D{{"$set", bson.D{{"Name", "abc"}}}}
+func (this *FileCollection) SaveEntity(entityKey interface{}, entityData interface{}) error {
+	update, err := toBsonDocument(entityData)
+	if err != nil {
+		return err
+	}
+	return this.updateDocument(entityKey, update)
+}
+
+func (this *FileCollection) DeleteEntity(entityKey interface{}) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if err := this.documents.delete(entityKey); err != nil {
+		return err
+	}
+	this.notifyChanged(entityKey, nil)
+	return nil
+}
+
+func (this *FileCollection) SaveComponent(entityKey interface{}, componentName string, componentData interface{}) error {
+	return this.SaveComponents(entityKey, map[string]interface{}{componentName: componentData})
+}
+
+func (this *FileCollection) SupportIncrementalSave() bool {
+	return true
+}
+
+func (this *FileCollection) SaveComponents(entityKey interface{}, components map[string]interface{}) error {
+	if len(components) == 0 {
+		return nil
+	}
+	update, err := toBsonDocument(getComponentsUpdate(components))
+	if err != nil {
+		return err
+	}
+	return this.updateDocument(entityKey, update)
+}
+
+func (this *FileCollection) SaveComponentField(entityKey interface{}, componentName string, fieldName string, fieldData interface{}) error {
+	return this.SaveComponents(entityKey, map[string]interface{}{componentName + "." + fieldName: fieldData})
+}
+
+// 删除1个组件的某些字段
+func (this *FileCollection) DeleteComponentField(entityKey interface{}, componentName string, fieldName ...string) error {
+	if len(fieldName) == 0 {
+		return nil
+	}
+	fieldNames := make(memDocument)
+	for _, name := range fieldName {
+		fieldNames[componentName+"."+name] = ""
+	}
+	return this.updateDocument(entityKey, memDocument{"$unset": fieldNames})
+}
+
+func (this *FileCollection) SetVersionField(versionField string) {
+	this.versionField = versionField
+}
+
+func (this *FileCollection) GetVersionField() string {
+	return this.versionField
+}
+
+func (this *FileCollection) FindEntityVersion(entityKey interface{}) (int64, error) {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+	doc, err := this.documents.read(entityKey)
+	if err != nil {
+		return 0, err
+	}
+	if doc == nil {
+		return 0, ErrEntityNotExists
+	}
+	return getDocumentVersion(doc, this.versionField), nil
+}
+
+func (this *FileCollection) SaveComponentsWithVersion(entityKey interface{}, components map[string]interface{}, version int64) error {
+	if len(this.versionField) == 0 {
+		return this.SaveComponents(entityKey, components)
+	}
+	update, err := toVersionUpdate(components, this.versionField)
+	if err != nil {
+		return err
+	}
+	return this.updateDocumentIf(entityKey, update, func(doc memDocument) error {
+		return checkDocumentVersion(doc, this.versionField, version)
+	})
+}
+
+// 更新文档,文档不存在时和mongodb的UpdateOne一样,不报错
+func (this *FileCollection) updateDocument(entityKey interface{}, update memDocument) error {
+	return this.updateDocumentIf(entityKey, update, nil)
+}
+
+// 更新文档,check不为nil时,check返回nil才更新,文档不存在时check的参数为nil
+//
+//	更新出错时不会修改原文件
+func (this *FileCollection) updateDocumentIf(entityKey interface{}, update memDocument, check func(doc memDocument) error) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	doc, err := this.documents.read(entityKey)
+	if err != nil {
+		return err
+	}
+	if check != nil {
+		if err = check(doc); err != nil {
+			return err
+		}
+	}
+	if doc == nil {
+		return nil
+	}
+	if err = applyDocumentUpdate(doc, update); err != nil {
+		return err
+	}
+	if err = this.documents.write(entityKey, doc); err != nil {
+		return err
+	}
+	this.notifyChanged(entityKey, doc)
+	return nil
+}
+
+func (this *FileCollection) PushToList(entityKey interface{}, listName string, item interface{}, maxLen int) error {
+	bsonItem, err := toBsonValue(item)
+	if err != nil {
+		return err
+	}
+	return this.updateList(entityKey, listName, func(list bson.A) (bson.A, error) {
+		return pushListItem(list, bsonItem, maxLen), nil
+	})
+}
+
+func (this *FileCollection) PopList(entityKey interface{}, listName string, count int, data interface{}) error {
+	var popped bson.A
+	err := this.updateList(entityKey, listName, func(list bson.A) (bson.A, error) {
+		var rest bson.A
+		popped, rest = popListItems(list, count)
+		// 和MongoCollection一致,取出全部时删除列表字段
+		if count <= 0 {
+			return nil, nil
+		}
+		if rest == nil {
+			rest = bson.A{}
+		}
+		return rest, nil
+	})
+	if err != nil || popped == nil {
+		return err
+	}
+	return decodeBsonList(popped, data)
+}
+
+func (this *FileCollection) RangeList(entityKey interface{}, listName string, start int, count int, data interface{}) error {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+	doc, err := this.documents.read(entityKey)
+	if err != nil {
+		return err
+	}
+	if doc == nil {
+		return ErrEntityNotExists
+	}
+	list, err := getDocumentList(doc, listName)
+	if err != nil || list == nil {
+		return err
+	}
+	return decodeBsonList(rangeListItems(list, start, count), data)
+}
+
+func (this *FileCollection) RemoveFromList(entityKey interface{}, listName string, item interface{}) error {
+	bsonItem, err := toBsonValue(item)
+	if err != nil {
+		return err
+	}
+	return this.updateList(entityKey, listName, func(list bson.A) (bson.A, error) {
+		if list == nil {
+			return nil, nil
+		}
+		return removeListItems(list, func(v any) bool {
+			return isBsonValueEqual(v, bsonItem)
+		}), nil
+	})
+}
+
+// 列表操作,实体不存在时返回ErrEntityNotExists
+func (this *FileCollection) updateList(entityKey interface{}, listName string, f func(list bson.A) (bson.A, error)) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	doc, err := this.documents.read(entityKey)
+	if err != nil {
+		return err
+	}
+	if doc == nil {
+		return ErrEntityNotExists
+	}
+	if err = updateDocumentList(doc, listName, f); err != nil {
+		return err
+	}
+	if err = this.documents.write(entityKey, doc); err != nil {
+		return err
+	}
+	this.notifyChanged(entityKey, doc)
+	return nil
+}
+
+// 账号索引的key
+type fileAccountKey struct {
+	accountId int64
+	regionId  int32
+}
+
+// PlayerDb的本地文件实现
+//
+//	账号相关的查询使用内存索引,索引在Connect时通过扫描目录建立
+type FileCollectionPlayer struct {
+	FileCollection
+	// 账号id列名
+	colAccountId string
+	// 玩家区服id列名
+	colRegionId string
+	// playerId -> 账号
+	playerAccounts map[int64]fileAccountKey
+	// 账号 -> playerIds(升序)
+	accountPlayers map[fileAccountKey][]int64
+}
+
+// 重建账号索引
+func (this *FileCollectionPlayer) buildIndex() error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.playerAccounts = make(map[int64]fileAccountKey)
+	this.accountPlayers = make(map[fileAccountKey][]int64)
+	return this.documents.rangeDocs(func(doc memDocument) bool {
+		this.updateIndex(doc[this.uniqueId], doc)
+		return true
+	})
+}
+
+// 更新账号索引,调用者需要加锁
+func (this *FileCollectionPlayer) updateIndex(entityKey any, doc memDocument) {
+	playerId, ok := toInt64(entityKey)
+	if !ok {
+		return
+	}
+	if oldAccount, exists := this.playerAccounts[playerId]; exists {
+		playerIds := this.accountPlayers[oldAccount]
+		if index, found := slices.BinarySearch(playerIds, playerId); found {
+			playerIds = slices.Delete(playerIds, index, index+1)
+		}
+		if len(playerIds) == 0 {
+			delete(this.accountPlayers, oldAccount)
+		} else {
+			this.accountPlayers[oldAccount] = playerIds
+		}
+		delete(this.playerAccounts, playerId)
+	}
+	if doc == nil {
+		return
+	}
+	accountId, _ := toInt64(doc[this.colAccountId])
+	regionId, _ := toInt64(doc[this.colRegionId])
+	account := fileAccountKey{accountId: accountId, regionId: int32(regionId)}
+	this.playerAccounts[playerId] = account
+	playerIds := this.accountPlayers[account]
+	index, _ := slices.BinarySearch(playerIds, playerId)
+	this.accountPlayers[account] = slices.Insert(playerIds, index, playerId)
+}
+
+// 根据账号id查找玩家数据
+// 适用于一个账号在一个区服只有一个玩家角色的游戏
+func (this *FileCollectionPlayer) FindPlayerByAccountId(accountId int64, regionId int32, playerData interface{}) (bool, error) {
+	exists, _, err := this.FindPlayerByAccountIdWithVersion(accountId, regionId, playerData)
+	return exists, err
+}
+
+func (this *FileCollectionPlayer) FindPlayerByAccountIdWithVersion(accountId int64, regionId int32, playerData interface{}) (bool, int64, error) {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+	playerIds := this.accountPlayers[fileAccountKey{accountId: accountId, regionId: regionId}]
+	if len(playerIds) == 0 {
+		return false, 0, nil
+	}
+	doc, err := this.documents.read(playerIds[0])
+	if err != nil || doc == nil {
+		return false, 0, err
+	}
+	err = decodeBsonDocument(doc, playerData)
+	if err != nil {
+		return false, 0, err
+	}
+	return true, getDocumentVersion(doc, this.versionField), nil
+}
+
+func (this *FileCollectionPlayer) FindPlayerIdByAccountId(accountId int64, regionId int32) (int64, error) {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+	playerIds := this.accountPlayers[fileAccountKey{accountId: accountId, regionId: regionId}]
+	if len(playerIds) == 0 {
+		return 0, nil
+	}
+	return playerIds[0], nil
+}
+
+func (this *FileCollectionPlayer) FindPlayerIdsByAccountId(accountId int64, regionId int32) ([]int64, error) {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+	return slices.Clone(this.accountPlayers[fileAccountKey{accountId: accountId, regionId: regionId}]), nil
+}
+
+func (this *FileCollectionPlayer) FindAccountIdByPlayerId(playerId int64) (int64, error) {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+	return this.playerAccounts[playerId].accountId, nil
+}
+
+// KvDb的本地文件实现,一个key对应一个文件
+type FileKvDb struct {
+	documents *fileDocuments
+	lock      sync.RWMutex
+
+	// 表名
+	collectionName string
+	// key column name
+	keyName string
+	// value column name
+	valueName string
+}
+
+func (this *FileKvDb) Find(key interface{}) (interface{}, error) {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+	doc, err := this.documents.read(key)
+	if err != nil || doc == nil {
+		return nil, err
+	}
+	// 和MongoKvDb.Find的返回格式保持一致
+	var result bson.M
+	err = decodeBsonDocument(doc, &result)
+	if err != nil {
+		return nil, err
+	}
+	return result[this.valueName], nil
+}
+
+func (this *FileKvDb) FindAndDecode(key interface{}, decodeData interface{}) error {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+	doc, err := this.documents.read(key)
+	if err != nil || doc == nil {
+		return err
+	}
+	raw, err := bson.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	value, err := bson.Raw(raw).LookupErr(this.valueName)
+	if err != nil {
+		return err
+	}
+	return value.Unmarshal(decodeData)
+}
+
+func (this *FileKvDb) Insert(key interface{}, value interface{}) (err error, isDuplicateKey bool) {
+	doc, err := toBsonDocument(bson.D{{Key: this.keyName, Value: key}, {Key: this.valueName, Value: value}})
+	if err != nil {
+		return err, false
+	}
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if this.documents.exists(key) {
+		return fmt.Errorf("%v %v:%v %w", this.collectionName, this.keyName, key, ErrDuplicateKey), true
+	}
+	return this.documents.write(key, doc), false
+}
+
+func (this *FileKvDb) Update(key interface{}, value interface{}, upsert bool) error {
+	bsonValue, err := toBsonValue(value)
+	if err != nil {
+		return err
+	}
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	doc, err := this.documents.read(key)
+	if err != nil {
+		return err
+	}
+	if doc == nil {
+		if !upsert {
+			return nil
+		}
+		doc, err = toBsonDocument(bson.D{{Key: this.keyName, Value: key}})
+		if err != nil {
+			return err
+		}
+	}
+	doc[this.valueName] = bsonValue
+	return this.documents.write(key, doc)
+}
+
+func (this *FileKvDb) Inc(key interface{}, value interface{}, upsert bool) (interface{}, error) {
+	bsonValue, err := toBsonValue(value)
+	if err != nil {
+		return nil, err
+	}
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	doc, err := this.documents.read(key)
+	if err != nil {
+		return nil, err
+	}
+	if doc == nil {
+		if !upsert {
+			// 和mongodb的FindOneAndUpdate一致
+			return nil, mongo.ErrNoDocuments
+		}
+		doc, err = toBsonDocument(bson.D{{Key: this.keyName, Value: key}})
+		if err != nil {
+			return nil, err
+		}
+	}
+	newValue, err := incBsonValue(doc[this.valueName], bsonValue)
+	if err != nil {
+		return nil, err
+	}
+	doc[this.valueName] = newValue
+	if err = this.documents.write(key, doc); err != nil {
+		return nil, err
+	}
+	return newValue, nil
+}
+
+func (this *FileKvDb) Delete(key interface{}) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return this.documents.delete(key)
+}
+
+func (this *FileKvDb) FindMany(keys []interface{}) (map[interface{}]interface{}, error) {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+	values := make(map[interface{}]interface{})
+	for _, key := range keys {
+		doc, err := this.documents.read(key)
+		if err != nil {
+			return nil, err
+		}
+		if doc == nil {
+			continue
+		}
+		value, err := getKvDocumentValue(doc, this.valueName)
+		if err != nil {
+			return nil, err
+		}
+		values[key] = value
+	}
+	return values, nil
+}
+
+func (this *FileKvDb) CompareAndSwap(key interface{}, expected interface{}, newValue interface{}) (bool, error) {
+	if expected == nil {
+		err, isDuplicateKey := this.Insert(key, newValue)
+		if isDuplicateKey {
+			return false, nil
+		}
+		return err == nil, err
+	}
+	expectedValue, err := toBsonValue(expected)
+	if err != nil {
+		return false, err
+	}
+	bsonValue, err := toBsonValue(newValue)
+	if err != nil {
+		return false, err
+	}
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	doc, err := this.documents.read(key)
+	if err != nil || doc == nil || !isBsonValueEqual(doc[this.valueName], expectedValue) {
+		return false, err
+	}
+	doc[this.valueName] = bsonValue
+	if err = this.documents.write(key, doc); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// 需要读取所有文件,适用于数据量不大的情况
+func (this *FileKvDb) Scan(scan *KvScan) (*KvScanResult, error) {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+	var docs []memDocument
+	err := this.documents.rangeDocs(func(doc memDocument) bool {
+		docs = append(docs, doc)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return scanKvDocuments(docs, this.keyName, this.valueName, scan)
+}
+
+func (this *FileKvDb) IncFields(key interface{}, fields map[string]interface{}, upsert bool) (map[string]interface{}, error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	doc, err := this.documents.read(key)
+	if err != nil {
+		return nil, err
+	}
+	if doc == nil {
+		if !upsert {
+			// 和mongodb的FindOneAndUpdate一致
+			return nil, mongo.ErrNoDocuments
+		}
+		doc, err = toBsonDocument(bson.D{{Key: this.keyName, Value: key}})
+		if err != nil {
+			return nil, err
+		}
+	}
+	newValues, err := incKvDocumentFields(doc, this.valueName, fields)
+	if err != nil {
+		return nil, err
+	}
+	if err = this.documents.write(key, doc); err != nil {
+		return nil, err
+	}
+	return newValues, nil
+}
+
+// DbMgr的本地文件实现
+//
+//	接口和MongoDb一致,每个collection对应rootDir下的一个子目录
+type FileDb struct {
+	rootDir   string
+	entityDbs map[string]EntityDb
+	kvDbs     map[string]KvDb
+}
+
+func NewFileDb(rootDir string) *FileDb {
+	return &FileDb{
+		rootDir:   rootDir,
+		entityDbs: make(map[string]EntityDb),
+		kvDbs:     make(map[string]KvDb),
+	}
+}
+
+func (this *FileDb) newDocuments(collectionName string) *fileDocuments {
+	return &fileDocuments{
+		dir: filepath.Join(this.rootDir, collectionName),
+	}
+}
+
+// 注册普通Entity对应的表
+func (this *FileDb) RegisterEntityDb(collectionName string, uniqueId string) EntityDb {
+	col := &FileCollection{
+		documents:      this.newDocuments(collectionName),
+		collectionName: collectionName,
+		uniqueId:       uniqueId,
+	}
+	this.entityDbs[collectionName] = col
+	GetLogger().Info("RegisterEntityDb %v %v", collectionName, uniqueId)
+	return col
+}
+
+// 注册玩家对应的表
+func (this *FileDb) RegisterPlayerDb(collectionName string, playerId, accountId, region string) PlayerDb {
+	col := &FileCollectionPlayer{
+		FileCollection: FileCollection{
+			documents:      this.newDocuments(collectionName),
+			collectionName: collectionName,
+			uniqueId:       playerId,
+		},
+		colAccountId:   accountId,
+		colRegionId:    region,
+		playerAccounts: make(map[int64]fileAccountKey),
+		accountPlayers: make(map[fileAccountKey][]int64),
+	}
+	col.onChanged = col.updateIndex
+	this.entityDbs[collectionName] = col
+	GetLogger().Info("RegisterPlayerDb %v %v", collectionName, playerId)
+	return col
+}
+
+func (this *FileDb) RegisterKvDb(collectionName string, keyName, valueName string) KvDb {
+	col := &FileKvDb{
+		documents:      this.newDocuments(collectionName),
+		collectionName: collectionName,
+		keyName:        keyName,
+		valueName:      valueName,
+	}
+	this.kvDbs[collectionName] = col
+	GetLogger().Info("RegisterKvDb %v %v %v", collectionName, keyName, valueName)
+	return col
+}
+
+func (this *FileDb) GetEntityDb(name string) EntityDb {
+	return this.entityDbs[name]
+}
+
+func (this *FileDb) GetKvDb(name string) KvDb {
+	return this.kvDbs[name]
+}
+
+// 创建目录,并建立玩家表的账号索引
+func (this *FileDb) Connect() bool {
+	for _, entityDb := range this.entityDbs {
+		switch fileCollection := entityDb.(type) {
+		case *FileCollection:
+			if err := fileCollection.documents.init(); err != nil {
+				GetLogger().Error("%v init err:%v", fileCollection.collectionName, err)
+				return false
+			}
+		case *FileCollectionPlayer:
+			if err := fileCollection.documents.init(); err != nil {
+				GetLogger().Error("%v init err:%v", fileCollection.collectionName, err)
+				return false
+			}
+			if err := fileCollection.buildIndex(); err != nil {
+				GetLogger().Error("%v buildIndex err:%v", fileCollection.collectionName, err)
+				return false
+			}
+		}
+	}
+	for _, kvDb := range this.kvDbs {
+		if fileKvDb, ok := kvDb.(*FileKvDb); ok {
+			if err := fileKvDb.documents.init(); err != nil {
+				GetLogger().Error("%v init err:%v", fileKvDb.collectionName, err)
+				return false
+			}
+		}
+	}
+	GetLogger().Info("file db Connected %v", this.rootDir)
+	return true
+}
+
+func (this *FileDb) Disconnect() {
+	GetLogger().Info("file db Disconnected %v", this.rootDir)
+}
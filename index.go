@@ -0,0 +1,217 @@
+package gentity
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// 索引的关键字,用在组件的保存字段上,允许应用层自行修改
+//
+//	多个索引用;分隔,每个索引的字段和选项用,分隔
+//	字段名是相对于保存字段的路径,字段名前加-表示降序,没有字段名表示索引保存字段本身
+//	选项: unique(唯一索引) sparse(稀疏索引) ttl=时长(如ttl=24h,ttl=0s表示在字段的时间过期,只能用于单字段的时间类型)
+//	type BaseInfo struct {
+//	  gentity.DataComponent
+//	  BaseInfo *pb.BaseInfo `db:"plain" index:"-level,-exp;gender"`
+//	}
+//	type Guild struct {
+//	  gentity.BaseComponent
+//	  Name *gentity.ProtoData[string] `child:"" index:"unique"`
+//	}
+var KeywordIndex = "index"
+
+// 索引的字段
+type IndexKey struct {
+	// 字段路径,如BaseInfo.level
+	Field string
+	// 是否降序
+	Desc bool
+}
+
+// 索引定义
+type IndexDef struct {
+	// 索引名,为空则使用mongodb默认的命名规则,如AccountId_1_RegionId_1
+	Name string
+	Keys []IndexKey
+	// 唯一索引
+	Unique bool
+	// 稀疏索引
+	Sparse bool
+	// 是否是TTL索引
+	TTL bool
+	// TTL索引的过期时间,字段的时间加上ExpireAfter之后过期,0表示在字段的时间过期
+	ExpireAfter time.Duration
+}
+
+// 创建索引定义,字段名前加-表示降序
+//
+//	NewIndexDef("AccountId", "RegionId")
+//	NewIndexDef("-BaseInfo.level").SetName("level")
+func NewIndexDef(fields ...string) *IndexDef {
+	indexDef := &IndexDef{}
+	for _, field := range fields {
+		indexDef.Keys = append(indexDef.Keys, parseIndexKey(field))
+	}
+	return indexDef
+}
+
+func parseIndexKey(field string) IndexKey {
+	if strings.HasPrefix(field, "-") {
+		return IndexKey{Field: field[1:], Desc: true}
+	}
+	return IndexKey{Field: field}
+}
+
+func (this *IndexDef) SetName(name string) *IndexDef {
+	this.Name = name
+	return this
+}
+
+func (this *IndexDef) SetUnique(unique bool) *IndexDef {
+	this.Unique = unique
+	return this
+}
+
+func (this *IndexDef) SetSparse(sparse bool) *IndexDef {
+	this.Sparse = sparse
+	return this
+}
+
+// 设置为TTL索引
+func (this *IndexDef) SetExpireAfter(expireAfter time.Duration) *IndexDef {
+	this.TTL = true
+	this.ExpireAfter = expireAfter
+	return this
+}
+
+// 索引名
+func (this *IndexDef) GetName() string {
+	if this.Name != "" {
+		return this.Name
+	}
+	var sb strings.Builder
+	for i, key := range this.Keys {
+		if i > 0 {
+			sb.WriteString("_")
+		}
+		sb.WriteString(key.Field)
+		if key.Desc {
+			sb.WriteString("_-1")
+		} else {
+			sb.WriteString("_1")
+		}
+	}
+	return sb.String()
+}
+
+func (this *IndexDef) String() string {
+	if this.TTL {
+		return fmt.Sprintf("%v%v unique:%v sparse:%v expireAfter:%v", this.GetName(), this.Keys, this.Unique, this.Sparse, this.ExpireAfter)
+	}
+	return fmt.Sprintf("%v%v unique:%v sparse:%v", this.GetName(), this.Keys, this.Unique, this.Sparse)
+}
+
+// 解析组件保存字段上的index标签
+func parseIndexTag(fieldPath string, indexSetting string) ([]*IndexDef, error) {
+	var indexDefs []*IndexDef
+	for _, indexStr := range strings.Split(indexSetting, ";") {
+		indexDef := &IndexDef{}
+		for _, item := range strings.Split(indexStr, ",") {
+			item = strings.TrimSpace(item)
+			switch {
+			case item == "":
+			case item == "unique":
+				indexDef.Unique = true
+			case item == "sparse":
+				indexDef.Sparse = true
+			case strings.HasPrefix(item, "ttl="):
+				expireAfter, err := time.ParseDuration(strings.TrimPrefix(item, "ttl="))
+				if err != nil {
+					return nil, err
+				}
+				indexDef.SetExpireAfter(expireAfter)
+			default:
+				indexKey := parseIndexKey(item)
+				indexKey.Field = fieldPath + "." + indexKey.Field
+				indexDef.Keys = append(indexDef.Keys, indexKey)
+			}
+		}
+		if len(indexDef.Keys) == 0 {
+			indexDef.Keys = append(indexDef.Keys, IndexKey{Field: fieldPath})
+		}
+		if indexDef.TTL && len(indexDef.Keys) > 1 {
+			return nil, errors.New(fmt.Sprintf("%v ttl index must be single field", fieldPath))
+		}
+		indexDefs = append(indexDefs, indexDef)
+	}
+	return indexDefs, nil
+}
+
+// 解析实体的组件保存字段上的index标签
+//
+//	用于MongoDb.RegisterEntityDb和MongoDb.RegisterPlayerDb的索引参数
+func GetEntityIndexDefs(entity Entity) []*IndexDef {
+	var indexDefs []*IndexDef
+	entity.RangeComponent(func(component Component) bool {
+		structCache := GetObjSaveableStruct(component)
+		if structCache == nil {
+			return true
+		}
+		componentName := GetComponentSaveName(component)
+		addFieldIndexDefs := func(fieldPath string, structField reflect.StructField) {
+			indexSetting, ok := structField.Tag.Lookup(KeywordIndex)
+			if !ok {
+				return
+			}
+			fieldIndexDefs, err := parseIndexTag(fieldPath, indexSetting)
+			if err != nil {
+				GetLogger().Error("%v %v index err:%v", componentName, structField.Name, err)
+				return
+			}
+			indexDefs = append(indexDefs, fieldIndexDefs...)
+		}
+		if structCache.IsSingleField() {
+			addFieldIndexDefs(componentName, structCache.Field.StructField)
+		} else {
+			for _, childField := range structCache.Children {
+				addFieldIndexDefs(componentName+"."+childField.Name, childField.StructField)
+			}
+		}
+		return true
+	})
+	return indexDefs
+}
+
+// 数据库里的索引和声明的索引不一致的类型
+type IndexDriftType int
+
+const (
+	// 同名索引的字段或选项和声明的不一致
+	IndexDriftMismatch IndexDriftType = iota + 1
+	// 数据库里存在未声明的索引
+	IndexDriftUndeclared
+)
+
+// 数据库里的索引和声明的索引不一致
+//
+//	不会自动删除或者重建索引,由运维人员处理
+type IndexDrift struct {
+	CollectionName string
+	IndexName      string
+	DriftType      IndexDriftType
+	// 描述,如: declared:xxx existing:xxx
+	Detail string
+}
+
+func (this *IndexDrift) String() string {
+	switch this.DriftType {
+	case IndexDriftMismatch:
+		return fmt.Sprintf("%v index %v mismatch %v", this.CollectionName, this.IndexName, this.Detail)
+	case IndexDriftUndeclared:
+		return fmt.Sprintf("%v index %v undeclared %v", this.CollectionName, this.IndexName, this.Detail)
+	}
+	return fmt.Sprintf("%v index %v %v", this.CollectionName, this.IndexName, this.Detail)
+}
@@ -0,0 +1,214 @@
+package gentity
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// map或者struct -> 字段名:字段值
+func toJsonFields(entityData interface{}) (map[string]any, error) {
+	if fields, ok := entityData.(map[string]interface{}); ok {
+		copyFields := make(map[string]any, len(fields))
+		for k, v := range fields {
+			copyFields[k] = v
+		}
+		return copyFields, nil
+	}
+	jsonBytes, err := json.Marshal(entityData)
+	if err != nil {
+		return nil, err
+	}
+	rawFields := make(map[string]json.RawMessage)
+	if err = json.Unmarshal(jsonBytes, &rawFields); err != nil {
+		return nil, err
+	}
+	fields := make(map[string]any, len(rawFields))
+	for k, v := range rawFields {
+		fields[k] = v
+	}
+	return fields, nil
+}
+
+// json -> interface{},整数解析成int64,其他数字解析成float64
+func decodeJsonValue(value []byte) (interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(value))
+	decoder.UseNumber()
+	var v interface{}
+	if err := decoder.Decode(&v); err != nil {
+		return nil, err
+	}
+	if number, ok := v.(json.Number); ok {
+		if i, err := number.Int64(); err == nil {
+			return i, nil
+		}
+		return number.Float64()
+	}
+	return v, nil
+}
+
+// json数字 + incValue -> json数字
+func addJsonValue(oldValue []byte, incValue any) ([]byte, error) {
+	var old any = int64(0)
+	if oldValue != nil {
+		var err error
+		old, err = decodeJsonValue(oldValue)
+		if err != nil {
+			return nil, err
+		}
+	}
+	oldInt, oldIsInt := old.(int64)
+	incInt, incIsInt := toInt64(incValue)
+	if oldIsInt && incIsInt {
+		return json.Marshal(oldInt + incInt)
+	}
+	oldFloat, ok1 := toFloat64(old)
+	incFloat, ok2 := toFloat64(incValue)
+	if !ok1 || !ok2 {
+		return nil, errors.New(fmt.Sprintf("Cannot apply $inc to a value of non-numeric type:%v %v", old, incValue))
+	}
+	return json.Marshal(oldFloat + incFloat)
+}
+
+// 字段名:json数据 -> data
+func decodeJsonFields(fields map[string]json.RawMessage, data interface{}) error {
+	docBytes, err := json.Marshal(fields)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(docBytes, data)
+}
+
+// 设置json对象的字段,中间层的对象不存在时会自动创建
+//
+//	和mongodb一样,不能在非对象类型的字段下创建字段
+func setJsonPath(raw json.RawMessage, names []string, value json.RawMessage) (json.RawMessage, error) {
+	if len(names) == 0 {
+		return value, nil
+	}
+	obj := make(map[string]json.RawMessage)
+	if len(raw) > 0 && string(raw) != "null" {
+		if err := json.Unmarshal(raw, &obj); err != nil {
+			return nil, errors.New(fmt.Sprintf("Cannot create field '%v' in element %v", names[0], string(raw)))
+		}
+	}
+	child, err := setJsonPath(obj[names[0]], names[1:], value)
+	if err != nil {
+		return nil, err
+	}
+	obj[names[0]] = child
+	return json.Marshal(obj)
+}
+
+// 删除json对象的字段,字段不存在时不报错
+func removeJsonPath(raw json.RawMessage, names []string) (json.RawMessage, error) {
+	if len(names) == 0 || len(raw) == 0 {
+		return raw, nil
+	}
+	obj := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(raw, &obj); err != nil {
+		// 非对象类型的字段,和mongodb的$unset一样忽略
+		return raw, nil
+	}
+	child, ok := obj[names[0]]
+	if !ok {
+		return raw, nil
+	}
+	if len(names) == 1 {
+		delete(obj, names[0])
+	} else {
+		newChild, err := removeJsonPath(child, names[1:])
+		if err != nil {
+			return nil, err
+		}
+		obj[names[0]] = newChild
+	}
+	return json.Marshal(obj)
+}
+
+// json文档中字段路径的json数据,字段不存在时返回nil
+func getJsonPath(raw json.RawMessage, names []string) (json.RawMessage, error) {
+	for _, name := range names {
+		if raw == nil {
+			return nil, nil
+		}
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(raw, &fields); err != nil {
+			return nil, err
+		}
+		raw = fields[name]
+	}
+	return raw, nil
+}
+
+// json文档中字段路径的值,字段不存在时返回nil
+func getJsonPathValue(raw json.RawMessage, names []string) (interface{}, error) {
+	raw, err := getJsonPath(raw, names)
+	if err != nil || raw == nil {
+		return nil, err
+	}
+	return decodeJsonValue(raw)
+}
+
+// 累加json对象的多个字段,字段路径用.分隔 -> 新的json对象,累加后的值
+func incJsonFields(oldValue []byte, fields map[string]any) ([]byte, map[string]any, error) {
+	newValue := json.RawMessage(oldValue)
+	newValues := make(map[string]any, len(fields))
+	for fieldPath, incValue := range fields {
+		names := strings.Split(fieldPath, ".")
+		oldField, err := getJsonPath(newValue, names)
+		if err != nil {
+			return nil, nil, err
+		}
+		newField, err := addJsonValue(oldField, incValue)
+		if err != nil {
+			return nil, nil, err
+		}
+		if newValue, err = setJsonPath(newValue, names, newField); err != nil {
+			return nil, nil, err
+		}
+		if newValues[fieldPath], err = decodeJsonValue(newField); err != nil {
+			return nil, nil, err
+		}
+	}
+	return newValue, newValues, nil
+}
+
+// 把数据逐个序列化成json
+func marshalJsonItems(items []interface{}) ([]string, error) {
+	jsonItems := make([]string, len(items))
+	for i, item := range items {
+		itemBytes, err := json.Marshal(item)
+		if err != nil {
+			return nil, err
+		}
+		jsonItems[i] = string(itemBytes)
+	}
+	return jsonItems, nil
+}
+
+// 在json对象的数组字段的尾部追加数据,字段不存在时创建数组
+func appendJsonPath(raw json.RawMessage, names []string, items []interface{}) (json.RawMessage, error) {
+	oldList, err := getJsonPath(raw, names)
+	if err != nil {
+		return nil, err
+	}
+	list, err := parseJsonList(oldList)
+	if err != nil {
+		return nil, err
+	}
+	for _, item := range items {
+		itemBytes, err := json.Marshal(item)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, itemBytes)
+	}
+	newList, err := json.Marshal(list)
+	if err != nil {
+		return nil, err
+	}
+	return setJsonPath(raw, names, newList)
+}
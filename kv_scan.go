@@ -0,0 +1,150 @@
+package gentity
+
+import (
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"slices"
+	"strings"
+)
+
+// KvDb的扫描条件,按照key升序
+//
+// example:
+//
+//	// 拍卖行的商品,key格式为auction_商品id,每页50条
+//	scan := NewKvScan().SetPrefix("auction_").SetLimit(50)
+type KvScan struct {
+	// key的前缀,只对字符串类型的key有效
+	Prefix string
+	// key的范围[Start,End),nil表示不限制
+	Start interface{}
+	End   interface{}
+	// <=0表示不限制数量
+	Limit int64
+	// 从游标之后开始扫描,值是上一页最后一条数据的key
+	Cursor interface{}
+}
+
+// key-value
+type KvPair struct {
+	Key   interface{}
+	Value interface{}
+}
+
+// 扫描结果
+type KvScanResult struct {
+	Pairs []*KvPair
+	// 下一页的游标,Limit>0且返回的数据量等于Limit时才有值
+	NextCursor interface{}
+}
+
+func NewKvScan() *KvScan {
+	return &KvScan{}
+}
+
+func (this *KvScan) SetPrefix(prefix string) *KvScan {
+	this.Prefix = prefix
+	return this
+}
+
+// key的范围[start,end),nil表示不限制
+func (this *KvScan) SetRange(start, end interface{}) *KvScan {
+	this.Start = start
+	this.End = end
+	return this
+}
+
+func (this *KvScan) SetLimit(limit int64) *KvScan {
+	this.Limit = limit
+	return this
+}
+
+func (this *KvScan) SetCursor(cursor interface{}) *KvScan {
+	this.Cursor = cursor
+	return this
+}
+
+// key是否满足扫描条件,比较规则和mongodb一致
+func (this *KvScan) matchKey(key interface{}) bool {
+	if this.Prefix != "" {
+		s, ok := key.(string)
+		if !ok || !strings.HasPrefix(s, this.Prefix) {
+			return false
+		}
+	}
+	if this.Start != nil && compareBsonValue(key, this.Start) < 0 {
+		return false
+	}
+	if this.End != nil && compareBsonValue(key, this.End) >= 0 {
+		return false
+	}
+	if this.Cursor != nil && compareBsonValue(key, this.Cursor) <= 0 {
+		return false
+	}
+	return true
+}
+
+func (this *KvScan) makeResult(pairs []*KvPair) *KvScanResult {
+	result := &KvScanResult{
+		Pairs: pairs,
+	}
+	if this.Limit > 0 && int64(len(pairs)) == this.Limit {
+		result.NextCursor = pairs[len(pairs)-1].Key
+	}
+	return result
+}
+
+// kv文档的value,和MongoKvDb.Find的返回格式保持一致
+func getKvDocumentValue(doc memDocument, valueName string) (interface{}, error) {
+	var result bson.M
+	if err := decodeBsonDocument(doc, &result); err != nil {
+		return nil, err
+	}
+	return result[valueName], nil
+}
+
+// 在内存中扫描kv文档,MemKvDb和FileKvDb共用
+func scanKvDocuments(docs []memDocument, keyName, valueName string, scan *KvScan) (*KvScanResult, error) {
+	var matchDocs []memDocument
+	for _, doc := range docs {
+		if scan.matchKey(doc[keyName]) {
+			matchDocs = append(matchDocs, doc)
+		}
+	}
+	slices.SortFunc(matchDocs, func(a, b memDocument) int {
+		return compareBsonValue(a[keyName], b[keyName])
+	})
+	if scan.Limit > 0 && int64(len(matchDocs)) > scan.Limit {
+		matchDocs = matchDocs[:scan.Limit]
+	}
+	var pairs []*KvPair
+	for _, doc := range matchDocs {
+		value, err := getKvDocumentValue(doc, valueName)
+		if err != nil {
+			return nil, err
+		}
+		pairs = append(pairs, &KvPair{Key: doc[keyName], Value: value})
+	}
+	return scan.makeResult(pairs), nil
+}
+
+// 累加kv文档的value里的多个字段,MemKvDb和FileKvDb共用
+func incKvDocumentFields(doc memDocument, valueName string, fields map[string]interface{}) (map[string]interface{}, error) {
+	newValues := make(map[string]interface{}, len(fields))
+	for fieldPath, incValue := range fields {
+		bsonValue, err := toBsonValue(incValue)
+		if err != nil {
+			return nil, err
+		}
+		path := valueName + "." + fieldPath
+		oldValue, _ := getDocumentPath(doc, path)
+		newValue, err := incBsonValue(oldValue, bsonValue)
+		if err != nil {
+			return nil, err
+		}
+		if err = setDocumentPath(doc, path, newValue); err != nil {
+			return nil, err
+		}
+		newValues[fieldPath] = newValue
+	}
+	return newValues, nil
+}
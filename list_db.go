@@ -0,0 +1,89 @@
+package gentity
+
+import (
+	"encoding/json"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"reflect"
+	"slices"
+)
+
+// EntityDb列表接口的通用操作,用于MongoCollection以外的实现,规则和mongodb保持一致
+
+// 添加到列表尾部,只保留最后的maxLen项,maxLen<=0表示不限制长度
+func pushListItem[T any](list []T, item T, maxLen int) []T {
+	list = append(slices.Clone(list), item)
+	if maxLen > 0 && len(list) > maxLen {
+		list = list[len(list)-maxLen:]
+	}
+	return list
+}
+
+// 取出列表头部的count项,count<=0表示取出全部
+func popListItems[T any](list []T, count int) (popped []T, rest []T) {
+	if count <= 0 || count >= len(list) {
+		return list, nil
+	}
+	return list[:count], slices.Clone(list[count:])
+}
+
+// 列表从start开始的最多count项,和mongodb的$slice:[skip,limit]一致
+func rangeListItems[T any](list []T, start int, count int) []T {
+	if start < 0 {
+		start = max(len(list)+start, 0)
+	}
+	if start >= len(list) {
+		return nil
+	}
+	if count <= 0 || count > len(list)-start {
+		count = len(list) - start
+	}
+	return list[start : start+count]
+}
+
+// 删除满足条件的项
+func removeListItems[T any](list []T, equal func(item T) bool) []T {
+	return slices.DeleteFunc(slices.Clone(list), equal)
+}
+
+// bson格式的列表 -> data(slice的指针)
+func decodeBsonList(list bson.A, data interface{}) error {
+	bytes, err := bson.Marshal(bson.D{{Key: "v", Value: list}})
+	if err != nil {
+		return err
+	}
+	return bson.Raw(bytes).Lookup("v").Unmarshal(data)
+}
+
+// json格式的列表 -> data(slice的指针)
+func decodeJsonList(list []json.RawMessage, data interface{}) error {
+	if list == nil {
+		list = []json.RawMessage{}
+	}
+	bytes, err := json.Marshal(list)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(bytes, data)
+}
+
+// json格式的列表,值为空时返回nil
+func parseJsonList(value []byte) ([]json.RawMessage, error) {
+	if len(value) == 0 || string(value) == "null" {
+		return nil, nil
+	}
+	var list []json.RawMessage
+	if err := json.Unmarshal(value, &list); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// json格式的值是否相等,数据库返回的json格式可能和序列化的格式不一致(如mysql会调整空格和字段顺序),解析后再比较
+func isJsonValueEqual(a, b []byte) bool {
+	valueA, errA := decodeJsonValue(a)
+	valueB, errB := decodeJsonValue(b)
+	if errA != nil || errB != nil {
+		return false
+	}
+	return reflect.DeepEqual(valueA, valueB)
+}
@@ -1,6 +1,7 @@
 package gentity
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -8,6 +9,7 @@ import (
 	"github.com/redis/go-redis/v9"
 	"google.golang.org/protobuf/proto"
 	"reflect"
+	"strings"
 )
 
 // map[k]any类型的字段,无法直接反序列化,因为不知道map的value具体是什么类型
@@ -264,6 +266,7 @@ func loadFieldSlice(obj any, field reflect.Value, data any, fieldStruct *Saveabl
 				field.Set(reflect.Append(field, reflect.ValueOf(dataItemInterface)))
 				GetLogger().Debug("%v append, fieldElemType:%v dataItemType:%v", fieldStruct.Name, fieldElemType, dataItemType)
 			}
+			setSliceDbSaved(obj)
 			return nil
 
 		default:
@@ -286,6 +289,7 @@ func loadFieldSlice(obj any, field reflect.Value, data any, fieldStruct *Saveabl
 				field.SetLen(dataVal.Len())
 			}
 			reflect.Copy(field, dataVal)
+			setSliceDbSaved(obj)
 			return nil
 		}
 
@@ -295,6 +299,13 @@ func loadFieldSlice(obj any, field reflect.Value, data any, fieldStruct *Saveabl
 	}
 }
 
+// 数据库里有整体数据了,之后的追加可以增量保存
+func setSliceDbSaved(obj any) {
+	if sliceDirtyMark, ok := obj.(SliceDirtyMark); ok {
+		sliceDirtyMark.SetDbSaved()
+	}
+}
+
 func loadFieldMap(obj any, field reflect.Value, data any, fieldStruct *SaveableField) error {
 	dataTyp := reflect.TypeOf(data)
 	if dataTyp.Kind() != reflect.Map {
@@ -312,6 +323,10 @@ func loadFieldMap(obj any, field reflect.Value, data any, fieldStruct *SaveableF
 		v := ConvertValueToInterface(dataValType, valType, sourceIt.Value())
 		field.SetMapIndex(reflect.ValueOf(k), reflect.ValueOf(v))
 	}
+	// 数据库里有整体数据了,之后的修改可以增量保存
+	if dbDirtyMark, ok := obj.(MapDbDirtyMark); ok {
+		dbDirtyMark.SetDbSaved()
+	}
 	return nil
 }
 
@@ -573,6 +588,30 @@ func loadFieldFromCache(obj any, kvCache KvCache, cacheKey string, fieldStruct *
 		}
 		return true, nil
 
+	case "list":
+		// list类型的缓存支持slice类型,每一项是json序列化的数据
+		if fieldType.Kind() != reflect.Slice {
+			GetLogger().Error("%v unsupport cache type:%v", cacheKey, cacheType)
+			return true, errors.New(fmt.Sprintf("%v unsupport cache type:%v", cacheKey, cacheType))
+		}
+		items, err := kvCache.LRange(cacheKey, 0, -1)
+		if IsRedisError(err) {
+			GetLogger().Error("LRange %v %v err:%v", cacheKey, cacheType, err)
+			return true, err
+		}
+		// 拼接成json数组后整体反序列化
+		err = json.Unmarshal([]byte("["+strings.Join(items, ",")+"]"), field.Addr().Interface())
+		if err != nil {
+			GetLogger().Error("list json.Unmarshal %v err:%v", cacheKey, err)
+			return true, err
+		}
+		// 缓存里有整体数据了,之后的追加可以RPUSH
+		if sliceDirtyMark, ok := obj.(SliceDirtyMark); ok {
+			sliceDirtyMark.SetCached()
+		}
+		GetLogger().Debug("load list %v field:%v", cacheKey, fieldStruct.Name)
+		return true, nil
+
 	default:
 		GetLogger().Error("%v unsupport cache type:%v", cacheKey, cacheType)
 		return true, errors.New(fmt.Sprintf("%v unsupport cache type:%v", cacheKey, cacheType))
@@ -621,8 +660,37 @@ func LoadFromCache(obj interface{}, kvCache KvCache, cacheKey string, parentObj
 	}
 }
 
+// LoadFromCache的context版本,缓存的操作都使用ctx
+func LoadFromCacheContext(ctx context.Context, obj interface{}, kvCache KvCache, cacheKey string, parentObj any) (bool, error) {
+	return LoadFromCache(obj, WithKvCacheContext(ctx, kvCache), cacheKey, parentObj)
+}
+
+// FixEntityDataFromCache的context版本,数据库和缓存的操作都使用ctx
+func FixEntityDataFromCacheContext(ctx context.Context, entity Entity, db EntityDb, kvCache KvCache, cacheKeyPrefix string, entityKey interface{}) {
+	FixEntityDataFromCache(entity, WithEntityDbContext(ctx, db), WithKvCacheContext(ctx, kvCache), cacheKeyPrefix, entityKey)
+}
+
+// 实体的数据库数据被外部修改时,删除受影响的组件的缓存
+// 防止之后加载实体时,FixEntityDataFromCache用旧的缓存数据覆盖数据库的修改
+//
+//	schemaEntity用于解析组件结构
+func InvalidateEntityCache(kvCache KvCache, schemaEntity Entity, cacheKeyPrefix string, event *EntityChangeEvent) error {
+	cacheKeys := GetEntityComponentCacheKeys(schemaEntity, cacheKeyPrefix, event.EntityKey, event.GetComponentNames()...)
+	if len(cacheKeys) == 0 {
+		return nil
+	}
+	_, err := kvCache.Del(cacheKeys...)
+	if IsRedisError(err) {
+		GetLogger().Error("InvalidateEntityCache %v err:%v", event.EntityKey, err.Error())
+		return err
+	}
+	GetLogger().Debug("InvalidateEntityCache %v %v", event.EntityKey, cacheKeys)
+	return nil
+}
+
 // 根据缓存数据,修复数据
 // 如:服务器crash时,缓存数据没来得及保存到数据库,服务器重启后读取缓存中的数据,保存到数据库,防止数据回档
+// 开启了乐观锁时,entity需要先设置加载时的版本号
 func FixEntityDataFromCache(entity Entity, db EntityDb, kvCache KvCache, cacheKeyPrefix string, entityKey interface{}) {
 	entity.RangeComponent(func(component Component) bool {
 		objStruct := GetObjSaveableStruct(component)
@@ -650,7 +718,8 @@ func FixEntityDataFromCache(entity Entity, db EntityDb, kvCache KvCache, cacheKe
 				GetLogger().Error("%v Save %v err %v", entityKey, component.GetName(), err.Error())
 				return true
 			}
-			saveDbErr := db.SaveComponent(entityKey, GetComponentSaveName(component), saveData)
+			// 开启了乐观锁时,检查并增加版本号,其他服务器上的旧实体之后保存会返回ErrVersionConflict
+			saveDbErr := saveEntityComponents(db, entity, entityKey, map[string]interface{}{GetComponentSaveName(component): saveData})
 			if saveDbErr != nil {
 				GetLogger().Error("%v SaveDb %v err %v", entityKey, GetComponentSaveName(component), saveDbErr.Error())
 				return true
@@ -689,7 +758,7 @@ func FixEntityDataFromCache(entity Entity, db EntityDb, kvCache KvCache, cacheKe
 					return true
 				}
 				//GetLogger().Debug("%v", saveData)
-				saveDbErr := db.SaveComponentField(entityKey, GetComponentSaveName(component), childStruct.Name, saveData)
+				saveDbErr := saveEntityComponents(db, entity, entityKey, map[string]interface{}{GetComponentSaveName(component) + "." + childStruct.Name: saveData})
 				if saveDbErr != nil {
 					GetLogger().Error("%v SaveDb %v.%v err %v", entityKey, GetComponentSaveName(component), childStruct.Name, saveDbErr.Error())
 					return true
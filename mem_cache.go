@@ -0,0 +1,789 @@
+package gentity
+
+import (
+	"encoding"
+	"errors"
+	"fmt"
+	"google.golang.org/protobuf/proto"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// https://github.com/uber-go/guide/blob/master/style.md#verify-interface-compliance
+var _ KvCache = (*MemCache)(nil)
+var _ AdvancedKvCache = (*MemCache)(nil)
+var _ AtomicHashKvCache = (*MemCache)(nil)
+var _ KvCacheBatch = (*MemCache)(nil)
+
+// 和redis一致的类型错误
+var errMemCacheWrongType = errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
+var errMemCacheNotInteger = errors.New("ERR value is not an integer or out of range")
+var errMemCacheNotFloat = errors.New("ERR value is not a valid float")
+
+// 缓存项,string或hash或zset或list
+type memCacheItem struct {
+	str  string
+	hash map[string]string
+	zset map[string]float64
+	list []string
+	// 过期时间,零值表示不过期
+	expireAt time.Time
+}
+
+func (this *memCacheItem) typeName() string {
+	if this.hash != nil {
+		return "hash"
+	}
+	if this.zset != nil {
+		return "zset"
+	}
+	if this.list != nil {
+		return "list"
+	}
+	return "string"
+}
+
+// KvCache的内存实现,模拟redis的string和hash的语义
+//
+//	用于单元测试和单进程的开发服务器,无需部署redis
+type MemCache struct {
+	items map[string]*memCacheItem
+	// 批量操作时使用空锁
+	lock sync.Locker
+	// 获取当前时间的接口,默认使用time.Now()
+	nowFunc func() time.Time
+}
+
+func NewMemCache() *MemCache {
+	return &MemCache{
+		items: make(map[string]*memCacheItem),
+		lock:  new(sync.Mutex),
+	}
+}
+
+func (this *MemCache) SetNowFunc(nowFunc func() time.Time) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.nowFunc = nowFunc
+}
+
+func (this *MemCache) now() time.Time {
+	if this.nowFunc == nil {
+		return time.Now()
+	}
+	return this.nowFunc()
+}
+
+// 获取缓存项,过期的缓存项会被删除
+// 调用者需要加锁
+func (this *MemCache) getItem(key string) *memCacheItem {
+	item, ok := this.items[key]
+	if !ok {
+		return nil
+	}
+	if !item.expireAt.IsZero() && !this.now().Before(item.expireAt) {
+		delete(this.items, key)
+		return nil
+	}
+	return item
+}
+
+// 调用者需要加锁
+func (this *MemCache) getHashItem(key string, create bool) (*memCacheItem, error) {
+	item := this.getItem(key)
+	if item == nil {
+		if !create {
+			return nil, nil
+		}
+		item = &memCacheItem{
+			hash: make(map[string]string),
+		}
+		this.items[key] = item
+		return item, nil
+	}
+	if item.hash == nil {
+		return nil, errMemCacheWrongType
+	}
+	return item, nil
+}
+
+// 调用者需要加锁
+func (this *MemCache) setString(key string, value interface{}, expiration time.Duration) error {
+	str, err := formatMemCacheValue(value)
+	if err != nil {
+		return err
+	}
+	item := &memCacheItem{
+		str: str,
+	}
+	if expiration > 0 {
+		item.expireAt = this.now().Add(expiration)
+	}
+	this.items[key] = item
+	return nil
+}
+
+func (this *MemCache) Get(key string) (string, error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	item := this.getItem(key)
+	if item == nil {
+		return "", nil
+	}
+	if item.typeName() != "string" {
+		return "", errMemCacheWrongType
+	}
+	return item.str, nil
+}
+
+func (this *MemCache) Set(key string, value interface{}, expiration time.Duration) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return this.setString(key, value, expiration)
+}
+
+func (this *MemCache) SetNX(key string, value interface{}, expiration time.Duration) (bool, error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if this.getItem(key) != nil {
+		return false, nil
+	}
+	err := this.setString(key, value, expiration)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (this *MemCache) Del(key ...string) (int64, error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	delCount := int64(0)
+	for _, k := range key {
+		if this.getItem(k) != nil {
+			delete(this.items, k)
+			delCount++
+		}
+	}
+	return delCount, nil
+}
+
+func (this *MemCache) Type(key string) (string, error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	item := this.getItem(key)
+	if item == nil {
+		return "none", nil
+	}
+	return item.typeName(), nil
+}
+
+// 设置过期时间,expiration<=0时删除缓存,和redis的Expire一致
+func (this *MemCache) Expire(key string, expiration time.Duration) (bool, error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	item := this.getItem(key)
+	if item == nil {
+		return false, nil
+	}
+	if expiration <= 0 {
+		delete(this.items, key)
+		return true, nil
+	}
+	item.expireAt = this.now().Add(expiration)
+	return true, nil
+}
+
+// 和redis一致,key不存在时从0开始,保留原来的过期时间
+func (this *MemCache) IncrBy(key string, value int64) (int64, error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	item := this.getItem(key)
+	if item == nil {
+		item = &memCacheItem{str: "0"}
+		this.items[key] = item
+	}
+	if item.typeName() != "string" {
+		return 0, errMemCacheWrongType
+	}
+	i, err := strconv.ParseInt(item.str, 10, 64)
+	if err != nil {
+		return 0, errMemCacheNotInteger
+	}
+	i += value
+	item.str = strconv.FormatInt(i, 10)
+	return i, nil
+}
+
+// 和redis一致,key不存在时从0开始,保留原来的过期时间
+func (this *MemCache) IncrByFloat(key string, value float64) (float64, error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	item := this.getItem(key)
+	if item == nil {
+		item = &memCacheItem{str: "0"}
+		this.items[key] = item
+	}
+	if item.typeName() != "string" {
+		return 0, errMemCacheWrongType
+	}
+	f, err := strconv.ParseFloat(item.str, 64)
+	if err != nil {
+		return 0, errMemCacheNotFloat
+	}
+	f += value
+	item.str = strconv.FormatFloat(f, 'f', -1, 64)
+	return f, nil
+}
+
+// f执行期间持有锁,f中的操作直接执行,其他协程不会看到中间状态
+//
+//	f中不能使用MemCache本身,否则会死锁
+func (this *MemCache) Batch(f func(batchCache KvCache)) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	// 嵌套的Batch已经持有锁
+	if _, ok := this.lock.(memCacheNoLock); ok {
+		f(this)
+		return nil
+	}
+	f(&MemCache{
+		items:   this.items,
+		lock:    memCacheNoLock{},
+		nowFunc: this.nowFunc,
+	})
+	return nil
+}
+
+// 空锁
+type memCacheNoLock struct {
+}
+
+func (this memCacheNoLock) Lock() {
+}
+
+func (this memCacheNoLock) Unlock() {
+}
+
+// 剩余的过期时间,和redis的TTL一致: key不存在返回-2,没有过期时间返回-1
+func (this *MemCache) TTL(key string) (time.Duration, error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	item := this.getItem(key)
+	if item == nil {
+		return -2, nil
+	}
+	if item.expireAt.IsZero() {
+		return -1, nil
+	}
+	return item.expireAt.Sub(this.now()), nil
+}
+
+// hash -> map
+func (this *MemCache) GetMap(key string, m interface{}) error {
+	if m == nil {
+		return errors.New(fmt.Sprintf("map must valid key:%v", key))
+	}
+	strMap, err := this.HGetAll(key)
+	if err != nil {
+		return err
+	}
+	return loadMapFromCacheData(key, strMap, m)
+}
+
+// map -> hash
+func (this *MemCache) SetMap(k string, m interface{}) error {
+	cacheData, err := convertMapToCacheData(m)
+	if err != nil {
+		return err
+	}
+	if len(cacheData) == 0 {
+		return nil
+	}
+	_, err = this.HSet(k, cacheData)
+	return err
+}
+
+func (this *MemCache) HGetAll(key string) (map[string]string, error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	item, err := this.getHashItem(key, false)
+	if err != nil {
+		return nil, err
+	}
+	m := make(map[string]string)
+	if item != nil {
+		for k, v := range item.hash {
+			m[k] = v
+		}
+	}
+	return m, nil
+}
+
+// 参数格式和RedisCache.HSet一致
+func (this *MemCache) HSet(key string, values ...interface{}) (int64, error) {
+	fieldValues, err := flattenMemCacheHashValues(values)
+	if err != nil {
+		return 0, err
+	}
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	item, err := this.getHashItem(key, true)
+	if err != nil {
+		return 0, err
+	}
+	addCount := int64(0)
+	for i := 0; i < len(fieldValues); i += 2 {
+		if _, ok := item.hash[fieldValues[i]]; !ok {
+			addCount++
+		}
+		item.hash[fieldValues[i]] = fieldValues[i+1]
+	}
+	return addCount, nil
+}
+
+func (this *MemCache) HSetNX(key, field string, value interface{}) (bool, error) {
+	str, err := formatMemCacheValue(value)
+	if err != nil {
+		return false, err
+	}
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	item, err := this.getHashItem(key, true)
+	if err != nil {
+		return false, err
+	}
+	if _, ok := item.hash[field]; ok {
+		return false, nil
+	}
+	item.hash[field] = str
+	return true, nil
+}
+
+func (this *MemCache) HDel(key string, fields ...string) (int64, error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	item, err := this.getHashItem(key, false)
+	if err != nil || item == nil {
+		return 0, err
+	}
+	delCount := int64(0)
+	for _, field := range fields {
+		if _, ok := item.hash[field]; ok {
+			delete(item.hash, field)
+			delCount++
+		}
+	}
+	// 和redis一样,hash为空时删除key
+	if len(item.hash) == 0 {
+		delete(this.items, key)
+	}
+	return delCount, nil
+}
+
+func (this *MemCache) HSetIfNotExists(key string, values map[string]string, expiration time.Duration) (bool, error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if this.getItem(key) != nil {
+		return false, nil
+	}
+	item := &memCacheItem{
+		hash: make(map[string]string, len(values)),
+	}
+	for field, value := range values {
+		item.hash[field] = value
+	}
+	if expiration > 0 {
+		item.expireAt = this.now().Add(expiration)
+	}
+	this.items[key] = item
+	return true, nil
+}
+
+func (this *MemCache) HCompareAndSwap(key string, expected map[string]string, values map[string]string, delFields []string, expiration time.Duration) (bool, error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	item, err := this.getHashItem(key, false)
+	if err != nil || item == nil {
+		return false, err
+	}
+	for field, value := range expected {
+		if item.hash[field] != value {
+			return false, nil
+		}
+	}
+	for field, value := range values {
+		item.hash[field] = value
+	}
+	for _, field := range delFields {
+		delete(item.hash, field)
+	}
+	// 和redis一样,hash为空时删除key
+	if len(item.hash) == 0 {
+		delete(this.items, key)
+		return true, nil
+	}
+	if expiration > 0 {
+		item.expireAt = this.now().Add(expiration)
+	}
+	return true, nil
+}
+
+func (this *MemCache) GetProto(key string, value proto.Message) error {
+	str, err := this.Get(key)
+	// 不存在的key或者空数据,直接跳过,防止错误的覆盖
+	if err != nil {
+		return err
+	}
+	if len(str) == 0 {
+		return nil
+	}
+	return proto.Unmarshal([]byte(str), value)
+}
+
+// 调用者需要加锁
+func (this *MemCache) getZSetItem(key string, create bool) (*memCacheItem, error) {
+	item := this.getItem(key)
+	if item == nil {
+		if !create {
+			return nil, nil
+		}
+		item = &memCacheItem{
+			zset: make(map[string]float64),
+		}
+		this.items[key] = item
+		return item, nil
+	}
+	if item.zset == nil {
+		return nil, errMemCacheWrongType
+	}
+	return item, nil
+}
+
+// 调用者需要加锁
+func (this *MemCache) getListItem(key string) (*memCacheItem, error) {
+	item := this.getItem(key)
+	if item == nil {
+		return nil, nil
+	}
+	if item.list == nil {
+		return nil, errMemCacheWrongType
+	}
+	return item, nil
+}
+
+func (this *MemCache) ZAdd(key string, members ...ZMember) (int64, error) {
+	strMembers := make([]string, len(members))
+	for i, member := range members {
+		str, err := formatCacheMember(member.Member)
+		if err != nil {
+			return 0, err
+		}
+		strMembers[i] = str
+	}
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	item, err := this.getZSetItem(key, true)
+	if err != nil {
+		return 0, err
+	}
+	addCount := int64(0)
+	for i, member := range members {
+		if _, ok := item.zset[strMembers[i]]; !ok {
+			addCount++
+		}
+		item.zset[strMembers[i]] = member.Score
+	}
+	return addCount, nil
+}
+
+func (this *MemCache) ZIncrBy(key string, increment float64, member interface{}) (float64, error) {
+	str, err := formatCacheMember(member)
+	if err != nil {
+		return 0, err
+	}
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	item, err := this.getZSetItem(key, true)
+	if err != nil {
+		return 0, err
+	}
+	item.zset[str] += increment
+	return item.zset[str], nil
+}
+
+// 按分数从低到高排序,分数相同的按member的字典序,和redis一致
+func (this *memCacheItem) sortedZSetMembers() []ZMember {
+	members := make([]ZMember, 0, len(this.zset))
+	for member, score := range this.zset {
+		members = append(members, ZMember{
+			Score:  score,
+			Member: member,
+		})
+	}
+	sort.Slice(members, func(i, j int) bool {
+		if members[i].Score != members[j].Score {
+			return members[i].Score < members[j].Score
+		}
+		return members[i].Member.(string) < members[j].Member.(string)
+	})
+	return members
+}
+
+func (this *MemCache) ZRevRangeWithScores(key string, start, stop int64) ([]ZMember, error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	item, err := this.getZSetItem(key, false)
+	if err != nil || item == nil {
+		return nil, err
+	}
+	members := item.sortedZSetMembers()
+	slices.Reverse(members)
+	begin, end := memCacheRange(len(members), start, stop)
+	return members[begin:end], nil
+}
+
+func (this *MemCache) ZRank(key string, member interface{}) (int64, error) {
+	str, err := formatCacheMember(member)
+	if err != nil {
+		return -1, err
+	}
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	item, err := this.getZSetItem(key, false)
+	if err != nil || item == nil {
+		return -1, err
+	}
+	if _, ok := item.zset[str]; !ok {
+		return -1, nil
+	}
+	for i, m := range item.sortedZSetMembers() {
+		if m.Member.(string) == str {
+			return int64(i), nil
+		}
+	}
+	return -1, nil
+}
+
+func (this *MemCache) ZRem(key string, members ...interface{}) (int64, error) {
+	strMembers, err := formatCacheMembers(members)
+	if err != nil {
+		return 0, err
+	}
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	item, err := this.getZSetItem(key, false)
+	if err != nil || item == nil {
+		return 0, err
+	}
+	remCount := int64(0)
+	for _, member := range strMembers {
+		if _, ok := item.zset[member.(string)]; ok {
+			delete(item.zset, member.(string))
+			remCount++
+		}
+	}
+	// 和redis一样,有序集合为空时删除key
+	if len(item.zset) == 0 {
+		delete(this.items, key)
+	}
+	return remCount, nil
+}
+
+// 和redis一致,依次插入到列表头部
+func (this *MemCache) LPush(key string, values ...interface{}) (int64, error) {
+	strValues, err := formatCacheMembers(values)
+	if err != nil {
+		return 0, err
+	}
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	item, err := this.getListItem(key)
+	if err != nil {
+		return 0, err
+	}
+	if item == nil {
+		item = &memCacheItem{
+			list: make([]string, 0, len(strValues)),
+		}
+		this.items[key] = item
+	}
+	for _, value := range strValues {
+		item.list = append([]string{value.(string)}, item.list...)
+	}
+	return int64(len(item.list)), nil
+}
+
+// 和redis一致,依次插入到列表尾部
+func (this *MemCache) RPush(key string, values ...interface{}) (int64, error) {
+	strValues, err := formatCacheMembers(values)
+	if err != nil {
+		return 0, err
+	}
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	item, err := this.getListItem(key)
+	if err != nil {
+		return 0, err
+	}
+	if item == nil {
+		item = &memCacheItem{
+			list: make([]string, 0, len(strValues)),
+		}
+		this.items[key] = item
+	}
+	for _, value := range strValues {
+		item.list = append(item.list, value.(string))
+	}
+	return int64(len(item.list)), nil
+}
+
+func (this *MemCache) LTrim(key string, start, stop int64) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	item, err := this.getListItem(key)
+	if err != nil || item == nil {
+		return err
+	}
+	begin, end := memCacheRange(len(item.list), start, stop)
+	// 和redis一样,列表为空时删除key
+	if begin >= end {
+		delete(this.items, key)
+		return nil
+	}
+	item.list = slices.Clone(item.list[begin:end])
+	return nil
+}
+
+func (this *MemCache) LRange(key string, start, stop int64) ([]string, error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	item, err := this.getListItem(key)
+	if err != nil || item == nil {
+		return nil, err
+	}
+	begin, end := memCacheRange(len(item.list), start, stop)
+	return slices.Clone(item.list[begin:end]), nil
+}
+
+// redis的[start,stop]下标 -> [begin,end)
+// 负数表示从尾部开始计数,-1表示最后一个元素
+func memCacheRange(length int, start, stop int64) (int, int) {
+	n := int64(length)
+	if start < 0 {
+		start += n
+	}
+	if stop < 0 {
+		stop += n
+	}
+	if start < 0 {
+		start = 0
+	}
+	if stop >= n {
+		stop = n - 1
+	}
+	if start > stop {
+		return 0, 0
+	}
+	return int(start), int(stop + 1)
+}
+
+// value -> string,规则和go-redis的参数序列化一致
+// value如果是proto.Message,会先进行序列化
+func formatMemCacheValue(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case []byte:
+		return string(v), nil
+	case int:
+		return strconv.FormatInt(int64(v), 10), nil
+	case int8:
+		return strconv.FormatInt(int64(v), 10), nil
+	case int16:
+		return strconv.FormatInt(int64(v), 10), nil
+	case int32:
+		return strconv.FormatInt(int64(v), 10), nil
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	case uint:
+		return strconv.FormatUint(uint64(v), 10), nil
+	case uint8:
+		return strconv.FormatUint(uint64(v), 10), nil
+	case uint16:
+		return strconv.FormatUint(uint64(v), 10), nil
+	case uint32:
+		return strconv.FormatUint(uint64(v), 10), nil
+	case uint64:
+		return strconv.FormatUint(v, 10), nil
+	case float32:
+		return strconv.FormatFloat(float64(v), 'f', -1, 32), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case bool:
+		if v {
+			return "1", nil
+		}
+		return "0", nil
+	case time.Time:
+		return v.Format(time.RFC3339Nano), nil
+	case time.Duration:
+		return strconv.FormatInt(v.Nanoseconds(), 10), nil
+	case proto.Message:
+		bytes, err := proto.Marshal(v)
+		if err != nil {
+			return "", err
+		}
+		return string(bytes), nil
+	case encoding.BinaryMarshaler:
+		bytes, err := v.MarshalBinary()
+		if err != nil {
+			return "", err
+		}
+		return string(bytes), nil
+	default:
+		return "", errors.New(fmt.Sprintf("can't marshal %T (implement encoding.BinaryMarshaler)", value))
+	}
+}
+
+// HSet的参数 -> [field1,value1,field2,value2...]
+func flattenMemCacheHashValues(values []interface{}) ([]string, error) {
+	if len(values) == 1 {
+		switch v := values[0].(type) {
+		case []string:
+			values = make([]interface{}, len(v))
+			for i, s := range v {
+				values[i] = s
+			}
+		case []interface{}:
+			values = v
+		case map[string]interface{}:
+			values = make([]interface{}, 0, len(v)*2)
+			for field, value := range v {
+				values = append(values, field, value)
+			}
+		case map[string]string:
+			values = make([]interface{}, 0, len(v)*2)
+			for field, value := range v {
+				values = append(values, field, value)
+			}
+		}
+	}
+	if len(values) == 0 || len(values)%2 != 0 {
+		return nil, errors.New("wrong number of arguments for 'hset' command")
+	}
+	fieldValues := make([]string, len(values))
+	for i, value := range values {
+		str, err := formatMemCacheValue(value)
+		if err != nil {
+			return nil, err
+		}
+		fieldValues[i] = str
+	}
+	return fieldValues, nil
+}
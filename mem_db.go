@@ -0,0 +1,1218 @@
+package gentity
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/fish-tennis/gentity/util"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"math"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// https://github.com/uber-go/guide/blob/master/style.md#verify-interface-compliance
+var _ PlayerDb = (*MemCollectionPlayer)(nil)
+var _ VersionedPlayerDb = (*MemCollectionPlayer)(nil)
+var _ EntityDb = (*MemCollection)(nil)
+var _ IncrementalEntityDb = (*MemCollection)(nil)
+var _ VersionedEntityDb = (*MemCollection)(nil)
+var _ KvDb = (*MemKvDb)(nil)
+var _ ExpirableKvDb = (*MemKvDb)(nil)
+var _ AdvancedKvDb = (*MemKvDb)(nil)
+var _ DbMgr = (*MemDb)(nil)
+var _ TransactionDbMgr = (*MemDb)(nil)
+
+// 内存中的文档,数据格式和mongodb保持一致(先经过bson序列化),以便和MongoCollection有相同的加载结果
+type memDocument = bson.M
+
+// value -> bson格式的value
+// 嵌套的文档统一转换成bson.M,便于按照字段路径修改
+func toBsonValue(value any) (any, error) {
+	doc, err := toBsonDocument(bson.D{{Key: "v", Value: value}})
+	if err != nil {
+		return nil, err
+	}
+	return doc["v"], nil
+}
+
+// 对象 -> bson格式的文档
+func toBsonDocument(obj any) (memDocument, error) {
+	data, err := bson.Marshal(obj)
+	if err != nil {
+		return nil, err
+	}
+	decoder := bson.NewDecoder(bson.NewDocumentReader(bytes.NewReader(data)))
+	decoder.DefaultDocumentM()
+	doc := make(memDocument)
+	if err = decoder.Decode(&doc); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+// 文档 -> 对象,和mongo.SingleResult.Decode的规则一致
+func decodeBsonDocument(doc memDocument, data any) error {
+	bytes, err := bson.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	return bson.Unmarshal(bytes, data)
+}
+
+// 数值转换成int64,mongodb比较数值时不区分int32,int64,double
+func toInt64(v any) (int64, bool) {
+	switch n := v.(type) {
+	case int:
+		return int64(n), true
+	case int8:
+		return int64(n), true
+	case int16:
+		return int64(n), true
+	case int32:
+		return int64(n), true
+	case int64:
+		return n, true
+	case uint:
+		return int64(n), true
+	case uint8:
+		return int64(n), true
+	case uint16:
+		return int64(n), true
+	case uint32:
+		return int64(n), true
+	case uint64:
+		return int64(n), true
+	case float32:
+		if float64(n) == math.Trunc(float64(n)) {
+			return int64(n), true
+		}
+	case float64:
+		if n == math.Trunc(n) {
+			return int64(n), true
+		}
+	}
+	return 0, false
+}
+
+func toFloat64(v any) (float64, bool) {
+	switch n := v.(type) {
+	case float32:
+		return float64(n), true
+	case float64:
+		return n, true
+	}
+	if i, ok := toInt64(v); ok {
+		return float64(i), true
+	}
+	return 0, false
+}
+
+// 主键的比较值
+func memKey(key any) string {
+	if i, ok := toInt64(key); ok {
+		return util.Itoa(i)
+	}
+	return fmt.Sprintf("%v", key)
+}
+
+// 比较2个bson格式的value是否相等
+func isBsonValueEqual(a, b any) bool {
+	if ai, ok := toInt64(a); ok {
+		bi, ok2 := toInt64(b)
+		return ok2 && ai == bi
+	}
+	if af, ok := toFloat64(a); ok {
+		bf, ok2 := toFloat64(b)
+		return ok2 && af == bf
+	}
+	switch av := a.(type) {
+	case bson.D, bson.M:
+		// 文档不区分bson.D和bson.M,也不区分字段顺序
+		ad, errA := toBsonDocument(av)
+		bd, errB := toBsonDocument(b)
+		if errA != nil || errB != nil || len(ad) != len(bd) {
+			return false
+		}
+		for k, v := range ad {
+			if bv, ok := bd[k]; !ok || !isBsonValueEqual(v, bv) {
+				return false
+			}
+		}
+		return true
+	case bson.A:
+		bv, ok := b.(bson.A)
+		if !ok || len(av) != len(bv) {
+			return false
+		}
+		for i := range av {
+			if !isBsonValueEqual(av[i], bv[i]) {
+				return false
+			}
+		}
+		return true
+	}
+	return fmt.Sprintf("%v", a) == fmt.Sprintf("%v", b)
+}
+
+// $inc的数值相加,类型提升规则参考mongodb: int32+int32=int32(溢出时转int64),有double参与时结果为double
+func incBsonValue(oldValue, incValue any) (any, error) {
+	if oldValue == nil {
+		return incValue, nil
+	}
+	switch oldValue.(type) {
+	case float32, float64:
+		return addFloat(oldValue, incValue)
+	}
+	switch incValue.(type) {
+	case float32, float64:
+		return addFloat(oldValue, incValue)
+	}
+	a, ok := toInt64(oldValue)
+	b, ok2 := toInt64(incValue)
+	if !ok || !ok2 {
+		return nil, errors.New(fmt.Sprintf("cannot apply $inc to a value of non-numeric type:%T", oldValue))
+	}
+	_, isOldInt32 := oldValue.(int32)
+	_, isIncInt32 := incValue.(int32)
+	sum := a + b
+	if isOldInt32 && isIncInt32 && sum >= math.MinInt32 && sum <= math.MaxInt32 {
+		return int32(sum), nil
+	}
+	return sum, nil
+}
+
+func addFloat(a, b any) (any, error) {
+	af, ok := toFloat64(a)
+	bf, ok2 := toFloat64(b)
+	if !ok || !ok2 {
+		return nil, errors.New(fmt.Sprintf("cannot apply $inc to a value of non-numeric type:%T", a))
+	}
+	return af + bf, nil
+}
+
+// 根据字段路径(如Component.Field)设置文档的值
+// 和mongodb的$set一样,中间节点不存在时会自动创建,中间节点不是文档时报错
+func setDocumentPath(doc memDocument, path string, value any) error {
+	names := strings.Split(path, ".")
+	cur := doc
+	for i := 0; i < len(names)-1; i++ {
+		child, ok := cur[names[i]]
+		if !ok {
+			newChild := make(memDocument)
+			cur[names[i]] = newChild
+			cur = newChild
+			continue
+		}
+		childDoc, isDoc := child.(memDocument)
+		if !isDoc {
+			return errors.New(fmt.Sprintf("Cannot create field '%v' in element {%v: %v}", names[i+1], names[i], child))
+		}
+		cur = childDoc
+	}
+	cur[names[len(names)-1]] = value
+	return nil
+}
+
+// 根据字段路径获取文档的值
+func getDocumentPath(doc memDocument, path string) (any, bool) {
+	names := strings.Split(path, ".")
+	cur := doc
+	for i := 0; i < len(names)-1; i++ {
+		childDoc, ok := cur[names[i]].(memDocument)
+		if !ok {
+			return nil, false
+		}
+		cur = childDoc
+	}
+	v, ok := cur[names[len(names)-1]]
+	return v, ok
+}
+
+// 根据字段路径删除文档的值,路径不存在时忽略
+func unsetDocumentPath(doc memDocument, path string) {
+	names := strings.Split(path, ".")
+	cur := doc
+	for i := 0; i < len(names)-1; i++ {
+		childDoc, ok := cur[names[i]].(memDocument)
+		if !ok {
+			return
+		}
+		cur = childDoc
+	}
+	delete(cur, names[len(names)-1])
+}
+
+// 对文档执行mongodb格式的更新操作,支持$set $unset $inc $push
+func applyDocumentUpdate(doc memDocument, update memDocument) error {
+	if len(update) == 0 {
+		return errors.New("update document must contain key beginning with '$'")
+	}
+	for op, fields := range update {
+		fieldsDoc, ok := fields.(memDocument)
+		if !ok {
+			return errors.New(fmt.Sprintf("update document must contain key beginning with '$':%v", op))
+		}
+		switch op {
+		case "$set":
+			for path, value := range fieldsDoc {
+				if err := setDocumentPath(doc, path, value); err != nil {
+					return err
+				}
+			}
+		case "$unset":
+			for path := range fieldsDoc {
+				unsetDocumentPath(doc, path)
+			}
+		case "$inc":
+			for path, value := range fieldsDoc {
+				oldValue, _ := getDocumentPath(doc, path)
+				newValue, err := incBsonValue(oldValue, value)
+				if err != nil {
+					return err
+				}
+				if err = setDocumentPath(doc, path, newValue); err != nil {
+					return err
+				}
+			}
+		case "$push":
+			for path, value := range fieldsDoc {
+				items := bson.A{value}
+				if eachDoc, ok := value.(memDocument); ok {
+					if eachItems, ok := eachDoc["$each"].(bson.A); ok {
+						items = eachItems
+					}
+				}
+				var list bson.A
+				if oldValue, exists := getDocumentPath(doc, path); exists {
+					// 和mongodb一样,只能追加到数组字段
+					if list, ok = oldValue.(bson.A); !ok {
+						return errors.New(fmt.Sprintf("The field '%v' must be an array but is of type %T", path, oldValue))
+					}
+				}
+				if err := setDocumentPath(doc, path, append(list, items...)); err != nil {
+					return err
+				}
+			}
+		default:
+			return errors.New(fmt.Sprintf("unsupported update operator:%v", op))
+		}
+	}
+	return nil
+}
+
+// 用新文档的内容替换原文档,原文档的引用保持不变
+func replaceDocument(doc memDocument, newDoc memDocument) {
+	for k := range doc {
+		delete(doc, k)
+	}
+	for k, v := range newDoc {
+		doc[k] = v
+	}
+}
+
+// 文档的版本号,版本号字段不存在时为0
+func getDocumentVersion(doc memDocument, versionField string) int64 {
+	value, _ := getDocumentPath(doc, versionField)
+	version, _ := toInt64(value)
+	return version
+}
+
+// 检查文档的版本号,和mongodb以版本号作为更新条件的结果一致
+func checkDocumentVersion(doc memDocument, versionField string, version int64) error {
+	if doc == nil {
+		return ErrEntityNotExists
+	}
+	if getDocumentVersion(doc, versionField) != version {
+		return ErrVersionConflict
+	}
+	return nil
+}
+
+// 保存组件的同时版本号+1
+func toVersionUpdate(components map[string]interface{}, versionField string) (memDocument, error) {
+	update := getComponentsUpdate(components)
+	update["$inc"] = bson.M{versionField: int64(1)}
+	return toBsonDocument(update)
+}
+
+// 主键的比较值 -> 主键,用于批量查找时把查询结果对应到调用者传入的主键
+func getEntityKeyMap(entityKeys []interface{}) map[string]interface{} {
+	keyMap := make(map[string]interface{}, len(entityKeys))
+	for _, entityKey := range entityKeys {
+		keyMap[memKey(entityKey)] = entityKey
+	}
+	return keyMap
+}
+
+// 只保留文档的主键和指定的字段,和mongodb的投影一致
+func projectDocument(doc memDocument, uniqueId string, fieldNames []string) memDocument {
+	if len(fieldNames) == 0 {
+		return doc
+	}
+	newDoc := make(memDocument, len(fieldNames)+1)
+	if v, ok := doc[uniqueId]; ok {
+		newDoc[uniqueId] = v
+	}
+	for _, name := range fieldNames {
+		if v, ok := getDocumentPath(doc, name); ok {
+			setDocumentPath(newDoc, name, v)
+		}
+	}
+	return newDoc
+}
+
+// 根据字段路径获取列表,字段不存在时返回nil
+func getDocumentList(doc memDocument, listName string) (bson.A, error) {
+	value, ok := getDocumentPath(doc, listName)
+	if !ok || value == nil {
+		return nil, nil
+	}
+	list, ok := value.(bson.A)
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("The field '%v' must be an array but is of type %T", listName, value))
+	}
+	return list, nil
+}
+
+// 对文档的列表字段执行操作,f返回新的列表,返回nil时删除列表字段
+func updateDocumentList(doc memDocument, listName string, f func(list bson.A) (bson.A, error)) error {
+	list, err := getDocumentList(doc, listName)
+	if err != nil {
+		return err
+	}
+	newList, err := f(list)
+	if err != nil {
+		return err
+	}
+	if newList == nil {
+		unsetDocumentPath(doc, listName)
+		return nil
+	}
+	return setDocumentPath(doc, listName, newList)
+}
+
+// 内存中的文档集合,按照插入顺序遍历
+type memDocuments struct {
+	docs map[string]memDocument
+	keys []string
+}
+
+func newMemDocuments() *memDocuments {
+	return &memDocuments{
+		docs: make(map[string]memDocument),
+	}
+}
+
+func (this *memDocuments) get(key any) memDocument {
+	return this.docs[memKey(key)]
+}
+
+func (this *memDocuments) insert(key any, doc memDocument) bool {
+	k := memKey(key)
+	if _, ok := this.docs[k]; ok {
+		return false
+	}
+	this.docs[k] = doc
+	this.keys = append(this.keys, k)
+	return true
+}
+
+func (this *memDocuments) delete(key any) {
+	k := memKey(key)
+	if _, ok := this.docs[k]; !ok {
+		return
+	}
+	delete(this.docs, k)
+	for i, v := range this.keys {
+		if v == k {
+			this.keys = append(this.keys[:i], this.keys[i+1:]...)
+			break
+		}
+	}
+}
+
+func (this *memDocuments) rangeDocs(f func(doc memDocument) bool) {
+	for _, k := range this.keys {
+		if !f(this.docs[k]) {
+			return
+		}
+	}
+}
+
+// EntityDb的内存实现,用于单元测试和本地工具,无需部署mongodb
+//
+//	数据格式和MongoCollection一致,字段路径(componentName.fieldName)的规则也一致
+type MemCollection struct {
+	documents *memDocuments
+	lock      sync.RWMutex
+
+	// 表名
+	collectionName string
+	// 唯一id
+	uniqueId string
+	// 乐观锁的版本号字段,为空表示不使用乐观锁
+	versionField string
+}
+
+func (this *MemCollection) GetCollectionName() string {
+	return this.collectionName
+}
+
+// 根据id查找数据
+func (this *MemCollection) FindEntityById(entityKey interface{}, data interface{}) (bool, error) {
+	exists, _, err := this.FindEntityByIdWithVersion(entityKey, data)
+	return exists, err
+}
+
+func (this *MemCollection) FindEntityByIdWithVersion(entityKey interface{}, data interface{}) (bool, int64, error) {
+	if len(this.uniqueId) == 0 {
+		return false, 0, ErrNoUniqueColumn
+	}
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+	doc := this.documents.get(entityKey)
+	if doc == nil {
+		return false, 0, nil
+	}
+	err := decodeBsonDocument(doc, data)
+	if err != nil {
+		return false, 0, err
+	}
+	return true, getDocumentVersion(doc, this.versionField), nil
+}
+
+func (this *MemCollection) FindEntitiesByIds(entityKeys []interface{}, newData func() interface{}, componentNames ...string) (map[interface{}]interface{}, error) {
+	if len(this.uniqueId) == 0 {
+		return nil, ErrNoUniqueColumn
+	}
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+	datas := make(map[interface{}]interface{}, len(entityKeys))
+	for _, entityKey := range entityKeys {
+		doc := this.documents.get(entityKey)
+		if doc == nil {
+			continue
+		}
+		data := newData()
+		if err := decodeBsonDocument(projectDocument(doc, this.uniqueId, componentNames), data); err != nil {
+			return nil, err
+		}
+		datas[entityKey] = data
+	}
+	return datas, nil
+}
+
+// 在内存中执行查询,遍历所有文档
+func (this *MemCollection) FindEntities(query *Query, newData func() interface{}) (*QueryResult, error) {
+	if len(this.uniqueId) == 0 {
+		return nil, ErrNoUniqueColumn
+	}
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+	var docs []memDocument
+	this.documents.rangeDocs(func(doc memDocument) bool {
+		docs = append(docs, doc)
+		return true
+	})
+	return decodeQueryDocuments(query, this.uniqueId, docs, newData)
+}
+
+func (this *MemCollection) InsertEntity(entityKey interface{}, entityData interface{}) (err error, isDuplicateKey bool) {
+	doc, err := toBsonDocument(entityData)
+	if err != nil {
+		return err, false
+	}
+	// 和mongodb一样,以文档里的uniqueId作为主键
+	if key, ok := doc[this.uniqueId]; ok {
+		entityKey = key
+	} else {
+		doc[this.uniqueId], err = toBsonValue(entityKey)
+		if err != nil {
+			return err, false
+		}
+	}
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if !this.documents.insert(entityKey, doc) {
+		return fmt.Errorf("%v %v:%v %w", this.collectionName, this.uniqueId, entityKey, ErrDuplicateKey), true
+	}
+	return nil, false
+}
+
+// entityData是mongodb格式的更新操作,如bson.D{{"$set", bson.D{{"Name", "abc"}}}}
+func (this *MemCollection) SaveEntity(entityKey interface{}, entityData interface{}) error {
+	update, err := toBsonDocument(entityData)
+	if err != nil {
+		return err
+	}
+	return this.updateDocument(entityKey, update)
+}
+
+func (this *MemCollection) DeleteEntity(entityKey interface{}) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.documents.delete(entityKey)
+	return nil
+}
+
+func (this *MemCollection) SaveComponent(entityKey interface{}, componentName string, componentData interface{}) error {
+	return this.SaveComponents(entityKey, map[string]interface{}{componentName: componentData})
+}
+
+func (this *MemCollection) SupportIncrementalSave() bool {
+	return true
+}
+
+func (this *MemCollection) SaveComponents(entityKey interface{}, components map[string]interface{}) error {
+	if len(components) == 0 {
+		return nil
+	}
+	update, err := toBsonDocument(getComponentsUpdate(components))
+	if err != nil {
+		return err
+	}
+	return this.updateDocument(entityKey, update)
+}
+
+func (this *MemCollection) SaveComponentField(entityKey interface{}, componentName string, fieldName string, fieldData interface{}) error {
+	return this.SaveComponents(entityKey, map[string]interface{}{componentName + "." + fieldName: fieldData})
+}
+
+// 删除1个组件的某些字段
+func (this *MemCollection) DeleteComponentField(entityKey interface{}, componentName string, fieldName ...string) error {
+	if len(fieldName) == 0 {
+		return nil
+	}
+	fieldNames := make(memDocument)
+	for _, name := range fieldName {
+		fieldNames[componentName+"."+name] = ""
+	}
+	return this.updateDocument(entityKey, memDocument{"$unset": fieldNames})
+}
+
+func (this *MemCollection) SetVersionField(versionField string) {
+	this.versionField = versionField
+}
+
+func (this *MemCollection) GetVersionField() string {
+	return this.versionField
+}
+
+func (this *MemCollection) FindEntityVersion(entityKey interface{}) (int64, error) {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+	doc := this.documents.get(entityKey)
+	if doc == nil {
+		return 0, ErrEntityNotExists
+	}
+	return getDocumentVersion(doc, this.versionField), nil
+}
+
+func (this *MemCollection) SaveComponentsWithVersion(entityKey interface{}, components map[string]interface{}, version int64) error {
+	if len(this.versionField) == 0 {
+		return this.SaveComponents(entityKey, components)
+	}
+	update, err := toVersionUpdate(components, this.versionField)
+	if err != nil {
+		return err
+	}
+	return this.updateDocumentIf(entityKey, update, func(doc memDocument) error {
+		return checkDocumentVersion(doc, this.versionField, version)
+	})
+}
+
+// 更新文档,文档不存在时和mongodb的UpdateOne一样,不报错
+func (this *MemCollection) updateDocument(entityKey interface{}, update memDocument) error {
+	return this.updateDocumentIf(entityKey, update, nil)
+}
+
+// 更新文档,check不为nil时,check返回nil才更新,文档不存在时check的参数为nil
+//
+//	更新操作先作用在副本上,出错时不会修改原文档
+func (this *MemCollection) updateDocumentIf(entityKey interface{}, update memDocument, check func(doc memDocument) error) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	doc := this.documents.get(entityKey)
+	if check != nil {
+		if err := check(doc); err != nil {
+			return err
+		}
+	}
+	if doc == nil {
+		return nil
+	}
+	newDoc, err := toBsonDocument(doc)
+	if err != nil {
+		return err
+	}
+	if err = applyDocumentUpdate(newDoc, update); err != nil {
+		return err
+	}
+	replaceDocument(doc, newDoc)
+	return nil
+}
+
+func (this *MemCollection) getMemCollection() *MemCollection {
+	return this
+}
+
+func (this *MemCollection) PushToList(entityKey interface{}, listName string, item interface{}, maxLen int) error {
+	bsonItem, err := toBsonValue(item)
+	if err != nil {
+		return err
+	}
+	return this.updateList(entityKey, listName, func(list bson.A) (bson.A, error) {
+		return pushListItem(list, bsonItem, maxLen), nil
+	})
+}
+
+func (this *MemCollection) PopList(entityKey interface{}, listName string, count int, data interface{}) error {
+	var popped bson.A
+	err := this.updateList(entityKey, listName, func(list bson.A) (bson.A, error) {
+		var rest bson.A
+		popped, rest = popListItems(list, count)
+		// 和MongoCollection一致,取出全部时删除列表字段
+		if count <= 0 {
+			return nil, nil
+		}
+		if rest == nil {
+			rest = bson.A{}
+		}
+		return rest, nil
+	})
+	if err != nil || popped == nil {
+		return err
+	}
+	return decodeBsonList(popped, data)
+}
+
+func (this *MemCollection) RangeList(entityKey interface{}, listName string, start int, count int, data interface{}) error {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+	doc := this.documents.get(entityKey)
+	if doc == nil {
+		return ErrEntityNotExists
+	}
+	list, err := getDocumentList(doc, listName)
+	if err != nil || list == nil {
+		return err
+	}
+	return decodeBsonList(rangeListItems(list, start, count), data)
+}
+
+func (this *MemCollection) RemoveFromList(entityKey interface{}, listName string, item interface{}) error {
+	bsonItem, err := toBsonValue(item)
+	if err != nil {
+		return err
+	}
+	return this.updateList(entityKey, listName, func(list bson.A) (bson.A, error) {
+		if list == nil {
+			return nil, nil
+		}
+		return removeListItems(list, func(v any) bool {
+			return isBsonValueEqual(v, bsonItem)
+		}), nil
+	})
+}
+
+// 列表操作,实体不存在时返回ErrEntityNotExists
+func (this *MemCollection) updateList(entityKey interface{}, listName string, f func(list bson.A) (bson.A, error)) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	doc := this.documents.get(entityKey)
+	if doc == nil {
+		return ErrEntityNotExists
+	}
+	return updateDocumentList(doc, listName, f)
+}
+
+// PlayerDb的内存实现
+type MemCollectionPlayer struct {
+	MemCollection
+	// 账号id列名
+	colAccountId string
+	// 玩家区服id列名
+	colRegionId string
+}
+
+// 调用者需要加锁
+func (this *MemCollectionPlayer) findPlayerDocs(accountId int64, regionId int32, limit int) []memDocument {
+	var docs []memDocument
+	this.documents.rangeDocs(func(doc memDocument) bool {
+		if isBsonValueEqual(doc[this.colAccountId], accountId) && isBsonValueEqual(doc[this.colRegionId], regionId) {
+			docs = append(docs, doc)
+		}
+		return limit <= 0 || len(docs) < limit
+	})
+	return docs
+}
+
+// 根据账号id查找玩家数据
+// 适用于一个账号在一个区服只有一个玩家角色的游戏
+func (this *MemCollectionPlayer) FindPlayerByAccountId(accountId int64, regionId int32, playerData interface{}) (bool, error) {
+	exists, _, err := this.FindPlayerByAccountIdWithVersion(accountId, regionId, playerData)
+	return exists, err
+}
+
+func (this *MemCollectionPlayer) FindPlayerByAccountIdWithVersion(accountId int64, regionId int32, playerData interface{}) (bool, int64, error) {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+	docs := this.findPlayerDocs(accountId, regionId, 1)
+	if len(docs) == 0 {
+		return false, 0, nil
+	}
+	err := decodeBsonDocument(docs[0], playerData)
+	if err != nil {
+		return false, 0, err
+	}
+	return true, getDocumentVersion(docs[0], this.versionField), nil
+}
+
+func (this *MemCollectionPlayer) FindPlayerIdByAccountId(accountId int64, regionId int32) (int64, error) {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+	docs := this.findPlayerDocs(accountId, regionId, 1)
+	if len(docs) == 0 {
+		return 0, nil
+	}
+	playerId, _ := toInt64(docs[0][this.uniqueId])
+	return playerId, nil
+}
+
+func (this *MemCollectionPlayer) FindPlayerIdsByAccountId(accountId int64, regionId int32) ([]int64, error) {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+	docs := this.findPlayerDocs(accountId, regionId, 0)
+	playerIds := make([]int64, len(docs), len(docs))
+	for i, doc := range docs {
+		playerIds[i], _ = toInt64(doc[this.uniqueId])
+	}
+	return playerIds, nil
+}
+
+func (this *MemCollectionPlayer) FindAccountIdByPlayerId(playerId int64) (int64, error) {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+	doc := this.documents.get(playerId)
+	if doc == nil {
+		return 0, nil
+	}
+	accountId, _ := toInt64(doc[this.colAccountId])
+	return accountId, nil
+}
+
+// KvDb的内存实现
+type MemKvDb struct {
+	documents *memDocuments
+	lock      sync.RWMutex
+
+	// 表名
+	collectionName string
+	// key column name
+	keyName string
+	// value column name
+	valueName string
+	// 过期时间字段
+	expireAtField string
+}
+
+// 设置过期时间字段名
+func (this *MemKvDb) SetExpireAtField(expireAtField string) {
+	this.expireAtField = expireAtField
+}
+
+// 没过期的数据,过期的数据视为不存在
+func (this *MemKvDb) getAlive(key interface{}) memDocument {
+	doc := this.documents.get(key)
+	if doc == nil {
+		return nil
+	}
+	if expireAt, ok := doc[this.expireAtField].(bson.DateTime); ok && !expireAt.Time().After(time.Now()) {
+		return nil
+	}
+	return doc
+}
+
+// 写操作之前删除过期的数据,和mongodb的TTL索引删除过期数据的效果一致
+func (this *MemKvDb) removeExpired(key interface{}) {
+	if this.documents.get(key) != nil && this.getAlive(key) == nil {
+		this.documents.delete(key)
+	}
+}
+
+func (this *MemKvDb) Find(key interface{}) (interface{}, error) {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+	doc := this.getAlive(key)
+	if doc == nil {
+		return nil, nil
+	}
+	// 和MongoKvDb.Find的返回格式保持一致
+	var result bson.M
+	err := decodeBsonDocument(doc, &result)
+	if err != nil {
+		return nil, err
+	}
+	return result[this.valueName], nil
+}
+
+func (this *MemKvDb) FindAndDecode(key interface{}, decodeData interface{}) error {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+	doc := this.getAlive(key)
+	if doc == nil {
+		return nil
+	}
+	raw, err := bson.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	value, err := bson.Raw(raw).LookupErr(this.valueName)
+	if err != nil {
+		return err
+	}
+	return value.Unmarshal(decodeData)
+}
+
+func (this *MemKvDb) Insert(key interface{}, value interface{}) (err error, isDuplicateKey bool) {
+	return this.insert(bson.D{{Key: this.keyName, Value: key}, {Key: this.valueName, Value: value}})
+}
+
+func (this *MemKvDb) InsertWithTTL(key interface{}, value interface{}, ttl time.Duration) (err error, isDuplicateKey bool) {
+	return this.insert(bson.D{{Key: this.keyName, Value: key}, {Key: this.valueName, Value: value},
+		{Key: this.expireAtField, Value: time.Now().Add(ttl)}})
+}
+
+func (this *MemKvDb) insert(obj bson.D) (err error, isDuplicateKey bool) {
+	doc, err := toBsonDocument(obj)
+	if err != nil {
+		return err, false
+	}
+	key := obj[0].Value
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.removeExpired(key)
+	if !this.documents.insert(key, doc) {
+		return fmt.Errorf("%v %v:%v %w", this.collectionName, this.keyName, key, ErrDuplicateKey), true
+	}
+	return nil, false
+}
+
+// 保留原有的过期时间
+func (this *MemKvDb) Update(key interface{}, value interface{}, upsert bool) error {
+	bsonValue, err := toBsonValue(value)
+	if err != nil {
+		return err
+	}
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.removeExpired(key)
+	doc := this.documents.get(key)
+	if doc == nil {
+		if !upsert {
+			return nil
+		}
+		doc, err = toBsonDocument(bson.D{{Key: this.keyName, Value: key}})
+		if err != nil {
+			return err
+		}
+		this.documents.insert(key, doc)
+	}
+	doc[this.valueName] = bsonValue
+	return nil
+}
+
+func (this *MemKvDb) UpdateWithTTL(key interface{}, value interface{}, ttl time.Duration, upsert bool) error {
+	bsonValue, err := toBsonValue(value)
+	if err != nil {
+		return err
+	}
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.removeExpired(key)
+	doc := this.documents.get(key)
+	if doc == nil {
+		if !upsert {
+			return nil
+		}
+		doc, err = toBsonDocument(bson.D{{Key: this.keyName, Value: key}})
+		if err != nil {
+			return err
+		}
+		this.documents.insert(key, doc)
+	}
+	doc[this.valueName] = bsonValue
+	doc[this.expireAtField] = bson.NewDateTimeFromTime(time.Now().Add(ttl))
+	return nil
+}
+
+func (this *MemKvDb) Inc(key interface{}, value interface{}, upsert bool) (interface{}, error) {
+	bsonValue, err := toBsonValue(value)
+	if err != nil {
+		return nil, err
+	}
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.removeExpired(key)
+	doc := this.documents.get(key)
+	if doc == nil {
+		if !upsert {
+			// 和mongodb的FindOneAndUpdate一致
+			return nil, mongo.ErrNoDocuments
+		}
+		doc, err = toBsonDocument(bson.D{{Key: this.keyName, Value: key}})
+		if err != nil {
+			return nil, err
+		}
+		this.documents.insert(key, doc)
+	}
+	newValue, err := incBsonValue(doc[this.valueName], bsonValue)
+	if err != nil {
+		return nil, err
+	}
+	doc[this.valueName] = newValue
+	return newValue, nil
+}
+
+func (this *MemKvDb) Delete(key interface{}) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.documents.delete(key)
+	return nil
+}
+
+func (this *MemKvDb) FindMany(keys []interface{}) (map[interface{}]interface{}, error) {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+	values := make(map[interface{}]interface{})
+	for _, key := range keys {
+		doc := this.getAlive(key)
+		if doc == nil {
+			continue
+		}
+		value, err := getKvDocumentValue(doc, this.valueName)
+		if err != nil {
+			return nil, err
+		}
+		values[key] = value
+	}
+	return values, nil
+}
+
+func (this *MemKvDb) CompareAndSwap(key interface{}, expected interface{}, newValue interface{}) (bool, error) {
+	if expected == nil {
+		err, isDuplicateKey := this.Insert(key, newValue)
+		if isDuplicateKey {
+			return false, nil
+		}
+		return err == nil, err
+	}
+	expectedValue, err := toBsonValue(expected)
+	if err != nil {
+		return false, err
+	}
+	bsonValue, err := toBsonValue(newValue)
+	if err != nil {
+		return false, err
+	}
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	doc := this.getAlive(key)
+	if doc == nil || !isBsonValueEqual(doc[this.valueName], expectedValue) {
+		return false, nil
+	}
+	doc[this.valueName] = bsonValue
+	return true, nil
+}
+
+func (this *MemKvDb) Scan(scan *KvScan) (*KvScanResult, error) {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+	var docs []memDocument
+	this.documents.rangeDocs(func(doc memDocument) bool {
+		if this.getAlive(doc[this.keyName]) != nil {
+			docs = append(docs, doc)
+		}
+		return true
+	})
+	return scanKvDocuments(docs, this.keyName, this.valueName, scan)
+}
+
+func (this *MemKvDb) IncFields(key interface{}, fields map[string]interface{}, upsert bool) (map[string]interface{}, error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.removeExpired(key)
+	doc := this.documents.get(key)
+	if doc == nil && !upsert {
+		// 和mongodb的FindOneAndUpdate一致
+		return nil, mongo.ErrNoDocuments
+	}
+	// 先在副本上累加,出错时不影响原数据
+	var newDoc memDocument
+	var err error
+	if doc == nil {
+		newDoc, err = toBsonDocument(bson.D{{Key: this.keyName, Value: key}})
+	} else {
+		newDoc, err = toBsonDocument(doc)
+	}
+	if err != nil {
+		return nil, err
+	}
+	newValues, err := incKvDocumentFields(newDoc, this.valueName, fields)
+	if err != nil {
+		return nil, err
+	}
+	if doc == nil {
+		this.documents.insert(key, newDoc)
+	} else {
+		doc[this.valueName] = newDoc[this.valueName]
+	}
+	return newValues, nil
+}
+
+// DbMgr的内存实现
+//
+//	接口和MongoDb一致,可以直接替换MongoDb用于单元测试
+type MemDb struct {
+	entityDbs map[string]EntityDb
+	kvDbs     map[string]KvDb
+}
+
+func NewMemDb() *MemDb {
+	return &MemDb{
+		entityDbs: make(map[string]EntityDb),
+		kvDbs:     make(map[string]KvDb),
+	}
+}
+
+// 注册普通Entity对应的表
+func (this *MemDb) RegisterEntityDb(collectionName string, uniqueId string) EntityDb {
+	col := &MemCollection{
+		documents:      newMemDocuments(),
+		collectionName: collectionName,
+		uniqueId:       uniqueId,
+	}
+	this.entityDbs[collectionName] = col
+	GetLogger().Info("RegisterEntityDb %v %v", collectionName, uniqueId)
+	return col
+}
+
+// 注册玩家对应的表
+func (this *MemDb) RegisterPlayerDb(collectionName string, playerId, accountId, region string) PlayerDb {
+	col := &MemCollectionPlayer{
+		MemCollection: MemCollection{
+			documents:      newMemDocuments(),
+			collectionName: collectionName,
+			uniqueId:       playerId,
+		},
+		colAccountId: accountId,
+		colRegionId:  region,
+	}
+	this.entityDbs[collectionName] = col
+	GetLogger().Info("RegisterPlayerDb %v %v", collectionName, playerId)
+	return col
+}
+
+func (this *MemDb) RegisterKvDb(collectionName string, keyName, valueName string) KvDb {
+	col := &MemKvDb{
+		documents:      newMemDocuments(),
+		collectionName: collectionName,
+		keyName:        keyName,
+		valueName:      valueName,
+		expireAtField:  DefaultExpireAtField,
+	}
+	this.kvDbs[collectionName] = col
+	GetLogger().Info("RegisterKvDb %v %v %v", collectionName, keyName, valueName)
+	return col
+}
+
+func (this *MemDb) GetEntityDb(name string) EntityDb {
+	return this.entityDbs[name]
+}
+
+func (this *MemDb) GetKvDb(name string) KvDb {
+	return this.kvDbs[name]
+}
+
+// 内存数据库的事务,相关的collection全部加锁,先在副本上执行所有更新,全部成功后才替换原文档
+func (this *MemDb) SaveComponentsInTransaction(datas []*EntityComponentsData) error {
+	type memCollectionGetter interface {
+		getMemCollection() *MemCollection
+	}
+	var cols []*MemCollection
+	for _, data := range datas {
+		getter, ok := data.EntityDb.(memCollectionGetter)
+		if !ok {
+			return errors.New(fmt.Sprintf("%v not a MemCollection", data.EntityKey))
+		}
+		if col := getter.getMemCollection(); !slices.Contains(cols, col) {
+			cols = append(cols, col)
+		}
+	}
+	// 按照表名的顺序加锁,防止死锁
+	sort.Slice(cols, func(i, j int) bool {
+		return cols[i].collectionName < cols[j].collectionName
+	})
+	for _, col := range cols {
+		col.lock.Lock()
+		defer col.lock.Unlock()
+	}
+	type pendingDocument struct {
+		doc    memDocument
+		newDoc memDocument
+	}
+	pendingDocs := make(map[*MemCollection]map[string]*pendingDocument)
+	for _, data := range datas {
+		col := data.EntityDb.(memCollectionGetter).getMemCollection()
+		key := memKey(data.EntityKey)
+		pending := pendingDocs[col][key]
+		if pending == nil {
+			doc := col.documents.get(data.EntityKey)
+			if doc == nil {
+				if data.CheckVersion {
+					return ErrEntityNotExists
+				}
+				// 和SaveComponents一样,文档不存在时忽略
+				continue
+			}
+			newDoc, err := toBsonDocument(doc)
+			if err != nil {
+				return err
+			}
+			pending = &pendingDocument{doc: doc, newDoc: newDoc}
+			if pendingDocs[col] == nil {
+				pendingDocs[col] = make(map[string]*pendingDocument)
+			}
+			pendingDocs[col][key] = pending
+		}
+		var update memDocument
+		var err error
+		if data.CheckVersion {
+			if err = checkDocumentVersion(pending.newDoc, col.versionField, data.Version); err != nil {
+				return err
+			}
+			update, err = toVersionUpdate(data.Components, col.versionField)
+		} else if len(data.Components) > 0 {
+			update, err = toBsonDocument(getComponentsUpdate(data.Components))
+		} else {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err = applyDocumentUpdate(pending.newDoc, update); err != nil {
+			return err
+		}
+	}
+	for _, colPendingDocs := range pendingDocs {
+		for _, pending := range colPendingDocs {
+			replaceDocument(pending.doc, pending.newDoc)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,227 @@
+package gentity
+
+import (
+	"context"
+	"go.mongodb.org/mongo-driver/v2/mongo/readpref"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// mongodb的连接状态
+type MongoConnState int32
+
+const (
+	// 未连接或者已经Disconnect
+	MongoConnDisconnected MongoConnState = iota
+	// 连接正常
+	MongoConnHealthy
+	// ping失败,等待mongo driver自动重连
+	MongoConnUnhealthy
+)
+
+func (this MongoConnState) String() string {
+	switch this {
+	case MongoConnDisconnected:
+		return "Disconnected"
+	case MongoConnHealthy:
+		return "Healthy"
+	case MongoConnUnhealthy:
+		return "Unhealthy"
+	}
+	return "Unknown"
+}
+
+// 健康检查和重连的设置,需要在Connect之前设置
+type MongoHealthOptions struct {
+	// 定时ping的间隔,<=0表示不做健康检查
+	PingInterval time.Duration
+	// ping的超时时间
+	PingTimeout time.Duration
+	// 连续失败多少次判定为不健康,避免偶尔一次ping超时就让所有操作返回ErrNotConnected
+	FailureThreshold int
+	// 不健康时先按MinBackoff的间隔快速重试FastRetries次,之后每次失败间隔翻倍,最大MaxBackoff
+	MinBackoff  time.Duration
+	MaxBackoff  time.Duration
+	FastRetries int
+	// 自定义的健康检查,如检查从库,nil表示ping主库
+	Ping func(ctx context.Context) error
+}
+
+func NewMongoHealthOptions() *MongoHealthOptions {
+	return &MongoHealthOptions{
+		PingInterval:     0,
+		PingTimeout:      3 * time.Second,
+		FailureThreshold: 3,
+		MinBackoff:       200 * time.Millisecond,
+		MaxBackoff:       30 * time.Second,
+		FastRetries:      5,
+	}
+}
+
+// 不健康时第retries次重试失败之后,下一次重试的间隔
+func (this *MongoHealthOptions) nextBackoff(backoff time.Duration, retries int) time.Duration {
+	if retries <= this.FastRetries {
+		return this.MinBackoff
+	}
+	return nextBackoff(backoff, this.MinBackoff, this.MaxBackoff)
+}
+
+// 指数退避,从minBackoff开始,每次翻倍,最大maxBackoff(<=0表示不限制)
+func nextBackoff(backoff, minBackoff, maxBackoff time.Duration) time.Duration {
+	if backoff < minBackoff {
+		return minBackoff
+	}
+	backoff *= 2
+	if maxBackoff > 0 && backoff > maxBackoff {
+		return maxBackoff
+	}
+	return backoff
+}
+
+// mongodb的连接状态,MongoDb和它的collection共用
+//
+//	连接不正常时,collection的操作直接返回ErrNotConnected,不用等待mongo driver的超时
+type mongoHealth struct {
+	state atomic.Int32
+
+	callbackLock sync.RWMutex
+	callbacks    []func(state MongoConnState)
+}
+
+func newMongoHealth() *mongoHealth {
+	return &mongoHealth{}
+}
+
+func (this *mongoHealth) getState() MongoConnState {
+	return MongoConnState(this.state.Load())
+}
+
+func (this *mongoHealth) check() error {
+	if this == nil || this.getState() != MongoConnHealthy {
+		return ErrNotConnected
+	}
+	return nil
+}
+
+func (this *mongoHealth) addCallback(callback func(state MongoConnState)) {
+	this.callbackLock.Lock()
+	defer this.callbackLock.Unlock()
+	this.callbacks = append(this.callbacks, callback)
+}
+
+func (this *mongoHealth) setState(state MongoConnState) {
+	oldState := MongoConnState(this.state.Swap(int32(state)))
+	if oldState == state {
+		return
+	}
+	GetLogger().Info("mongo state %v -> %v", oldState, state)
+	this.callbackLock.RLock()
+	callbacks := this.callbacks
+	this.callbackLock.RUnlock()
+	for _, callback := range callbacks {
+		callback(state)
+	}
+}
+
+// 健康检查和重连的设置,需要在Connect之前设置
+func (this *MongoDb) GetHealthOptions() *MongoHealthOptions {
+	return this.healthOptions
+}
+
+// 连接是否正常
+func (this *MongoDb) IsHealthy() bool {
+	return this.health.getState() == MongoConnHealthy
+}
+
+func (this *MongoDb) GetConnState() MongoConnState {
+	return this.health.getState()
+}
+
+// 添加连接状态变化的回调,在Connect,Disconnect和健康检查的协程里调用,不要阻塞
+func (this *MongoDb) AddConnStateCallback(callback func(state MongoConnState)) {
+	this.health.addCallback(callback)
+}
+
+func (this *MongoDb) ping(ctx context.Context) error {
+	if this.healthOptions.PingTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, this.healthOptions.PingTimeout)
+		defer cancel()
+	}
+	if this.healthOptions.Ping != nil {
+		return this.healthOptions.Ping(ctx)
+	}
+	return this.mongoClient.Ping(ctx, readpref.Primary())
+}
+
+// 开启健康检查的协程,Disconnect时结束
+func (this *MongoDb) startHealthCheck() {
+	if this.healthOptions.PingInterval <= 0 {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	this.stopHealthCheck = cancel
+	this.healthCheckWg.Add(1)
+	go func() {
+		defer this.healthCheckWg.Done()
+		this.runHealthCheck(ctx)
+	}()
+}
+
+func (this *MongoDb) stopHealthCheckRoutine() {
+	if this.stopHealthCheck == nil {
+		return
+	}
+	this.stopHealthCheck()
+	this.healthCheckWg.Wait()
+	this.stopHealthCheck = nil
+}
+
+// 定时ping,连续失败FailureThreshold次判定为不健康,不健康时先快速重试,再按照退避策略重试
+//
+//	mongo driver会在后台自动重连,ping成功就恢复为健康状态
+func (this *MongoDb) runHealthCheck(ctx context.Context) {
+	options := this.healthOptions
+	failures := 0
+	// 不健康之后重试失败的次数
+	retries := 0
+	interval := options.PingInterval
+	if this.health.getState() == MongoConnUnhealthy {
+		interval = options.MinBackoff
+	}
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+		err := this.ping(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if err == nil {
+			failures = 0
+			retries = 0
+			interval = options.PingInterval
+			if !this.indexesEnsured {
+				// Connect时没有连上,连接恢复后再创建索引
+				this.ensureAllIndexes()
+			}
+			this.health.setState(MongoConnHealthy)
+		} else {
+			failures++
+			GetLogger().Error("mongo ping failures:%v err:%v", failures, err)
+			if this.health.getState() == MongoConnUnhealthy {
+				retries++
+				interval = options.nextBackoff(interval, retries)
+			} else if failures >= options.FailureThreshold {
+				interval = options.MinBackoff
+				this.health.setState(MongoConnUnhealthy)
+			}
+		}
+		timer.Reset(interval)
+	}
+}
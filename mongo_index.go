@@ -0,0 +1,167 @@
+package gentity
+
+import (
+	"context"
+	"fmt"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+	"time"
+)
+
+// mongodb里已存在的索引,只解析需要的字段
+type mongoIndexSpec struct {
+	Name               string `bson:"name"`
+	Key                bson.D `bson:"key"`
+	Unique             bool   `bson:"unique"`
+	Sparse             bool   `bson:"sparse"`
+	ExpireAfterSeconds *int64 `bson:"expireAfterSeconds"`
+}
+
+func (this *mongoIndexSpec) String() string {
+	if this.ExpireAfterSeconds != nil {
+		expireAfter := time.Duration(*this.ExpireAfterSeconds) * time.Second
+		return fmt.Sprintf("%v%v unique:%v sparse:%v expireAfter:%v", this.Name, this.Key, this.Unique, this.Sparse, expireAfter)
+	}
+	return fmt.Sprintf("%v%v unique:%v sparse:%v", this.Name, this.Key, this.Unique, this.Sparse)
+}
+
+// 和声明的索引是否一致
+func (this *mongoIndexSpec) isSame(indexDef *IndexDef) bool {
+	if len(this.Key) != len(indexDef.Keys) || this.Unique != indexDef.Unique || this.Sparse != indexDef.Sparse {
+		return false
+	}
+	for i, key := range indexDef.Keys {
+		order, ok := toInt64(this.Key[i].Value)
+		if !ok || this.Key[i].Key != key.Field || (order < 0) != key.Desc {
+			return false
+		}
+	}
+	if this.ExpireAfterSeconds == nil || !indexDef.TTL {
+		return this.ExpireAfterSeconds == nil && !indexDef.TTL
+	}
+	return *this.ExpireAfterSeconds == int64(indexDef.ExpireAfter/time.Second)
+}
+
+func toMongoIndexModel(indexDef *IndexDef) mongo.IndexModel {
+	keys := bson.D{}
+	for _, key := range indexDef.Keys {
+		if key.Desc {
+			keys = append(keys, bson.E{Key: key.Field, Value: -1})
+		} else {
+			keys = append(keys, bson.E{Key: key.Field, Value: 1})
+		}
+	}
+	indexOptions := options.Index().SetName(indexDef.GetName())
+	if indexDef.Unique {
+		indexOptions.SetUnique(true)
+	}
+	if indexDef.Sparse {
+		indexOptions.SetSparse(true)
+	}
+	if indexDef.TTL {
+		indexOptions.SetExpireAfterSeconds(int32(indexDef.ExpireAfter / time.Second))
+	}
+	return mongo.IndexModel{
+		Keys:    keys,
+		Options: indexOptions,
+	}
+}
+
+// 创建声明的索引,已存在的同名索引不会重建
+//
+//	返回数据库里的索引和声明的索引不一致的地方(字段或选项不同,未声明的索引),只报告不处理
+func ensureMongoIndexes(ctx context.Context, col *mongo.Collection, indexDefs []*IndexDef) ([]*IndexDrift, error) {
+	cursor, err := col.Indexes().List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var existingIndexes []*mongoIndexSpec
+	if err = cursor.All(ctx, &existingIndexes); err != nil {
+		return nil, err
+	}
+	existingMap := make(map[string]*mongoIndexSpec)
+	for _, existing := range existingIndexes {
+		existingMap[existing.Name] = existing
+	}
+	var drifts []*IndexDrift
+	declaredNames := map[string]struct{}{
+		"_id_": {},
+	}
+	var indexModels []mongo.IndexModel
+	for _, indexDef := range indexDefs {
+		indexName := indexDef.GetName()
+		if _, ok := declaredNames[indexName]; ok {
+			continue
+		}
+		declaredNames[indexName] = struct{}{}
+		existing, ok := existingMap[indexName]
+		if !ok {
+			indexModels = append(indexModels, toMongoIndexModel(indexDef))
+			continue
+		}
+		if !existing.isSame(indexDef) {
+			drifts = append(drifts, &IndexDrift{
+				CollectionName: col.Name(),
+				IndexName:      indexName,
+				DriftType:      IndexDriftMismatch,
+				Detail:         fmt.Sprintf("declared:%v existing:%v", indexDef, existing),
+			})
+		}
+	}
+	for _, existing := range existingIndexes {
+		if _, ok := declaredNames[existing.Name]; !ok {
+			drifts = append(drifts, &IndexDrift{
+				CollectionName: col.Name(),
+				IndexName:      existing.Name,
+				DriftType:      IndexDriftUndeclared,
+				Detail:         fmt.Sprintf("existing:%v", existing),
+			})
+		}
+	}
+	if len(indexModels) > 0 {
+		indexNames, createErr := col.Indexes().CreateMany(ctx, indexModels)
+		if createErr != nil {
+			return drifts, createErr
+		}
+		GetLogger().Info("%v create indexes:%v", col.Name(), indexNames)
+	}
+	return drifts, nil
+}
+
+// 设置需要创建的索引,在MongoDb.Connect时创建
+func (this *MongoCollection) AddIndexes(indexDefs ...*IndexDef) {
+	this.indexDefs = append(this.indexDefs, indexDefs...)
+}
+
+// 声明的索引,包含uniqueId的唯一索引
+func (this *MongoCollection) GetIndexDefs() []*IndexDef {
+	var indexDefs []*IndexDef
+	if this.uniqueId != "" && this.uniqueId != "_id" {
+		indexDefs = append(indexDefs, NewIndexDef(this.uniqueId).SetUnique(true))
+	}
+	return append(indexDefs, this.indexDefs...)
+}
+
+// 创建声明的索引,并返回数据库里的索引和声明的索引不一致的地方
+func (this *MongoCollection) EnsureIndexes(ctx context.Context) ([]*IndexDrift, error) {
+	return ensureMongoIndexes(ctx, this.GetCollection(), this.GetIndexDefs())
+}
+
+// 声明的索引,包含key的唯一索引和过期时间字段的TTL索引
+func (this *MongoKvDb) GetIndexDefs() []*IndexDef {
+	var indexDefs []*IndexDef
+	if this.keyName != "" && this.keyName != "_id" {
+		indexDefs = append(indexDefs, NewIndexDef(this.keyName).SetUnique(true))
+	}
+	if this.expireAtField != "" {
+		// 在expireAt的时间过期
+		indexDefs = append(indexDefs, NewIndexDef(this.expireAtField).SetExpireAfter(0))
+	}
+	return indexDefs
+}
+
+// 创建声明的索引,并返回数据库里的索引和声明的索引不一致的地方
+func (this *MongoKvDb) EnsureIndexes(ctx context.Context) ([]*IndexDrift, error) {
+	return ensureMongoIndexes(ctx, this.GetCollection(), this.GetIndexDefs())
+}
@@ -6,8 +6,16 @@ import (
 	"go.mongodb.org/mongo-driver/v2/bson"
 	"go.mongodb.org/mongo-driver/v2/mongo"
 	"go.mongodb.org/mongo-driver/v2/mongo/options"
+	"regexp"
+	"time"
 )
 
+var _ ExpirableKvDb = (*MongoKvDb)(nil)
+var _ AdvancedKvDb = (*MongoKvDb)(nil)
+
+// 默认的过期时间字段名
+const DefaultExpireAtField = "expireAt"
+
 // KvDb的mongo实现
 type MongoKvDb struct {
 	mongoDatabase  *mongo.Database
@@ -19,6 +27,40 @@ type MongoKvDb struct {
 	keyName string
 	// value column name
 	valueName string
+	// 操作的超时设置
+	timeouts *OpTimeouts
+	// 过期时间字段,MongoDb.Connect时会创建该字段的TTL索引
+	expireAtField string
+	// 连接状态,和MongoDb共用
+	health *mongoHealth
+}
+
+// 设置过期时间字段名,需要在MongoDb.Connect之前设置
+func (this *MongoKvDb) SetExpireAtField(expireAtField string) {
+	this.expireAtField = expireAtField
+}
+
+// 查询没过期的数据的条件
+//
+//	mongodb的TTL索引是后台定时删除过期数据的,已过期但还没被删除的数据视为不存在
+func (this *MongoKvDb) getAliveFilter(key interface{}) bson.D {
+	if this.expireAtField == "" {
+		return bson.D{{Key: this.keyName, Value: key}}
+	}
+	return bson.D{
+		{Key: this.keyName, Value: key},
+		{Key: this.expireAtField, Value: bson.D{{Key: "$not", Value: bson.D{{Key: "$lte", Value: time.Now()}}}}},
+	}
+}
+
+// 在update pipeline里判断数据是否过期的表达式
+//
+//	字段不存在(或null)时和任何日期比较都是$lte,所以只有日期类型的过期时间才算过期,没有过期时间的数据永不过期
+func (this *MongoKvDb) getExpiredExpr(now time.Time) bson.D {
+	return bson.D{{Key: "$and", Value: bson.A{
+		bson.D{{Key: "$eq", Value: bson.A{bson.D{{Key: "$type", Value: "$" + this.expireAtField}}, "date"}}},
+		bson.D{{Key: "$lte", Value: bson.A{"$" + this.expireAtField, now}}},
+	}}}
 }
 
 func (this *MongoKvDb) GetCollection() *mongo.Collection {
@@ -26,8 +68,17 @@ func (this *MongoKvDb) GetCollection() *mongo.Collection {
 }
 
 func (this *MongoKvDb) Find(key interface{}) (interface{}, error) {
+	return this.FindContext(context.Background(), key)
+}
+
+func (this *MongoKvDb) FindContext(ctx context.Context, key interface{}) (interface{}, error) {
+	if err := this.health.check(); err != nil {
+		return nil, err
+	}
+	ctx, cancel := this.timeouts.WithTimeout(ctx, "Find")
+	defer cancel()
 	col := this.mongoDatabase.Collection(this.collectionName)
-	result := col.FindOne(context.Background(), bson.D{{Key: this.keyName, Value: key}})
+	result := col.FindOne(ctx, this.getAliveFilter(key))
 	if result == nil || result.Err() == mongo.ErrNoDocuments {
 		return nil, nil
 	}
@@ -40,10 +91,19 @@ func (this *MongoKvDb) Find(key interface{}) (interface{}, error) {
 }
 
 func (this *MongoKvDb) FindAndDecode(key interface{}, decodeData interface{}) error {
+	return this.FindAndDecodeContext(context.Background(), key, decodeData)
+}
+
+func (this *MongoKvDb) FindAndDecodeContext(ctx context.Context, key interface{}, decodeData interface{}) error {
+	if err := this.health.check(); err != nil {
+		return err
+	}
+	ctx, cancel := this.timeouts.WithTimeout(ctx, "FindAndDecode")
+	defer cancel()
 	col := this.mongoDatabase.Collection(this.collectionName)
 	opts := options.FindOne().
 		SetProjection(bson.D{{Key: this.valueName, Value: 1}})
-	result := col.FindOne(context.Background(), bson.D{{Key: this.keyName, Value: key}}, opts)
+	result := col.FindOne(ctx, this.getAliveFilter(key), opts)
 	if result == nil || result.Err() == mongo.ErrNoDocuments {
 		return nil
 	}
@@ -56,32 +116,164 @@ func (this *MongoKvDb) FindAndDecode(key interface{}, decodeData interface{}) er
 }
 
 func (this *MongoKvDb) Insert(key interface{}, value interface{}) (err error, isDuplicateKey bool) {
+	return this.InsertContext(context.Background(), key, value)
+}
+
+func (this *MongoKvDb) InsertContext(ctx context.Context, key interface{}, value interface{}) (err error, isDuplicateKey bool) {
+	if err = this.health.check(); err != nil {
+		return
+	}
+	ctx, cancel := this.timeouts.WithTimeout(ctx, "Insert")
+	defer cancel()
+	return this.insert(ctx, key, value, nil)
+}
+
+func (this *MongoKvDb) insert(ctx context.Context, key interface{}, value interface{}, expireAt *time.Time) (err error, isDuplicateKey bool) {
 	col := this.mongoDatabase.Collection(this.collectionName)
-	_, err = col.InsertOne(context.Background(),
-		bson.D{{Key: this.keyName, Value: key}, {Key: this.valueName, Value: value}})
-	if err != nil {
-		isDuplicateKey = IsDuplicateKeyError(err)
+	doc := bson.D{{Key: this.keyName, Value: key}, {Key: this.valueName, Value: value}}
+	if expireAt != nil {
+		doc = append(doc, bson.E{Key: this.expireAtField, Value: *expireAt})
+	}
+	_, err = col.InsertOne(ctx, doc)
+	if err == nil {
+		return
+	}
+	isDuplicateKey = IsDuplicateKeyError(err)
+	if !isDuplicateKey || this.expireAtField == "" {
+		return
+	}
+	// 已过期但还没被删除的数据,视为不存在,直接覆盖
+	update := bson.D{{Key: "$set", Value: bson.D{{Key: this.valueName, Value: value}}}}
+	if expireAt != nil {
+		update[0].Value = append(update[0].Value.(bson.D), bson.E{Key: this.expireAtField, Value: *expireAt})
+	} else {
+		update = append(update, bson.E{Key: "$unset", Value: bson.D{{Key: this.expireAtField, Value: ""}}})
+	}
+	result, updateErr := col.UpdateOne(ctx, bson.D{
+		{Key: this.keyName, Value: key},
+		{Key: this.expireAtField, Value: bson.D{{Key: "$lte", Value: time.Now()}}},
+	}, update)
+	if updateErr != nil {
+		return updateErr, false
+	}
+	if result.MatchedCount > 0 {
+		return nil, false
 	}
 	return
 }
 
+func (this *MongoKvDb) InsertWithTTL(key interface{}, value interface{}, ttl time.Duration) (err error, isDuplicateKey bool) {
+	return this.InsertWithTTLContext(context.Background(), key, value, ttl)
+}
+
+func (this *MongoKvDb) InsertWithTTLContext(ctx context.Context, key interface{}, value interface{}, ttl time.Duration) (err error, isDuplicateKey bool) {
+	if err = this.health.check(); err != nil {
+		return
+	}
+	ctx, cancel := this.timeouts.WithTimeout(ctx, "InsertWithTTL")
+	defer cancel()
+	expireAt := time.Now().Add(ttl)
+	return this.insert(ctx, key, value, &expireAt)
+}
+
 func (this *MongoKvDb) Update(key interface{}, value interface{}, upsert bool) error {
+	return this.UpdateContext(context.Background(), key, value, upsert)
+}
+
+// 保留原有的过期时间,已过期的数据视为不存在
+func (this *MongoKvDb) UpdateContext(ctx context.Context, key interface{}, value interface{}, upsert bool) error {
+	if err := this.health.check(); err != nil {
+		return err
+	}
+	ctx, cancel := this.timeouts.WithTimeout(ctx, "Update")
+	defer cancel()
 	col := this.mongoDatabase.Collection(this.collectionName)
-	opt := options.UpdateOne().SetUpsert(upsert)
-	_, err := col.UpdateOne(context.Background(),
+	if this.expireAtField == "" {
+		opt := options.UpdateOne().SetUpsert(upsert)
+		_, err := col.UpdateOne(ctx,
+			bson.D{{Key: this.keyName, Value: key}},
+			bson.D{{Key: "$set", Value: bson.D{{Key: this.valueName, Value: value}}}},
+			opt)
+		return err
+	}
+	if !upsert {
+		_, err := col.UpdateOne(ctx,
+			this.getAliveFilter(key),
+			bson.D{{Key: "$set", Value: bson.D{{Key: this.valueName, Value: value}}}})
+		return err
+	}
+	// upsert时,已过期的数据当作新数据,去掉过期时间
+	now := time.Now()
+	_, err := col.UpdateOne(ctx,
 		bson.D{{Key: this.keyName, Value: key}},
-		bson.D{{Key: "$set", Value: bson.D{{Key: this.valueName, Value: value}}}},
-		opt)
+		mongo.Pipeline{{{Key: "$set", Value: bson.D{
+			{Key: this.valueName, Value: bson.D{{Key: "$literal", Value: value}}},
+			{Key: this.expireAtField, Value: bson.D{{Key: "$cond", Value: bson.A{this.getExpiredExpr(now), "$$REMOVE", "$" + this.expireAtField}}}},
+		}}}},
+		options.UpdateOne().SetUpsert(true))
+	return err
+}
+
+func (this *MongoKvDb) UpdateWithTTL(key interface{}, value interface{}, ttl time.Duration, upsert bool) error {
+	return this.UpdateWithTTLContext(context.Background(), key, value, ttl, upsert)
+}
+
+func (this *MongoKvDb) UpdateWithTTLContext(ctx context.Context, key interface{}, value interface{}, ttl time.Duration, upsert bool) error {
+	if err := this.health.check(); err != nil {
+		return err
+	}
+	ctx, cancel := this.timeouts.WithTimeout(ctx, "UpdateWithTTL")
+	defer cancel()
+	col := this.mongoDatabase.Collection(this.collectionName)
+	filter := bson.D{{Key: this.keyName, Value: key}}
+	if !upsert {
+		filter = this.getAliveFilter(key)
+	}
+	_, err := col.UpdateOne(ctx, filter,
+		bson.D{{Key: "$set", Value: bson.D{
+			{Key: this.valueName, Value: value},
+			{Key: this.expireAtField, Value: time.Now().Add(ttl)},
+		}}},
+		options.UpdateOne().SetUpsert(upsert))
 	return err
 }
 
 func (this *MongoKvDb) Inc(key interface{}, value interface{}, upsert bool) (interface{}, error) {
+	return this.IncContext(context.Background(), key, value, upsert)
+}
+
+func (this *MongoKvDb) IncContext(ctx context.Context, key interface{}, value interface{}, upsert bool) (interface{}, error) {
+	if err := this.health.check(); err != nil {
+		return nil, err
+	}
+	ctx, cancel := this.timeouts.WithTimeout(ctx, "Inc")
+	defer cancel()
 	col := this.mongoDatabase.Collection(this.collectionName)
 	opt := options.FindOneAndUpdate().SetUpsert(upsert).SetReturnDocument(options.After)
-	updateResult := col.FindOneAndUpdate(context.Background(),
-		bson.D{{Key: this.keyName, Value: key}},
-		bson.D{{Key: "$inc", Value: bson.D{{Key: this.valueName, Value: value}}}},
-		opt)
+	var updateResult *mongo.SingleResult
+	if this.expireAtField == "" {
+		updateResult = col.FindOneAndUpdate(ctx,
+			bson.D{{Key: this.keyName, Value: key}},
+			bson.D{{Key: "$inc", Value: bson.D{{Key: this.valueName, Value: value}}}},
+			opt)
+	} else if !upsert {
+		updateResult = col.FindOneAndUpdate(ctx,
+			this.getAliveFilter(key),
+			bson.D{{Key: "$inc", Value: bson.D{{Key: this.valueName, Value: value}}}},
+			opt)
+	} else {
+		// upsert时,已过期的数据从0开始累加,并去掉过期时间
+		now := time.Now()
+		expired := this.getExpiredExpr(now)
+		oldValue := bson.D{{Key: "$cond", Value: bson.A{expired, 0, bson.D{{Key: "$ifNull", Value: bson.A{"$" + this.valueName, 0}}}}}}
+		updateResult = col.FindOneAndUpdate(ctx,
+			bson.D{{Key: this.keyName, Value: key}},
+			mongo.Pipeline{{{Key: "$set", Value: bson.D{
+				{Key: this.valueName, Value: bson.D{{Key: "$add", Value: bson.A{oldValue, value}}}},
+				{Key: this.expireAtField, Value: bson.D{{Key: "$cond", Value: bson.A{expired, "$$REMOVE", "$" + this.expireAtField}}}},
+			}}}},
+			opt)
+	}
 	if updateResult.Err() != nil {
 		return nil, updateResult.Err()
 	}
@@ -91,11 +283,181 @@ func (this *MongoKvDb) Inc(key interface{}, value interface{}, upsert bool) (int
 }
 
 func (this *MongoKvDb) Delete(key interface{}) error {
+	return this.DeleteContext(context.Background(), key)
+}
+
+func (this *MongoKvDb) DeleteContext(ctx context.Context, key interface{}) error {
+	if err := this.health.check(); err != nil {
+		return err
+	}
+	ctx, cancel := this.timeouts.WithTimeout(ctx, "Delete")
+	defer cancel()
 	col := this.mongoDatabase.Collection(this.collectionName)
-	_, err := col.DeleteOne(context.Background(), bson.D{{Key: this.keyName, Value: key}})
+	_, err := col.DeleteOne(ctx, bson.D{{Key: this.keyName, Value: key}})
 	return err
 }
 
+func (this *MongoKvDb) FindMany(keys []interface{}) (map[interface{}]interface{}, error) {
+	return this.FindManyContext(context.Background(), keys)
+}
+
+func (this *MongoKvDb) FindManyContext(ctx context.Context, keys []interface{}) (map[interface{}]interface{}, error) {
+	if err := this.health.check(); err != nil {
+		return nil, err
+	}
+	values := make(map[interface{}]interface{})
+	if len(keys) == 0 {
+		return values, nil
+	}
+	ctx, cancel := this.timeouts.WithTimeout(ctx, "FindMany")
+	defer cancel()
+	col := this.mongoDatabase.Collection(this.collectionName)
+	filter := this.getAliveFilter(bson.D{{Key: "$in", Value: keys}})
+	cursor, err := col.Find(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+	keyMap := getEntityKeyMap(keys)
+	for cursor.Next(ctx) {
+		var doc bson.M
+		if err = cursor.Decode(&doc); err != nil {
+			return nil, err
+		}
+		if key, ok := keyMap[memKey(doc[this.keyName])]; ok {
+			values[key] = doc[this.valueName]
+		}
+	}
+	return values, cursor.Err()
+}
+
+func (this *MongoKvDb) CompareAndSwap(key interface{}, expected interface{}, newValue interface{}) (bool, error) {
+	return this.CompareAndSwapContext(context.Background(), key, expected, newValue)
+}
+
+// 保留原有的过期时间
+func (this *MongoKvDb) CompareAndSwapContext(ctx context.Context, key interface{}, expected interface{}, newValue interface{}) (bool, error) {
+	if err := this.health.check(); err != nil {
+		return false, err
+	}
+	ctx, cancel := this.timeouts.WithTimeout(ctx, "CompareAndSwap")
+	defer cancel()
+	if expected == nil {
+		err, isDuplicateKey := this.insert(ctx, key, newValue, nil)
+		if isDuplicateKey {
+			return false, nil
+		}
+		return err == nil, err
+	}
+	col := this.mongoDatabase.Collection(this.collectionName)
+	filter := append(this.getAliveFilter(key), bson.E{Key: this.valueName, Value: expected})
+	result, err := col.UpdateOne(ctx, filter,
+		bson.D{{Key: "$set", Value: bson.D{{Key: this.valueName, Value: newValue}}}})
+	if err != nil {
+		return false, err
+	}
+	return result.MatchedCount > 0, nil
+}
+
+func (this *MongoKvDb) Scan(scan *KvScan) (*KvScanResult, error) {
+	return this.ScanContext(context.Background(), scan)
+}
+
+func (this *MongoKvDb) ScanContext(ctx context.Context, scan *KvScan) (*KvScanResult, error) {
+	if err := this.health.check(); err != nil {
+		return nil, err
+	}
+	ctx, cancel := this.timeouts.WithTimeout(ctx, "Scan")
+	defer cancel()
+	keyCondition := bson.D{}
+	if scan.Prefix != "" {
+		keyCondition = append(keyCondition, bson.E{Key: "$regex", Value: "^" + regexp.QuoteMeta(scan.Prefix)})
+	}
+	if scan.Start != nil {
+		keyCondition = append(keyCondition, bson.E{Key: "$gte", Value: scan.Start})
+	}
+	if scan.End != nil {
+		keyCondition = append(keyCondition, bson.E{Key: "$lt", Value: scan.End})
+	}
+	if scan.Cursor != nil {
+		keyCondition = append(keyCondition, bson.E{Key: "$gt", Value: scan.Cursor})
+	}
+	var filter bson.D
+	if len(keyCondition) > 0 {
+		filter = this.getAliveFilter(keyCondition)
+	} else if this.expireAtField != "" {
+		filter = this.getAliveFilter(bson.D{{Key: "$exists", Value: true}})
+	} else {
+		filter = bson.D{}
+	}
+	opts := options.Find().SetSort(bson.D{{Key: this.keyName, Value: 1}})
+	if scan.Limit > 0 {
+		opts.SetLimit(scan.Limit)
+	}
+	col := this.mongoDatabase.Collection(this.collectionName)
+	cursor, err := col.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+	var pairs []*KvPair
+	for cursor.Next(ctx) {
+		var doc bson.M
+		if err = cursor.Decode(&doc); err != nil {
+			return nil, err
+		}
+		pairs = append(pairs, &KvPair{Key: doc[this.keyName], Value: doc[this.valueName]})
+	}
+	if err = cursor.Err(); err != nil {
+		return nil, err
+	}
+	return scan.makeResult(pairs), nil
+}
+
+func (this *MongoKvDb) IncFields(key interface{}, fields map[string]interface{}, upsert bool) (map[string]interface{}, error) {
+	return this.IncFieldsContext(context.Background(), key, fields, upsert)
+}
+
+// 保留原有的过期时间,已过期的数据视为不存在
+func (this *MongoKvDb) IncFieldsContext(ctx context.Context, key interface{}, fields map[string]interface{}, upsert bool) (map[string]interface{}, error) {
+	if err := this.health.check(); err != nil {
+		return nil, err
+	}
+	ctx, cancel := this.timeouts.WithTimeout(ctx, "IncFields")
+	defer cancel()
+	col := this.mongoDatabase.Collection(this.collectionName)
+	incFields := bson.D{}
+	for fieldPath, value := range fields {
+		incFields = append(incFields, bson.E{Key: this.valueName + "." + fieldPath, Value: value})
+	}
+	opt := options.FindOneAndUpdate().SetUpsert(upsert).SetReturnDocument(options.After)
+	updateResult := col.FindOneAndUpdate(ctx, this.getAliveFilter(key), bson.D{{Key: "$inc", Value: incFields}}, opt)
+	if upsert && this.expireAtField != "" && IsDuplicateKeyError(updateResult.Err()) {
+		// 存在已过期但还没被删除的数据,删除后重试
+		_, err := col.DeleteOne(ctx, bson.D{
+			{Key: this.keyName, Value: key},
+			{Key: this.expireAtField, Value: bson.D{{Key: "$lte", Value: time.Now()}}},
+		})
+		if err != nil {
+			return nil, err
+		}
+		updateResult = col.FindOneAndUpdate(ctx, this.getAliveFilter(key), bson.D{{Key: "$inc", Value: incFields}}, opt)
+	}
+	raw, err := updateResult.Raw()
+	if err != nil {
+		return nil, err
+	}
+	doc, err := toBsonDocument(raw)
+	if err != nil {
+		return nil, err
+	}
+	newValues := make(map[string]interface{}, len(fields))
+	for fieldPath := range fields {
+		newValues[fieldPath], _ = getDocumentPath(doc, this.valueName+"."+fieldPath)
+	}
+	return newValues, nil
+}
+
 // 设置分片key
 func (this *MongoKvDb) Shard() error {
 	collectionFullName := fmt.Sprintf("%v.%v", this.mongoDatabase.Name(), this.collectionName)
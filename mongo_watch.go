@@ -0,0 +1,91 @@
+package gentity
+
+import (
+	"context"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+// change stream的事件,只解析需要的字段
+type mongoChangeEvent struct {
+	OperationType     string `bson:"operationType"`
+	DocumentKey       bson.M `bson:"documentKey"`
+	FullDocument      bson.M `bson:"fullDocument"`
+	UpdateDescription struct {
+		UpdatedFields bson.M   `bson:"updatedFields"`
+		RemovedFields []string `bson:"removedFields"`
+	} `bson:"updateDescription"`
+}
+
+// 使用change stream监听collection的变化,阻塞直到ctx取消或者出错
+//
+//	用于GM工具或者离线任务直接修改数据库时,删除实体的缓存或者通知实体重新加载,本服务器保存实体时也会产生事件
+//	mongodb需要部署为副本集或者分片集群
+func (this *MongoCollection) Watch(ctx context.Context, onChanged func(event *EntityChangeEvent)) error {
+	if err := this.health.check(); err != nil {
+		return err
+	}
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.D{{Key: "operationType", Value: bson.D{{Key: "$in", Value: bson.A{"insert", "update", "replace", "delete"}}}}}}},
+	}
+	opts := options.ChangeStream()
+	if this.uniqueId != "_id" {
+		// documentKey里只有_id(分片集群还有分片key),需要从fullDocument里获取uniqueId
+		// delete事件没有fullDocument,uniqueId不是分片key时无法获取
+		opts.SetFullDocument(options.UpdateLookup)
+		pipeline = append(pipeline, bson.D{{Key: "$project", Value: bson.D{
+			{Key: "operationType", Value: 1},
+			{Key: "documentKey", Value: 1},
+			{Key: "updateDescription", Value: 1},
+			{Key: "fullDocument." + this.uniqueId, Value: 1},
+		}}})
+	}
+	col := this.mongoDatabase.Collection(this.collectionName)
+	stream, err := col.Watch(ctx, pipeline, opts)
+	if err != nil {
+		return err
+	}
+	defer stream.Close(context.Background())
+	GetLogger().Info("Watch %v", this.collectionName)
+	for stream.Next(ctx) {
+		change := &mongoChangeEvent{}
+		if err = stream.Decode(change); err != nil {
+			GetLogger().Error("Watch %v decode err:%v", this.collectionName, err)
+			continue
+		}
+		event := this.toEntityChangeEvent(change)
+		if event == nil {
+			GetLogger().Error("Watch %v no uniqueId:%v", this.collectionName, change.DocumentKey)
+			continue
+		}
+		onChanged(event)
+	}
+	return stream.Err()
+}
+
+func (this *MongoCollection) toEntityChangeEvent(change *mongoChangeEvent) *EntityChangeEvent {
+	entityKey, ok := change.DocumentKey[this.uniqueId]
+	if !ok {
+		entityKey, ok = change.FullDocument[this.uniqueId]
+		if !ok {
+			return nil
+		}
+	}
+	event := &EntityChangeEvent{
+		EntityKey:     entityKey,
+		OperationType: change.OperationType,
+	}
+	for fieldPath := range change.UpdateDescription.UpdatedFields {
+		// 批量保存写入的token字段不是实体数据
+		if !this.isVersionTokenField(fieldPath) {
+			event.UpdatedFields = append(event.UpdatedFields, fieldPath)
+		}
+	}
+	event.UpdatedFields = append(event.UpdatedFields, change.UpdateDescription.RemovedFields...)
+	if len(this.versionField) > 0 {
+		// updatedFields的key是完整的字段路径
+		event.Version, _ = toInt64(change.UpdateDescription.UpdatedFields[this.versionField])
+	}
+	return event
+}
@@ -2,16 +2,25 @@ package gentity
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"go.mongodb.org/mongo-driver/v2/bson"
 	"go.mongodb.org/mongo-driver/v2/mongo"
 	"go.mongodb.org/mongo-driver/v2/mongo/options"
 	"go.mongodb.org/mongo-driver/v2/mongo/readpref"
+	"math"
+	"slices"
+	"strings"
+	"sync"
 )
 
 // https://github.com/uber-go/guide/blob/master/style.md#verify-interface-compliance
 var _ PlayerDb = (*MongoCollectionPlayer)(nil)
+var _ VersionedPlayerDb = (*MongoCollectionPlayer)(nil)
 var _ EntityDb = (*MongoCollection)(nil)
+var _ IncrementalEntityDb = (*MongoCollection)(nil)
+var _ VersionedEntityDb = (*MongoCollection)(nil)
+var _ BulkEntityDb = (*MongoCollection)(nil)
 
 type Sharding interface {
 	Shard() error
@@ -27,6 +36,14 @@ type MongoCollection struct {
 	collectionName string
 	// 唯一id
 	uniqueId string
+	// 操作的超时设置
+	timeouts *OpTimeouts
+	// 乐观锁的版本号字段,为空表示不使用乐观锁
+	versionField string
+	// 需要创建的索引(不包含uniqueId的唯一索引)
+	indexDefs []*IndexDef
+	// 连接状态,所有collection共用
+	health *mongoHealth
 }
 
 func (this *MongoCollection) GetCollection() *mongo.Collection {
@@ -70,24 +87,209 @@ func (this *MongoCollection) Shard() error {
 
 // 根据id查找数据
 func (this *MongoCollection) FindEntityById(entityKey interface{}, data interface{}) (bool, error) {
+	return this.FindEntityByIdContext(context.Background(), entityKey, data)
+}
+
+func (this *MongoCollection) FindEntityByIdContext(ctx context.Context, entityKey interface{}, data interface{}) (bool, error) {
+	exists, _, err := this.FindEntityByIdWithVersionContext(ctx, entityKey, data)
+	return exists, err
+}
+
+func (this *MongoCollection) FindEntityByIdWithVersion(entityKey interface{}, data interface{}) (bool, int64, error) {
+	return this.FindEntityByIdWithVersionContext(context.Background(), entityKey, data)
+}
+
+func (this *MongoCollection) FindEntityByIdWithVersionContext(ctx context.Context, entityKey interface{}, data interface{}) (bool, int64, error) {
+	if err := this.health.check(); err != nil {
+		return false, 0, err
+	}
 	if len(this.uniqueId) == 0 {
-		return false, ErrNoUniqueColumn
+		return false, 0, ErrNoUniqueColumn
 	}
+	ctx, cancel := this.timeouts.WithTimeout(ctx, "FindEntityById")
+	defer cancel()
 	col := this.mongoDatabase.Collection(this.collectionName)
-	result := col.FindOne(context.Background(), bson.D{{Key: this.uniqueId, Value: entityKey}})
+	opts := options.FindOne()
+	if projection := this.getEntityProjection(); projection != nil {
+		opts.SetProjection(projection)
+	}
+	result := col.FindOne(ctx, bson.D{{Key: this.uniqueId, Value: entityKey}}, opts)
+	return this.decodeWithVersion(result, data)
+}
+
+// 解码查询结果,同时返回文档里的版本号
+func (this *MongoCollection) decodeWithVersion(result *mongo.SingleResult, data interface{}) (bool, int64, error) {
 	if result == nil || result.Err() == mongo.ErrNoDocuments {
-		return false, nil
+		return false, 0, nil
 	}
 	err := result.Decode(data)
 	if err != nil {
-		return false, err
+		return false, 0, err
+	}
+	if len(this.versionField) == 0 {
+		return true, 0, nil
 	}
-	return true, nil
+	raw, err := result.Raw()
+	if err != nil {
+		return false, 0, err
+	}
+	version, err := this.getRawVersion(raw)
+	if err != nil {
+		return false, 0, err
+	}
+	return true, version, nil
+}
+
+// 文档里的版本号,版本号字段不存在时返回0
+func (this *MongoCollection) getRawVersion(raw bson.Raw) (int64, error) {
+	versionValue, err := raw.LookupErr(strings.Split(this.versionField, ".")...)
+	if err != nil {
+		// 版本号字段不存在
+		return 0, nil
+	}
+	var version interface{}
+	if err = versionValue.Unmarshal(&version); err != nil {
+		return 0, err
+	}
+	i, _ := toInt64(version)
+	return i, nil
+}
+
+// 使用$in查询,只有1次数据库交互
+func (this *MongoCollection) FindEntitiesByIds(entityKeys []interface{}, newData func() interface{}, componentNames ...string) (map[interface{}]interface{}, error) {
+	return this.FindEntitiesByIdsContext(context.Background(), entityKeys, newData, componentNames...)
+}
+
+func (this *MongoCollection) FindEntitiesByIdsContext(ctx context.Context, entityKeys []interface{}, newData func() interface{}, componentNames ...string) (map[interface{}]interface{}, error) {
+	if err := this.health.check(); err != nil {
+		return nil, err
+	}
+	if len(this.uniqueId) == 0 {
+		return nil, ErrNoUniqueColumn
+	}
+	datas := make(map[interface{}]interface{}, len(entityKeys))
+	if len(entityKeys) == 0 {
+		return datas, nil
+	}
+	ctx, cancel := this.timeouts.WithTimeout(ctx, "FindEntitiesByIds")
+	defer cancel()
+	col := this.mongoDatabase.Collection(this.collectionName)
+	opts := options.Find()
+	if len(componentNames) > 0 {
+		projection := bson.D{{Key: this.uniqueId, Value: 1}}
+		for _, componentName := range componentNames {
+			projection = append(projection, bson.E{Key: componentName, Value: 1})
+		}
+		opts.SetProjection(projection)
+	} else if projection := this.getEntityProjection(); projection != nil {
+		opts.SetProjection(projection)
+	}
+	cursor, err := col.Find(ctx, bson.D{{Key: this.uniqueId, Value: bson.D{{Key: "$in", Value: entityKeys}}}}, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+	keyMap := getEntityKeyMap(entityKeys)
+	for cursor.Next(ctx) {
+		keyValue, err := cursor.Current.LookupErr(this.uniqueId)
+		if err != nil {
+			return nil, err
+		}
+		var key interface{}
+		if err = keyValue.Unmarshal(&key); err != nil {
+			return nil, err
+		}
+		entityKey, ok := keyMap[memKey(key)]
+		if !ok {
+			continue
+		}
+		data := newData()
+		if err = cursor.Decode(data); err != nil {
+			return nil, err
+		}
+		datas[entityKey] = data
+	}
+	if err = cursor.Err(); err != nil {
+		return nil, err
+	}
+	return datas, nil
+}
+
+// 查询条件转换成bson格式,字段路径直接对应mongodb的点号路径
+func (this *MongoCollection) FindEntities(query *Query, newData func() interface{}) (*QueryResult, error) {
+	return this.FindEntitiesContext(context.Background(), query, newData)
+}
+
+func (this *MongoCollection) FindEntitiesContext(ctx context.Context, query *Query, newData func() interface{}) (*QueryResult, error) {
+	if err := this.health.check(); err != nil {
+		return nil, err
+	}
+	if len(this.uniqueId) == 0 {
+		return nil, ErrNoUniqueColumn
+	}
+	if err := query.check(this.uniqueId); err != nil {
+		return nil, err
+	}
+	ctx, cancel := this.timeouts.WithTimeout(ctx, "FindEntities")
+	defer cancel()
+	col := this.mongoDatabase.Collection(this.collectionName)
+	opts := options.Find().SetSort(query.toBsonSort(this.uniqueId))
+	if query.Skip > 0 {
+		opts.SetSkip(query.Skip)
+	}
+	if query.Limit > 0 {
+		opts.SetLimit(query.Limit)
+	}
+	if projection := query.toBsonProjection(this.uniqueId); projection != nil {
+		opts.SetProjection(projection)
+	} else if projection := this.getEntityProjection(); projection != nil {
+		opts.SetProjection(projection)
+	}
+	cursor, err := col.Find(ctx, query.toBsonFilter(this.uniqueId), opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+	result := &QueryResult{}
+	var last bson.Raw
+	for cursor.Next(ctx) {
+		data := newData()
+		if err = cursor.Decode(data); err != nil {
+			return nil, err
+		}
+		result.Datas = append(result.Datas, data)
+		// cursor.Current在获取下一批数据后会失效
+		last = append(last[:0], cursor.Current...)
+	}
+	if err = cursor.Err(); err != nil {
+		return nil, err
+	}
+	if last != nil {
+		result.NextCursor = query.makeNextCursor(this.uniqueId, len(result.Datas), func(fieldPath string) interface{} {
+			rawValue, lookupErr := last.LookupErr(strings.Split(fieldPath, ".")...)
+			if lookupErr != nil {
+				return nil
+			}
+			var value interface{}
+			rawValue.Unmarshal(&value)
+			return value
+		})
+	}
+	return result, nil
 }
 
 func (this *MongoCollection) InsertEntity(entityKey interface{}, entityData interface{}) (err error, isDuplicateKey bool) {
+	return this.InsertEntityContext(context.Background(), entityKey, entityData)
+}
+
+func (this *MongoCollection) InsertEntityContext(ctx context.Context, entityKey interface{}, entityData interface{}) (err error, isDuplicateKey bool) {
+	if err = this.health.check(); err != nil {
+		return
+	}
+	ctx, cancel := this.timeouts.WithTimeout(ctx, "InsertEntity")
+	defer cancel()
 	col := this.mongoDatabase.Collection(this.collectionName)
-	_, err = col.InsertOne(context.Background(), entityData)
+	_, err = col.InsertOne(ctx, entityData)
 	if err != nil {
 		isDuplicateKey = IsDuplicateKeyError(err)
 	}
@@ -95,20 +297,47 @@ func (this *MongoCollection) InsertEntity(entityKey interface{}, entityData inte
 }
 
 func (this *MongoCollection) SaveEntity(entityKey interface{}, entityData interface{}) error {
+	return this.SaveEntityContext(context.Background(), entityKey, entityData)
+}
+
+func (this *MongoCollection) SaveEntityContext(ctx context.Context, entityKey interface{}, entityData interface{}) error {
+	if err := this.health.check(); err != nil {
+		return err
+	}
+	ctx, cancel := this.timeouts.WithTimeout(ctx, "SaveEntity")
+	defer cancel()
 	col := this.mongoDatabase.Collection(this.collectionName)
-	_, err := col.UpdateOne(context.Background(), bson.D{{Key: this.uniqueId, Value: entityKey}}, entityData)
+	_, err := col.UpdateOne(ctx, bson.D{{Key: this.uniqueId, Value: entityKey}}, entityData)
 	return err
 }
 
 func (this *MongoCollection) DeleteEntity(entityKey interface{}) error {
+	return this.DeleteEntityContext(context.Background(), entityKey)
+}
+
+func (this *MongoCollection) DeleteEntityContext(ctx context.Context, entityKey interface{}) error {
+	if err := this.health.check(); err != nil {
+		return err
+	}
+	ctx, cancel := this.timeouts.WithTimeout(ctx, "DeleteEntity")
+	defer cancel()
 	col := this.mongoDatabase.Collection(this.collectionName)
-	_, err := col.DeleteOne(context.Background(), bson.D{{Key: this.uniqueId, Value: entityKey}})
+	_, err := col.DeleteOne(ctx, bson.D{{Key: this.uniqueId, Value: entityKey}})
 	return err
 }
 
 func (this *MongoCollection) SaveComponent(entityKey interface{}, componentName string, componentData interface{}) error {
+	return this.SaveComponentContext(context.Background(), entityKey, componentName, componentData)
+}
+
+func (this *MongoCollection) SaveComponentContext(ctx context.Context, entityKey interface{}, componentName string, componentData interface{}) error {
+	if err := this.health.check(); err != nil {
+		return err
+	}
+	ctx, cancel := this.timeouts.WithTimeout(ctx, "SaveComponent")
+	defer cancel()
 	col := this.mongoDatabase.Collection(this.collectionName)
-	_, updateErr := col.UpdateOne(context.Background(), bson.D{{Key: this.uniqueId, Value: entityKey}},
+	_, updateErr := col.UpdateOne(ctx, bson.D{{Key: this.uniqueId, Value: entityKey}},
 		bson.D{{Key: "$set", Value: bson.D{{Key: componentName, Value: componentData}}}})
 	if updateErr != nil {
 		return updateErr
@@ -116,24 +345,300 @@ func (this *MongoCollection) SaveComponent(entityKey interface{}, componentName
 	return nil
 }
 
+func (this *MongoCollection) SupportIncrementalSave() bool {
+	return true
+}
+
 func (this *MongoCollection) SaveComponents(entityKey interface{}, components map[string]interface{}) error {
+	return this.SaveComponentsContext(context.Background(), entityKey, components)
+}
+
+func (this *MongoCollection) SaveComponentsContext(ctx context.Context, entityKey interface{}, components map[string]interface{}) error {
+	if err := this.health.check(); err != nil {
+		return err
+	}
 	if len(components) == 0 {
 		return nil
 	}
+	ctx, cancel := this.timeouts.WithTimeout(ctx, "SaveComponents")
+	defer cancel()
 	col := this.mongoDatabase.Collection(this.collectionName)
-	_, updateErr := col.UpdateMany(context.Background(), bson.D{{Key: this.uniqueId, Value: entityKey}},
-		bson.D{{Key: "$set", Value: components}})
+	_, updateErr := col.UpdateMany(ctx, bson.D{{Key: this.uniqueId, Value: entityKey}},
+		getComponentsUpdate(components))
 	if updateErr != nil {
 		return updateErr
 	}
 	return nil
 }
 
+// 把组件数据转换成mongodb格式的更新操作,UnsetComponentField转换成$unset,PushComponentField转换成$push
+//
+//	MemDb和FileDb也使用相同格式的更新操作
+func getComponentsUpdate(components map[string]interface{}) bson.M {
+	update := bson.M{}
+	setFields := bson.M{}
+	unsetFields := bson.M{}
+	pushFields := bson.M{}
+	for fieldPath, value := range components {
+		if isUnsetComponentField(value) {
+			unsetFields[fieldPath] = ""
+		} else if items, ok := getPushComponentField(value); ok {
+			pushFields[fieldPath] = bson.M{"$each": items}
+		} else {
+			setFields[fieldPath] = value
+		}
+	}
+	if len(setFields) > 0 {
+		update["$set"] = setFields
+	}
+	if len(unsetFields) > 0 {
+		update["$unset"] = unsetFields
+	}
+	if len(pushFields) > 0 {
+		update["$push"] = pushFields
+	}
+	return update
+}
+
+func (this *MongoCollection) getMongoClient() *mongo.Client {
+	return this.mongoClient
+}
+
+// 批量保存(SaveComponentsBulk)检查版本号时,会在实体的文档里额外保存一个token数组字段,字段名是versionField+"Token",
+// 查询实体数据时会排除该字段
+func (this *MongoCollection) SetVersionField(versionField string) {
+	this.versionField = versionField
+}
+
+func (this *MongoCollection) GetVersionField() string {
+	return this.versionField
+}
+
+func (this *MongoCollection) FindEntityVersion(entityKey interface{}) (int64, error) {
+	return this.FindEntityVersionContext(context.Background(), entityKey)
+}
+
+func (this *MongoCollection) FindEntityVersionContext(ctx context.Context, entityKey interface{}) (int64, error) {
+	if err := this.health.check(); err != nil {
+		return 0, err
+	}
+	ctx, cancel := this.timeouts.WithTimeout(ctx, "FindEntityVersion")
+	defer cancel()
+	col := this.mongoDatabase.Collection(this.collectionName)
+	result := col.FindOne(ctx, bson.D{{Key: this.uniqueId, Value: entityKey}},
+		options.FindOne().SetProjection(bson.D{{Key: this.versionField, Value: 1}}))
+	raw, err := result.Raw()
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return 0, ErrEntityNotExists
+		}
+		return 0, err
+	}
+	return this.getRawVersion(raw)
+}
+
+// 以版本号作为更新条件,同时$inc版本号
+func (this *MongoCollection) SaveComponentsWithVersion(entityKey interface{}, components map[string]interface{}, version int64) error {
+	return this.SaveComponentsWithVersionContext(context.Background(), entityKey, components, version)
+}
+
+func (this *MongoCollection) SaveComponentsWithVersionContext(ctx context.Context, entityKey interface{}, components map[string]interface{}, version int64) error {
+	if err := this.health.check(); err != nil {
+		return err
+	}
+	if len(this.versionField) == 0 {
+		return this.SaveComponentsContext(ctx, entityKey, components)
+	}
+	ctx, cancel := this.timeouts.WithTimeout(ctx, "SaveComponents")
+	defer cancel()
+	col := this.mongoDatabase.Collection(this.collectionName)
+	var versionFilter interface{} = version
+	if version == 0 {
+		// 版本号字段不存在时,当作0
+		versionFilter = bson.D{{Key: "$in", Value: bson.A{0, nil}}}
+	}
+	update := getComponentsUpdate(components)
+	update["$inc"] = bson.M{this.versionField: int64(1)}
+	result, err := col.UpdateOne(ctx, bson.D{{Key: this.uniqueId, Value: entityKey}, {Key: this.versionField, Value: versionFilter}}, update)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount > 0 {
+		return nil
+	}
+	count, err := col.CountDocuments(ctx, bson.D{{Key: this.uniqueId, Value: entityKey}})
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return ErrEntityNotExists
+	}
+	return ErrVersionConflict
+}
+
+// 使用无序的BulkWrite,只有1次数据库交互,其中一个实体保存失败不影响其他实体
+func (this *MongoCollection) SaveComponentsBulk(datas []*EntityComponentsData) []error {
+	return this.SaveComponentsBulkContext(context.Background(), datas)
+}
+
+func (this *MongoCollection) SaveComponentsBulkContext(ctx context.Context, datas []*EntityComponentsData) []error {
+	errs := make([]error, len(datas))
+	if err := this.health.check(); err != nil {
+		for i := range errs {
+			errs[i] = err
+		}
+		return errs
+	}
+	var models []mongo.WriteModel
+	// models的索引 -> datas的索引
+	var dataIndexes []int
+	// 检查版本号的实体,每次更新写入一个唯一的token,用于确认是否是本次更新生效
+	versionTokens := make(map[int]bson.ObjectID)
+	for i, data := range datas {
+		filter := bson.D{{Key: this.uniqueId, Value: data.EntityKey}}
+		update := getComponentsUpdate(data.Components)
+		if data.CheckVersion && len(this.versionField) > 0 {
+			var versionFilter interface{} = data.Version
+			if data.Version == 0 {
+				// 版本号字段不存在时,当作0
+				versionFilter = bson.D{{Key: "$in", Value: bson.A{0, nil}}}
+			}
+			filter = append(filter, bson.E{Key: this.versionField, Value: versionFilter})
+			update["$inc"] = bson.M{this.versionField: int64(1)}
+			token := bson.NewObjectID()
+			pushUpdate, _ := update["$push"].(bson.M)
+			if pushUpdate == nil {
+				pushUpdate = make(bson.M)
+				update["$push"] = pushUpdate
+			}
+			pushUpdate[this.getVersionTokenField()] = bson.M{"$each": bson.A{token}, "$slice": -mongoVersionTokenCount}
+			versionTokens[i] = token
+		}
+		if len(update) == 0 {
+			continue
+		}
+		models = append(models, mongo.NewUpdateOneModel().SetFilter(filter).SetUpdate(update))
+		dataIndexes = append(dataIndexes, i)
+	}
+	if len(models) == 0 {
+		return errs
+	}
+	ctx, cancel := this.timeouts.WithTimeout(ctx, "SaveComponentsBulk")
+	defer cancel()
+	col := this.mongoDatabase.Collection(this.collectionName)
+	result, err := col.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+	if err != nil {
+		var bulkErr mongo.BulkWriteException
+		if !errors.As(err, &bulkErr) || len(bulkErr.WriteErrors) == 0 {
+			// 整体失败
+			for _, i := range dataIndexes {
+				errs[i] = err
+			}
+			return errs
+		}
+		for _, writeErr := range bulkErr.WriteErrors {
+			errs[dataIndexes[writeErr.Index]] = writeErr
+		}
+	}
+	successCount := int64(0)
+	for _, i := range dataIndexes {
+		if errs[i] == nil {
+			successCount++
+		}
+	}
+	if len(versionTokens) == 0 || (result != nil && result.MatchedCount >= successCount) {
+		return errs
+	}
+	// BulkWrite的结果只有总数,需要查询token,才能知道哪些实体的版本号不一致
+	this.checkBulkVersions(ctx, datas, versionTokens, errs)
+	return errs
+}
+
+// 批量保存时,每次检查版本号的更新都往token字段追加一个唯一的token,只保留最近的mongoVersionTokenCount个
+//
+//	不能用版本号判断是否保存成功: 其他进程可能在本次更新之前或之后也保存了该实体
+const mongoVersionTokenCount = 8
+
+func (this *MongoCollection) getVersionTokenField() string {
+	return this.versionField + "Token"
+}
+
+// 查询实体数据时的projection,排除批量保存写入的token字段,nil表示不需要projection
+func (this *MongoCollection) getEntityProjection() bson.D {
+	if len(this.versionField) == 0 {
+		return nil
+	}
+	return bson.D{{Key: this.getVersionTokenField(), Value: 0}}
+}
+
+// 是否是批量保存写入的token字段
+func (this *MongoCollection) isVersionTokenField(fieldPath string) bool {
+	if len(this.versionField) == 0 {
+		return false
+	}
+	tokenField := this.getVersionTokenField()
+	return fieldPath == tokenField || strings.HasPrefix(fieldPath, tokenField+".")
+}
+
+// 批量保存后,根据数据库中的token判断每个实体是否保存成功
+func (this *MongoCollection) checkBulkVersions(ctx context.Context, datas []*EntityComponentsData, versionTokens map[int]bson.ObjectID, errs []error) {
+	var entityKeys []interface{}
+	for i, data := range datas {
+		if _, ok := versionTokens[i]; ok && errs[i] == nil {
+			entityKeys = append(entityKeys, data.EntityKey)
+		}
+	}
+	tokenField := this.getVersionTokenField()
+	col := this.mongoDatabase.Collection(this.collectionName)
+	cursor, err := col.Find(ctx, bson.D{{Key: this.uniqueId, Value: bson.D{{Key: "$in", Value: entityKeys}}}},
+		options.Find().SetProjection(bson.D{{Key: this.uniqueId, Value: 1}, {Key: tokenField, Value: 1}}))
+	if err != nil {
+		for i := range versionTokens {
+			if errs[i] == nil {
+				errs[i] = err
+			}
+		}
+		return
+	}
+	defer cursor.Close(ctx)
+	tokens := make(map[string]bson.A, len(entityKeys))
+	for cursor.Next(ctx) {
+		doc := make(memDocument)
+		if err = cursor.Decode(&doc); err != nil {
+			continue
+		}
+		key, _ := getDocumentPath(doc, this.uniqueId)
+		savedTokens, _ := getDocumentPath(doc, tokenField)
+		tokenArray, _ := savedTokens.(bson.A)
+		tokens[memKey(key)] = tokenArray
+	}
+	for i, token := range versionTokens {
+		if errs[i] != nil {
+			continue
+		}
+		savedTokens, ok := tokens[memKey(datas[i].EntityKey)]
+		if !ok {
+			errs[i] = ErrEntityNotExists
+		} else if !slices.Contains(savedTokens, interface{}(token)) {
+			errs[i] = ErrVersionConflict
+		}
+	}
+}
+
 func (this *MongoCollection) SaveComponentField(entityKey interface{}, componentName string, fieldName string, fieldData interface{}) error {
+	return this.SaveComponentFieldContext(context.Background(), entityKey, componentName, fieldName, fieldData)
+}
+
+func (this *MongoCollection) SaveComponentFieldContext(ctx context.Context, entityKey interface{}, componentName string, fieldName string, fieldData interface{}) error {
+	if err := this.health.check(); err != nil {
+		return err
+	}
+	ctx, cancel := this.timeouts.WithTimeout(ctx, "SaveComponentField")
+	defer cancel()
 	col := this.mongoDatabase.Collection(this.collectionName)
 	// NOTE:如果player.ComponentName == null
 	// 直接更新player.ComponentName.fieldName会报错: Cannot create field 'fieldName' in element
-	_, updateErr := col.UpdateOne(context.Background(), bson.D{{Key: this.uniqueId, Value: entityKey}},
+	_, updateErr := col.UpdateOne(ctx, bson.D{{Key: this.uniqueId, Value: entityKey}},
 		bson.D{{Key: "$set", Value: bson.D{{Key: componentName + "." + fieldName, Value: fieldData}}}})
 	if updateErr != nil {
 		return updateErr
@@ -143,15 +648,24 @@ func (this *MongoCollection) SaveComponentField(entityKey interface{}, component
 
 // 删除1个组件的某些字段
 func (this *MongoCollection) DeleteComponentField(entityKey interface{}, componentName string, fieldName ...string) error {
+	return this.DeleteComponentFieldContext(context.Background(), entityKey, componentName, fieldName...)
+}
+
+func (this *MongoCollection) DeleteComponentFieldContext(ctx context.Context, entityKey interface{}, componentName string, fieldName ...string) error {
+	if err := this.health.check(); err != nil {
+		return err
+	}
 	if len(fieldName) == 0 {
 		return nil
 	}
+	ctx, cancel := this.timeouts.WithTimeout(ctx, "DeleteComponentField")
+	defer cancel()
 	col := this.mongoDatabase.Collection(this.collectionName)
 	fieldNames := bson.D{}
 	for _, name := range fieldName {
 		fieldNames = append(fieldNames, bson.E{Key: componentName + "." + name})
 	}
-	result, updateErr := col.UpdateOne(context.Background(), bson.D{{Key: this.uniqueId, Value: entityKey}},
+	result, updateErr := col.UpdateOne(ctx, bson.D{{Key: this.uniqueId, Value: entityKey}},
 		bson.D{{Key: "$unset", Value: fieldNames}})
 	if updateErr != nil {
 		return updateErr
@@ -160,6 +674,133 @@ func (this *MongoCollection) DeleteComponentField(entityKey interface{}, compone
 	return nil
 }
 
+// 使用$push+$slice,添加和截断是原子操作
+func (this *MongoCollection) PushToList(entityKey interface{}, listName string, item interface{}, maxLen int) error {
+	return this.PushToListContext(context.Background(), entityKey, listName, item, maxLen)
+}
+
+func (this *MongoCollection) PushToListContext(ctx context.Context, entityKey interface{}, listName string, item interface{}, maxLen int) error {
+	if err := this.health.check(); err != nil {
+		return err
+	}
+	ctx, cancel := this.timeouts.WithTimeout(ctx, "PushToList")
+	defer cancel()
+	col := this.mongoDatabase.Collection(this.collectionName)
+	pushValue := bson.D{{Key: "$each", Value: bson.A{item}}}
+	if maxLen > 0 {
+		pushValue = append(pushValue, bson.E{Key: "$slice", Value: -maxLen})
+	}
+	result, updateErr := col.UpdateOne(ctx, bson.D{{Key: this.uniqueId, Value: entityKey}},
+		bson.D{{Key: "$push", Value: bson.D{{Key: listName, Value: pushValue}}}})
+	if updateErr != nil {
+		return updateErr
+	}
+	if result.MatchedCount == 0 {
+		return ErrEntityNotExists
+	}
+	return nil
+}
+
+// 使用FindOneAndUpdate,读取和删除是原子操作
+//
+//	count>0时使用聚合管道更新,需要mongodb 4.2以上版本
+func (this *MongoCollection) PopList(entityKey interface{}, listName string, count int, data interface{}) error {
+	return this.PopListContext(context.Background(), entityKey, listName, count, data)
+}
+
+func (this *MongoCollection) PopListContext(ctx context.Context, entityKey interface{}, listName string, count int, data interface{}) error {
+	if err := this.health.check(); err != nil {
+		return err
+	}
+	ctx, cancel := this.timeouts.WithTimeout(ctx, "PopList")
+	defer cancel()
+	col := this.mongoDatabase.Collection(this.collectionName)
+	var update interface{}
+	var projection bson.D
+	if count <= 0 {
+		update = bson.D{{Key: "$unset", Value: bson.D{{Key: listName, Value: ""}}}}
+		projection = bson.D{{Key: this.uniqueId, Value: 1}, {Key: listName, Value: 1}}
+	} else {
+		// {$set:{listName:{$slice:[list, count, max(size,1)]}}}
+		list := bson.D{{Key: "$ifNull", Value: bson.A{"$" + listName, bson.A{}}}}
+		size := bson.D{{Key: "$max", Value: bson.A{bson.D{{Key: "$size", Value: list}}, 1}}}
+		update = mongo.Pipeline{
+			{{Key: "$set", Value: bson.D{{Key: listName, Value: bson.D{{Key: "$slice", Value: bson.A{list, count, size}}}}}}},
+		}
+		projection = bson.D{{Key: this.uniqueId, Value: 1}, {Key: listName, Value: bson.D{{Key: "$slice", Value: count}}}}
+	}
+	opts := options.FindOneAndUpdate().
+		SetProjection(projection).
+		SetReturnDocument(options.Before)
+	raw, err := col.FindOneAndUpdate(ctx, bson.D{{Key: this.uniqueId, Value: entityKey}}, update, opts).Raw()
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return ErrEntityNotExists
+		}
+		return err
+	}
+	return decodeMongoList(raw, listName, data)
+}
+
+// 使用$slice投影,只读取列表的部分数据
+func (this *MongoCollection) RangeList(entityKey interface{}, listName string, start int, count int, data interface{}) error {
+	return this.RangeListContext(context.Background(), entityKey, listName, start, count, data)
+}
+
+func (this *MongoCollection) RangeListContext(ctx context.Context, entityKey interface{}, listName string, start int, count int, data interface{}) error {
+	if err := this.health.check(); err != nil {
+		return err
+	}
+	ctx, cancel := this.timeouts.WithTimeout(ctx, "RangeList")
+	defer cancel()
+	col := this.mongoDatabase.Collection(this.collectionName)
+	if count <= 0 {
+		count = math.MaxInt32
+	}
+	opts := options.FindOne().
+		SetProjection(bson.D{{Key: this.uniqueId, Value: 1}, {Key: listName, Value: bson.D{{Key: "$slice", Value: bson.A{start, count}}}}})
+	raw, err := col.FindOne(ctx, bson.D{{Key: this.uniqueId, Value: entityKey}}, opts).Raw()
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return ErrEntityNotExists
+		}
+		return err
+	}
+	return decodeMongoList(raw, listName, data)
+}
+
+// 使用$pull
+func (this *MongoCollection) RemoveFromList(entityKey interface{}, listName string, item interface{}) error {
+	return this.RemoveFromListContext(context.Background(), entityKey, listName, item)
+}
+
+func (this *MongoCollection) RemoveFromListContext(ctx context.Context, entityKey interface{}, listName string, item interface{}) error {
+	if err := this.health.check(); err != nil {
+		return err
+	}
+	ctx, cancel := this.timeouts.WithTimeout(ctx, "RemoveFromList")
+	defer cancel()
+	col := this.mongoDatabase.Collection(this.collectionName)
+	result, updateErr := col.UpdateOne(ctx, bson.D{{Key: this.uniqueId, Value: entityKey}},
+		bson.D{{Key: "$pull", Value: bson.D{{Key: listName, Value: item}}}})
+	if updateErr != nil {
+		return updateErr
+	}
+	if result.MatchedCount == 0 {
+		return ErrEntityNotExists
+	}
+	return nil
+}
+
+// 文档中的列表字段 -> data(slice的指针),列表字段不存在时不修改data
+func decodeMongoList(raw bson.Raw, listName string, data interface{}) error {
+	value, err := raw.LookupErr(strings.Split(listName, ".")...)
+	if err != nil || value.Type == bson.TypeNull {
+		return nil
+	}
+	return value.Unmarshal(data)
+}
+
 // db.PlayerDb的mongo实现
 type MongoCollectionPlayer struct {
 	MongoCollection
@@ -174,23 +815,47 @@ type MongoCollectionPlayer struct {
 // 根据账号id查找玩家数据
 // 适用于一个账号在一个区服只有一个玩家角色的游戏
 func (this *MongoCollectionPlayer) FindPlayerByAccountId(accountId int64, regionId int32, playerData interface{}) (bool, error) {
-	col := this.mongoDatabase.Collection(this.collectionName)
-	result := col.FindOne(context.Background(), bson.D{{Key: this.colAccountId, Value: accountId}, {Key: this.colRegionId, Value: regionId}})
-	if result == nil || result.Err() == mongo.ErrNoDocuments {
-		return false, nil
+	return this.FindPlayerByAccountIdContext(context.Background(), accountId, regionId, playerData)
+}
+
+func (this *MongoCollectionPlayer) FindPlayerByAccountIdContext(ctx context.Context, accountId int64, regionId int32, playerData interface{}) (bool, error) {
+	exists, _, err := this.FindPlayerByAccountIdWithVersionContext(ctx, accountId, regionId, playerData)
+	return exists, err
+}
+
+func (this *MongoCollectionPlayer) FindPlayerByAccountIdWithVersion(accountId int64, regionId int32, playerData interface{}) (bool, int64, error) {
+	return this.FindPlayerByAccountIdWithVersionContext(context.Background(), accountId, regionId, playerData)
+}
+
+func (this *MongoCollectionPlayer) FindPlayerByAccountIdWithVersionContext(ctx context.Context, accountId int64, regionId int32, playerData interface{}) (bool, int64, error) {
+	if err := this.health.check(); err != nil {
+		return false, 0, err
 	}
-	err := result.Decode(playerData)
-	if err != nil {
-		return false, err
+	ctx, cancel := this.timeouts.WithTimeout(ctx, "FindPlayerByAccountId")
+	defer cancel()
+	col := this.mongoDatabase.Collection(this.collectionName)
+	opts := options.FindOne()
+	if projection := this.getEntityProjection(); projection != nil {
+		opts.SetProjection(projection)
 	}
-	return true, nil
+	result := col.FindOne(ctx, bson.D{{Key: this.colAccountId, Value: accountId}, {Key: this.colRegionId, Value: regionId}}, opts)
+	return this.decodeWithVersion(result, playerData)
 }
 
 func (this *MongoCollectionPlayer) FindPlayerIdByAccountId(accountId int64, regionId int32) (int64, error) {
+	return this.FindPlayerIdByAccountIdContext(context.Background(), accountId, regionId)
+}
+
+func (this *MongoCollectionPlayer) FindPlayerIdByAccountIdContext(ctx context.Context, accountId int64, regionId int32) (int64, error) {
+	if err := this.health.check(); err != nil {
+		return 0, err
+	}
+	ctx, cancel := this.timeouts.WithTimeout(ctx, "FindPlayerIdByAccountId")
+	defer cancel()
 	col := this.mongoDatabase.Collection(this.collectionName)
 	opts := options.FindOne().
 		SetProjection(bson.D{{Key: this.uniqueId, Value: 1}})
-	result := col.FindOne(context.Background(), bson.D{{Key: this.colAccountId, Value: accountId}, {Key: this.colRegionId, Value: regionId}}, opts)
+	result := col.FindOne(ctx, bson.D{{Key: this.colAccountId, Value: accountId}, {Key: this.colRegionId, Value: regionId}}, opts)
 	if result == nil || result.Err() == mongo.ErrNoDocuments {
 		return 0, nil
 	}
@@ -206,15 +871,24 @@ func (this *MongoCollectionPlayer) FindPlayerIdByAccountId(accountId int64, regi
 }
 
 func (this *MongoCollectionPlayer) FindPlayerIdsByAccountId(accountId int64, regionId int32) ([]int64, error) {
+	return this.FindPlayerIdsByAccountIdContext(context.Background(), accountId, regionId)
+}
+
+func (this *MongoCollectionPlayer) FindPlayerIdsByAccountIdContext(ctx context.Context, accountId int64, regionId int32) ([]int64, error) {
+	if err := this.health.check(); err != nil {
+		return nil, err
+	}
+	ctx, cancel := this.timeouts.WithTimeout(ctx, "FindPlayerIdsByAccountId")
+	defer cancel()
 	col := this.mongoDatabase.Collection(this.collectionName)
 	opts := options.Find().
 		SetProjection(bson.D{{Key: this.uniqueId, Value: 1}})
-	cursor, err := col.Find(context.Background(), bson.D{{Key: this.colAccountId, Value: accountId}, {Key: this.colRegionId, Value: regionId}}, opts)
+	cursor, err := col.Find(ctx, bson.D{{Key: this.colAccountId, Value: accountId}, {Key: this.colRegionId, Value: regionId}}, opts)
 	if err != nil {
 		return nil, err
 	}
 	var datas []bson.M
-	if err = cursor.All(context.Background(), &datas); err != nil {
+	if err = cursor.All(ctx, &datas); err != nil {
 		return nil, err
 	}
 	playerIds := make([]int64, len(datas), len(datas))
@@ -238,10 +912,19 @@ func (this *MongoCollectionPlayer) FindPlayerIdsByAccountId(accountId int64, reg
 }
 
 func (this *MongoCollectionPlayer) FindAccountIdByPlayerId(playerId int64) (int64, error) {
+	return this.FindAccountIdByPlayerIdContext(context.Background(), playerId)
+}
+
+func (this *MongoCollectionPlayer) FindAccountIdByPlayerIdContext(ctx context.Context, playerId int64) (int64, error) {
+	if err := this.health.check(); err != nil {
+		return 0, err
+	}
+	ctx, cancel := this.timeouts.WithTimeout(ctx, "FindAccountIdByPlayerId")
+	defer cancel()
 	col := this.mongoDatabase.Collection(this.collectionName)
 	opts := options.FindOne().
 		SetProjection(bson.D{{Key: this.colAccountId, Value: 1}})
-	result := col.FindOne(context.Background(), bson.D{{Key: this.uniqueId, Value: playerId}}, opts)
+	result := col.FindOne(ctx, bson.D{{Key: this.uniqueId, Value: playerId}}, opts)
 	if result == nil || result.Err() == mongo.ErrNoDocuments {
 		return 0, nil
 	}
@@ -257,6 +940,7 @@ func (this *MongoCollectionPlayer) FindAccountIdByPlayerId(playerId int64) (int6
 }
 
 var _ DbMgr = (*MongoDb)(nil)
+var _ TransactionDbMgr = (*MongoDb)(nil)
 
 // db.DbMgr的mongo实现
 type MongoDb struct {
@@ -268,25 +952,52 @@ type MongoDb struct {
 
 	entityDbs map[string]EntityDb
 	kvDbs     map[string]KvDb
+	// 操作的超时设置,所有collection共用
+	timeouts *OpTimeouts
+	// Connect时检查到的索引不一致
+	indexDrifts    []*IndexDrift
+	indexLock      sync.Mutex
+	indexesEnsured bool
+	// 连接状态,所有collection共用
+	health *mongoHealth
+	// 健康检查和重连的设置
+	healthOptions   *MongoHealthOptions
+	stopHealthCheck context.CancelFunc
+	healthCheckWg   sync.WaitGroup
 }
 
+// 默认不超时,可以通过GetTimeouts()设置超时时间
+// 默认不做健康检查,可以通过GetHealthOptions()设置
 func NewMongoDb(uri, dbName string) *MongoDb {
 	return &MongoDb{
-		uri:       uri,
-		dbName:    dbName,
-		entityDbs: make(map[string]EntityDb),
-		kvDbs:     make(map[string]KvDb),
+		uri:           uri,
+		dbName:        dbName,
+		entityDbs:     make(map[string]EntityDb),
+		kvDbs:         make(map[string]KvDb),
+		timeouts:      NewOpTimeouts(0),
+		health:        newMongoHealth(),
+		healthOptions: NewMongoHealthOptions(),
 	}
 }
 
+// 操作的超时设置
+func (this *MongoDb) GetTimeouts() *OpTimeouts {
+	return this.timeouts
+}
+
 // 注册普通Entity对应的collection
-func (this *MongoDb) RegisterEntityDb(collectionName string, hashedShardKey bool, uniqueId string) EntityDb {
+//
+//	indexDefs: 需要创建的索引,可以使用GetEntityIndexDefs解析组件上的index标签
+func (this *MongoDb) RegisterEntityDb(collectionName string, hashedShardKey bool, uniqueId string, indexDefs ...*IndexDef) EntityDb {
 	col := &MongoCollection{
 		mongoClient:    this.mongoClient,
 		mongoDatabase:  this.mongoDatabase,
 		hashedShardKey: hashedShardKey,
 		collectionName: collectionName,
 		uniqueId:       uniqueId,
+		timeouts:       this.timeouts,
+		indexDefs:      indexDefs,
+		health:         this.health,
 	}
 	this.entityDbs[collectionName] = col
 	GetLogger().Info("RegisterEntityDb %v %v", collectionName, uniqueId)
@@ -294,7 +1005,9 @@ func (this *MongoDb) RegisterEntityDb(collectionName string, hashedShardKey bool
 }
 
 // 注册玩家对应的collection
-func (this *MongoDb) RegisterPlayerDb(collectionName string, hashedShardKey bool, playerId, accountId, region string) PlayerDb {
+//
+//	indexDefs: 需要创建的索引,如FindPlayerByAccountId需要的NewIndexDef(accountId, region)
+func (this *MongoDb) RegisterPlayerDb(collectionName string, hashedShardKey bool, playerId, accountId, region string, indexDefs ...*IndexDef) PlayerDb {
 	col := &MongoCollectionPlayer{
 		MongoCollection: MongoCollection{
 			mongoClient:    this.mongoClient,
@@ -302,6 +1015,9 @@ func (this *MongoDb) RegisterPlayerDb(collectionName string, hashedShardKey bool
 			hashedShardKey: hashedShardKey,
 			collectionName: collectionName,
 			uniqueId:       playerId,
+			timeouts:       this.timeouts,
+			indexDefs:      indexDefs,
+			health:         this.health,
 		},
 		colAccountId: accountId,
 		colRegionId:  region,
@@ -318,6 +1034,9 @@ func (this *MongoDb) RegisterKvDb(collectionName string, hashedShardKey bool, ke
 		collectionName: collectionName,
 		keyName:        keyName,
 		valueName:      valueName,
+		timeouts:       this.timeouts,
+		expireAtField:  DefaultExpireAtField,
+		health:         this.health,
 	}
 	this.kvDbs[collectionName] = col
 	GetLogger().Info("RegisterKvDb %v %v %v", collectionName, keyName, valueName)
@@ -332,17 +1051,55 @@ func (this *MongoDb) GetKvDb(name string) KvDb {
 	return this.kvDbs[name]
 }
 
+// 使用mongodb的事务,mongodb需要部署为副本集或者分片集群
+func (this *MongoDb) SaveComponentsInTransaction(datas []*EntityComponentsData) error {
+	return this.SaveComponentsInTransactionContext(context.Background(), datas)
+}
+
+func (this *MongoDb) SaveComponentsInTransactionContext(ctx context.Context, datas []*EntityComponentsData) error {
+	if err := this.health.check(); err != nil {
+		return err
+	}
+	for _, data := range datas {
+		// 只能是同一个MongoDb里的collection
+		col, ok := data.EntityDb.(interface{ getMongoClient() *mongo.Client })
+		if !ok || col.getMongoClient() != this.mongoClient {
+			return errors.New(fmt.Sprintf("%v not a collection of this MongoDb", data.EntityKey))
+		}
+	}
+	session, err := this.mongoClient.StartSession()
+	if err != nil {
+		return err
+	}
+	defer session.EndSession(ctx)
+	_, err = session.WithTransaction(ctx, func(sessionCtx context.Context) (interface{}, error) {
+		for _, data := range datas {
+			col := data.EntityDb.(EntityDbContext)
+			var saveErr error
+			if data.CheckVersion {
+				saveErr = col.SaveComponentsWithVersionContext(sessionCtx, data.EntityKey, data.Components, data.Version)
+			} else {
+				saveErr = col.SaveComponentsContext(sessionCtx, data.EntityKey, data.Components)
+			}
+			if saveErr != nil {
+				return nil, saveErr
+			}
+		}
+		return nil, nil
+	})
+	return err
+}
+
+// 连接数据库,并创建索引
+//
+//	开启健康检查时(GetHealthOptions().PingInterval>0),即使ping失败也会在后台重试,连接恢复后再创建索引
 func (this *MongoDb) Connect() bool {
+	this.stopHealthCheckRoutine()
 	client, err := mongo.Connect(options.Client().ApplyURI(this.uri))
 	if err != nil {
 		GetLogger().Error("%v", err)
 		return false
 	}
-	// Ping the primary
-	if err = client.Ping(context.Background(), readpref.Primary()); err != nil {
-		GetLogger().Error("%v", err)
-		return false
-	}
 	this.mongoClient = client
 	this.mongoDatabase = this.mongoClient.Database(this.dbName)
 	for _, entityDb := range this.entityDbs {
@@ -350,47 +1107,86 @@ func (this *MongoDb) Connect() bool {
 		case *MongoCollection:
 			mongoCollection.mongoClient = this.mongoClient
 			mongoCollection.mongoDatabase = this.mongoDatabase
-			if mongoCollection.uniqueId != "" && mongoCollection.uniqueId != "_id" {
-				mongoCollection.CreateIndex(mongoCollection.uniqueId, true)
-			}
-
 		case *MongoCollectionPlayer:
 			mongoCollection.mongoClient = this.mongoClient
 			mongoCollection.mongoDatabase = this.mongoDatabase
-			if mongoCollection.uniqueId != "" && mongoCollection.uniqueId != "_id" {
-				mongoCollection.CreateIndex(mongoCollection.uniqueId, true)
-			}
 		}
 	}
-
 	for _, kvDb := range this.kvDbs {
 		switch mongoCollection := kvDb.(type) {
 		case *MongoKvDb:
 			mongoCollection.mongoDatabase = this.mongoDatabase
-			if mongoCollection.keyName != "" && mongoCollection.keyName != "_id" {
-				indexModel := mongo.IndexModel{
-					Keys:    bson.D{{Key: mongoCollection.keyName, Value: 1}},
-					Options: options.Index().SetUnique(true),
-				}
-				col := this.mongoDatabase.Collection(mongoCollection.collectionName)
-				indexName, indexErr := col.Indexes().CreateOne(context.Background(), indexModel)
-				if indexErr != nil {
-					GetLogger().Error("%v create index %v err:%v", mongoCollection.collectionName, indexName, indexErr)
-				} else {
-					GetLogger().Info("%v index:%v", mongoCollection.collectionName, indexName)
-				}
-			}
 		}
 	}
-
+	this.indexesEnsured = false
+	// Ping the primary
+	if err = client.Ping(context.Background(), readpref.Primary()); err != nil {
+		GetLogger().Error("%v", err)
+		if this.healthOptions.PingInterval <= 0 {
+			client.Disconnect(context.Background())
+			return false
+		}
+		this.health.setState(MongoConnUnhealthy)
+		this.startHealthCheck()
+		return false
+	}
+	this.ensureAllIndexes()
+	this.health.setState(MongoConnHealthy)
+	this.startHealthCheck()
 	GetLogger().Info("mongo Connected")
 	return true
 }
 
+func (this *MongoDb) ensureAllIndexes() {
+	this.indexLock.Lock()
+	this.indexDrifts = nil
+	this.indexLock.Unlock()
+	for _, entityDb := range this.entityDbs {
+		switch mongoCollection := entityDb.(type) {
+		case *MongoCollection:
+			this.ensureIndexes(mongoCollection)
+		case *MongoCollectionPlayer:
+			this.ensureIndexes(mongoCollection)
+		}
+	}
+	for _, kvDb := range this.kvDbs {
+		switch mongoCollection := kvDb.(type) {
+		case *MongoKvDb:
+			this.ensureIndexes(mongoCollection)
+		}
+	}
+	this.indexesEnsured = true
+}
+
+func (this *MongoDb) ensureIndexes(col interface {
+	EnsureIndexes(ctx context.Context) ([]*IndexDrift, error)
+}) {
+	drifts, err := col.EnsureIndexes(context.Background())
+	if err != nil {
+		GetLogger().Error("EnsureIndexes err:%v", err)
+	}
+	for _, drift := range drifts {
+		GetLogger().Error("%v", drift)
+	}
+	this.indexLock.Lock()
+	this.indexDrifts = append(this.indexDrifts, drifts...)
+	this.indexLock.Unlock()
+}
+
+// Connect时检查到的数据库里的索引和声明的索引不一致的地方
+func (this *MongoDb) GetIndexDrifts() []*IndexDrift {
+	this.indexLock.Lock()
+	defer this.indexLock.Unlock()
+	return this.indexDrifts
+}
+
+// 断开连接后,可以再次调用Connect
 func (this *MongoDb) Disconnect() {
+	this.stopHealthCheckRoutine()
 	if this.mongoClient == nil {
 		return
 	}
+	this.health.setState(MongoConnDisconnected)
 	if err := this.mongoClient.Disconnect(context.Background()); err != nil {
 		GetLogger().Error("%v", err)
 	}
@@ -447,5 +1243,5 @@ func (this *MongoDb) ShardCollection(collectionFullName, keyName string, hashedS
 
 // 检查是否是key重复错误
 func IsDuplicateKeyError(err error) bool {
-	return mongo.IsDuplicateKeyError(err)
+	return mongo.IsDuplicateKeyError(err) || errors.Is(err, ErrDuplicateKey)
 }
@@ -0,0 +1,546 @@
+package gentity
+
+import (
+	"errors"
+	"fmt"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// 查询条件的比较操作,和mongodb的操作符一致
+type QueryOp string
+
+const (
+	QueryOpEq  QueryOp = "$eq"
+	QueryOpNe  QueryOp = "$ne"
+	QueryOpGt  QueryOp = "$gt"
+	QueryOpGte QueryOp = "$gte"
+	QueryOpLt  QueryOp = "$lt"
+	QueryOpLte QueryOp = "$lte"
+	// value是slice
+	QueryOpIn QueryOp = "$in"
+	// value是slice
+	QueryOpNin QueryOp = "$nin"
+	// value是bool
+	QueryOpExists QueryOp = "$exists"
+)
+
+// 字段的过滤条件
+type QueryFilter struct {
+	// 字段路径,和SaveComponents的格式一致,如"BaseInfo.Level","Quest.Quests"
+	FieldPath string
+	Op        QueryOp
+	Value     interface{}
+}
+
+// 字段的排序
+type QuerySort struct {
+	FieldPath string
+	Desc      bool
+}
+
+// 分页游标,记录上一页最后一条数据的排序字段的值
+//
+//	可以序列化后发给客户端,下一页查询时传回来
+type QueryCursor struct {
+	Values []interface{}
+}
+
+// 和具体数据库无关的查询条件
+//
+// example:
+//
+//	// BaseInfo.Level > 50的玩家,按经验从高到低排序,每页20条,第3页
+//	query := NewQuery().Where("BaseInfo.Level", QueryOpGt, 50).SortBy("BaseInfo.Exp", true).SetSkip(40).SetLimit(20)
+type Query struct {
+	// 多个过滤条件之间是and的关系
+	Filters []*QueryFilter
+	// 按顺序排序,排序字段最后会自动加上唯一id,保证分页的顺序稳定
+	Sorts []*QuerySort
+	Skip  int64
+	// <=0表示不限制数量
+	Limit int64
+	// 只加载这些字段,为空时加载全部字段
+	Projection []string
+	// 从游标之后开始查询,用于数据量大时代替Skip
+	Cursor *QueryCursor
+}
+
+// 查询结果
+type QueryResult struct {
+	Datas []interface{}
+	// 下一页的游标,Limit>0且返回的数据量等于Limit时才有值
+	NextCursor *QueryCursor
+}
+
+func NewQuery() *Query {
+	return &Query{}
+}
+
+// 增加过滤条件
+func (this *Query) Where(fieldPath string, op QueryOp, value interface{}) *Query {
+	this.Filters = append(this.Filters, &QueryFilter{
+		FieldPath: fieldPath,
+		Op:        op,
+		Value:     value,
+	})
+	return this
+}
+
+// 增加排序字段
+func (this *Query) SortBy(fieldPath string, desc bool) *Query {
+	this.Sorts = append(this.Sorts, &QuerySort{
+		FieldPath: fieldPath,
+		Desc:      desc,
+	})
+	return this
+}
+
+func (this *Query) SetSkip(skip int64) *Query {
+	this.Skip = skip
+	return this
+}
+
+func (this *Query) SetLimit(limit int64) *Query {
+	this.Limit = limit
+	return this
+}
+
+// 设置需要加载的字段
+func (this *Query) Select(fieldPaths ...string) *Query {
+	this.Projection = append(this.Projection, fieldPaths...)
+	return this
+}
+
+func (this *Query) SetCursor(cursor *QueryCursor) *Query {
+	this.Cursor = cursor
+	return this
+}
+
+// 实际使用的排序字段,最后加上唯一id
+func (this *Query) getSorts(uniqueId string) []*QuerySort {
+	for _, s := range this.Sorts {
+		if s.FieldPath == uniqueId {
+			return this.Sorts
+		}
+	}
+	sorts := make([]*QuerySort, len(this.Sorts), len(this.Sorts)+1)
+	copy(sorts, this.Sorts)
+	return append(sorts, &QuerySort{FieldPath: uniqueId})
+}
+
+// 检查查询条件
+func (this *Query) check(uniqueId string) error {
+	for _, filter := range this.Filters {
+		switch filter.Op {
+		case QueryOpEq, QueryOpNe, QueryOpGt, QueryOpGte, QueryOpLt, QueryOpLte:
+		case QueryOpIn, QueryOpNin:
+			if _, err := toQueryValues(filter.Value); err != nil {
+				return errors.New(fmt.Sprintf("%v %v err:%v", filter.FieldPath, filter.Op, err))
+			}
+		case QueryOpExists:
+			if _, ok := filter.Value.(bool); !ok {
+				return errors.New(fmt.Sprintf("%v %v value must be bool", filter.FieldPath, filter.Op))
+			}
+		default:
+			return errors.New(fmt.Sprintf("%v unsupported query op:%v", filter.FieldPath, filter.Op))
+		}
+	}
+	if this.Cursor != nil && len(this.Cursor.Values) != len(this.getSorts(uniqueId)) {
+		return errors.New(fmt.Sprintf("cursor values count:%v not match sorts", len(this.Cursor.Values)))
+	}
+	return nil
+}
+
+// 游标条件: (s1>v1) or (s1=v1 and s2>v2) or ...
+// 降序字段使用<
+func (this *Query) rangeCursorConditions(uniqueId string, f func(sorts []*QuerySort, values []interface{}, lastOp QueryOp)) {
+	if this.Cursor == nil {
+		return
+	}
+	sorts := this.getSorts(uniqueId)
+	for i, s := range sorts {
+		op := QueryOpGt
+		if s.Desc {
+			op = QueryOpLt
+		}
+		f(sorts[:i+1], this.Cursor.Values[:i+1], op)
+	}
+}
+
+// In和Nin的参数 -> []interface{}
+func toQueryValues(value interface{}) ([]interface{}, error) {
+	if values, ok := value.([]interface{}); ok {
+		return values, nil
+	}
+	val := reflect.ValueOf(value)
+	if val.Kind() != reflect.Slice && val.Kind() != reflect.Array {
+		return nil, errors.New(fmt.Sprintf("value must be slice:%T", value))
+	}
+	values := make([]interface{}, val.Len())
+	for i := 0; i < val.Len(); i++ {
+		values[i] = val.Index(i).Interface()
+	}
+	return values, nil
+}
+
+// 查询条件 -> mongodb的bson格式
+func (this *Query) toBsonFilter(uniqueId string) bson.D {
+	var conditions bson.A
+	for _, filter := range this.Filters {
+		value := filter.Value
+		if filter.Op == QueryOpIn || filter.Op == QueryOpNin {
+			value, _ = toQueryValues(filter.Value)
+		}
+		conditions = append(conditions, bson.D{{Key: filter.FieldPath, Value: bson.D{{Key: string(filter.Op), Value: value}}}})
+	}
+	var cursorConditions bson.A
+	this.rangeCursorConditions(uniqueId, func(sorts []*QuerySort, values []interface{}, lastOp QueryOp) {
+		condition := bson.D{}
+		for i, s := range sorts {
+			op := QueryOpEq
+			if i == len(sorts)-1 {
+				op = lastOp
+			}
+			condition = append(condition, bson.E{Key: s.FieldPath, Value: bson.D{{Key: string(op), Value: values[i]}}})
+		}
+		cursorConditions = append(cursorConditions, condition)
+	})
+	if len(cursorConditions) > 0 {
+		conditions = append(conditions, bson.D{{Key: "$or", Value: cursorConditions}})
+	}
+	if len(conditions) == 0 {
+		return bson.D{}
+	}
+	if len(conditions) == 1 {
+		return conditions[0].(bson.D)
+	}
+	return bson.D{{Key: "$and", Value: conditions}}
+}
+
+// 排序 -> mongodb的bson格式
+func (this *Query) toBsonSort(uniqueId string) bson.D {
+	sorts := this.getSorts(uniqueId)
+	sortDoc := make(bson.D, len(sorts))
+	for i, s := range sorts {
+		order := 1
+		if s.Desc {
+			order = -1
+		}
+		sortDoc[i] = bson.E{Key: s.FieldPath, Value: order}
+	}
+	return sortDoc
+}
+
+// 投影 -> mongodb的bson格式
+func (this *Query) toBsonProjection(uniqueId string) bson.D {
+	if len(this.Projection) == 0 {
+		return nil
+	}
+	projection := bson.D{{Key: uniqueId, Value: 1}}
+	for _, fieldPath := range this.Projection {
+		if fieldPath != uniqueId {
+			projection = append(projection, bson.E{Key: fieldPath, Value: 1})
+		}
+	}
+	return projection
+}
+
+// 根据最后一条数据生成下一页的游标
+//
+//	getValue: 获取最后一条数据的字段值
+func (this *Query) makeNextCursor(uniqueId string, count int, getValue func(fieldPath string) interface{}) *QueryCursor {
+	if this.Limit <= 0 || int64(count) < this.Limit {
+		return nil
+	}
+	sorts := this.getSorts(uniqueId)
+	cursor := &QueryCursor{
+		Values: make([]interface{}, len(sorts)),
+	}
+	for i, s := range sorts {
+		cursor.Values[i] = getValue(s.FieldPath)
+	}
+	return cursor
+}
+
+// 在内存中执行查询,用于MemCollection和FileCollection,规则和mongodb保持一致
+func queryDocuments(query *Query, uniqueId string, docs []memDocument) ([]memDocument, *QueryCursor, error) {
+	if err := query.check(uniqueId); err != nil {
+		return nil, nil, err
+	}
+	matcher, err := newDocumentMatcher(query, uniqueId)
+	if err != nil {
+		return nil, nil, err
+	}
+	var results []memDocument
+	for _, doc := range docs {
+		if matcher.match(doc) {
+			results = append(results, doc)
+		}
+	}
+	sorts := query.getSorts(uniqueId)
+	sort.SliceStable(results, func(i, j int) bool {
+		return compareDocumentsBySorts(results[i], results[j], sorts) < 0
+	})
+	if query.Skip > 0 {
+		if query.Skip >= int64(len(results)) {
+			results = nil
+		} else {
+			results = results[query.Skip:]
+		}
+	}
+	if query.Limit > 0 && int64(len(results)) > query.Limit {
+		results = results[:query.Limit]
+	}
+	var nextCursor *QueryCursor
+	if len(results) > 0 {
+		last := results[len(results)-1]
+		nextCursor = query.makeNextCursor(uniqueId, len(results), func(fieldPath string) interface{} {
+			v, _ := getDocumentPath(last, fieldPath)
+			return v
+		})
+	}
+	for i, doc := range results {
+		results[i] = projectDocument(doc, uniqueId, query.Projection)
+	}
+	return results, nextCursor, nil
+}
+
+// 在内存中执行查询,并把查询结果转换成对象
+func decodeQueryDocuments(query *Query, uniqueId string, docs []memDocument, newData func() interface{}) (*QueryResult, error) {
+	results, nextCursor, err := queryDocuments(query, uniqueId, docs)
+	if err != nil {
+		return nil, err
+	}
+	queryResult := &QueryResult{
+		NextCursor: nextCursor,
+	}
+	for _, doc := range results {
+		data := newData()
+		if err = decodeBsonDocument(doc, data); err != nil {
+			return nil, err
+		}
+		queryResult.Datas = append(queryResult.Datas, data)
+	}
+	return queryResult, nil
+}
+
+func compareDocumentsBySorts(a, b memDocument, sorts []*QuerySort) int {
+	for _, s := range sorts {
+		av, _ := getDocumentPath(a, s.FieldPath)
+		bv, _ := getDocumentPath(b, s.FieldPath)
+		c := compareBsonValue(av, bv)
+		if s.Desc {
+			c = -c
+		}
+		if c != 0 {
+			return c
+		}
+	}
+	return 0
+}
+
+// bson格式的value的类型排序,和mongodb一致: null < 数值 < 字符串 < 文档 < 数组 < 二进制 < bool < 其他
+func getBsonTypeOrder(v any) int {
+	if v == nil {
+		return 0
+	}
+	if _, ok := toFloat64(v); ok {
+		return 1
+	}
+	switch v.(type) {
+	case string:
+		return 2
+	case bson.M, bson.D:
+		return 3
+	case bson.A:
+		return 4
+	case bson.Binary, []byte:
+		return 5
+	case bool:
+		return 6
+	}
+	return 7
+}
+
+// 比较2个bson格式的value,不同类型按类型排序
+func compareBsonValue(a, b any) int {
+	ta, tb := getBsonTypeOrder(a), getBsonTypeOrder(b)
+	if ta != tb {
+		if ta < tb {
+			return -1
+		}
+		return 1
+	}
+	switch ta {
+	case 0:
+		return 0
+	case 1:
+		if ai, ok := toInt64(a); ok {
+			if bi, ok := toInt64(b); ok {
+				return compareOrdered(ai, bi)
+			}
+		}
+		af, _ := toFloat64(a)
+		bf, _ := toFloat64(b)
+		return compareOrdered(af, bf)
+	case 2:
+		return strings.Compare(a.(string), b.(string))
+	case 6:
+		ab, bb := a.(bool), b.(bool)
+		if ab == bb {
+			return 0
+		}
+		if !ab {
+			return -1
+		}
+		return 1
+	}
+	return strings.Compare(fmt.Sprintf("%v", a), fmt.Sprintf("%v", b))
+}
+
+func compareOrdered[T int64 | float64](a, b T) int {
+	if a < b {
+		return -1
+	}
+	if a > b {
+		return 1
+	}
+	return 0
+}
+
+// 文档的过滤条件
+type documentFilter struct {
+	fieldPath string
+	op        QueryOp
+	// bson格式的值,In和Nin是多个值
+	values []any
+}
+
+type documentMatcher struct {
+	filters []*documentFilter
+	// 游标条件,满足任意一组即可
+	cursorFilters [][]*documentFilter
+}
+
+func newDocumentFilter(fieldPath string, op QueryOp, value interface{}) (*documentFilter, error) {
+	filter := &documentFilter{
+		fieldPath: fieldPath,
+		op:        op,
+	}
+	var values []interface{}
+	switch op {
+	case QueryOpIn, QueryOpNin:
+		values, _ = toQueryValues(value)
+	case QueryOpExists:
+		filter.values = []any{value}
+		return filter, nil
+	default:
+		values = []interface{}{value}
+	}
+	for _, v := range values {
+		bsonValue, err := toBsonValue(v)
+		if err != nil {
+			return nil, err
+		}
+		filter.values = append(filter.values, bsonValue)
+	}
+	return filter, nil
+}
+
+func newDocumentMatcher(query *Query, uniqueId string) (*documentMatcher, error) {
+	matcher := &documentMatcher{}
+	for _, f := range query.Filters {
+		filter, err := newDocumentFilter(f.FieldPath, f.Op, f.Value)
+		if err != nil {
+			return nil, err
+		}
+		matcher.filters = append(matcher.filters, filter)
+	}
+	var err error
+	query.rangeCursorConditions(uniqueId, func(sorts []*QuerySort, values []interface{}, lastOp QueryOp) {
+		var filters []*documentFilter
+		for i, s := range sorts {
+			op := QueryOpEq
+			if i == len(sorts)-1 {
+				op = lastOp
+			}
+			filter, filterErr := newDocumentFilter(s.FieldPath, op, values[i])
+			if filterErr != nil {
+				err = filterErr
+				return
+			}
+			filters = append(filters, filter)
+		}
+		matcher.cursorFilters = append(matcher.cursorFilters, filters)
+	})
+	return matcher, err
+}
+
+func (this *documentMatcher) match(doc memDocument) bool {
+	for _, filter := range this.filters {
+		if !filter.match(doc) {
+			return false
+		}
+	}
+	if len(this.cursorFilters) == 0 {
+		return true
+	}
+	for _, filters := range this.cursorFilters {
+		matchAll := true
+		for _, filter := range filters {
+			if !filter.match(doc) {
+				matchAll = false
+				break
+			}
+		}
+		if matchAll {
+			return true
+		}
+	}
+	return false
+}
+
+func (this *documentFilter) match(doc memDocument) bool {
+	v, exists := getDocumentPath(doc, this.fieldPath)
+	switch this.op {
+	case QueryOpExists:
+		return exists == this.values[0].(bool)
+	case QueryOpEq:
+		return isBsonValueEqual(v, this.values[0])
+	case QueryOpNe:
+		return !isBsonValueEqual(v, this.values[0])
+	case QueryOpIn:
+		for _, value := range this.values {
+			if isBsonValueEqual(v, value) {
+				return true
+			}
+		}
+		return false
+	case QueryOpNin:
+		for _, value := range this.values {
+			if isBsonValueEqual(v, value) {
+				return false
+			}
+		}
+		return true
+	}
+	// 和mongodb一样,大小比较只在相同类型之间进行
+	if !exists || getBsonTypeOrder(v) != getBsonTypeOrder(this.values[0]) {
+		return false
+	}
+	c := compareBsonValue(v, this.values[0])
+	switch this.op {
+	case QueryOpGt:
+		return c > 0
+	case QueryOpGte:
+		return c >= 0
+	case QueryOpLt:
+		return c < 0
+	case QueryOpLte:
+		return c <= 0
+	}
+	return false
+}
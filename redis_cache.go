@@ -6,24 +6,35 @@ import (
 	"fmt"
 	"github.com/redis/go-redis/v9"
 	"google.golang.org/protobuf/proto"
-	"reflect"
 	"time"
 )
 
 // https://github.com/uber-go/guide/blob/master/style.md#verify-interface-compliance
 var _ KvCache = (*RedisCache)(nil)
+var _ AdvancedKvCache = (*RedisCache)(nil)
+var _ AtomicHashKvCache = (*RedisCache)(nil)
+var _ KvCacheBatch = (*RedisCache)(nil)
 
 // KvCache的redis实现
 type RedisCache struct {
 	redisClient redis.Cmdable
+	// 操作的超时设置
+	timeouts *OpTimeouts
 }
 
+// 默认不超时,可以通过GetTimeouts()设置超时时间
 func NewRedisCache(redisClient redis.Cmdable) *RedisCache {
 	return &RedisCache{
 		redisClient: redisClient,
+		timeouts:    NewOpTimeouts(0),
 	}
 }
 
+// 操作的超时设置
+func (this *RedisCache) GetTimeouts() *OpTimeouts {
+	return this.timeouts
+}
+
 func ignoreNilError(redisError error) error {
 	if IsRedisError(redisError) {
 		return redisError
@@ -32,117 +43,283 @@ func ignoreNilError(redisError error) error {
 }
 
 func (this *RedisCache) Get(key string) (string, error) {
-	data, err := this.redisClient.Get(context.Background(), key).Result()
+	return this.GetContext(context.Background(), key)
+}
+
+func (this *RedisCache) GetContext(ctx context.Context, key string) (string, error) {
+	ctx, cancel := this.timeouts.WithTimeout(ctx, "Get")
+	defer cancel()
+	data, err := this.redisClient.Get(ctx, key).Result()
 	return data, ignoreNilError(err)
 }
 
 func (this *RedisCache) Set(key string, value interface{}, expiration time.Duration) error {
+	return this.SetContext(context.Background(), key, value, expiration)
+}
+
+func (this *RedisCache) SetContext(ctx context.Context, key string, value interface{}, expiration time.Duration) error {
+	ctx, cancel := this.timeouts.WithTimeout(ctx, "Set")
+	defer cancel()
 	// 如果是proto,自动转换成[]byte
 	if protoMessage, ok := value.(proto.Message); ok {
 		bytes, protoErr := proto.Marshal(protoMessage)
 		if protoErr != nil {
 			return protoErr
 		}
-		_, err := this.redisClient.Set(context.Background(), key, bytes, expiration).Result()
+		_, err := this.redisClient.Set(ctx, key, bytes, expiration).Result()
 		return ignoreNilError(err)
 	}
-	_, err := this.redisClient.Set(context.Background(), key, value, expiration).Result()
+	_, err := this.redisClient.Set(ctx, key, value, expiration).Result()
 	return ignoreNilError(err)
 }
 
 func (this *RedisCache) SetNX(key string, value interface{}, expiration time.Duration) (bool, error) {
+	return this.SetNXContext(context.Background(), key, value, expiration)
+}
+
+func (this *RedisCache) SetNXContext(ctx context.Context, key string, value interface{}, expiration time.Duration) (bool, error) {
+	ctx, cancel := this.timeouts.WithTimeout(ctx, "SetNX")
+	defer cancel()
 	// 如果是proto,自动转换成[]byte
 	if protoMessage, ok := value.(proto.Message); ok {
 		bytes, protoErr := proto.Marshal(protoMessage)
 		if protoErr != nil {
 			return false, protoErr
 		}
-		isSetOk, err := this.redisClient.SetNX(context.Background(), key, bytes, expiration).Result()
+		isSetOk, err := this.redisClient.SetNX(ctx, key, bytes, expiration).Result()
 		return isSetOk, ignoreNilError(err)
 	}
-	isSetOk, err := this.redisClient.SetNX(context.Background(), key, value, expiration).Result()
+	isSetOk, err := this.redisClient.SetNX(ctx, key, value, expiration).Result()
 	return isSetOk, ignoreNilError(err)
 }
 
 func (this *RedisCache) Del(key ...string) (int64, error) {
-	delCount, err := this.redisClient.Del(context.Background(), key...).Result()
+	return this.DelContext(context.Background(), key...)
+}
+
+func (this *RedisCache) DelContext(ctx context.Context, key ...string) (int64, error) {
+	ctx, cancel := this.timeouts.WithTimeout(ctx, "Del")
+	defer cancel()
+	delCount, err := this.redisClient.Del(ctx, key...).Result()
 	return delCount, ignoreNilError(err)
 }
 
 func (this *RedisCache) Type(key string) (string, error) {
-	data, err := this.redisClient.Type(context.Background(), key).Result()
+	return this.TypeContext(context.Background(), key)
+}
+
+func (this *RedisCache) TypeContext(ctx context.Context, key string) (string, error) {
+	ctx, cancel := this.timeouts.WithTimeout(ctx, "Type")
+	defer cancel()
+	data, err := this.redisClient.Type(ctx, key).Result()
 	return data, ignoreNilError(err)
 }
 
+func (this *RedisCache) Expire(key string, expiration time.Duration) (bool, error) {
+	return this.ExpireContext(context.Background(), key, expiration)
+}
+
+func (this *RedisCache) ExpireContext(ctx context.Context, key string, expiration time.Duration) (bool, error) {
+	ctx, cancel := this.timeouts.WithTimeout(ctx, "Expire")
+	defer cancel()
+	ok, err := this.redisClient.Expire(ctx, key, expiration).Result()
+	return ok, ignoreNilError(err)
+}
+
+func (this *RedisCache) IncrBy(key string, value int64) (int64, error) {
+	return this.IncrByContext(context.Background(), key, value)
+}
+
+func (this *RedisCache) IncrByContext(ctx context.Context, key string, value int64) (int64, error) {
+	ctx, cancel := this.timeouts.WithTimeout(ctx, "IncrBy")
+	defer cancel()
+	return this.redisClient.IncrBy(ctx, key, value).Result()
+}
+
+func (this *RedisCache) IncrByFloat(key string, value float64) (float64, error) {
+	return this.IncrByFloatContext(context.Background(), key, value)
+}
+
+func (this *RedisCache) IncrByFloatContext(ctx context.Context, key string, value float64) (float64, error) {
+	ctx, cancel := this.timeouts.WithTimeout(ctx, "IncrByFloat")
+	defer cancel()
+	return this.redisClient.IncrByFloat(ctx, key, value).Result()
+}
+
 // redis hash -> map
 func (this *RedisCache) GetMap(key string, m interface{}) error {
+	return this.GetMapContext(context.Background(), key, m)
+}
+
+func (this *RedisCache) GetMapContext(ctx context.Context, key string, m interface{}) error {
 	if m == nil {
 		return errors.New(fmt.Sprintf("map must valid key:%v", key))
 	}
-	strMap, err := this.redisClient.HGetAll(context.Background(), key).Result()
+	ctx, cancel := this.timeouts.WithTimeout(ctx, "GetMap")
+	defer cancel()
+	strMap, err := this.redisClient.HGetAll(ctx, key).Result()
 	if IsRedisError(err) {
 		return err
 	}
-	val := reflect.ValueOf(m)
-	if val.Kind() != reflect.Map {
-		return errors.New(fmt.Sprintf("unsupport type kind:%v key:%v", val.Kind(), key))
-	}
-	typ := reflect.TypeOf(m)
-	keyType := typ.Key()
-	valType := typ.Elem()
-	for k, v := range strMap {
-		realKey := ConvertStringToRealType(keyType, k)
-		// 如果是map是map[string]any,value解析需要特殊处理
-		realValue := ConvertStringToRealType(valType, v)
-		val.SetMapIndex(reflect.ValueOf(realKey), reflect.ValueOf(realValue))
-	}
-	return nil
+	return loadMapFromCacheData(key, strMap, m)
 }
 
 // map -> redis hash
 func (this *RedisCache) SetMap(k string, m interface{}) error {
-	cacheData := make(map[string]interface{})
-	val := reflect.ValueOf(m)
-	it := val.MapRange()
-	for it.Next() {
-		key, err := convertValueToString(it.Key())
-		if err != nil {
-			return err
-		}
-		value, err := convertValueToStringOrInterface(it.Value())
-		if err != nil {
-			return err
-		}
-		cacheData[key] = value
+	return this.SetMapContext(context.Background(), k, m)
+}
+
+func (this *RedisCache) SetMapContext(ctx context.Context, k string, m interface{}) error {
+	cacheData, err := convertMapToCacheData(m)
+	if err != nil {
+		return err
 	}
 	if len(cacheData) == 0 {
 		return nil
 	}
-	_, err := this.redisClient.HSet(context.Background(), k, cacheData).Result()
+	ctx, cancel := this.timeouts.WithTimeout(ctx, "SetMap")
+	defer cancel()
+	_, err = this.redisClient.HSet(ctx, k, cacheData).Result()
 	return ignoreNilError(err)
 }
 
 func (this *RedisCache) HGetAll(key string) (map[string]string, error) {
-	m, err := this.redisClient.HGetAll(context.Background(), key).Result()
+	return this.HGetAllContext(context.Background(), key)
+}
+
+func (this *RedisCache) HGetAllContext(ctx context.Context, key string) (map[string]string, error) {
+	ctx, cancel := this.timeouts.WithTimeout(ctx, "HGetAll")
+	defer cancel()
+	m, err := this.redisClient.HGetAll(ctx, key).Result()
 	return m, ignoreNilError(err)
 }
 
 func (this *RedisCache) HSet(key string, values ...interface{}) (int64, error) {
-	count, redisError := this.redisClient.HSet(context.Background(), key, values...).Result()
+	return this.HSetContext(context.Background(), key, values...)
+}
+
+func (this *RedisCache) HSetContext(ctx context.Context, key string, values ...interface{}) (int64, error) {
+	ctx, cancel := this.timeouts.WithTimeout(ctx, "HSet")
+	defer cancel()
+	count, redisError := this.redisClient.HSet(ctx, key, values...).Result()
 	return count, ignoreNilError(redisError)
 }
 
 func (this *RedisCache) HSetNX(key, field string, value interface{}) (bool, error) {
-	return this.redisClient.HSetNX(context.Background(), key, field, value).Result()
+	return this.HSetNXContext(context.Background(), key, field, value)
+}
+
+func (this *RedisCache) HSetNXContext(ctx context.Context, key, field string, value interface{}) (bool, error) {
+	ctx, cancel := this.timeouts.WithTimeout(ctx, "HSetNX")
+	defer cancel()
+	return this.redisClient.HSetNX(ctx, key, field, value).Result()
 }
 
 func (this *RedisCache) HDel(key string, fields ...string) (int64, error) {
-	delCount, err := this.redisClient.HDel(context.Background(), key, fields...).Result()
+	return this.HDelContext(context.Background(), key, fields...)
+}
+
+func (this *RedisCache) HDelContext(ctx context.Context, key string, fields ...string) (int64, error) {
+	ctx, cancel := this.timeouts.WithTimeout(ctx, "HDel")
+	defer cancel()
+	delCount, err := this.redisClient.HDel(ctx, key, fields...).Result()
 	return delCount, ignoreNilError(err)
 }
 
+// ARGV: 过期时间(毫秒), field1, value1, field2, value2...
+var redisHSetIfNotExistsScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 1 then
+	return 0
+end
+if #ARGV > 1 then
+	redis.call('HSET', KEYS[1], unpack(ARGV, 2))
+end
+if tonumber(ARGV[1]) > 0 then
+	redis.call('PEXPIRE', KEYS[1], ARGV[1])
+end
+return 1
+`)
+
+// ARGV: 过期时间(毫秒), expected的数量, expected的field和value..., values的数量, values的field和value..., delFields...
+var redisHCompareAndSwapScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	return 0
+end
+local i = 2
+local n = tonumber(ARGV[i])
+i = i + 1
+for j = 1, n do
+	local v = redis.call('HGET', KEYS[1], ARGV[i])
+	if (v or '') ~= ARGV[i + 1] then
+		return 0
+	end
+	i = i + 2
+end
+n = tonumber(ARGV[i])
+i = i + 1
+for j = 1, n do
+	redis.call('HSET', KEYS[1], ARGV[i], ARGV[i + 1])
+	i = i + 2
+end
+while i <= #ARGV do
+	redis.call('HDEL', KEYS[1], ARGV[i])
+	i = i + 1
+end
+if tonumber(ARGV[1]) > 0 and redis.call('EXISTS', KEYS[1]) == 1 then
+	redis.call('PEXPIRE', KEYS[1], ARGV[1])
+end
+return 1
+`)
+
+// 使用lua脚本
+func (this *RedisCache) HSetIfNotExists(key string, values map[string]string, expiration time.Duration) (bool, error) {
+	return this.HSetIfNotExistsContext(context.Background(), key, values, expiration)
+}
+
+func (this *RedisCache) HSetIfNotExistsContext(ctx context.Context, key string, values map[string]string, expiration time.Duration) (bool, error) {
+	ctx, cancel := this.timeouts.WithTimeout(ctx, "HSetIfNotExists")
+	defer cancel()
+	args := make([]interface{}, 0, 1+len(values)*2)
+	args = append(args, expiration.Milliseconds())
+	for field, value := range values {
+		args = append(args, field, value)
+	}
+	result, err := redisHSetIfNotExistsScript.Run(ctx, this.redisClient, []string{key}, args...).Int()
+	return result == 1, err
+}
+
+// 使用lua脚本
+func (this *RedisCache) HCompareAndSwap(key string, expected map[string]string, values map[string]string, delFields []string, expiration time.Duration) (bool, error) {
+	return this.HCompareAndSwapContext(context.Background(), key, expected, values, delFields, expiration)
+}
+
+func (this *RedisCache) HCompareAndSwapContext(ctx context.Context, key string, expected map[string]string, values map[string]string, delFields []string, expiration time.Duration) (bool, error) {
+	ctx, cancel := this.timeouts.WithTimeout(ctx, "HCompareAndSwap")
+	defer cancel()
+	args := make([]interface{}, 0, 3+len(expected)*2+len(values)*2+len(delFields))
+	args = append(args, expiration.Milliseconds(), len(expected))
+	for field, value := range expected {
+		args = append(args, field, value)
+	}
+	args = append(args, len(values))
+	for field, value := range values {
+		args = append(args, field, value)
+	}
+	for _, field := range delFields {
+		args = append(args, field)
+	}
+	result, err := redisHCompareAndSwapScript.Run(ctx, this.redisClient, []string{key}, args...).Int()
+	return result == 1, err
+}
+
 func (this *RedisCache) GetProto(key string, value proto.Message) error {
-	str, err := this.redisClient.Get(context.Background(), key).Result()
+	return this.GetProtoContext(context.Background(), key, value)
+}
+
+func (this *RedisCache) GetProtoContext(ctx context.Context, key string, value proto.Message) error {
+	ctx, cancel := this.timeouts.WithTimeout(ctx, "GetProto")
+	defer cancel()
+	str, err := this.redisClient.Get(ctx, key).Result()
 	// 不存在的key或者空数据,直接跳过,防止错误的覆盖
 	if err == redis.Nil || len(str) == 0 {
 		return nil
@@ -154,6 +331,151 @@ func (this *RedisCache) GetProto(key string, value proto.Message) error {
 	return err
 }
 
+func (this *RedisCache) ZAdd(key string, members ...ZMember) (int64, error) {
+	return this.ZAddContext(context.Background(), key, members...)
+}
+
+func (this *RedisCache) ZAddContext(ctx context.Context, key string, members ...ZMember) (int64, error) {
+	zMembers := make([]redis.Z, len(members))
+	for i, member := range members {
+		str, err := formatCacheMember(member.Member)
+		if err != nil {
+			return 0, err
+		}
+		zMembers[i] = redis.Z{
+			Score:  member.Score,
+			Member: str,
+		}
+	}
+	ctx, cancel := this.timeouts.WithTimeout(ctx, "ZAdd")
+	defer cancel()
+	addCount, err := this.redisClient.ZAdd(ctx, key, zMembers...).Result()
+	return addCount, ignoreNilError(err)
+}
+
+func (this *RedisCache) ZIncrBy(key string, increment float64, member interface{}) (float64, error) {
+	return this.ZIncrByContext(context.Background(), key, increment, member)
+}
+
+func (this *RedisCache) ZIncrByContext(ctx context.Context, key string, increment float64, member interface{}) (float64, error) {
+	str, err := formatCacheMember(member)
+	if err != nil {
+		return 0, err
+	}
+	ctx, cancel := this.timeouts.WithTimeout(ctx, "ZIncrBy")
+	defer cancel()
+	return this.redisClient.ZIncrBy(ctx, key, increment, str).Result()
+}
+
+func (this *RedisCache) ZRevRangeWithScores(key string, start, stop int64) ([]ZMember, error) {
+	return this.ZRevRangeWithScoresContext(context.Background(), key, start, stop)
+}
+
+func (this *RedisCache) ZRevRangeWithScoresContext(ctx context.Context, key string, start, stop int64) ([]ZMember, error) {
+	ctx, cancel := this.timeouts.WithTimeout(ctx, "ZRevRangeWithScores")
+	defer cancel()
+	zMembers, err := this.redisClient.ZRevRangeWithScores(ctx, key, start, stop).Result()
+	if IsRedisError(err) {
+		return nil, err
+	}
+	members := make([]ZMember, len(zMembers))
+	for i, zMember := range zMembers {
+		members[i] = ZMember{
+			Score:  zMember.Score,
+			Member: zMember.Member,
+		}
+	}
+	return members, nil
+}
+
+func (this *RedisCache) ZRank(key string, member interface{}) (int64, error) {
+	return this.ZRankContext(context.Background(), key, member)
+}
+
+func (this *RedisCache) ZRankContext(ctx context.Context, key string, member interface{}) (int64, error) {
+	str, err := formatCacheMember(member)
+	if err != nil {
+		return -1, err
+	}
+	ctx, cancel := this.timeouts.WithTimeout(ctx, "ZRank")
+	defer cancel()
+	rank, err := this.redisClient.ZRank(ctx, key, str).Result()
+	if err == redis.Nil {
+		return -1, nil
+	}
+	if err != nil {
+		return -1, err
+	}
+	return rank, nil
+}
+
+func (this *RedisCache) ZRem(key string, members ...interface{}) (int64, error) {
+	return this.ZRemContext(context.Background(), key, members...)
+}
+
+func (this *RedisCache) ZRemContext(ctx context.Context, key string, members ...interface{}) (int64, error) {
+	strMembers, err := formatCacheMembers(members)
+	if err != nil {
+		return 0, err
+	}
+	ctx, cancel := this.timeouts.WithTimeout(ctx, "ZRem")
+	defer cancel()
+	remCount, err := this.redisClient.ZRem(ctx, key, strMembers...).Result()
+	return remCount, ignoreNilError(err)
+}
+
+func (this *RedisCache) LPush(key string, values ...interface{}) (int64, error) {
+	return this.LPushContext(context.Background(), key, values...)
+}
+
+func (this *RedisCache) LPushContext(ctx context.Context, key string, values ...interface{}) (int64, error) {
+	strValues, err := formatCacheMembers(values)
+	if err != nil {
+		return 0, err
+	}
+	ctx, cancel := this.timeouts.WithTimeout(ctx, "LPush")
+	defer cancel()
+	count, err := this.redisClient.LPush(ctx, key, strValues...).Result()
+	return count, ignoreNilError(err)
+}
+
+func (this *RedisCache) RPush(key string, values ...interface{}) (int64, error) {
+	return this.RPushContext(context.Background(), key, values...)
+}
+
+func (this *RedisCache) RPushContext(ctx context.Context, key string, values ...interface{}) (int64, error) {
+	strValues, err := formatCacheMembers(values)
+	if err != nil {
+		return 0, err
+	}
+	ctx, cancel := this.timeouts.WithTimeout(ctx, "RPush")
+	defer cancel()
+	count, err := this.redisClient.RPush(ctx, key, strValues...).Result()
+	return count, ignoreNilError(err)
+}
+
+func (this *RedisCache) LTrim(key string, start, stop int64) error {
+	return this.LTrimContext(context.Background(), key, start, stop)
+}
+
+func (this *RedisCache) LTrimContext(ctx context.Context, key string, start, stop int64) error {
+	ctx, cancel := this.timeouts.WithTimeout(ctx, "LTrim")
+	defer cancel()
+	_, err := this.redisClient.LTrim(ctx, key, start, stop).Result()
+	return ignoreNilError(err)
+}
+
+func (this *RedisCache) LRange(key string, start, stop int64) ([]string, error) {
+	return this.LRangeContext(context.Background(), key, start, stop)
+}
+
+func (this *RedisCache) LRangeContext(ctx context.Context, key string, start, stop int64) ([]string, error) {
+	ctx, cancel := this.timeouts.WithTimeout(ctx, "LRange")
+	defer cancel()
+	values, err := this.redisClient.LRange(ctx, key, start, stop).Result()
+	return values, ignoreNilError(err)
+}
+
 // 检查redis返回的error是否是异常
 func IsRedisError(redisError error) bool {
 	// redis的key不存在,会返回redis.Nil,但是不是我们常规认为的error(异常),所以要忽略redis.Nil
@@ -162,3 +484,27 @@ func IsRedisError(redisError error) bool {
 	}
 	return false
 }
+
+// 使用MULTI/EXEC事务管道批量执行
+func (this *RedisCache) Batch(f func(batchCache KvCache)) error {
+	return this.BatchContext(context.Background(), f)
+}
+
+func (this *RedisCache) BatchContext(ctx context.Context, f func(batchCache KvCache)) error {
+	// 嵌套的Batch,合并到外层的管道中
+	if _, ok := this.redisClient.(redis.Pipeliner); ok {
+		f(this)
+		return nil
+	}
+	pipe := this.redisClient.TxPipeline()
+	f(&RedisCache{
+		redisClient: pipe,
+	})
+	if pipe.Len() == 0 {
+		return nil
+	}
+	ctx, cancel := this.timeouts.WithTimeout(ctx, "Batch")
+	defer cancel()
+	_, err := pipe.Exec(ctx)
+	return ignoreNilError(err)
+}
@@ -43,6 +43,8 @@ type BaseRoutineEntity struct {
 	stopOnce sync.Once
 	// 计时管理
 	timerEntries *TimerEntries
+	// 定时保存
+	entitySaver *EntitySaver
 }
 
 func NewRoutineEntity(messageChanLen int) *BaseRoutineEntity {
@@ -57,6 +59,17 @@ func (this *BaseRoutineEntity) GetTimerEntries() *TimerEntries {
 	return this.timerEntries
 }
 
+func (this *BaseRoutineEntity) GetEntitySaver() *EntitySaver {
+	return this.entitySaver
+}
+
+// 设置定时保存,需要在RunProcessRoutine之前调用
+//
+//	协程启动时开始定时保存,协程结束时强制保存一次
+func (this *BaseRoutineEntity) SetEntitySaver(entitySaver *EntitySaver) {
+	this.entitySaver = entitySaver
+}
+
 // 停止协程
 func (this *BaseRoutineEntity) Stop() {
 	this.stopOnce.Do(func() {
@@ -84,6 +97,12 @@ func (this *BaseRoutineEntity) RunProcessRoutine(routineEntity RoutineEntity, ro
 	go func(ctx context.Context) {
 		defer func() {
 			this.timerEntries.Stop()
+			// 处理完剩余的消息后,强制保存一次
+			if this.entitySaver != nil {
+				if err := this.entitySaver.Stop(); err != nil {
+					GetLogger().Error("EntitySaver Stop %v err:%v", this.GetId(), err)
+				}
+			}
 			// 协程结束的时候,清理接口
 			if routineArgs.EndFunc != nil {
 				routineArgs.EndFunc(routineEntity)
@@ -99,6 +118,9 @@ func (this *BaseRoutineEntity) RunProcessRoutine(routineEntity RoutineEntity, ro
 		if this.timerEntries == nil {
 			this.timerEntries = NewTimerEntries()
 		}
+		if this.entitySaver != nil {
+			this.entitySaver.Start(this.timerEntries)
+		}
 		this.timerEntries.Start()
 		for {
 			select {
@@ -1,12 +1,14 @@
 package gentity
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/fish-tennis/gentity/util"
 	"google.golang.org/protobuf/proto"
 	"reflect"
+	"strconv"
 	"strings"
 )
 
@@ -74,6 +76,54 @@ func SaveComponentChangedDataToCache(kvCache KvCache, cacheKeyPrefix string, ent
 	SaveObjectChangedDataToCache(kvCache, cacheKey, component)
 }
 
+// 批量保存缓存时使用的KvCache,记录提交成功后需要执行的操作
+type batchSaveCache struct {
+	KvCache
+	onCommits []func()
+}
+
+// 缓存写入成功后的处理,如重置脏标记
+// 批量保存时,延迟到提交成功后执行,提交失败时保留脏标记,下次重新保存
+func afterCacheSaved(kvCache KvCache, f func()) {
+	if batchCache, ok := kvCache.(*batchSaveCache); ok {
+		batchCache.onCommits = append(batchCache.onCommits, f)
+		return
+	}
+	f()
+}
+
+// 把实体的修改数据保存到缓存
+// kvCache实现了KvCacheBatch接口时,所有组件的修改数据批量提交,只有1次网络交互
+func SaveEntityChangedDataToCache(kvCache KvCache, cacheKeyPrefix string, entityKey interface{}, entity Entity) error {
+	kvCacheBatch, ok := kvCache.(KvCacheBatch)
+	if !ok {
+		entity.RangeComponent(func(component Component) bool {
+			SaveComponentChangedDataToCache(kvCache, cacheKeyPrefix, entityKey, component)
+			return true
+		})
+		return nil
+	}
+	var onCommits []func()
+	err := kvCacheBatch.Batch(func(batchCache KvCache) {
+		saveCache := &batchSaveCache{
+			KvCache: batchCache,
+		}
+		entity.RangeComponent(func(component Component) bool {
+			SaveComponentChangedDataToCache(saveCache, cacheKeyPrefix, entityKey, component)
+			return true
+		})
+		onCommits = saveCache.onCommits
+	})
+	if err != nil {
+		GetLogger().Error("%v SaveCache err:%v", GetEntityCacheKey(cacheKeyPrefix, entityKey), err.Error())
+		return err
+	}
+	for _, onCommit := range onCommits {
+		onCommit()
+	}
+	return nil
+}
+
 func saveDirtyMark(kvCache KvCache, obj interface{}, cacheKeyName string, fieldCache *SaveableField) {
 	// 缓存数据作为一个整体的
 	if dirtyMark, ok := obj.(DirtyMark); ok {
@@ -94,7 +144,7 @@ func saveDirtyMark(kvCache KvCache, obj interface{}, cacheKeyName string, fieldC
 		} else {
 			SaveValueToCache(kvCache, cacheKeyName, val)
 		}
-		dirtyMark.ResetDirty()
+		afterCacheSaved(kvCache, dirtyMark.ResetDirty)
 		GetLogger().Debug("SaveCache %v", cacheKeyName)
 	}
 }
@@ -119,16 +169,82 @@ func saveMapDirtyMark(kvCache KvCache, obj interface{}, cacheKeyName string, fie
 		} else {
 			SaveMapValueToCache(kvCache, cacheKeyName, val, dirtyMark)
 		}
-		dirtyMark.ResetDirty()
+		afterCacheSaved(kvCache, dirtyMark.ResetDirty)
 		GetLogger().Debug("SaveCache %v", cacheKeyName)
 	}
 }
 
+// slice格式的,缓存里有整体数据并且只追加了数据时,使用RPUSH追加,否则用list保存整体数据
+func saveSliceDirtyMark(kvCache KvCache, obj interface{}, cacheKeyName string, fieldCache *SaveableField) {
+	dirtyMark, ok := obj.(SliceDirtyMark)
+	if !ok || !dirtyMark.IsDirty() {
+		return
+	}
+	reflectVal := reflect.ValueOf(obj)
+	if reflectVal.Kind() == reflect.Ptr {
+		reflectVal = reflectVal.Elem()
+	}
+	val := reflectVal.Field(fieldCache.FieldIndex)
+	appendIndex := dirtyMark.GetCacheAppendIndex()
+	if dirtyMark.HasCached() && appendIndex > 0 && appendIndex <= val.Len() {
+		if err := pushSliceValueToCache(kvCache, cacheKeyName, val, appendIndex); err != nil {
+			GetLogger().Error("%v cache err:%v", cacheKeyName, err.Error())
+			return
+		}
+		afterCacheSaved(kvCache, dirtyMark.ResetDirty)
+		GetLogger().Debug("SaveCache %v append:%v", cacheKeyName, val.Len()-appendIndex)
+		return
+	}
+	// 保存整体数据,先删除之前的数据
+	_, err := kvCache.Del(cacheKeyName)
+	if IsRedisError(err) {
+		GetLogger().Error("%v cache err:%v", cacheKeyName, err.Error())
+		return
+	}
+	if val.Len() > 0 {
+		if err = pushSliceValueToCache(kvCache, cacheKeyName, val, 0); err != nil {
+			GetLogger().Error("%v cache err:%v", cacheKeyName, err.Error())
+			return
+		}
+		afterCacheSaved(kvCache, dirtyMark.SetCached)
+	} else {
+		// redis里不存在空的list,空slice用json字符串保存
+		if !util.IsValueNil(val) {
+			SaveValueToCache(kvCache, cacheKeyName, val)
+		}
+		afterCacheSaved(kvCache, dirtyMark.ResetCached)
+	}
+	afterCacheSaved(kvCache, dirtyMark.ResetDirty)
+	GetLogger().Debug("SaveCache %v", cacheKeyName)
+}
+
+// slice从start开始的数据用json序列化之后RPUSH到缓存
+func pushSliceValueToCache(kvCache KvCache, cacheKeyName string, val reflect.Value, start int) error {
+	values := make([]interface{}, 0, val.Len()-start)
+	for i := start; i < val.Len(); i++ {
+		jsonBytes, err := json.Marshal(val.Index(i).Interface())
+		if err != nil {
+			return err
+		}
+		values = append(values, string(jsonBytes))
+	}
+	_, err := kvCache.RPush(cacheKeyName, values...)
+	if IsRedisError(err) {
+		return err
+	}
+	return nil
+}
+
 // 把修改数据保存到缓存
 func SaveChangedDataToCache(kvCache KvCache, obj any, cacheKeyName string, saveableField *SaveableField) {
 	if saveableField == nil {
 		return
 	}
+	// slice格式的,支持追加保存
+	if _, ok := obj.(SliceDirtyMark); ok {
+		saveSliceDirtyMark(kvCache, obj, cacheKeyName, saveableField)
+		return
+	}
 	// 缓存数据作为一个整体的
 	if _, ok := obj.(DirtyMark); ok {
 		saveDirtyMark(kvCache, obj, cacheKeyName, saveableField)
@@ -214,7 +330,7 @@ func SaveMapValueToCache(kvCache KvCache, cacheKeyName string, val reflect.Value
 			GetLogger().Error("%v cache err:%v", cacheKeyName, err.Error())
 			return
 		}
-		dirtyMark.SetCached()
+		afterCacheSaved(kvCache, dirtyMark.SetCached)
 	} else {
 		setMap := make(map[interface{}]interface{})
 		var delMap []string
@@ -262,10 +378,48 @@ func SaveEntityChangedDataToDb(entityDb EntityDb, entity Entity, kvCache KvCache
 	return SaveEntityChangedDataToDbByKey(entityDb, entity, entity.GetId(), kvCache, removeCacheAfterSaveDb, cachePrefix)
 }
 
+// SaveEntityChangedDataToDb的context版本,数据库和缓存的操作都使用ctx
+func SaveEntityChangedDataToDbContext(ctx context.Context, entityDb EntityDb, entity Entity, kvCache KvCache, removeCacheAfterSaveDb bool, cachePrefix string) error {
+	return SaveEntityChangedDataToDbByKeyContext(ctx, entityDb, entity, entity.GetId(), kvCache, removeCacheAfterSaveDb, cachePrefix)
+}
+
+// SaveEntityChangedDataToDbByKey的context版本,数据库和缓存的操作都使用ctx
+func SaveEntityChangedDataToDbByKeyContext(ctx context.Context, entityDb EntityDb, entity Entity, entityKey interface{}, kvCache KvCache, removeCacheAfterSaveDb bool, cachePrefix string) error {
+	return SaveEntityChangedDataToDbByKey(WithEntityDbContext(ctx, entityDb), entity, entityKey, WithKvCacheContext(ctx, kvCache), removeCacheAfterSaveDb, cachePrefix)
+}
+
 type saveDataRecord struct {
+	entityKey   interface{}
 	changedData map[string]any
 	saved       []Saveable
-	delKeys     []string
+	// 保存了整体数据的map,保存成功后设置数据库里是否有整体数据
+	mapDbSaved []*mapDbSavedRecord
+	delKeys    []string
+	// 开启了乐观锁的实体
+	versionedEntity VersionedEntity
+}
+
+type mapDbSavedRecord struct {
+	dbDirtyMark MapDbDirtyMark
+	// 保存的是nil map,数据库里是null
+	isNull bool
+}
+
+// 记录保存了整体数据的map,之后的修改才能增量保存
+func (this *saveDataRecord) addMapDbSaved(saveable Saveable, saveableField *SaveableField) {
+	dbDirtyMark, ok := saveable.(MapDbDirtyMark)
+	if !ok {
+		return
+	}
+	objVal := reflect.ValueOf(saveable)
+	if objVal.Kind() == reflect.Ptr {
+		objVal = objVal.Elem()
+	}
+	field := objVal.Field(saveableField.FieldIndex)
+	this.mapDbSaved = append(this.mapDbSaved, &mapDbSavedRecord{
+		dbDirtyMark: dbDirtyMark,
+		isNull:      field.Kind() != reflect.Map || field.IsNil(),
+	})
 }
 
 func saveObjectChangedDataToDbByKey(entityDb EntityDb, obj any, entityKey interface{}, kvCache KvCache,
@@ -286,13 +440,18 @@ func saveObjectChangedDataToDbByKey(entityDb EntityDb, obj any, entityKey interf
 			GetLogger().Debug("%v ignore %v", entityKey, saveableField.Name)
 			return
 		}
-		saveData, err := getSaveDataOfSaveable(saveable, saveableField, objName)
-		if err != nil {
-			GetLogger().Error("%v Save %v err:%v", entityKey, saveableField.Name, err.Error())
-			return
+		if collectIncrementalDataToDb(entityDb, saveable, saveableField, objName, record.changedData) {
+			GetLogger().Debug("SaveDb %v %v incremental", entityKey, saveableField.Name)
+		} else {
+			saveData, err := getSaveDataOfSaveable(saveable, saveableField, objName)
+			if err != nil {
+				GetLogger().Error("%v Save %v err:%v", entityKey, saveableField.Name, err.Error())
+				return
+			}
+			// 使用protobuf存mongodb时,mongodb默认会把字段名转成小写,因为protobuf没设置bson tag
+			record.changedData[objName] = saveData
+			record.addMapDbSaved(saveable, saveableField)
 		}
-		// 使用protobuf存mongodb时,mongodb默认会把字段名转成小写,因为protobuf没设置bson tag
-		record.changedData[objName] = saveData
 		if removeCacheAfterSaveDb {
 			record.delKeys = append(record.delKeys, fmt.Sprintf("%v.%v", parentCacheKey, saveableField.Name))
 		}
@@ -314,11 +473,6 @@ func saveObjectChangedDataToDbByKey(entityDb EntityDb, obj any, entityKey interf
 				GetLogger().Debug("%v ignore child %v", entityKey, saveableField.Name)
 				continue
 			}
-			saveData, err := getSaveDataOfSaveable(saveable, saveableField, objName)
-			if err != nil {
-				GetLogger().Error("%v SaveChild %v err:%v", entityKey, saveableField.Name, err.Error())
-				continue
-			}
 			// 使用protobuf存mongodb时,mongodb默认会把字段名转成小写,因为protobuf没设置bson tag
 			childName := ""
 			if _saveableStructsMap.useLowerName {
@@ -326,7 +480,17 @@ func saveObjectChangedDataToDbByKey(entityDb EntityDb, obj any, entityKey interf
 			} else {
 				childName = objName + "." + childStruct.Name
 			}
-			record.changedData[childName] = saveData
+			if collectIncrementalDataToDb(entityDb, saveable, saveableField, childName, record.changedData) {
+				GetLogger().Debug("SaveDb Child %v %v incremental", entityKey, childName)
+			} else {
+				saveData, err := getSaveDataOfSaveable(saveable, saveableField, objName)
+				if err != nil {
+					GetLogger().Error("%v SaveChild %v err:%v", entityKey, saveableField.Name, err.Error())
+					continue
+				}
+				record.changedData[childName] = saveData
+				record.addMapDbSaved(saveable, saveableField)
+			}
 			if removeCacheAfterSaveDb {
 				record.delKeys = append(record.delKeys, fmt.Sprintf("%v.%v", parentCacheKey, childName))
 			}
@@ -336,43 +500,350 @@ func saveObjectChangedDataToDbByKey(entityDb EntityDb, obj any, entityKey interf
 	}
 }
 
-// Entity的变化数据保存到数据库,只保存有数据变化的组件数据,但组件的数据不会分割,只要一个组件有数据变化,组件的数据就是全量覆盖
+// 数据库的增量保存(map的修改项,slice的追加数据),返回false表示需要保存整体数据
 //
-//	指定key
-func SaveEntityChangedDataToDbByKey(entityDb EntityDb, entity Entity, entityKey interface{}, kvCache KvCache, removeCacheAfterSaveDb bool, cachePrefix string) error {
-	record := &saveDataRecord{
-		changedData: make(map[string]any),
+//	entityDb需要实现IncrementalEntityDb
+func collectIncrementalDataToDb(entityDb EntityDb, saveable Saveable, saveableField *SaveableField, fieldPath string, changedData map[string]any) bool {
+	if !isIncrementalEntityDb(entityDb) {
+		return false
 	}
-	entity.RangeComponent(func(component Component) bool {
-		saveObjectChangedDataToDbByKey(entityDb, component, entityKey, kvCache, removeCacheAfterSaveDb,
-			component.GetName(), GetEntityCacheKey(cachePrefix, entityKey), record)
+	if collectMapDirtyDataToDb(saveable, saveableField, fieldPath, changedData) {
 		return true
+	}
+	return collectSliceAppendDataToDb(saveable, saveableField, fieldPath, changedData)
+}
+
+// entityDb是否支持SaveComponents的UnsetComponentField和PushComponentField
+func isIncrementalEntityDb(entityDb EntityDb) bool {
+	incrementalDb, ok := entityDb.(IncrementalEntityDb)
+	return ok && incrementalDb.SupportIncrementalSave()
+}
+
+// slice的数据库追加保存,数据库里有整体数据并且只追加了数据时,追加的数据转换成$push
+//
+//	返回false表示需要保存整体数据
+func collectSliceAppendDataToDb(saveable Saveable, saveableField *SaveableField, fieldPath string, changedData map[string]any) bool {
+	sliceDirtyMark, ok := saveable.(SliceDirtyMark)
+	if !ok || !sliceDirtyMark.HasDbSaved() {
+		return false
+	}
+	objVal := reflect.ValueOf(saveable)
+	if objVal.Kind() == reflect.Ptr {
+		objVal = objVal.Elem()
+	}
+	field := objVal.Field(saveableField.FieldIndex)
+	// 上次保存时是空slice的话,数据库里可能是null,不能追加
+	appendIndex := sliceDirtyMark.GetDbAppendIndex()
+	if field.Kind() != reflect.Slice || appendIndex <= 0 || appendIndex > field.Len() {
+		return false
+	}
+	elemType := field.Type().Elem()
+	// 需要序列化的数据,和saveFieldSlice保持一致
+	needConvert := !saveableField.IsPlain && (elemType.Kind() == reflect.Interface || elemType.Kind() == reflect.Ptr)
+	items := make([]interface{}, 0, field.Len()-appendIndex)
+	for i := appendIndex; i < field.Len(); i++ {
+		item := field.Index(i).Interface()
+		if needConvert {
+			v, err := getInterfaceSaveData(item, fieldPath, saveableField)
+			if err != nil {
+				GetLogger().Error("%v convert index:%v err:%v", fieldPath, i, err.Error())
+				return false
+			}
+			item = v
+		}
+		items = append(items, item)
+	}
+	changedData[fieldPath] = PushComponentField(items...)
+	return true
+}
+
+// map的数据库增量保存,数据库里有整体数据之后,修改的项转换成fieldPath.key的$set,删除的项转换成$unset
+//
+//	返回false表示需要保存整体数据,如数据库里还没有整体数据,map的key不能作为字段名
+func collectMapDirtyDataToDb(saveable Saveable, saveableField *SaveableField, fieldPath string, changedData map[string]any) bool {
+	dbDirtyMark, ok := saveable.(MapDbDirtyMark)
+	if !ok || !dbDirtyMark.HasDbSaved() {
+		return false
+	}
+	objVal := reflect.ValueOf(saveable)
+	if objVal.Kind() == reflect.Ptr {
+		objVal = objVal.Elem()
+	}
+	field := objVal.Field(saveableField.FieldIndex)
+	if field.Kind() != reflect.Map || field.IsNil() {
+		return false
+	}
+	valType := field.Type().Elem()
+	// 需要序列化的value,和saveFieldMap保持一致
+	needConvert := !saveableField.IsPlain && (valType.Kind() == reflect.Interface || valType.Kind() == reflect.Ptr)
+	dirtyData := make(map[string]any)
+	isValid := true
+	dbDirtyMark.RangeDbDirtyMap(func(dirtyKey interface{}, isAddOrUpdate bool) {
+		if !isValid {
+			return
+		}
+		keyName, ok := getMapKeyFieldName(dirtyKey)
+		if !ok {
+			isValid = false
+			return
+		}
+		keyPath := fieldPath + "." + keyName
+		mapValue := reflect.Value{}
+		if isAddOrUpdate {
+			mapValue = field.MapIndex(reflect.ValueOf(dirtyKey))
+		}
+		if !mapValue.IsValid() {
+			dirtyData[keyPath] = UnsetComponentField
+			return
+		}
+		if !needConvert {
+			dirtyData[keyPath] = mapValue.Interface()
+			return
+		}
+		v, err := getInterfaceSaveData(mapValue.Interface(), fieldPath, saveableField)
+		if err != nil {
+			GetLogger().Error("%v convert key:%v err:%v", fieldPath, dirtyKey, err.Error())
+			isValid = false
+			return
+		}
+		dirtyData[keyPath] = v
 	})
+	if !isValid {
+		return false
+	}
+	for k, v := range dirtyData {
+		changedData[k] = v
+	}
+	return true
+}
+
+// map的key作为数据库的字段名,只支持整数和不含.和$的字符串
+func getMapKeyFieldName(key interface{}) (string, bool) {
+	keyVal := reflect.ValueOf(key)
+	switch keyVal.Kind() {
+	case reflect.String:
+		keyName := keyVal.String()
+		if keyName == "" || strings.ContainsAny(keyName, ".$") {
+			return "", false
+		}
+		return keyName, true
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(keyVal.Int(), 10), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return strconv.FormatUint(keyVal.Uint(), 10), true
+	}
+	return "", false
+}
+
+// Entity的变化数据保存到数据库,只保存有数据变化的组件数据
+//
+//	组件的数据一般是全量覆盖,数据库里有整体数据之后,实现了MapDbDirtyMark的map数据(如MapData)只保存修改过的项
+//	实现了SliceDirtyMark的slice数据(如SliceData)只追加了数据时,只保存追加的数据
+//
+//	指定key
+func SaveEntityChangedDataToDbByKey(entityDb EntityDb, entity Entity, entityKey interface{}, kvCache KvCache, removeCacheAfterSaveDb bool, cachePrefix string) error {
+	record := collectEntityChangedData(entityDb, entity, entityKey, kvCache, removeCacheAfterSaveDb, cachePrefix)
 	if len(record.changedData) == 0 {
 		GetLogger().Debug("ignore unchanged data %v", entityKey)
 		return nil
 	}
 	// NOTE: 明文保存的proto字段,字段名会被mongodb自动转为小写 Q:有办法解决吗?
 	// 如examples里的baseInfoComponent的pb.BaseInfo的LongFieldNameTest字段在mongodb中会被转成longfieldnametest
-	saveDbErr := entityDb.SaveComponents(entityKey, record.changedData)
+	var saveDbErr error
+	if versionedDb, _ := getVersionedEntityDb(entityDb, entity); versionedDb != nil {
+		// 开启了乐观锁,版本号不一致时返回ErrVersionConflict,并保留修改标记
+		saveDbErr = versionedDb.SaveComponentsWithVersion(entityKey, record.changedData, record.versionedEntity.GetVersion())
+	} else {
+		saveDbErr = entityDb.SaveComponents(entityKey, record.changedData)
+	}
 	if saveDbErr != nil {
 		GetLogger().Error("SaveDb %v err:%v", entityKey, saveDbErr)
 		GetLogger().Error("%v", record.changedData)
-	} else {
-		GetLogger().Debug("SaveDb %v", entityKey)
+		return saveDbErr
+	}
+	GetLogger().Debug("SaveDb %v", entityKey)
+	record.onSaved(kvCache)
+	return nil
+}
+
+// 收集实体的修改数据
+func collectEntityChangedData(entityDb EntityDb, entity Entity, entityKey interface{}, kvCache KvCache, removeCacheAfterSaveDb bool, cachePrefix string) *saveDataRecord {
+	record := &saveDataRecord{
+		entityKey:   entityKey,
+		changedData: make(map[string]any),
+	}
+	entity.RangeComponent(func(component Component) bool {
+		saveObjectChangedDataToDbByKey(entityDb, component, entityKey, kvCache, removeCacheAfterSaveDb,
+			component.GetName(), GetEntityCacheKey(cachePrefix, entityKey), record)
+		return true
+	})
+	_, record.versionedEntity = getVersionedEntityDb(entityDb, entity)
+	return record
+}
+
+// 保存数据库成功后,重置修改标记,版本号+1,删除缓存
+func (this *saveDataRecord) onSaved(kvCache KvCache) {
+	for _, saveable := range this.saved {
+		saveable.ResetChanged()
 	}
-	if saveDbErr == nil {
-		// 保存数据库成功后,重置修改标记
-		for _, saveable := range record.saved {
-			saveable.ResetChanged()
+	for _, mapDbSaved := range this.mapDbSaved {
+		if mapDbSaved.isNull {
+			mapDbSaved.dbDirtyMark.ResetDbSaved()
+		} else {
+			mapDbSaved.dbDirtyMark.SetDbSaved()
 		}
-		if len(record.delKeys) > 0 {
-			// 保存数据库成功后,才删除缓存
-			kvCache.Del(record.delKeys...)
-			GetLogger().Debug("RemoveCache %v %v", entityKey, record.delKeys)
+	}
+	if this.versionedEntity != nil {
+		this.versionedEntity.SetVersion(this.versionedEntity.GetVersion() + 1)
+	}
+	if kvCache != nil && len(this.delKeys) > 0 {
+		// 保存数据库成功后,才删除缓存
+		kvCache.Del(this.delKeys...)
+		for _, saveable := range this.saved {
+			if sliceDirtyMark, ok := saveable.(SliceDirtyMark); ok {
+				sliceDirtyMark.ResetCached()
+			}
 		}
+		GetLogger().Debug("RemoveCache %v %v", this.entityKey, this.delKeys)
+	}
+}
+
+// 批量保存多个实体的修改数据,如定时保存,停服时保存所有实体
+//
+//	entityDb实现了BulkEntityDb时只有1次数据库交互,否则逐个保存
+//	返回值和entities一一对应,nil表示保存成功或者没有修改数据,只有保存成功的实体才重置修改标记
+func SaveEntitiesChangedDataToDb(entityDb EntityDb, entities []Entity, kvCache KvCache, removeCacheAfterSaveDb bool, cachePrefix string) []error {
+	errs := make([]error, len(entities))
+	bulkEntityDb, ok := entityDb.(BulkEntityDb)
+	if !ok {
+		for i, entity := range entities {
+			errs[i] = SaveEntityChangedDataToDb(entityDb, entity, kvCache, removeCacheAfterSaveDb, cachePrefix)
+		}
+		return errs
+	}
+	var datas []*EntityComponentsData
+	var records []*saveDataRecord
+	// datas的索引 -> entities的索引
+	var entityIndexes []int
+	for i, entity := range entities {
+		record := collectEntityChangedData(entityDb, entity, entity.GetId(), kvCache, removeCacheAfterSaveDb, cachePrefix)
+		if len(record.changedData) == 0 {
+			continue
+		}
+		data := &EntityComponentsData{
+			EntityDb:   entityDb,
+			EntityKey:  record.entityKey,
+			Components: record.changedData,
+		}
+		if record.versionedEntity != nil {
+			data.CheckVersion = true
+			data.Version = record.versionedEntity.GetVersion()
+		}
+		datas = append(datas, data)
+		records = append(records, record)
+		entityIndexes = append(entityIndexes, i)
+	}
+	if len(datas) == 0 {
+		return errs
+	}
+	saveErrs := bulkEntityDb.SaveComponentsBulk(datas)
+	for i, record := range records {
+		if saveErrs[i] != nil {
+			GetLogger().Error("SaveDb bulk %v err:%v", record.entityKey, saveErrs[i])
+			errs[entityIndexes[i]] = saveErrs[i]
+			continue
+		}
+		record.onSaved(kvCache)
+	}
+	GetLogger().Debug("SaveDb bulk count:%v", len(datas))
+	return errs
+}
+
+// 需要保存的实体,用于同时保存多个实体
+type EntitySaveInfo struct {
+	EntityDb EntityDb
+	Entity   Entity
+	// 为nil时使用Entity.GetId()
+	EntityKey interface{}
+	// 缓存key的前缀
+	CachePrefix string
+}
+
+func (this *EntitySaveInfo) getEntityKey() interface{} {
+	if this.EntityKey == nil {
+		return this.Entity.GetId()
+	}
+	return this.EntityKey
+}
+
+// 在一个事务中保存多个实体的修改数据,如玩家之间的交易,玩家和公会之间的资源转移
+//
+//	dbMgr需要实现TransactionDbMgr,否则返回ErrNotSupported
+//	事务提交成功后,才重置所有实体的修改标记,提交失败时所有实体的修改标记都保留
+func SaveEntitiesChangedDataToDbInTransaction(dbMgr DbMgr, kvCache KvCache, removeCacheAfterSaveDb bool, entities ...*EntitySaveInfo) error {
+	transactionDbMgr, ok := dbMgr.(TransactionDbMgr)
+	if !ok {
+		return ErrNotSupported
+	}
+	var datas []*EntityComponentsData
+	var records []*saveDataRecord
+	for _, info := range entities {
+		entityKey := info.getEntityKey()
+		record := collectEntityChangedData(info.EntityDb, info.Entity, entityKey, kvCache, removeCacheAfterSaveDb, info.CachePrefix)
+		if len(record.changedData) == 0 {
+			continue
+		}
+		data := &EntityComponentsData{
+			EntityDb:   info.EntityDb,
+			EntityKey:  entityKey,
+			Components: record.changedData,
+		}
+		if record.versionedEntity != nil {
+			data.CheckVersion = true
+			data.Version = record.versionedEntity.GetVersion()
+		}
+		datas = append(datas, data)
+		records = append(records, record)
+	}
+	if len(datas) == 0 {
+		return nil
+	}
+	err := transactionDbMgr.SaveComponentsInTransaction(datas)
+	if err != nil {
+		GetLogger().Error("SaveDb transaction %v err:%v", len(datas), err)
+		return err
+	}
+	for _, record := range records {
+		GetLogger().Debug("SaveDb transaction %v", record.entityKey)
+		record.onSaved(kvCache)
+	}
+	return nil
+}
+
+// 保存实体的组件数据,开启了乐观锁时检查版本号,保存成功后实体的版本号+1
+func saveEntityComponents(entityDb EntityDb, entity Entity, entityKey interface{}, components map[string]interface{}) error {
+	versionedDb, versionedEntity := getVersionedEntityDb(entityDb, entity)
+	if versionedDb == nil {
+		return entityDb.SaveComponents(entityKey, components)
+	}
+	if err := versionedDb.SaveComponentsWithVersion(entityKey, components, versionedEntity.GetVersion()); err != nil {
+		return err
+	}
+	versionedEntity.SetVersion(versionedEntity.GetVersion() + 1)
+	return nil
+}
+
+// entityDb开启了乐观锁并且entity实现了VersionedEntity时,返回非nil
+func getVersionedEntityDb(entityDb EntityDb, entity Entity) (VersionedEntityDb, VersionedEntity) {
+	versionedDb, ok := entityDb.(VersionedEntityDb)
+	if !ok || len(versionedDb.GetVersionField()) == 0 {
+		return nil, nil
+	}
+	versionedEntity, ok := entity.(VersionedEntity)
+	if !ok {
+		return nil, nil
 	}
-	return saveDbErr
+	return versionedDb, versionedEntity
 }
 
 // 获取实体需要保存到数据库的完整数据
@@ -114,18 +114,39 @@ type MapDirtyMark interface {
 	RangeDirtyMap(f func(dirtyKey interface{}, isAddOrUpdate bool))
 }
 
+// 支持数据库增量保存的MapDirtyMark
+//
+//	数据库里有整体数据之后(从数据库加载过,或者保存过整体数据),只保存修改过的项($set map.key / $unset map.key)
+//	数据库和缓存的保存频率不同,所以数据库的修改项和缓存的修改项分开记录
+type MapDbDirtyMark interface {
+	// 数据库里是否有整体数据
+	HasDbSaved() bool
+	// 设置数据库里有整体数据,加载数据和保存了整体数据时自动调用
+	SetDbSaved()
+	// 数据库里的整体数据是null,如保存了nil map,之后需要保存整体数据
+	ResetDbSaved()
+	// 遍历上次保存数据库之后修改过的项
+	RangeDbDirtyMap(f func(dirtyKey interface{}, isAddOrUpdate bool))
+}
+
 type BaseMapDirtyMark struct {
 	isChanged bool
 	hasCached bool
 	dirtyMap  map[interface{}]bool
+	// 数据库里是否有整体数据
+	hasDbSaved bool
+	// 用于保存数据库的修改项
+	dbDirtyMap map[interface{}]bool
 }
 
 func (this *BaseMapDirtyMark) IsChanged() bool {
 	return this.isChanged
 }
 
+// 保存数据库成功后调用
 func (this *BaseMapDirtyMark) ResetChanged() {
 	this.isChanged = false
+	this.dbDirtyMap = nil
 }
 
 func (this *BaseMapDirtyMark) IsDirty() bool {
@@ -137,6 +158,10 @@ func (this *BaseMapDirtyMark) SetDirty(k interface{}, isAddOrUpdate bool) {
 		this.dirtyMap = make(map[interface{}]bool)
 	}
 	this.dirtyMap[k] = isAddOrUpdate
+	if this.dbDirtyMap == nil {
+		this.dbDirtyMap = make(map[interface{}]bool)
+	}
+	this.dbDirtyMap[k] = isAddOrUpdate
 	this.isChanged = true
 }
 
@@ -158,6 +183,24 @@ func (this *BaseMapDirtyMark) RangeDirtyMap(f func(dirtyKey interface{}, isAddOr
 	}
 }
 
+func (this *BaseMapDirtyMark) HasDbSaved() bool {
+	return this.hasDbSaved
+}
+
+func (this *BaseMapDirtyMark) SetDbSaved() {
+	this.hasDbSaved = true
+}
+
+func (this *BaseMapDirtyMark) ResetDbSaved() {
+	this.hasDbSaved = false
+}
+
+func (this *BaseMapDirtyMark) RangeDbDirtyMap(f func(dirtyKey interface{}, isAddOrUpdate bool)) {
+	for k, v := range this.dbDirtyMap {
+		f(k, v)
+	}
+}
+
 // 用于InterfaceMap的map's value的DirtyMark
 type MapValueDirtyMark[K comparable] struct {
 	// 父类才是真正的脏标记
@@ -188,3 +231,88 @@ func (m *MapValueDirtyMark[K]) SetDirty() {
 	}
 	m.Parent.SetDirty(m.MapKey, true)
 }
+
+// 支持追加保存的DirtyMark,用于追加为主的slice数据,如已完成的任务,战斗日志
+//
+//	只追加了数据时,数据库使用$push,缓存使用RPUSH,有其他修改时仍然保存整体数据
+//	数据库和缓存的保存频率不同,所以分开记录追加数据的起始位置
+type SliceDirtyMark interface {
+	DirtyMark
+	// 追加数据的标记,index是追加的第一个数据的位置
+	SetAppended(index int)
+
+	// 缓存里是否有整体数据(list类型),有整体数据之后,追加的数据才能使用RPUSH
+	HasCached() bool
+	SetCached()
+	// 缓存被删除或者不是list类型时调用,下次保存整体数据
+	ResetCached()
+	// 上次保存缓存之后追加的数据的起始位置,<0表示有追加以外的修改
+	GetCacheAppendIndex() int
+
+	// 数据库里是否有整体数据
+	HasDbSaved() bool
+	// 设置数据库里有整体数据,加载数据时自动调用
+	SetDbSaved()
+	// 上次保存数据库之后追加的数据的起始位置,<0表示有追加以外的修改
+	GetDbAppendIndex() int
+}
+
+type BaseSliceDirtyMark struct {
+	BaseDirtyMark
+	hasCached        bool
+	cacheAppendIndex int
+	hasDbSaved       bool
+	dbAppendIndex    int
+}
+
+// 追加以外的修改,需要保存整体数据
+func (this *BaseSliceDirtyMark) SetDirty() {
+	this.BaseDirtyMark.SetDirty()
+	this.cacheAppendIndex = -1
+	this.dbAppendIndex = -1
+}
+
+func (this *BaseSliceDirtyMark) SetAppended(index int) {
+	// 上次保存之后的第一次修改,记录追加数据的起始位置
+	if !this.isDirty {
+		this.cacheAppendIndex = index
+	}
+	if !this.isChanged {
+		this.dbAppendIndex = index
+	}
+	this.BaseDirtyMark.SetDirty()
+}
+
+// 保存数据库成功后调用,之后追加的数据可以追加保存
+func (this *BaseSliceDirtyMark) ResetChanged() {
+	this.BaseDirtyMark.ResetChanged()
+	this.hasDbSaved = true
+}
+
+func (this *BaseSliceDirtyMark) HasCached() bool {
+	return this.hasCached
+}
+
+func (this *BaseSliceDirtyMark) SetCached() {
+	this.hasCached = true
+}
+
+func (this *BaseSliceDirtyMark) ResetCached() {
+	this.hasCached = false
+}
+
+func (this *BaseSliceDirtyMark) GetCacheAppendIndex() int {
+	return this.cacheAppendIndex
+}
+
+func (this *BaseSliceDirtyMark) HasDbSaved() bool {
+	return this.hasDbSaved
+}
+
+func (this *BaseSliceDirtyMark) SetDbSaved() {
+	this.hasDbSaved = true
+}
+
+func (this *BaseSliceDirtyMark) GetDbAppendIndex() int {
+	return this.dbAppendIndex
+}
@@ -81,8 +81,10 @@ func NewMapDataComponent[K comparable, V any](entity Entity, componentName strin
 }
 
 // slice类型的数据的辅助类
+//
+//	只通过Add追加数据时,数据库和缓存只保存追加的数据,其他修改(如Delete)保存整体数据
 type SliceData[E any] struct {
-	BaseDirtyMark
+	BaseSliceDirtyMark
 	Data []E `db:""`
 }
 
@@ -90,8 +92,8 @@ func (sd *SliceData[E]) Add(v ...E) {
 	if len(v) == 0 {
 		return
 	}
+	sd.SetAppended(len(sd.Data))
 	sd.Data = append(sd.Data, v...)
-	sd.SetDirty()
 }
 
 // see slices.Delete
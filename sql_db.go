@@ -0,0 +1,1591 @@
+package gentity
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/fish-tennis/gentity/util"
+	"google.golang.org/protobuf/proto"
+	"math"
+	"reflect"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// https://github.com/uber-go/guide/blob/master/style.md#verify-interface-compliance
+var _ EntityDb = (*SqlCollection)(nil)
+var _ IncrementalEntityDb = (*SqlCollection)(nil)
+var _ PlayerDb = (*SqlCollectionPlayer)(nil)
+var _ KvDb = (*SqlKvDb)(nil)
+var _ AdvancedKvDb = (*SqlKvDb)(nil)
+var _ DbMgr = (*SqlDb)(nil)
+
+// Inc冲突时的最大重试次数
+const sqlKvIncMaxRetry = 100
+
+// 列表操作冲突时的最大重试次数
+const sqlListMaxRetry = 100
+
+// sql表的列类型
+type SqlColumnKind int
+
+const (
+	// 整数
+	SqlColumnInt SqlColumnKind = iota
+	// 字符串
+	SqlColumnString
+	// 二进制数据,非明文保存的proto
+	SqlColumnBlob
+	// json,明文保存的数据
+	SqlColumnJson
+	// 文本
+	SqlColumnText
+)
+
+// sql表的列
+type SqlColumn struct {
+	Name string
+	Kind SqlColumnKind
+}
+
+// 基于database/sql的EntityDb实现
+//
+//	一个组件对应一列,非明文保存的单字段组件(如proto)使用二进制列,其他组件使用json列
+//	组件的子字段保存在json列里,SaveComponents只会执行一条UPDATE语句
+type SqlCollection struct {
+	sqlDb     *SqlDb
+	tableName string
+	// 唯一id
+	uniqueId string
+	columns  []*SqlColumn
+	// 小写列名 -> 列
+	columnMap map[string]*SqlColumn
+	// 索引名 -> 列名
+	indexes map[string][]string
+}
+
+func (this *SqlCollection) GetTableName() string {
+	return this.tableName
+}
+
+func (this *SqlCollection) addColumn(column *SqlColumn) {
+	lowerName := strings.ToLower(column.Name)
+	if _, ok := this.columnMap[lowerName]; ok {
+		return
+	}
+	this.columns = append(this.columns, column)
+	this.columnMap[lowerName] = column
+}
+
+// 列名不区分大小写,和mongodb的字段名解析保持一致
+func (this *SqlCollection) getColumn(name string) *SqlColumn {
+	return this.columnMap[strings.ToLower(name)]
+}
+
+func (this *SqlCollection) quote(name string) string {
+	return this.sqlDb.dialect.QuoteIdentifier(name)
+}
+
+func (this *SqlCollection) selectColumns() string {
+	columnNames := make([]string, len(this.columns))
+	for i, column := range this.columns {
+		columnNames[i] = this.quote(column.Name)
+	}
+	return strings.Join(columnNames, ", ")
+}
+
+// 根据id查找数据
+func (this *SqlCollection) FindEntityById(entityKey interface{}, data interface{}) (bool, error) {
+	keyValue, err := encodeSqlColumnValue(this.getColumn(this.uniqueId), entityKey)
+	if err != nil {
+		return false, err
+	}
+	query := fmt.Sprintf("SELECT %v FROM %v WHERE %v = %v", this.selectColumns(), this.quote(this.tableName),
+		this.quote(this.uniqueId), this.sqlDb.dialect.Placeholder(1))
+	return this.findOne(query, data, keyValue)
+}
+
+func (this *SqlCollection) findOne(query string, data interface{}, args ...any) (bool, error) {
+	rows, err := this.sqlDb.db.Query(query, args...)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return false, rows.Err()
+	}
+	err = this.scanRow(rows, data)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// 一行数据 -> json -> data
+func (this *SqlCollection) scanRow(rows *sql.Rows, data interface{}) error {
+	doc, err := this.scanRowDocument(rows, this.columns)
+	if err != nil {
+		return err
+	}
+	return decodeJsonFields(doc, data)
+}
+
+// 一行数据 -> 列名:json,columns是查询的列
+func (this *SqlCollection) scanRowDocument(rows *sql.Rows, columns []*SqlColumn) (map[string]json.RawMessage, error) {
+	values := make([]any, len(columns))
+	for i, column := range columns {
+		switch column.Kind {
+		case SqlColumnInt:
+			values[i] = new(sql.NullInt64)
+		case SqlColumnString:
+			values[i] = new(sql.NullString)
+		default:
+			values[i] = new([]byte)
+		}
+	}
+	if err := rows.Scan(values...); err != nil {
+		return nil, err
+	}
+	doc := make(map[string]json.RawMessage)
+	for i, column := range columns {
+		var raw json.RawMessage
+		var err error
+		switch v := values[i].(type) {
+		case *sql.NullInt64:
+			if v.Valid {
+				raw = json.RawMessage(strconv.FormatInt(v.Int64, 10))
+			}
+		case *sql.NullString:
+			if v.Valid {
+				raw, err = json.Marshal(v.String)
+			}
+		case *[]byte:
+			if *v == nil {
+				break
+			}
+			if column.Kind == SqlColumnBlob {
+				// []byte在json中是base64字符串
+				raw, err = json.Marshal(*v)
+			} else if column.Kind == SqlColumnText {
+				raw, err = json.Marshal(string(*v))
+			} else {
+				raw = json.RawMessage(bytes.Clone(*v))
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		if raw != nil {
+			doc[column.Name] = raw
+		}
+	}
+	return doc, nil
+}
+
+// 使用IN查询,只有1次数据库交互
+func (this *SqlCollection) FindEntitiesByIds(entityKeys []interface{}, newData func() interface{}, componentNames ...string) (map[interface{}]interface{}, error) {
+	datas := make(map[interface{}]interface{}, len(entityKeys))
+	if len(entityKeys) == 0 {
+		return datas, nil
+	}
+	keyColumn := this.getColumn(this.uniqueId)
+	// 只查询主键和指定组件的列
+	columns := this.columns
+	if len(componentNames) > 0 {
+		columns = []*SqlColumn{keyColumn}
+		for _, componentName := range componentNames {
+			if column := this.getColumn(componentName); column != nil && column != keyColumn {
+				columns = append(columns, column)
+			}
+		}
+	}
+	columnNames := make([]string, len(columns))
+	for i, column := range columns {
+		columnNames[i] = this.quote(column.Name)
+	}
+	args := make([]any, len(entityKeys))
+	placeholders := make([]string, len(entityKeys))
+	keyMap := make(map[string]interface{}, len(entityKeys))
+	for i, entityKey := range entityKeys {
+		keyValue, err := encodeSqlColumnValue(keyColumn, entityKey)
+		if err != nil {
+			return nil, err
+		}
+		args[i] = keyValue
+		placeholders[i] = this.sqlDb.dialect.Placeholder(i + 1)
+		keyMap[memKey(keyValue)] = entityKey
+	}
+	query := fmt.Sprintf("SELECT %v FROM %v WHERE %v IN (%v)", strings.Join(columnNames, ", "), this.quote(this.tableName),
+		this.quote(this.uniqueId), strings.Join(placeholders, ", "))
+	rows, err := this.sqlDb.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		doc, err := this.scanRowDocument(rows, columns)
+		if err != nil {
+			return nil, err
+		}
+		key, err := decodeJsonValue(doc[keyColumn.Name])
+		if err != nil {
+			return nil, err
+		}
+		entityKey, ok := keyMap[memKey(key)]
+		if !ok {
+			continue
+		}
+		data := newData()
+		if err = decodeJsonFields(doc, data); err != nil {
+			return nil, err
+		}
+		datas[entityKey] = data
+	}
+	return datas, rows.Err()
+}
+
+// 按条件查询,字段路径的第一级是列名,后面的部分是json列里的路径
+//
+//	json字段的比较和排序使用数据库的json比较规则,投影只精确到列
+func (this *SqlCollection) FindEntities(query *Query, newData func() interface{}) (*QueryResult, error) {
+	if err := query.check(this.uniqueId); err != nil {
+		return nil, err
+	}
+	builder := &sqlQueryBuilder{collection: this}
+	var conditions []string
+	for _, filter := range query.Filters {
+		condition, err := builder.condition(filter.FieldPath, filter.Op, filter.Value)
+		if err != nil {
+			return nil, err
+		}
+		conditions = append(conditions, condition)
+	}
+	var cursorConditions []string
+	var cursorErr error
+	query.rangeCursorConditions(this.uniqueId, func(sorts []*QuerySort, values []interface{}, lastOp QueryOp) {
+		andConditions := make([]string, len(sorts))
+		for i, s := range sorts {
+			op := QueryOpEq
+			if i == len(sorts)-1 {
+				op = lastOp
+			}
+			condition, err := builder.condition(s.FieldPath, op, values[i])
+			if err != nil {
+				cursorErr = err
+				return
+			}
+			andConditions[i] = condition
+		}
+		cursorConditions = append(cursorConditions, "("+strings.Join(andConditions, " AND ")+")")
+	})
+	if cursorErr != nil {
+		return nil, cursorErr
+	}
+	if len(cursorConditions) > 0 {
+		conditions = append(conditions, "("+strings.Join(cursorConditions, " OR ")+")")
+	}
+	sorts := query.getSorts(this.uniqueId)
+	orderBys := make([]string, len(sorts))
+	for i, s := range sorts {
+		expr, _, _, err := builder.fieldExpr(s.FieldPath)
+		if err != nil {
+			return nil, err
+		}
+		if s.Desc {
+			expr += " DESC"
+		}
+		orderBys[i] = expr
+	}
+	// 除了投影的列,还需要查询排序的列,用于生成下一页的游标
+	columns := this.columns
+	var projectColumns map[*SqlColumn]struct{}
+	if len(query.Projection) > 0 {
+		keyColumn := this.getColumn(this.uniqueId)
+		columns = []*SqlColumn{keyColumn}
+		projectColumns = map[*SqlColumn]struct{}{keyColumn: {}}
+		for _, fieldPath := range query.Projection {
+			column := this.getColumn(strings.Split(fieldPath, ".")[0])
+			if column == nil {
+				continue
+			}
+			if _, ok := projectColumns[column]; !ok {
+				projectColumns[column] = struct{}{}
+				columns = append(columns, column)
+			}
+		}
+		for _, s := range sorts {
+			column := this.getColumn(strings.Split(s.FieldPath, ".")[0])
+			if !slices.Contains(columns, column) {
+				columns = append(columns, column)
+			}
+		}
+	}
+	columnNames := make([]string, len(columns))
+	for i, column := range columns {
+		columnNames[i] = this.quote(column.Name)
+	}
+	sqlQuery := fmt.Sprintf("SELECT %v FROM %v", strings.Join(columnNames, ", "), this.quote(this.tableName))
+	if len(conditions) > 0 {
+		sqlQuery += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	sqlQuery += " ORDER BY " + strings.Join(orderBys, ", ")
+	if query.Limit > 0 {
+		sqlQuery += fmt.Sprintf(" LIMIT %v", query.Limit)
+	} else if query.Skip > 0 {
+		// 有OFFSET时必须有LIMIT
+		sqlQuery += fmt.Sprintf(" LIMIT %v", int64(math.MaxInt64))
+	}
+	if query.Skip > 0 {
+		sqlQuery += fmt.Sprintf(" OFFSET %v", query.Skip)
+	}
+	rows, err := this.sqlDb.db.Query(sqlQuery, builder.args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var docs []map[string]json.RawMessage
+	for rows.Next() {
+		doc, err := this.scanRowDocument(rows, columns)
+		if err != nil {
+			return nil, err
+		}
+		docs = append(docs, doc)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	result := &QueryResult{}
+	if len(docs) > 0 {
+		last := docs[len(docs)-1]
+		result.NextCursor = query.makeNextCursor(this.uniqueId, len(docs), func(fieldPath string) interface{} {
+			names := strings.Split(fieldPath, ".")
+			value, _ := getJsonPathValue(last[this.getColumn(names[0]).Name], names[1:])
+			return value
+		})
+	}
+	for _, doc := range docs {
+		if projectColumns != nil {
+			for _, column := range columns {
+				if _, ok := projectColumns[column]; !ok {
+					delete(doc, column.Name)
+				}
+			}
+		}
+		data := newData()
+		if err = decodeJsonFields(doc, data); err != nil {
+			return nil, err
+		}
+		result.Datas = append(result.Datas, data)
+	}
+	return result, nil
+}
+
+// 查询条件 -> sql条件,参数按照在sql语句中出现的顺序添加
+type sqlQueryBuilder struct {
+	collection *SqlCollection
+	args       []any
+}
+
+func (this *sqlQueryBuilder) addArg(arg any) string {
+	this.args = append(this.args, arg)
+	return this.collection.sqlDb.dialect.Placeholder(len(this.args))
+}
+
+// 字段路径 -> sql表达式,json列使用JsonExtract
+func (this *sqlQueryBuilder) fieldExpr(fieldPath string) (expr string, column *SqlColumn, isJson bool, err error) {
+	names := strings.Split(fieldPath, ".")
+	column = this.collection.getColumn(names[0])
+	if column == nil {
+		return "", nil, false, errors.New(fmt.Sprintf("%v column not exists:%v", this.collection.tableName, names[0]))
+	}
+	switch column.Kind {
+	case SqlColumnJson:
+		dialect := this.collection.sqlDb.dialect
+		return dialect.JsonExtract(this.collection.quote(column.Name), this.addArg(dialect.JsonPath(names[1:]))), column, true, nil
+	case SqlColumnInt, SqlColumnString, SqlColumnText:
+		if len(names) == 1 {
+			return this.collection.quote(column.Name), column, false, nil
+		}
+	}
+	return "", nil, false, errors.New(fmt.Sprintf("%v field not queryable:%v", this.collection.tableName, fieldPath))
+}
+
+func (this *sqlQueryBuilder) valueExpr(column *SqlColumn, isJson bool, value any) (string, error) {
+	if isJson {
+		jsonBytes, err := json.Marshal(value)
+		if err != nil {
+			return "", err
+		}
+		return this.collection.sqlDb.dialect.JsonScalar(this.addArg(string(jsonBytes))), nil
+	}
+	columnValue, err := encodeSqlColumnValue(column, value)
+	if err != nil {
+		return "", err
+	}
+	return this.addArg(columnValue), nil
+}
+
+// 一个过滤条件 -> sql条件
+//
+//	和mongodb一样,$ne和$nin也匹配字段不存在的数据
+func (this *sqlQueryBuilder) condition(fieldPath string, op QueryOp, value any) (string, error) {
+	if op == QueryOpIn || op == QueryOpNin {
+		var nullCondition string
+		if op == QueryOpNin {
+			expr, _, _, err := this.fieldExpr(fieldPath)
+			if err != nil {
+				return "", err
+			}
+			nullCondition = expr + " IS NULL OR "
+		}
+		values, _ := toQueryValues(value)
+		orConditions := make([]string, len(values))
+		for i, v := range values {
+			condition, err := this.condition(fieldPath, QueryOpEq, v)
+			if err != nil {
+				return "", err
+			}
+			orConditions[i] = condition
+		}
+		if op == QueryOpIn {
+			if len(orConditions) == 0 {
+				return "1 = 0", nil
+			}
+			return "(" + strings.Join(orConditions, " OR ") + ")", nil
+		}
+		if len(orConditions) == 0 {
+			return "1 = 1", nil
+		}
+		return "(" + nullCondition + "NOT (" + strings.Join(orConditions, " OR ") + "))", nil
+	}
+	expr, column, isJson, err := this.fieldExpr(fieldPath)
+	if err != nil {
+		return "", err
+	}
+	var compareOp string
+	switch op {
+	case QueryOpExists:
+		if value.(bool) {
+			return expr + " IS NOT NULL", nil
+		}
+		return expr + " IS NULL", nil
+	case QueryOpEq:
+		if util.IsNil(value) {
+			return expr + " IS NULL", nil
+		}
+		compareOp = " = "
+	case QueryOpNe:
+		if util.IsNil(value) {
+			return expr + " IS NOT NULL", nil
+		}
+		// 每次使用字段表达式时都重新生成,以便参数的顺序和占位符一致
+		notNullExpr, _, _, _ := this.fieldExpr(fieldPath)
+		valueExpr, err := this.valueExpr(column, isJson, value)
+		if err != nil {
+			return "", err
+		}
+		return "(" + expr + " IS NULL OR " + notNullExpr + " <> " + valueExpr + ")", nil
+	case QueryOpGt:
+		compareOp = " > "
+	case QueryOpGte:
+		compareOp = " >= "
+	case QueryOpLt:
+		compareOp = " < "
+	case QueryOpLte:
+		compareOp = " <= "
+	default:
+		return "", errors.New(fmt.Sprintf("%v unsupported query op:%v", fieldPath, op))
+	}
+	valueExpr, err := this.valueExpr(column, isJson, value)
+	if err != nil {
+		return "", err
+	}
+	return expr + compareOp + valueExpr, nil
+}
+
+// 新建Entity(insert)
+//
+//	entityData可以是map[string]interface{}或者struct,struct会先转换成json
+//	没有对应列的字段会被忽略
+func (this *SqlCollection) InsertEntity(entityKey interface{}, entityData interface{}) (err error, isDuplicateKey bool) {
+	fields, err := toJsonFields(entityData)
+	if err != nil {
+		return err, false
+	}
+	fields[this.uniqueId] = entityKey
+	fieldNames := make([]string, 0, len(fields))
+	for fieldName := range fields {
+		fieldNames = append(fieldNames, fieldName)
+	}
+	sort.Strings(fieldNames)
+	var columnNames, placeholders []string
+	var args []any
+	inserted := make(map[*SqlColumn]struct{})
+	for _, fieldName := range fieldNames {
+		column := this.getColumn(fieldName)
+		if column == nil {
+			GetLogger().Debug("%v InsertEntity %v ignore field:%v", this.tableName, entityKey, fieldName)
+			continue
+		}
+		if _, ok := inserted[column]; ok {
+			continue
+		}
+		inserted[column] = struct{}{}
+		value, encodeErr := encodeSqlColumnValue(column, fields[fieldName])
+		if encodeErr != nil {
+			return errors.New(fmt.Sprintf("%v.%v err:%v", this.tableName, fieldName, encodeErr)), false
+		}
+		args = append(args, value)
+		columnNames = append(columnNames, this.quote(column.Name))
+		placeholders = append(placeholders, this.columnPlaceholder(column, len(args)))
+	}
+	query := fmt.Sprintf("INSERT INTO %v (%v) VALUES (%v)", this.quote(this.tableName),
+		strings.Join(columnNames, ", "), strings.Join(placeholders, ", "))
+	_, err = this.sqlDb.db.Exec(query, args...)
+	if err != nil {
+		if this.sqlDb.dialect.IsDuplicateKeyError(err) {
+			return fmt.Errorf("%v %v:%v %w: %v", this.tableName, this.uniqueId, entityKey, ErrDuplicateKey, err), true
+		}
+		return err, false
+	}
+	return nil, false
+}
+
+func (this *SqlCollection) columnPlaceholder(column *SqlColumn, index int) string {
+	placeholder := this.sqlDb.dialect.Placeholder(index)
+	if column.Kind == SqlColumnJson {
+		return this.sqlDb.dialect.JsonValue(placeholder)
+	}
+	return placeholder
+}
+
+// 保存Entity数据
+//
+//	entityData可以是map[string]interface{}或者struct,只更新entityData里有对应列的字段
+func (this *SqlCollection) SaveEntity(entityKey interface{}, entityData interface{}) error {
+	fields, err := toJsonFields(entityData)
+	if err != nil {
+		return err
+	}
+	components := make(map[string]interface{}, len(fields))
+	for fieldName, fieldData := range fields {
+		column := this.getColumn(fieldName)
+		if column == nil {
+			GetLogger().Debug("%v SaveEntity %v ignore field:%v", this.tableName, entityKey, fieldName)
+			continue
+		}
+		if column.Name == this.getColumn(this.uniqueId).Name {
+			continue
+		}
+		components[fieldName] = fieldData
+	}
+	return this.SaveComponents(entityKey, components)
+}
+
+// 删除Entity数据
+func (this *SqlCollection) DeleteEntity(entityKey interface{}) error {
+	keyValue, err := encodeSqlColumnValue(this.getColumn(this.uniqueId), entityKey)
+	if err != nil {
+		return err
+	}
+	query := fmt.Sprintf("DELETE FROM %v WHERE %v = %v", this.quote(this.tableName),
+		this.quote(this.uniqueId), this.sqlDb.dialect.Placeholder(1))
+	_, err = this.sqlDb.db.Exec(query, keyValue)
+	return err
+}
+
+// 保存1个组件
+func (this *SqlCollection) SaveComponent(entityKey interface{}, componentName string, componentData interface{}) error {
+	return this.SaveComponents(entityKey, map[string]interface{}{componentName: componentData})
+}
+
+func (this *SqlCollection) SupportIncrementalSave() bool {
+	return true
+}
+
+// 批量保存组件,只执行一条UPDATE语句
+//
+//	components的key格式: componentName 或 componentName.childName,值为UnsetComponentField时删除该字段
+//	值为PushComponentField的返回值时追加到json数组的尾部
+func (this *SqlCollection) SaveComponents(entityKey interface{}, components map[string]interface{}) error {
+	if len(components) == 0 {
+		return nil
+	}
+	keys := make([]string, 0, len(components))
+	for key := range components {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	dialect := this.sqlDb.dialect
+	var args []any
+	addArg := func(arg any) string {
+		args = append(args, arg)
+		return dialect.Placeholder(len(args))
+	}
+	// 列 -> 赋值表达式
+	columnExprs := make(map[*SqlColumn]string)
+	wholeColumns := make(map[*SqlColumn]struct{})
+	var columnOrder []*SqlColumn
+	for _, key := range keys {
+		names := strings.Split(key, ".")
+		column := this.getColumn(names[0])
+		if column == nil {
+			return errors.New(fmt.Sprintf("%v column not exists:%v", this.tableName, names[0]))
+		}
+		expr, exists := columnExprs[column]
+		if !exists {
+			columnOrder = append(columnOrder, column)
+		}
+		if len(names) == 1 {
+			if exists {
+				return errors.New(fmt.Sprintf("%v conflict update:%v", this.tableName, key))
+			}
+			if isUnsetComponentField(components[key]) {
+				columnExprs[column] = "NULL"
+				wholeColumns[column] = struct{}{}
+				continue
+			}
+			if pushItems, ok := getPushComponentField(components[key]); ok {
+				if column.Kind != SqlColumnJson {
+					return errors.New(fmt.Sprintf("%v column %v not a json column", this.tableName, column.Name))
+				}
+				items, err := marshalJsonItems(pushItems)
+				if err != nil {
+					return errors.New(fmt.Sprintf("%v.%v err:%v", this.tableName, key, err))
+				}
+				expr = fmt.Sprintf("COALESCE(%v, '[]')", this.quote(column.Name))
+				columnExprs[column] = dialect.JsonArrayAppend(expr, nil, items, addArg)
+				wholeColumns[column] = struct{}{}
+				continue
+			}
+			value, err := encodeSqlColumnValue(column, components[key])
+			if err != nil {
+				return errors.New(fmt.Sprintf("%v.%v err:%v", this.tableName, key, err))
+			}
+			args = append(args, value)
+			columnExprs[column] = this.columnPlaceholder(column, len(args))
+			wholeColumns[column] = struct{}{}
+			continue
+		}
+		// 和mongodb一样,不能在非文档类型的字段下创建字段
+		if column.Kind != SqlColumnJson {
+			return errors.New(fmt.Sprintf("%v Cannot create field '%v' in element {%v}", this.tableName, names[1], column.Name))
+		}
+		if _, ok := wholeColumns[column]; ok {
+			return errors.New(fmt.Sprintf("%v conflict update:%v", this.tableName, key))
+		}
+		if !exists {
+			expr = fmt.Sprintf("COALESCE(%v, %v)", this.quote(column.Name), dialect.EmptyJsonObject())
+		}
+		if isUnsetComponentField(components[key]) {
+			args = append(args, dialect.JsonPath(names[1:]))
+			columnExprs[column] = dialect.JsonRemove(expr, dialect.Placeholder(len(args)))
+			continue
+		}
+		if pushItems, ok := getPushComponentField(components[key]); ok {
+			items, err := marshalJsonItems(pushItems)
+			if err != nil {
+				return errors.New(fmt.Sprintf("%v.%v err:%v", this.tableName, key, err))
+			}
+			columnExprs[column] = dialect.JsonArrayAppend(expr, names[1:], items, addArg)
+			continue
+		}
+		value, err := json.Marshal(components[key])
+		if err != nil {
+			return errors.New(fmt.Sprintf("%v.%v err:%v", this.tableName, key, err))
+		}
+		columnExprs[column] = dialect.JsonSet(expr, names[1:], string(value), addArg)
+	}
+	setExprs := make([]string, len(columnOrder))
+	for i, column := range columnOrder {
+		setExprs[i] = fmt.Sprintf("%v = %v", this.quote(column.Name), columnExprs[column])
+	}
+	keyValue, err := encodeSqlColumnValue(this.getColumn(this.uniqueId), entityKey)
+	if err != nil {
+		return err
+	}
+	args = append(args, keyValue)
+	query := fmt.Sprintf("UPDATE %v SET %v WHERE %v = %v", this.quote(this.tableName),
+		strings.Join(setExprs, ", "), this.quote(this.uniqueId), dialect.Placeholder(len(args)))
+	_, err = this.sqlDb.db.Exec(query, args...)
+	return err
+}
+
+// 保存1个组件的一个字段
+func (this *SqlCollection) SaveComponentField(entityKey interface{}, componentName string, fieldName string, fieldData interface{}) error {
+	return this.SaveComponents(entityKey, map[string]interface{}{componentName + "." + fieldName: fieldData})
+}
+
+// 删除1个组件的某些字段
+func (this *SqlCollection) DeleteComponentField(entityKey interface{}, componentName string, fieldName ...string) error {
+	if len(fieldName) == 0 {
+		return nil
+	}
+	column := this.getColumn(componentName)
+	if column == nil {
+		return errors.New(fmt.Sprintf("%v column not exists:%v", this.tableName, componentName))
+	}
+	if column.Kind != SqlColumnJson {
+		return errors.New(fmt.Sprintf("%v column %v not a json column", this.tableName, componentName))
+	}
+	dialect := this.sqlDb.dialect
+	var args []any
+	expr := this.quote(column.Name)
+	for _, name := range fieldName {
+		args = append(args, dialect.JsonPath([]string{name}))
+		expr = dialect.JsonRemove(expr, dialect.Placeholder(len(args)))
+	}
+	keyValue, err := encodeSqlColumnValue(this.getColumn(this.uniqueId), entityKey)
+	if err != nil {
+		return err
+	}
+	args = append(args, keyValue)
+	query := fmt.Sprintf("UPDATE %v SET %v = %v WHERE %v = %v", this.quote(this.tableName), this.quote(column.Name),
+		expr, this.quote(this.uniqueId), dialect.Placeholder(len(args)))
+	_, err = this.sqlDb.db.Exec(query, args...)
+	return err
+}
+
+// 列表需要通过RegisterEntityDb的extraColumns注册为SqlColumnJson类型的列
+func (this *SqlCollection) getListColumn(listName string) (*SqlColumn, error) {
+	column := this.getColumn(listName)
+	if column == nil {
+		return nil, errors.New(fmt.Sprintf("%v column not exists:%v", this.tableName, listName))
+	}
+	if column.Kind != SqlColumnJson {
+		return nil, errors.New(fmt.Sprintf("%v column %v not a json column", this.tableName, listName))
+	}
+	return column, nil
+}
+
+// 读取列表列的原始数据
+func (this *SqlCollection) findListValue(column *SqlColumn, keyValue any) (value []byte, exists bool, err error) {
+	query := fmt.Sprintf("SELECT %v FROM %v WHERE %v = %v", this.quote(column.Name), this.quote(this.tableName),
+		this.quote(this.uniqueId), this.sqlDb.dialect.Placeholder(1))
+	err = this.sqlDb.db.QueryRow(query, keyValue).Scan(&value)
+	if err == sql.ErrNoRows {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return value, true, nil
+}
+
+// 列表操作,使用比较并交换的方式保证原子性,不依赖具体数据库的语法
+//
+//	f返回新的列表,返回nil时列的值设置为NULL
+func (this *SqlCollection) updateList(entityKey interface{}, listName string, f func(list []json.RawMessage) ([]json.RawMessage, error)) error {
+	column, err := this.getListColumn(listName)
+	if err != nil {
+		return err
+	}
+	keyValue, err := encodeSqlColumnValue(this.getColumn(this.uniqueId), entityKey)
+	if err != nil {
+		return err
+	}
+	dialect := this.sqlDb.dialect
+	for i := 0; i < sqlListMaxRetry; i++ {
+		oldValue, exists, err := this.findListValue(column, keyValue)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return ErrEntityNotExists
+		}
+		list, err := parseJsonList(oldValue)
+		if err != nil {
+			return errors.New(fmt.Sprintf("%v.%v err:%v", this.tableName, listName, err))
+		}
+		newList, err := f(list)
+		if err != nil {
+			return err
+		}
+		var newValue any
+		if newList != nil {
+			newBytes, err := json.Marshal(newList)
+			if err != nil {
+				return err
+			}
+			newValue = string(newBytes)
+		}
+		args := []any{newValue, keyValue}
+		setExpr := this.columnPlaceholder(column, 1)
+		if newValue == nil {
+			setExpr = dialect.Placeholder(1)
+		}
+		whereExpr := fmt.Sprintf("%v IS NULL", this.quote(column.Name))
+		if oldValue != nil {
+			args = append(args, string(oldValue))
+			whereExpr = dialect.JsonEqual(this.quote(column.Name), dialect.Placeholder(3))
+		}
+		query := fmt.Sprintf("UPDATE %v SET %v = %v WHERE %v = %v AND %v", this.quote(this.tableName),
+			this.quote(column.Name), setExpr, this.quote(this.uniqueId), dialect.Placeholder(2), whereExpr)
+		result, err := this.sqlDb.db.Exec(query, args...)
+		if err != nil {
+			return err
+		}
+		if rowsAffected, _ := result.RowsAffected(); rowsAffected > 0 {
+			return nil
+		}
+	}
+	return errors.New(fmt.Sprintf("%v %v update list %v conflict", this.tableName, entityKey, listName))
+}
+
+func (this *SqlCollection) PushToList(entityKey interface{}, listName string, item interface{}, maxLen int) error {
+	itemBytes, err := json.Marshal(item)
+	if err != nil {
+		return err
+	}
+	return this.updateList(entityKey, listName, func(list []json.RawMessage) ([]json.RawMessage, error) {
+		return pushListItem(list, json.RawMessage(itemBytes), maxLen), nil
+	})
+}
+
+func (this *SqlCollection) PopList(entityKey interface{}, listName string, count int, data interface{}) error {
+	var popped []json.RawMessage
+	err := this.updateList(entityKey, listName, func(list []json.RawMessage) ([]json.RawMessage, error) {
+		var rest []json.RawMessage
+		popped, rest = popListItems(list, count)
+		// 和MongoCollection一致,取出全部时删除列表
+		if count <= 0 {
+			return nil, nil
+		}
+		if rest == nil {
+			rest = []json.RawMessage{}
+		}
+		return rest, nil
+	})
+	if err != nil || popped == nil {
+		return err
+	}
+	return decodeJsonList(popped, data)
+}
+
+func (this *SqlCollection) RangeList(entityKey interface{}, listName string, start int, count int, data interface{}) error {
+	column, err := this.getListColumn(listName)
+	if err != nil {
+		return err
+	}
+	keyValue, err := encodeSqlColumnValue(this.getColumn(this.uniqueId), entityKey)
+	if err != nil {
+		return err
+	}
+	value, exists, err := this.findListValue(column, keyValue)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return ErrEntityNotExists
+	}
+	list, err := parseJsonList(value)
+	if err != nil || list == nil {
+		return err
+	}
+	return decodeJsonList(rangeListItems(list, start, count), data)
+}
+
+func (this *SqlCollection) RemoveFromList(entityKey interface{}, listName string, item interface{}) error {
+	itemBytes, err := json.Marshal(item)
+	if err != nil {
+		return err
+	}
+	return this.updateList(entityKey, listName, func(list []json.RawMessage) ([]json.RawMessage, error) {
+		if list == nil {
+			return nil, nil
+		}
+		return removeListItems(list, func(v json.RawMessage) bool {
+			return isJsonValueEqual(v, itemBytes)
+		}), nil
+	})
+}
+
+// 玩家数据表
+type SqlCollectionPlayer struct {
+	SqlCollection
+	colAccountId string
+	colRegionId  string
+}
+
+// 根据账号id查找玩家数据
+// 适用于一个账号在一个区服只有一个玩家角色的游戏
+func (this *SqlCollectionPlayer) FindPlayerByAccountId(accountId int64, regionId int32, playerData interface{}) (bool, error) {
+	dialect := this.sqlDb.dialect
+	query := fmt.Sprintf("SELECT %v FROM %v WHERE %v = %v AND %v = %v ORDER BY %v LIMIT 1", this.selectColumns(),
+		this.quote(this.tableName), this.quote(this.colAccountId), dialect.Placeholder(1),
+		this.quote(this.colRegionId), dialect.Placeholder(2), this.quote(this.uniqueId))
+	return this.findOne(query, playerData, accountId, regionId)
+}
+
+// 根据账号id查找角色id
+// 适用于一个账号在一个区服只有一个玩家角色的游戏
+func (this *SqlCollectionPlayer) FindPlayerIdByAccountId(accountId int64, regionId int32) (int64, error) {
+	playerIds, err := this.findPlayerIds(accountId, regionId, 1)
+	if err != nil || len(playerIds) == 0 {
+		return 0, err
+	}
+	return playerIds[0], nil
+}
+
+// 根据账号id查找角色id
+// MMORPG类型的游戏,可能一个账号在一个服有多个角色
+func (this *SqlCollectionPlayer) FindPlayerIdsByAccountId(accountId int64, regionId int32) ([]int64, error) {
+	return this.findPlayerIds(accountId, regionId, 0)
+}
+
+func (this *SqlCollectionPlayer) findPlayerIds(accountId int64, regionId int32, limit int) ([]int64, error) {
+	dialect := this.sqlDb.dialect
+	query := fmt.Sprintf("SELECT %v FROM %v WHERE %v = %v AND %v = %v ORDER BY %v", this.quote(this.uniqueId),
+		this.quote(this.tableName), this.quote(this.colAccountId), dialect.Placeholder(1),
+		this.quote(this.colRegionId), dialect.Placeholder(2), this.quote(this.uniqueId))
+	if limit > 0 {
+		query += fmt.Sprintf(" LIMIT %v", limit)
+	}
+	rows, err := this.sqlDb.db.Query(query, accountId, regionId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var playerIds []int64
+	for rows.Next() {
+		var playerId int64
+		if err = rows.Scan(&playerId); err != nil {
+			return nil, err
+		}
+		playerIds = append(playerIds, playerId)
+	}
+	return playerIds, rows.Err()
+}
+
+// 根据角色id查找账号id
+func (this *SqlCollectionPlayer) FindAccountIdByPlayerId(playerId int64) (int64, error) {
+	query := fmt.Sprintf("SELECT %v FROM %v WHERE %v = %v", this.quote(this.colAccountId),
+		this.quote(this.tableName), this.quote(this.uniqueId), this.sqlDb.dialect.Placeholder(1))
+	var accountId int64
+	err := this.sqlDb.db.QueryRow(query, playerId).Scan(&accountId)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return accountId, err
+}
+
+// 基于database/sql的KvDb实现
+//
+//	key保存为字符串,value保存为json文本
+type SqlKvDb struct {
+	sqlDb     *SqlDb
+	tableName string
+	keyName   string
+	valueName string
+}
+
+func (this *SqlKvDb) quote(name string) string {
+	return this.sqlDb.dialect.QuoteIdentifier(name)
+}
+
+func (this *SqlKvDb) findValue(key interface{}) ([]byte, error) {
+	query := fmt.Sprintf("SELECT %v FROM %v WHERE %v = %v", this.quote(this.valueName), this.quote(this.tableName),
+		this.quote(this.keyName), this.sqlDb.dialect.Placeholder(1))
+	var value []byte
+	err := this.sqlDb.db.QueryRow(query, sqlKvKey(key)).Scan(&value)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return value, err
+}
+
+// 数字会被解析成int64或float64
+func (this *SqlKvDb) Find(key interface{}) (interface{}, error) {
+	value, err := this.findValue(key)
+	if err != nil || value == nil {
+		return nil, err
+	}
+	return decodeJsonValue(value)
+}
+
+// 和其他KvDb一样,key不存在时返回nil,decodeData保持不变
+func (this *SqlKvDb) FindAndDecode(key interface{}, decodeData interface{}) error {
+	value, err := this.findValue(key)
+	if err != nil || value == nil {
+		return err
+	}
+	return json.Unmarshal(value, decodeData)
+}
+
+func (this *SqlKvDb) Insert(key interface{}, value interface{}) (err error, isDuplicateKey bool) {
+	valueBytes, err := json.Marshal(value)
+	if err != nil {
+		return err, false
+	}
+	return this.insertValue(key, string(valueBytes))
+}
+
+func (this *SqlKvDb) insertValue(key interface{}, value string) (err error, isDuplicateKey bool) {
+	dialect := this.sqlDb.dialect
+	query := fmt.Sprintf("INSERT INTO %v (%v, %v) VALUES (%v, %v)", this.quote(this.tableName), this.quote(this.keyName),
+		this.quote(this.valueName), dialect.Placeholder(1), dialect.Placeholder(2))
+	_, err = this.sqlDb.db.Exec(query, sqlKvKey(key), value)
+	if err != nil {
+		if dialect.IsDuplicateKeyError(err) {
+			return fmt.Errorf("%v %v:%v %w: %v", this.tableName, this.keyName, key, ErrDuplicateKey, err), true
+		}
+		return err, false
+	}
+	return nil, false
+}
+
+func (this *SqlKvDb) Update(key interface{}, value interface{}, upsert bool) error {
+	valueBytes, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	dialect := this.sqlDb.dialect
+	query := fmt.Sprintf("UPDATE %v SET %v = %v WHERE %v = %v", this.quote(this.tableName), this.quote(this.valueName),
+		dialect.Placeholder(1), this.quote(this.keyName), dialect.Placeholder(2))
+	result, err := this.sqlDb.db.Exec(query, string(valueBytes), sqlKvKey(key))
+	if err != nil || !upsert {
+		return err
+	}
+	// mysql在值没有变化时,RowsAffected也会返回0,插入时key重复则再更新一次
+	if rowsAffected, _ := result.RowsAffected(); rowsAffected > 0 {
+		return nil
+	}
+	err, isDuplicateKey := this.insertValue(key, string(valueBytes))
+	if isDuplicateKey {
+		_, err = this.sqlDb.db.Exec(query, string(valueBytes), sqlKvKey(key))
+	}
+	return err
+}
+
+// 使用比较并交换的方式实现原子的加法,不依赖具体数据库的语法
+func (this *SqlKvDb) Inc(key interface{}, value interface{}, upsert bool) (interface{}, error) {
+	dialect := this.sqlDb.dialect
+	query := fmt.Sprintf("UPDATE %v SET %v = %v WHERE %v = %v AND %v = %v", this.quote(this.tableName),
+		this.quote(this.valueName), dialect.Placeholder(1), this.quote(this.keyName), dialect.Placeholder(2),
+		this.quote(this.valueName), dialect.Placeholder(3))
+	for i := 0; i < sqlKvIncMaxRetry; i++ {
+		oldValue, err := this.findValue(key)
+		if err != nil {
+			return nil, err
+		}
+		if oldValue == nil {
+			if !upsert {
+				return nil, sql.ErrNoRows
+			}
+			newValue, err := addJsonValue(nil, value)
+			if err != nil {
+				return nil, err
+			}
+			err, isDuplicateKey := this.insertValue(key, string(newValue))
+			if isDuplicateKey {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			return decodeJsonValue(newValue)
+		}
+		newValue, err := addJsonValue(oldValue, value)
+		if err != nil {
+			return nil, err
+		}
+		result, err := this.sqlDb.db.Exec(query, string(newValue), sqlKvKey(key), string(oldValue))
+		if err != nil {
+			return nil, err
+		}
+		if rowsAffected, _ := result.RowsAffected(); rowsAffected > 0 {
+			return decodeJsonValue(newValue)
+		}
+	}
+	return nil, errors.New(fmt.Sprintf("%v Inc %v conflict", this.tableName, key))
+}
+
+func (this *SqlKvDb) Delete(key interface{}) error {
+	query := fmt.Sprintf("DELETE FROM %v WHERE %v = %v", this.quote(this.tableName), this.quote(this.keyName),
+		this.sqlDb.dialect.Placeholder(1))
+	_, err := this.sqlDb.db.Exec(query, sqlKvKey(key))
+	return err
+}
+
+// 数字会被解析成int64或float64
+func (this *SqlKvDb) FindMany(keys []interface{}) (map[interface{}]interface{}, error) {
+	values := make(map[interface{}]interface{})
+	if len(keys) == 0 {
+		return values, nil
+	}
+	dialect := this.sqlDb.dialect
+	placeholders := make([]string, 0, len(keys))
+	args := make([]interface{}, 0, len(keys))
+	keyMap := make(map[string]interface{}, len(keys))
+	for i, key := range keys {
+		placeholders = append(placeholders, dialect.Placeholder(i+1))
+		args = append(args, sqlKvKey(key))
+		keyMap[sqlKvKey(key)] = key
+	}
+	query := fmt.Sprintf("SELECT %v, %v FROM %v WHERE %v IN (%v)", this.quote(this.keyName), this.quote(this.valueName),
+		this.quote(this.tableName), this.quote(this.keyName), strings.Join(placeholders, ", "))
+	rows, err := this.sqlDb.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var key string
+		var value []byte
+		if err = rows.Scan(&key, &value); err != nil {
+			return nil, err
+		}
+		values[keyMap[key]], err = decodeJsonValue(value)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return values, rows.Err()
+}
+
+// 值使用json格式比较
+func (this *SqlKvDb) CompareAndSwap(key interface{}, expected interface{}, newValue interface{}) (bool, error) {
+	newBytes, err := json.Marshal(newValue)
+	if err != nil {
+		return false, err
+	}
+	if expected == nil {
+		err, isDuplicateKey := this.insertValue(key, string(newBytes))
+		if isDuplicateKey {
+			return false, nil
+		}
+		return err == nil, err
+	}
+	expectedBytes, err := json.Marshal(expected)
+	if err != nil {
+		return false, err
+	}
+	dialect := this.sqlDb.dialect
+	query := fmt.Sprintf("UPDATE %v SET %v = %v WHERE %v = %v AND %v = %v", this.quote(this.tableName),
+		this.quote(this.valueName), dialect.Placeholder(1), this.quote(this.keyName), dialect.Placeholder(2),
+		this.quote(this.valueName), dialect.Placeholder(3))
+	result, err := this.sqlDb.db.Exec(query, string(newBytes), sqlKvKey(key), string(expectedBytes))
+	if err != nil {
+		return false, err
+	}
+	if rowsAffected, _ := result.RowsAffected(); rowsAffected > 0 {
+		return true, nil
+	}
+	if !bytes.Equal(newBytes, expectedBytes) {
+		return false, nil
+	}
+	// mysql在值没有变化时,RowsAffected也会返回0
+	oldValue, err := this.findValue(key)
+	return err == nil && bytes.Equal(oldValue, expectedBytes), err
+}
+
+// key按照字符串比较,前缀是否区分大小写取决于数据库的排序规则
+func (this *SqlKvDb) Scan(scan *KvScan) (*KvScanResult, error) {
+	dialect := this.sqlDb.dialect
+	var conditions []string
+	var args []interface{}
+	addCondition := func(op string, arg interface{}) {
+		args = append(args, arg)
+		conditions = append(conditions, fmt.Sprintf("%v %v %v", this.quote(this.keyName), op, dialect.Placeholder(len(args))))
+	}
+	if scan.Prefix != "" {
+		// 使用!作为转义字符,各个数据库的写法一致
+		escaper := strings.NewReplacer("!", "!!", "%", "!%", "_", "!_")
+		addCondition("LIKE", escaper.Replace(scan.Prefix)+"%")
+		conditions[len(conditions)-1] += " ESCAPE '!'"
+	}
+	if scan.Start != nil {
+		addCondition(">=", sqlKvKey(scan.Start))
+	}
+	if scan.End != nil {
+		addCondition("<", sqlKvKey(scan.End))
+	}
+	if scan.Cursor != nil {
+		addCondition(">", sqlKvKey(scan.Cursor))
+	}
+	query := fmt.Sprintf("SELECT %v, %v FROM %v", this.quote(this.keyName), this.quote(this.valueName), this.quote(this.tableName))
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	query += fmt.Sprintf(" ORDER BY %v", this.quote(this.keyName))
+	if scan.Limit > 0 {
+		query += fmt.Sprintf(" LIMIT %v", scan.Limit)
+	}
+	rows, err := this.sqlDb.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var pairs []*KvPair
+	for rows.Next() {
+		var key string
+		var value []byte
+		if err = rows.Scan(&key, &value); err != nil {
+			return nil, err
+		}
+		pair := &KvPair{Key: key}
+		if pair.Value, err = decodeJsonValue(value); err != nil {
+			return nil, err
+		}
+		pairs = append(pairs, pair)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return scan.makeResult(pairs), nil
+}
+
+// 使用比较并交换的方式实现原子的加法,和Inc一致
+func (this *SqlKvDb) IncFields(key interface{}, fields map[string]interface{}, upsert bool) (map[string]interface{}, error) {
+	dialect := this.sqlDb.dialect
+	query := fmt.Sprintf("UPDATE %v SET %v = %v WHERE %v = %v AND %v = %v", this.quote(this.tableName),
+		this.quote(this.valueName), dialect.Placeholder(1), this.quote(this.keyName), dialect.Placeholder(2),
+		this.quote(this.valueName), dialect.Placeholder(3))
+	for i := 0; i < sqlKvIncMaxRetry; i++ {
+		oldValue, err := this.findValue(key)
+		if err != nil {
+			return nil, err
+		}
+		if oldValue == nil && !upsert {
+			return nil, sql.ErrNoRows
+		}
+		newValue, newValues, err := incJsonFields(oldValue, fields)
+		if err != nil {
+			return nil, err
+		}
+		if oldValue == nil {
+			err, isDuplicateKey := this.insertValue(key, string(newValue))
+			if isDuplicateKey {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			return newValues, nil
+		}
+		result, err := this.sqlDb.db.Exec(query, string(newValue), sqlKvKey(key), string(oldValue))
+		if err != nil {
+			return nil, err
+		}
+		if rowsAffected, _ := result.RowsAffected(); rowsAffected > 0 {
+			return newValues, nil
+		}
+	}
+	return nil, errors.New(fmt.Sprintf("%v IncFields %v conflict", this.tableName, key))
+}
+
+// 基于database/sql的DbMgr实现
+//
+//	Connect时根据注册的Entity的组件结构,自动创建表和新增的列
+//	需要应用层导入对应的数据库驱动,如modernc.org/sqlite
+type SqlDb struct {
+	db             *sql.DB
+	driverName     string
+	dataSourceName string
+	dialect        SqlDialect
+	entityDbs      map[string]EntityDb
+	kvDbs          map[string]KvDb
+	// 按注册顺序建表
+	tableOrder []string
+}
+
+func NewSqlDb(driverName, dataSourceName string, dialect SqlDialect) *SqlDb {
+	return &SqlDb{
+		driverName:     driverName,
+		dataSourceName: dataSourceName,
+		dialect:        dialect,
+		entityDbs:      make(map[string]EntityDb),
+		kvDbs:          make(map[string]KvDb),
+	}
+}
+
+func (this *SqlDb) newCollection(tableName string, uniqueId string, entity Entity, extraColumns []*SqlColumn) *SqlCollection {
+	col := &SqlCollection{
+		sqlDb:     this,
+		tableName: tableName,
+		uniqueId:  uniqueId,
+		columnMap: make(map[string]*SqlColumn),
+		indexes:   make(map[string][]string),
+	}
+	// 额外的列可以覆盖唯一id的类型
+	for _, column := range extraColumns {
+		if strings.EqualFold(column.Name, uniqueId) {
+			col.addColumn(column)
+		}
+	}
+	col.addColumn(&SqlColumn{Name: uniqueId, Kind: SqlColumnInt})
+	for _, column := range extraColumns {
+		col.addColumn(column)
+	}
+	if entity != nil {
+		entity.RangeComponent(func(component Component) bool {
+			componentStruct := GetObjSaveableStruct(component)
+			if componentStruct == nil {
+				// 组件可以没有保存字段
+				return true
+			}
+			col.addColumn(&SqlColumn{
+				Name: GetComponentSaveName(component),
+				Kind: getSqlComponentColumnKind(componentStruct),
+			})
+			return true
+		})
+	}
+	return col
+}
+
+// 注册普通Entity对应的表
+//
+//	entity用于解析组件结构,每个组件对应一列,extraColumns是组件之外的列
+func (this *SqlDb) RegisterEntityDb(tableName string, uniqueId string, entity Entity, extraColumns ...*SqlColumn) EntityDb {
+	col := this.newCollection(tableName, uniqueId, entity, extraColumns)
+	this.entityDbs[tableName] = col
+	this.tableOrder = append(this.tableOrder, tableName)
+	GetLogger().Info("RegisterEntityDb %v %v", tableName, uniqueId)
+	return col
+}
+
+// 注册玩家对应的表
+//
+//	entity用于解析组件结构,每个组件对应一列,extraColumns是组件之外的列
+func (this *SqlDb) RegisterPlayerDb(tableName string, playerId, accountId, region string, entity Entity, extraColumns ...*SqlColumn) PlayerDb {
+	col := &SqlCollectionPlayer{
+		SqlCollection: *this.newCollection(tableName, playerId, entity, append([]*SqlColumn{
+			{Name: accountId, Kind: SqlColumnInt},
+			{Name: region, Kind: SqlColumnInt},
+		}, extraColumns...)),
+		colAccountId: accountId,
+		colRegionId:  region,
+	}
+	col.indexes[fmt.Sprintf("idx_%v_%v_%v", tableName, accountId, region)] = []string{accountId, region}
+	this.entityDbs[tableName] = col
+	this.tableOrder = append(this.tableOrder, tableName)
+	GetLogger().Info("RegisterPlayerDb %v %v", tableName, playerId)
+	return col
+}
+
+func (this *SqlDb) RegisterKvDb(tableName string, keyName, valueName string) KvDb {
+	col := &SqlKvDb{
+		sqlDb:     this,
+		tableName: tableName,
+		keyName:   keyName,
+		valueName: valueName,
+	}
+	this.kvDbs[tableName] = col
+	this.tableOrder = append(this.tableOrder, tableName)
+	GetLogger().Info("RegisterKvDb %v %v %v", tableName, keyName, valueName)
+	return col
+}
+
+func (this *SqlDb) GetEntityDb(name string) EntityDb {
+	return this.entityDbs[name]
+}
+
+func (this *SqlDb) GetKvDb(name string) KvDb {
+	return this.kvDbs[name]
+}
+
+func (this *SqlDb) GetDb() *sql.DB {
+	return this.db
+}
+
+// 连接数据库,并创建表或新增列
+func (this *SqlDb) Connect() bool {
+	db, err := sql.Open(this.driverName, this.dataSourceName)
+	if err != nil {
+		GetLogger().Error("%v", err)
+		return false
+	}
+	if err = db.Ping(); err != nil {
+		GetLogger().Error("%v", err)
+		db.Close()
+		return false
+	}
+	this.db = db
+	for _, tableName := range this.tableOrder {
+		if entityDb, ok := this.entityDbs[tableName]; ok {
+			var col *SqlCollection
+			switch sqlCollection := entityDb.(type) {
+			case *SqlCollection:
+				col = sqlCollection
+			case *SqlCollectionPlayer:
+				col = &sqlCollection.SqlCollection
+			}
+			if col != nil {
+				if err = this.syncTable(col.tableName, col.uniqueId, col.columns, col.indexes); err != nil {
+					GetLogger().Error("sync table %v err:%v", tableName, err)
+					return false
+				}
+			}
+			continue
+		}
+		if kvDb, ok := this.kvDbs[tableName].(*SqlKvDb); ok {
+			columns := []*SqlColumn{
+				{Name: kvDb.keyName, Kind: SqlColumnString},
+				{Name: kvDb.valueName, Kind: SqlColumnText},
+			}
+			if err = this.syncTable(kvDb.tableName, kvDb.keyName, columns, nil); err != nil {
+				GetLogger().Error("sync table %v err:%v", tableName, err)
+				return false
+			}
+		}
+	}
+	GetLogger().Info("sql Connected %v", this.driverName)
+	return true
+}
+
+// 创建表,新增缺少的列,创建索引
+//
+//	不会删除或修改已有的列,表中多余的列只打印日志
+func (this *SqlDb) syncTable(tableName string, primaryKey string, columns []*SqlColumn, indexes map[string][]string) error {
+	quote := this.dialect.QuoteIdentifier
+	columnDefs := make([]string, len(columns))
+	for i, column := range columns {
+		columnDefs[i] = fmt.Sprintf("%v %v", quote(column.Name), this.dialect.ColumnType(column.Kind))
+		if strings.EqualFold(column.Name, primaryKey) {
+			columnDefs[i] += " NOT NULL PRIMARY KEY"
+		}
+	}
+	createSql := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %v (%v)", quote(tableName), strings.Join(columnDefs, ", "))
+	if _, err := this.db.Exec(createSql); err != nil {
+		return err
+	}
+	existColumnNames, err := this.getTableColumnNames(tableName)
+	if err != nil {
+		return err
+	}
+	existColumns := make(map[string]struct{}, len(existColumnNames))
+	for _, columnName := range existColumnNames {
+		existColumns[strings.ToLower(columnName)] = struct{}{}
+	}
+	schemaColumns := make(map[string]struct{}, len(columns))
+	for _, column := range columns {
+		lowerName := strings.ToLower(column.Name)
+		schemaColumns[lowerName] = struct{}{}
+		if _, ok := existColumns[lowerName]; ok {
+			continue
+		}
+		alterSql := fmt.Sprintf("ALTER TABLE %v ADD COLUMN %v %v", quote(tableName), quote(column.Name),
+			this.dialect.ColumnType(column.Kind))
+		if _, err = this.db.Exec(alterSql); err != nil {
+			return err
+		}
+		GetLogger().Info("%v add column %v", tableName, column.Name)
+	}
+	for _, columnName := range existColumnNames {
+		if _, ok := schemaColumns[strings.ToLower(columnName)]; !ok {
+			GetLogger().Warn("%v column %v not in schema", tableName, columnName)
+		}
+	}
+	indexNames := make([]string, 0, len(indexes))
+	for indexName := range indexes {
+		indexNames = append(indexNames, indexName)
+	}
+	sort.Strings(indexNames)
+	for _, indexName := range indexNames {
+		indexSql := this.dialect.CreateIndex(tableName, indexName, indexes[indexName], false)
+		if _, err = this.db.Exec(indexSql); err != nil && !this.dialect.IsIndexExistsError(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (this *SqlDb) getTableColumnNames(tableName string) ([]string, error) {
+	rows, err := this.db.Query(fmt.Sprintf("SELECT * FROM %v WHERE 1 = 0", this.dialect.QuoteIdentifier(tableName)))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return rows.Columns()
+}
+
+func (this *SqlDb) Disconnect() {
+	if this.db == nil {
+		return
+	}
+	if err := this.db.Close(); err != nil {
+		GetLogger().Error("%v", err)
+	}
+	GetLogger().Info("sql Disconnected %v", this.driverName)
+}
+
+// 组件对应的列类型
+//
+//	非明文保存的单字段proto使用二进制列,其他使用json列
+func getSqlComponentColumnKind(componentStruct *SaveableStruct) SqlColumnKind {
+	if !componentStruct.IsSingleField() {
+		return SqlColumnJson
+	}
+	field := componentStruct.Field.getLeafField()
+	if field.IsPlain {
+		return SqlColumnJson
+	}
+	typ := field.StructField.Type
+	if typ.Kind() != reflect.Ptr {
+		typ = reflect.PointerTo(typ)
+	}
+	if typ.Implements(reflect.TypeOf((*proto.Message)(nil)).Elem()) {
+		return SqlColumnBlob
+	}
+	return SqlColumnJson
+}
+
+// 字段值 -> 列的参数
+func encodeSqlColumnValue(column *SqlColumn, value any) (any, error) {
+	if util.IsNil(value) {
+		return nil, nil
+	}
+	raw, isRaw := value.(json.RawMessage)
+	switch column.Kind {
+	case SqlColumnInt:
+		if isRaw {
+			var i int64
+			err := json.Unmarshal(raw, &i)
+			return i, err
+		}
+		if i, ok := toInt64(value); ok {
+			return i, nil
+		}
+		return nil, errors.New(fmt.Sprintf("%v not int:%v", column.Name, value))
+	case SqlColumnString, SqlColumnText:
+		if isRaw {
+			var s string
+			err := json.Unmarshal(raw, &s)
+			return s, err
+		}
+		return util.ToString(value)
+	case SqlColumnBlob:
+		switch v := value.(type) {
+		case json.RawMessage:
+			var b []byte
+			err := json.Unmarshal(v, &b)
+			return b, err
+		case []byte:
+			return v, nil
+		case proto.Message:
+			return proto.Marshal(v)
+		}
+		return nil, errors.New(fmt.Sprintf("%v not bytes:%v", column.Name, reflect.TypeOf(value)))
+	default:
+		if isRaw {
+			return string(raw), nil
+		}
+		jsonBytes, err := json.Marshal(value)
+		if err != nil {
+			return nil, err
+		}
+		return string(jsonBytes), nil
+	}
+}
+
+func sqlKvKey(key interface{}) string {
+	if s, err := util.ToString(key); err == nil {
+		return s
+	}
+	return fmt.Sprintf("%v", key)
+}
@@ -0,0 +1,387 @@
+package gentity
+
+import (
+	"fmt"
+	"strings"
+)
+
+// https://github.com/uber-go/guide/blob/master/style.md#verify-interface-compliance
+var _ SqlDialect = (*SqliteDialect)(nil)
+var _ SqlDialect = (*MysqlDialect)(nil)
+var _ SqlDialect = (*PostgresDialect)(nil)
+
+// 不同sql数据库的语法差异
+//
+//	内置了SqliteDialect,MysqlDialect,PostgresDialect
+type SqlDialect interface {
+	// 表名,列名
+	QuoteIdentifier(name string) string
+
+	// 第index个参数的占位符(index从1开始)
+	Placeholder(index int) string
+
+	// 列类型
+	ColumnType(kind SqlColumnKind) string
+
+	// json类型的参数
+	JsonValue(placeholder string) string
+
+	// json列和json类型的参数是否相等,用于比较并交换
+	JsonEqual(columnName, placeholder string) string
+
+	// 空的json对象
+	EmptyJsonObject() string
+
+	// json字段路径,如[]string{"Quests","1"}
+	JsonPath(names []string) string
+
+	// 设置json字段的值,names是字段路径,value是json格式的数据
+	// 和mongodb的$set一样,路径中不存在的中间对象需要自动创建
+	// addArg添加1个参数并返回它的占位符,参数需要按照占位符在语句中出现的顺序添加
+	JsonSet(expr string, names []string, value string, addArg func(arg any) string) string
+
+	// 删除json字段
+	JsonRemove(expr, pathPlaceholder string) string
+
+	// 在json数组的尾部追加数据,names为空表示expr本身是数组,items是json格式的数据
+	// 和mongodb的$push一样,路径中不存在的中间对象和数组需要自动创建
+	// addArg添加1个参数并返回它的占位符,参数需要按照占位符在语句中出现的顺序添加
+	JsonArrayAppend(expr string, names []string, items []string, addArg func(arg any) string) string
+
+	// json字段的值,用于条件查询和排序,可以和JsonScalar的结果比较
+	JsonExtract(expr, pathPlaceholder string) string
+
+	// json类型的参数,用于和JsonExtract的结果比较
+	JsonScalar(placeholder string) string
+
+	// 创建索引,索引已存在时不报错
+	CreateIndex(tableName, indexName string, columnNames []string, unique bool) string
+
+	// 是否是索引已存在的错误
+	IsIndexExistsError(err error) bool
+
+	// 是否是key重复错误
+	IsDuplicateKeyError(err error) bool
+}
+
+func quoteJsonPathName(name string) string {
+	return `"` + strings.ReplaceAll(strings.ReplaceAll(name, `\`, `\\`), `"`, `\"`) + `"`
+}
+
+// sqlite的语法,如modernc.org/sqlite
+type SqliteDialect struct {
+}
+
+func (this *SqliteDialect) QuoteIdentifier(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+func (this *SqliteDialect) Placeholder(index int) string {
+	return "?"
+}
+
+func (this *SqliteDialect) ColumnType(kind SqlColumnKind) string {
+	switch kind {
+	case SqlColumnInt:
+		return "INTEGER"
+	case SqlColumnBlob:
+		return "BLOB"
+	default:
+		return "TEXT"
+	}
+}
+
+func (this *SqliteDialect) JsonValue(placeholder string) string {
+	return placeholder
+}
+
+// json列以文本保存,直接比较读取到的文本
+func (this *SqliteDialect) JsonEqual(columnName, placeholder string) string {
+	return columnName + " = " + placeholder
+}
+
+func (this *SqliteDialect) EmptyJsonObject() string {
+	return "'{}'"
+}
+
+func (this *SqliteDialect) JsonPath(names []string) string {
+	path := "$"
+	for _, name := range names {
+		path += "." + quoteJsonPathName(name)
+	}
+	return path
+}
+
+// sqlite的json_set会自动创建路径中不存在的中间对象
+func (this *SqliteDialect) JsonSet(expr string, names []string, value string, addArg func(arg any) string) string {
+	pathPlaceholder := addArg(this.JsonPath(names))
+	return fmt.Sprintf("json_set(%v, %v, json(%v))", expr, pathPlaceholder, addArg(value))
+}
+
+func (this *SqliteDialect) JsonRemove(expr, pathPlaceholder string) string {
+	return fmt.Sprintf("json_remove(%v, %v)", expr, pathPlaceholder)
+}
+
+// json_insert的路径[#]表示数组的尾部,会自动创建路径中不存在的中间对象和数组
+func (this *SqliteDialect) JsonArrayAppend(expr string, names []string, items []string, addArg func(arg any) string) string {
+	path := this.JsonPath(names) + "[#]"
+	var sb strings.Builder
+	sb.WriteString("json_insert(" + expr)
+	for _, item := range items {
+		sb.WriteString(fmt.Sprintf(", %v, json(%v)", addArg(path), addArg(item)))
+	}
+	sb.WriteString(")")
+	return sb.String()
+}
+
+// json_extract返回的是sql类型的值,参数也需要转换成sql类型
+func (this *SqliteDialect) JsonExtract(expr, pathPlaceholder string) string {
+	return fmt.Sprintf("json_extract(%v, %v)", expr, pathPlaceholder)
+}
+
+func (this *SqliteDialect) JsonScalar(placeholder string) string {
+	return fmt.Sprintf("json_extract(%v, '$')", placeholder)
+}
+
+func (this *SqliteDialect) CreateIndex(tableName, indexName string, columnNames []string, unique bool) string {
+	return createIndexSql(this, "CREATE %vINDEX IF NOT EXISTS %v ON %v (%v)", tableName, indexName, columnNames, unique)
+}
+
+func (this *SqliteDialect) IsIndexExistsError(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "already exists")
+}
+
+func (this *SqliteDialect) IsDuplicateKeyError(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "UNIQUE constraint failed")
+}
+
+// mysql的语法,需要mysql5.7以上版本(json类型)
+type MysqlDialect struct {
+}
+
+func (this *MysqlDialect) QuoteIdentifier(name string) string {
+	return "`" + strings.ReplaceAll(name, "`", "``") + "`"
+}
+
+func (this *MysqlDialect) Placeholder(index int) string {
+	return "?"
+}
+
+func (this *MysqlDialect) ColumnType(kind SqlColumnKind) string {
+	switch kind {
+	case SqlColumnInt:
+		return "BIGINT"
+	case SqlColumnString:
+		return "VARCHAR(255)"
+	case SqlColumnBlob:
+		return "LONGBLOB"
+	case SqlColumnJson:
+		return "JSON"
+	default:
+		return "LONGTEXT"
+	}
+}
+
+func (this *MysqlDialect) JsonValue(placeholder string) string {
+	return placeholder
+}
+
+// json和字符串比较时,字符串会被当作json字符串,需要先转换成json
+func (this *MysqlDialect) JsonEqual(columnName, placeholder string) string {
+	return columnName + " = CAST(" + placeholder + " AS JSON)"
+}
+
+func (this *MysqlDialect) EmptyJsonObject() string {
+	return "JSON_OBJECT()"
+}
+
+func (this *MysqlDialect) JsonPath(names []string) string {
+	path := "$"
+	for _, name := range names {
+		path += "." + quoteJsonPathName(name)
+	}
+	return path
+}
+
+// JSON_SET和JSON_ARRAY_APPEND不会创建路径中不存在的中间对象,先用JSON_INSERT逐层插入空对象(已存在时不会修改)
+//
+//	JSON_INSERT的多个路径按顺序执行,后面的路径可以使用前面插入的对象
+func (this *MysqlDialect) insertParents(expr string, names []string, addArg func(arg any) string) string {
+	if len(names) < 2 {
+		return expr
+	}
+	var sb strings.Builder
+	sb.WriteString("JSON_INSERT(" + expr)
+	for i := 1; i < len(names); i++ {
+		sb.WriteString(fmt.Sprintf(", %v, JSON_OBJECT()", addArg(this.JsonPath(names[:i]))))
+	}
+	sb.WriteString(")")
+	return sb.String()
+}
+
+func (this *MysqlDialect) JsonSet(expr string, names []string, value string, addArg func(arg any) string) string {
+	expr = this.insertParents(expr, names, addArg)
+	pathPlaceholder := addArg(this.JsonPath(names))
+	return fmt.Sprintf("JSON_SET(%v, %v, CAST(%v AS JSON))", expr, pathPlaceholder, addArg(value))
+}
+
+func (this *MysqlDialect) JsonRemove(expr, pathPlaceholder string) string {
+	return fmt.Sprintf("JSON_REMOVE(%v, %v)", expr, pathPlaceholder)
+}
+
+// 数组不存在时,JSON_ARRAY_APPEND不会创建数组,先用JSON_INSERT插入空数组
+func (this *MysqlDialect) JsonArrayAppend(expr string, names []string, items []string, addArg func(arg any) string) string {
+	path := this.JsonPath(names)
+	if len(names) > 0 {
+		expr = this.insertParents(expr, names, addArg)
+		expr = fmt.Sprintf("JSON_INSERT(%v, %v, JSON_ARRAY())", expr, addArg(path))
+	}
+	var sb strings.Builder
+	sb.WriteString("JSON_ARRAY_APPEND(" + expr)
+	for _, item := range items {
+		sb.WriteString(fmt.Sprintf(", %v, CAST(%v AS JSON)", addArg(path), addArg(item)))
+	}
+	sb.WriteString(")")
+	return sb.String()
+}
+
+func (this *MysqlDialect) JsonExtract(expr, pathPlaceholder string) string {
+	return fmt.Sprintf("JSON_EXTRACT(%v, %v)", expr, pathPlaceholder)
+}
+
+func (this *MysqlDialect) JsonScalar(placeholder string) string {
+	return "CAST(" + placeholder + " AS JSON)"
+}
+
+// mysql不支持CREATE INDEX IF NOT EXISTS
+func (this *MysqlDialect) CreateIndex(tableName, indexName string, columnNames []string, unique bool) string {
+	return createIndexSql(this, "CREATE %vINDEX %v ON %v (%v)", tableName, indexName, columnNames, unique)
+}
+
+func (this *MysqlDialect) IsIndexExistsError(err error) bool {
+	// Error 1061: Duplicate key name
+	return err != nil && strings.Contains(err.Error(), "1061")
+}
+
+func (this *MysqlDialect) IsDuplicateKeyError(err error) bool {
+	// Error 1062: Duplicate entry
+	return err != nil && strings.Contains(err.Error(), "1062")
+}
+
+// postgresql的语法
+type PostgresDialect struct {
+}
+
+func (this *PostgresDialect) QuoteIdentifier(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+func (this *PostgresDialect) Placeholder(index int) string {
+	return fmt.Sprintf("$%v", index)
+}
+
+func (this *PostgresDialect) ColumnType(kind SqlColumnKind) string {
+	switch kind {
+	case SqlColumnInt:
+		return "BIGINT"
+	case SqlColumnString:
+		return "VARCHAR(255)"
+	case SqlColumnBlob:
+		return "BYTEA"
+	case SqlColumnJson:
+		return "JSONB"
+	default:
+		return "TEXT"
+	}
+}
+
+func (this *PostgresDialect) JsonValue(placeholder string) string {
+	return placeholder + "::jsonb"
+}
+
+func (this *PostgresDialect) JsonEqual(columnName, placeholder string) string {
+	return columnName + " = " + placeholder + "::jsonb"
+}
+
+func (this *PostgresDialect) EmptyJsonObject() string {
+	return "'{}'::jsonb"
+}
+
+func (this *PostgresDialect) JsonPath(names []string) string {
+	quoteNames := make([]string, len(names))
+	for i, name := range names {
+		quoteNames[i] = quoteJsonPathName(name)
+	}
+	return "{" + strings.Join(quoteNames, ",") + "}"
+}
+
+// jsonb_set只会创建路径的最后一层,中间对象不存在时不做修改,需要先逐层设置中间对象
+//
+//	f的参数是expr的别名,expr在标量子查询里只出现一次,避免多次引用expr导致语句长度成倍增长
+//	中间对象已存在时保持原值,由于是逐层创建的,每一层都可以从expr的原值中读取
+func (this *PostgresDialect) withParents(expr string, names []string, addArg func(arg any) string, f func(alias, parentsExpr string) string) string {
+	const alias = "s.d"
+	parentsExpr := alias
+	for i := 1; i < len(names); i++ {
+		pathPlaceholder := addArg(this.JsonPath(names[:i]))
+		parentsExpr = fmt.Sprintf("jsonb_set(%v, %v::text[], COALESCE(%v #> %v::text[], '{}'::jsonb), true)",
+			parentsExpr, pathPlaceholder, alias, pathPlaceholder)
+	}
+	return fmt.Sprintf("(SELECT %v FROM (SELECT %v AS d) AS s)", f(alias, parentsExpr), expr)
+}
+
+// 占位符带序号,可以重复使用
+func (this *PostgresDialect) JsonSet(expr string, names []string, value string, addArg func(arg any) string) string {
+	return this.withParents(expr, names, addArg, func(alias, parentsExpr string) string {
+		return fmt.Sprintf("jsonb_set(%v, %v::text[], %v::jsonb, true)", parentsExpr, addArg(this.JsonPath(names)), addArg(value))
+	})
+}
+
+func (this *PostgresDialect) JsonRemove(expr, pathPlaceholder string) string {
+	return fmt.Sprintf("(%v #- %v::text[])", expr, pathPlaceholder)
+}
+
+func (this *PostgresDialect) JsonArrayAppend(expr string, names []string, items []string, addArg func(arg any) string) string {
+	if len(names) == 0 {
+		return fmt.Sprintf("(%v || %v::jsonb)", expr, addArg("["+strings.Join(items, ",")+"]"))
+	}
+	return this.withParents(expr, names, addArg, func(alias, parentsExpr string) string {
+		pathPlaceholder := addArg(this.JsonPath(names))
+		valuePlaceholder := addArg("[" + strings.Join(items, ",") + "]")
+		return fmt.Sprintf("jsonb_set(%v, %v::text[], COALESCE(%v #> %v::text[], '[]'::jsonb) || %v::jsonb, true)",
+			parentsExpr, pathPlaceholder, alias, pathPlaceholder, valuePlaceholder)
+	})
+}
+
+func (this *PostgresDialect) JsonExtract(expr, pathPlaceholder string) string {
+	return fmt.Sprintf("(%v #> %v::text[])", expr, pathPlaceholder)
+}
+
+func (this *PostgresDialect) JsonScalar(placeholder string) string {
+	return placeholder + "::jsonb"
+}
+
+func (this *PostgresDialect) CreateIndex(tableName, indexName string, columnNames []string, unique bool) string {
+	return createIndexSql(this, "CREATE %vINDEX IF NOT EXISTS %v ON %v (%v)", tableName, indexName, columnNames, unique)
+}
+
+func (this *PostgresDialect) IsIndexExistsError(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "already exists")
+}
+
+func (this *PostgresDialect) IsDuplicateKeyError(err error) bool {
+	// SQLSTATE 23505: unique_violation
+	return err != nil && (strings.Contains(err.Error(), "23505") || strings.Contains(err.Error(), "duplicate key value"))
+}
+
+func createIndexSql(dialect SqlDialect, format, tableName, indexName string, columnNames []string, unique bool) string {
+	uniqueStr := ""
+	if unique {
+		uniqueStr = "UNIQUE "
+	}
+	quoteColumnNames := make([]string, len(columnNames))
+	for i, columnName := range columnNames {
+		quoteColumnNames[i] = dialect.QuoteIdentifier(columnName)
+	}
+	return fmt.Sprintf(format, uniqueStr, dialect.QuoteIdentifier(indexName), dialect.QuoteIdentifier(tableName), strings.Join(quoteColumnNames, ", "))
+}